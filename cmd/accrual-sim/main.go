@@ -0,0 +1,98 @@
+// Команда accrual-sim запускает симулятор системы начисления баллов по сценарию.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/accrualsim"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/logger"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"go.uber.org/zap"
+)
+
+func main() {
+	log, err := logger.NewLogger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer log.Sync()
+
+	var (
+		runAddress   string
+		scenarioPath string
+	)
+	flag.StringVar(&runAddress, "a", "localhost:8081", "address and port to run simulator")
+	flag.StringVar(&scenarioPath, "s", "", "path to scenario JSON file")
+	flag.Parse()
+
+	// Приоритет: flag > env > default
+	if runAddress == "localhost:8081" {
+		if envRunAddress := os.Getenv("RUN_ADDRESS"); envRunAddress != "" {
+			runAddress = envRunAddress
+		}
+	}
+	if scenarioPath == "" {
+		scenarioPath = os.Getenv("ACCRUAL_SIM_SCENARIO")
+	}
+
+	scenario := defaultScenario()
+	if scenarioPath != "" {
+		scenario, err = accrualsim.LoadScenarioFile(scenarioPath)
+		if err != nil {
+			log.Fatal("Failed to load scenario", zap.String("path", scenarioPath), zap.Error(err))
+		}
+	}
+
+	srv := &http.Server{
+		Addr:    runAddress,
+		Handler: accrualsim.New(*scenario),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErrors := make(chan error, 1)
+	go func() {
+		log.Info("Starting accrual simulator",
+			zap.String("address", runAddress),
+			zap.String("scenario", scenarioPath),
+			zap.Int("orders", len(scenario.Orders)))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErrors <- err
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case err := <-serverErrors:
+		log.Error("Server error", zap.Error(err))
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("Server shutdown error", zap.Error(err))
+	}
+
+	log.Info("Accrual simulator stopped")
+}
+
+// defaultScenario сценарий без файла: любой заказ проходит REGISTERED, PROCESSING
+// и обрабатывается с начислением 500
+func defaultScenario() *accrualsim.Scenario {
+	return &accrualsim.Scenario{
+		Default: accrualsim.Script{
+			accrualsim.WithStatus(models.AccrualStatusRegistered),
+			accrualsim.WithStatus(models.AccrualStatusProcessing),
+			accrualsim.Processed(models.Money(50000)),
+		},
+	}
+}
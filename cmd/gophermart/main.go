@@ -6,11 +6,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/config"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/logger"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/server"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
@@ -31,35 +34,246 @@ func main() {
 		log.Fatal("Failed to load config", zap.Error(err))
 	}
 
-	// Подключаемся к базе данных
-	dbStorage, err := storage.NewDatabaseStorage(context.Background(), cfg.DatabaseURI)
+	// Поворот ключей подписи JWT выполняется без запуска сервера
+	if cfg.RotateJWTKeys {
+		if err := runRotateJWTKeysCommand(cfg); err != nil {
+			log.Fatal("JWT key rotation failed", zap.Error(err))
+		}
+		return
+	}
+
+	// Создаем хранилище
+	var store server.Storage
+	switch cfg.StorageType {
+	case config.StorageMemory:
+		if cfg.MigrateCommand != "" {
+			log.Fatal("Migrations require database storage")
+		}
+		log.Warn("Using in-memory storage, data will be lost on restart")
+		store = storage.NewMemoryStorage()
+	default:
+		dbStorage, err := storage.NewDatabaseStorage(context.Background(), cfg.DatabaseURI)
+		if err != nil {
+			log.Fatal("Failed to connect to database", zap.Error(err))
+		}
+
+		migrator, err := storage.NewMigrator(dbStorage)
+		if err != nil {
+			log.Fatal("Failed to load migrations", zap.Error(err))
+		}
+
+		// Команда миграций выполняется без запуска сервера
+		if cfg.MigrateCommand != "" {
+			err := runMigrateCommand(context.Background(), migrator, cfg.MigrateCommand)
+			dbStorage.Close()
+			if err != nil {
+				log.Fatal("Migration command failed", zap.String("command", cfg.MigrateCommand), zap.Error(err))
+			}
+			return
+		}
+
+		// Применяем миграции до запуска сервера
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			log.Fatal("Failed to apply migrations", zap.Error(err))
+		}
+		log.Info("Database schema is up to date",
+			zap.Int("applied", applied),
+			zap.Int64("version", migrator.LatestVersion()))
+
+		store = dbStorage
+	}
+
+	// Повторная обработка журнала ответов выполняется без запуска сервера
+	if len(cfg.ReplayAccrualOrders) > 0 {
+		err := runReplayCommand(context.Background(), store, cfg.ReplayAccrualOrders, log)
+		store.Close()
+		if err != nil {
+			log.Fatal("Accrual replay failed", zap.Error(err))
+		}
+		return
+	}
+
+	// Сверяем балансы с журналом проводок; расхождения не мешают запуску, но требуют разбора
+	ledgerCheckInterval, err := cfg.GetLedgerCheckInterval()
 	if err != nil {
-		log.Fatal("Failed to connect to database", zap.Error(err))
+		log.Fatal("Failed to parse ledger check interval", zap.Error(err))
 	}
-	defer dbStorage.Close()
+	ledgerAuditor := server.NewLedgerAuditor(store, ledgerCheckInterval, log)
+	ledgerAuditor.Run(context.Background())
 
-	// Генерируем секретный ключ для JWT
-	jwtSecret, err := services.GenerateSecret()
+	// Ключи подписи JWT общие для всех экземпляров и переживают перезапуск
+	authService, err := newAuthService(cfg, log)
 	if err != nil {
-		log.Fatal("Failed to generate JWT secret", zap.Error(err))
+		log.Fatal("Failed to load JWT signing keys", zap.Error(err))
 	}
 
 	// Создаем сервисы
-	authService := services.NewAuthService(jwtSecret)
 	accrualService := services.NewAccrualService(cfg.AccrualSystemAddress)
+	accrualEvents := server.NewAccrualEventRecorder(store, log)
+	accrualService.SetEventRecorder(accrualEvents)
+
+	accrualBreakerCooldown, err := cfg.GetAccrualBreakerCooldown()
+	if err != nil {
+		log.Fatal("Failed to parse accrual breaker cooldown", zap.Error(err))
+	}
+	breakerSettings := services.BreakerSettings{
+		FailureThreshold: cfg.AccrualBreakerThreshold,
+		SuccessThreshold: services.DefaultBreakerSuccessThreshold,
+		CoolDown:         accrualBreakerCooldown,
+	}
+	accrualService.SetBreakerSettings(breakerSettings)
+
+	// Несколько систем начисления с правилами выбора; без описания используется одна ACCRUAL_SYSTEM_ADDRESS.
+	// Системы без своих параметров выключателя берут ACCRUAL_BREAKER_THRESHOLD и ACCRUAL_BREAKER_COOLDOWN.
+	providers, err := loadAccrualProviders(cfg, breakerSettings)
+	if err != nil {
+		log.Fatal("Failed to load accrual providers", zap.Error(err))
+	}
+	if providers != nil {
+		providers.SetEventRecorder(accrualEvents)
+		accrualService = providers.Default()
+		log.Info("Accrual providers configured", zap.Strings("providers", providers.Names()))
+	}
 
 	// Создаем роутер
-	router := server.NewRouter(dbStorage, authService, accrualService, log)
+	router := server.NewRouter(store, authService, accrualService, log)
+	if providers != nil {
+		router.SetProviders(providers)
+	}
+	adminHandlers := server.NewAdminHandlers(store, log)
+	if cfg.AdminToken != "" {
+		router.MountAdmin(adminHandlers, cfg.AdminToken)
+	}
 
 	orderProcessInterval, err := cfg.GetOrderProcessInterval()
 	if err != nil {
 		log.Fatal("Failed to parse order process interval", zap.Error(err))
 	}
 
+	accrualRetryBackoff, err := cfg.GetAccrualRetryBackoff()
+	if err != nil {
+		log.Fatal("Failed to parse accrual retry backoff", zap.Error(err))
+	}
+	accrualUnregisteredTimeout, err := cfg.GetAccrualUnregisteredTimeout()
+	if err != nil {
+		log.Fatal("Failed to parse accrual unregistered timeout", zap.Error(err))
+	}
+
 	// Создаем процессор заказов
-	orderProcessor := server.NewOrderProcessor(dbStorage, accrualService, orderProcessInterval, cfg.WorkerCount, log)
+	orderProcessor := server.NewOrderProcessor(store, accrualService, orderProcessInterval, cfg.WorkerCount, log)
+	orderProcessor.SetRetryPolicy(cfg.AccrualMaxAttempts, accrualRetryBackoff)
+	orderProcessor.SetUnregisteredTimeout(accrualUnregisteredTimeout)
+	if err := orderProcessor.SetWorkerBounds(cfg.WorkerMin, cfg.WorkerMax); err != nil {
+		log.Fatal("Invalid worker pool bounds", zap.Error(err))
+	}
+	if cfg.WorkerMin < cfg.WorkerMax {
+		log.Info("Worker pool autoscaling enabled",
+			zap.Int("min", cfg.WorkerMin),
+			zap.Int("max", cfg.WorkerMax))
+	}
+	schedulingPolicy, err := cfg.GetSchedulingPolicy()
+	if err != nil {
+		log.Fatal("Failed to parse scheduling policy", zap.Error(err))
+	}
+	orderProcessor.SetSchedulingPolicy(schedulingPolicy)
+	adminHandlers.SetOrderProcessor(orderProcessor)
+	adminHandlers.SetAuthService(authService)
+	adminHandlers.SetLedgerAuditor(ledgerAuditor)
+	if providers != nil {
+		orderProcessor.SetProviders(providers)
+	}
+
+	// Теневой режим: кандидат на замену системы начисления опрашивается параллельно, его ответы не применяются
+	var shadow *server.ShadowComparer
+	if cfg.AccrualShadowAddress != "" {
+		shadow = server.NewShadowComparer(services.NewAccrualService(cfg.AccrualShadowAddress), store, cfg.WorkerCount, log)
+		orderProcessor.SetShadow(shadow)
+		log.Info("Accrual shadow mode enabled", zap.String("shadowAddress", cfg.AccrualShadowAddress))
+	}
+
+	// Push-уведомления системы начисления; опрос остается для заказов без уведомления
+	if cfg.AccrualCallbackSecret != "" {
+		callbackTolerance, err := cfg.GetAccrualCallbackTolerance()
+		if err != nil {
+			log.Fatal("Failed to parse accrual callback tolerance", zap.Error(err))
+		}
+		pushDeadline, err := cfg.GetAccrualPushDeadline()
+		if err != nil {
+			log.Fatal("Failed to parse accrual push deadline", zap.Error(err))
+		}
+
+		verifier := services.NewCallbackVerifier([]byte(cfg.AccrualCallbackSecret), callbackTolerance)
+		callbackHandler := server.NewAccrualCallbackHandler(orderProcessor, verifier, log)
+		callbackHandler.SetEventRecorder(accrualEvents)
+		router.MountAccrualCallback(callbackHandler)
+		orderProcessor.SetPushDeadline(pushDeadline)
+		log.Info("Accrual push callbacks enabled", zap.Duration("pushDeadline", pushDeadline))
+	}
+
+	// Выборы ведущего экземпляра для задач, которые должны выполняться на одной реплике
+	leaderCheckInterval, err := cfg.GetLeaderCheckInterval()
+	if err != nil {
+		log.Fatal("Failed to parse leader check interval", zap.Error(err))
+	}
+	leaderElector := server.NewLeaderElector(store, server.DefaultLeaderElection, leaderCheckInterval, log)
+	router.SetLeaderElector(leaderElector)
+	if cfg.OrderProcessingLeaderOnly {
+		orderProcessor.SetLeaderOnly(leaderElector)
+		leaderElector.OnChange(func(leader bool) {
+			if leader {
+				orderProcessor.Wake()
+			}
+		})
+		log.Info("Order processing runs on the leader replica only")
+	}
+	leaderElector.Start()
+
+	// Дальше балансы сверяются по расписанию на ведущем экземпляре
+	ledgerAuditor.SetLeaderOnly(leaderElector)
+	ledgerAuditor.Start()
+
 	orderProcessor.Start()
-	defer orderProcessor.Stop()
+
+	// Сверка обработанных заказов с системой начисления
+	reconcileInterval, err := cfg.GetReconcileInterval()
+	if err != nil {
+		log.Fatal("Failed to parse reconcile interval", zap.Error(err))
+	}
+	var reconciler *server.Reconciler
+	if reconcileInterval > 0 {
+		reconcileWindow, err := cfg.GetReconcileWindow()
+		if err != nil {
+			log.Fatal("Failed to parse reconcile window", zap.Error(err))
+		}
+
+		reconciler = server.NewReconciler(store, accrualService, server.ReconcileSettings{
+			Interval:   reconcileInterval,
+			Window:     reconcileWindow,
+			SampleRate: cfg.ReconcileSampleRate,
+			Policy:     cfg.ReconcilePolicy,
+		}, log)
+		if providers != nil {
+			reconciler.SetProviders(providers)
+		}
+		reconciler.SetLeaderOnly(leaderElector)
+		adminHandlers.SetReconciler(reconciler)
+		reconciler.Start()
+		log.Info("Accrual reconciliation enabled",
+			zap.Duration("interval", reconcileInterval),
+			zap.Float64("sampleRate", cfg.ReconcileSampleRate),
+			zap.String("policy", cfg.ReconcilePolicy))
+	}
+
+	shutdownTimeout, err := cfg.GetShutdownTimeout()
+	if err != nil {
+		log.Fatal("Failed to parse shutdown timeout", zap.Error(err))
+	}
+
+	jwtKeyReloadInterval, err := cfg.GetJWTKeyReloadInterval()
+	if err != nil {
+		log.Fatal("Failed to parse JWT key reload interval", zap.Error(err))
+	}
 
 	// HTTP сервер
 	srv := &http.Server{
@@ -71,6 +285,11 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	// Экземпляры узнают о повороте ключей подписи, перечитывая общий файл ключей
+	if authService.KeyFile() != "" {
+		go watchJWTKeyFile(ctx, authService, jwtKeyReloadInterval, log)
+	}
+
 	// Канал для передачи ошибок сервера
 	serverErrors := make(chan error, 1)
 
@@ -91,13 +310,252 @@ func main() {
 		log.Info("Shutting down server...")
 	}
 
-	// Graceful shutdown
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Graceful shutdown: все этапы укладываются в общее время shutdownTimeout
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancel()
 
+	// Перестаем принимать запросы и дожидаемся начатых, в том числе push-уведомлений
 	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Error("Server shutdown error", zap.Error(err))
 	}
 
+	// Фоновые задачи останавливаются до закрытия хранилища
+	if reconciler != nil {
+		if err := reconciler.Stop(shutdownCtx); err != nil {
+			log.Error("Reconciliation did not stop in time", zap.Error(err))
+		}
+	}
+
+	if err := ledgerAuditor.Stop(shutdownCtx); err != nil {
+		log.Error("Ledger check did not stop in time", zap.Error(err))
+	}
+
+	unfinished, err := orderProcessor.Stop(shutdownCtx)
+	if err != nil {
+		log.Error("Order processing did not drain in time, in-flight checks interrupted", zap.Error(err))
+	}
+	if len(unfinished) > 0 {
+		// Заказы возвращены в очередь и будут проверены после перезапуска
+		log.Warn("Orders left unfinished on shutdown",
+			zap.Int("count", len(unfinished)),
+			zap.Strings("orders", unfinished))
+	}
+
+	if shadow != nil {
+		if err := shadow.Wait(shutdownCtx); err != nil {
+			log.Warn("Shadow comparisons did not finish in time", zap.Error(err))
+		}
+	}
+
+	// Блокировка лидерства снимается сразу, чтобы другая реплика не ждала потери сессии
+	if err := leaderElector.Stop(shutdownCtx); err != nil {
+		log.Warn("Leader election did not stop in time", zap.Error(err))
+	}
+
+	if err := store.Close(); err != nil {
+		log.Error("Failed to close storage", zap.Error(err))
+	}
+
 	log.Info("Server stopped")
 }
+
+// loadAccrualProviders создает набор систем начисления из файла или ACCRUAL_PROVIDERS;
+// возвращает nil, если описание не задано
+func loadAccrualProviders(cfg *config.Config, breaker services.BreakerSettings) (*services.ProviderRegistry, error) {
+	var (
+		providersCfg *services.ProvidersConfig
+		err          error
+	)
+	switch {
+	case cfg.AccrualProvidersFile != "":
+		providersCfg, err = services.LoadProvidersConfigFile(cfg.AccrualProvidersFile)
+	case cfg.AccrualProviders != "":
+		providersCfg, err = services.LoadProvidersConfig(strings.NewReader(cfg.AccrualProviders))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	providersCfg.SetBreakerDefaults(breaker)
+	return services.NewProviderRegistry(providersCfg)
+}
+
+// newAuthService создает сервис аутентификации с ключами подписи из файла ключей или JWT_KEYS.
+// Без них ключ генерируется при запуске: токены не переживают перезапуск и не принимаются
+// другими экземплярами.
+func newAuthService(cfg *config.Config, log *zap.Logger) (*services.AuthService, error) {
+	reloadInterval, err := cfg.GetJWTKeyReloadInterval()
+	if err != nil {
+		return nil, err
+	}
+	overlap, err := cfg.GetJWTKeyOverlap()
+	if err != nil {
+		return nil, err
+	}
+	accessTTL, refreshTTL, err := cfg.GetTokenTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	var authService *services.AuthService
+	switch {
+	case cfg.JWTKeyFile != "":
+		authService, err = services.NewAuthServiceWithKeyFile(cfg.JWTKeyFile, cfg.JWTSigningAlg)
+	case cfg.JWTKeys != "":
+		var keys *services.KeyRing
+		keys, err = services.LoadKeyRing(strings.NewReader(cfg.JWTKeys))
+		if err == nil {
+			authService, err = services.NewAuthServiceWithKeys(keys)
+		}
+	default:
+		log.Warn("JWT signing keys are not configured, tokens will not survive a restart or be accepted by other replicas")
+		var keys *services.KeyRing
+		keys, err = services.NewKeyRing(cfg.JWTSigningAlg, time.Now())
+		if err == nil {
+			authService, err = services.NewAuthServiceWithKeys(keys)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Новый ключ начинает подписывать, когда его наверняка загрузили остальные экземпляры
+	authService.SetKeyRotation(2*reloadInterval, overlap)
+	authService.SetTokenClaims(cfg.JWTIssuer, cfg.JWTAudience)
+	authService.SetTokenTTL(accessTTL, refreshTTL)
+	log.Info("JWT signing keys loaded",
+		zap.Int("keys", len(authService.Keys())),
+		zap.String("keyFile", cfg.JWTKeyFile),
+		zap.String("signingAlg", cfg.JWTSigningAlg))
+	return authService, nil
+}
+
+// watchJWTKeyFile перечитывает файл ключей подписи раз в interval до отмены ctx
+func watchJWTKeyFile(ctx context.Context, authService *services.AuthService, interval time.Duration, log *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := authService.ReloadKeyFile()
+			if err != nil {
+				log.Error("Failed to reload JWT signing keys, keeping the previous ones", zap.Error(err))
+				continue
+			}
+			if reloaded {
+				log.Info("JWT signing keys reloaded", zap.Int("keys", len(authService.Keys())))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runRotateJWTKeysCommand поворачивает ключи подписи в файле ключей и выводит их в stdout
+func runRotateJWTKeysCommand(cfg *config.Config) error {
+	reloadInterval, err := cfg.GetJWTKeyReloadInterval()
+	if err != nil {
+		return err
+	}
+	overlap, err := cfg.GetJWTKeyOverlap()
+	if err != nil {
+		return err
+	}
+
+	keys, err := services.RotateKeyRingFile(cfg.JWTKeyFile, cfg.JWTSigningAlg, 2*reloadInterval, overlap)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys.Info(time.Now()) {
+		expiresAt := "-"
+		if key.ExpiresAt != nil {
+			expiresAt = key.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\talg=%s\tactivates=%s\texpires=%s\tactive=%v\n",
+			key.ID, key.Algorithm, key.ActivatesAt.Format(time.RFC3339), expiresAt, key.Active)
+	}
+	return nil
+}
+
+// runMigrateCommand выполняет команду миграций и выводит результат в stdout
+func runMigrateCommand(ctx context.Context, migrator *storage.Migrator, command string) error {
+	switch command {
+	case config.MigrateUp:
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migration(s), schema version %d\n", applied, migrator.LatestVersion())
+	case config.MigrateDown:
+		version, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			fmt.Println("no migrations to roll back")
+		} else {
+			fmt.Printf("rolled back migration %d\n", version)
+		}
+	case config.MigrateStatus:
+		statuses, err := migrator.Status(ctx)
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%03d_%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command: %q", command)
+	}
+	return nil
+}
+
+// runReplayCommand повторно обрабатывает журнал ответов системы начисления для заказов numbers
+// и выводит в stdout сравнение с текущим состоянием заказов. Возвращает ошибку, если есть расхождения.
+func runReplayCommand(ctx context.Context, store server.Storage, numbers []string, log *zap.Logger) error {
+	if slices.Contains(numbers, config.ReplayAllOrders) {
+		all, err := store.ListAccrualEventOrders(ctx)
+		if err != nil {
+			return err
+		}
+		numbers = all
+	}
+
+	mismatches := 0
+	for _, number := range numbers {
+		// Каждый заказ обрабатывается в отдельной песочнице, хранилище не изменяется
+		replay, err := server.ReplayAccrualEvents(ctx, store, storage.NewMemoryStorage(), number, log)
+		if err != nil {
+			return fmt.Errorf("order %s: %w", number, err)
+		}
+
+		result := "ok"
+		if !replay.Matches() {
+			result = "MISMATCH"
+			mismatches++
+		}
+		fmt.Printf("%s\tevents=%d\treplayed=%s %s\tactual=%s %s\treparsed=%v\t%s\n",
+			replay.OrderNumber, replay.Events,
+			replay.Status, formatAccrual(replay.Accrual),
+			replay.ActualStatus, formatAccrual(replay.ActualAccrual),
+			replay.Reparsed, result)
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("%d of %d order(s) differ after replay", mismatches, len(numbers))
+	}
+	return nil
+}
+
+// formatAccrual выводит необязательное начисление
+func formatAccrual(accrual *models.Money) string {
+	if accrual == nil {
+		return "-"
+	}
+	return accrual.String()
+}
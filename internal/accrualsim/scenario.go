@@ -0,0 +1,140 @@
+package accrualsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// Step один ответ симулятора на запрос о заказе.
+// По умолчанию отвечает 200 с телом {order, status, accrual}.
+type Step struct {
+	// Status статус расчета: REGISTERED, PROCESSING, INVALID или PROCESSED
+	Status string `json:"status,omitempty"`
+	// Accrual начисление, отдается вместе со статусом
+	Accrual *models.Money `json:"accrual,omitempty"`
+	// HTTPStatus код ответа без тела, например 204, 500 или 503
+	HTTPStatus int `json:"http_status,omitempty"`
+	// Malformed отдает 200 с некорректным JSON
+	Malformed bool `json:"malformed,omitempty"`
+	// Delay задержка перед ответом
+	Delay Duration `json:"delay,omitempty"`
+}
+
+// Script последовательность ответов по заказу: каждый запрос переходит к следующему шагу,
+// последний шаг повторяется
+type Script []Step
+
+// Scenario сценарий работы симулятора
+type Scenario struct {
+	// Orders сценарии по номерам заказов
+	Orders map[string]Script `json:"orders,omitempty"`
+	// Default сценарий для заказов, которых нет в Orders; если не задан, отвечает 204
+	Default Script `json:"default,omitempty"`
+	// RateLimit число запросов в минуту, после которого отвечает 429; 0 — без ограничения
+	RateLimit int `json:"rate_limit,omitempty"`
+	// RetryAfter значение заголовка Retry-After для ответов 429; по умолчанию до конца минуты
+	RetryAfter Duration `json:"retry_after,omitempty"`
+}
+
+// Duration длительность, в JSON записывается строкой вида "1.5s"
+type Duration time.Duration
+
+// MarshalJSON записывает длительность строкой
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON читает длительность из строки
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Processed шаг с обработанным заказом и начислением
+func Processed(accrual models.Money) Step {
+	return Step{Status: models.AccrualStatusProcessed, Accrual: &accrual}
+}
+
+// WithStatus шаг с указанным статусом расчета без начисления
+func WithStatus(status string) Step {
+	return Step{Status: status}
+}
+
+// WithHTTPStatus шаг, отвечающий кодом без тела
+func WithHTTPStatus(code int) Step {
+	return Step{HTTPStatus: code}
+}
+
+// LoadScenario читает сценарий в формате JSON
+func LoadScenario(r io.Reader) (*Scenario, error) {
+	var scenario Scenario
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("failed to decode scenario: %w", err)
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+// LoadScenarioFile читает сценарий из файла
+func LoadScenarioFile(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario: %w", err)
+	}
+	defer f.Close()
+
+	return LoadScenario(f)
+}
+
+// Validate проверяет, что шаги сценария непротиворечивы
+func (s *Scenario) Validate() error {
+	if s.RateLimit < 0 {
+		return fmt.Errorf("rate limit must not be negative, got %d", s.RateLimit)
+	}
+	if err := s.Default.validate(); err != nil {
+		return fmt.Errorf("invalid default script: %w", err)
+	}
+	for number, script := range s.Orders {
+		if len(script) == 0 {
+			return fmt.Errorf("invalid script for order %s: no steps", number)
+		}
+		if err := script.validate(); err != nil {
+			return fmt.Errorf("invalid script for order %s: %w", number, err)
+		}
+	}
+	return nil
+}
+
+func (s Script) validate() error {
+	for i, step := range s {
+		if step.HTTPStatus == 0 && !step.Malformed {
+			if _, err := models.MapAccrualStatus(step.Status); err != nil {
+				return fmt.Errorf("step %d: %w", i, err)
+			}
+		}
+		if step.HTTPStatus != 0 && (step.HTTPStatus < 100 || step.HTTPStatus > 599) {
+			return fmt.Errorf("step %d: invalid http status %d", i, step.HTTPStatus)
+		}
+		if step.Delay < 0 {
+			return fmt.Errorf("step %d: negative delay", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package accrualsim реализует симулятор системы начисления баллов
+// для локальной разработки и сквозных тестов.
+package accrualsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// Simulator HTTP-обработчик, отвечающий на GET /api/orders/{number} по сценарию.
+// Можно встраивать в httptest.Server или запускать отдельно (cmd/accrual-sim).
+type Simulator struct {
+	mu       sync.Mutex
+	scenario Scenario
+	requests map[string]int // число запросов по каждому заказу
+	served   map[string]int // число запросов, продвинувших сценарий заказа
+
+	windowStart time.Time // начало текущей минуты для ограничения частоты
+	windowCount int
+
+	router *chi.Mux
+	now    func() time.Time
+}
+
+// New создает симулятор со сценарием scenario
+func New(scenario Scenario) *Simulator {
+	s := &Simulator{
+		scenario: scenario,
+		requests: make(map[string]int),
+		served:   make(map[string]int),
+		now:      time.Now,
+	}
+	s.scenario.Orders = maps.Clone(scenario.Orders)
+	if s.scenario.Orders == nil {
+		s.scenario.Orders = make(map[string]Script)
+	}
+
+	s.router = chi.NewRouter()
+	s.router.Get("/api/orders/{number}", s.orderHandler)
+
+	return s
+}
+
+// ServeHTTP реализует http.Handler
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// SetOrder задает сценарий заказа и сбрасывает счетчик его запросов
+func (s *Simulator) SetOrder(number string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scenario.Orders[number] = steps
+	delete(s.requests, number)
+	delete(s.served, number)
+}
+
+// SetRateLimit задает число запросов в минуту и значение Retry-After
+func (s *Simulator) SetRateLimit(perMinute int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scenario.RateLimit = perMinute
+	s.scenario.RetryAfter = Duration(retryAfter)
+	s.windowCount = 0
+}
+
+// Requests возвращает число запросов по заказу, включая отклоненные по лимиту
+func (s *Simulator) Requests(number string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[number]
+}
+
+// orderHandler отвечает очередным шагом сценария заказа
+func (s *Simulator) orderHandler(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	step, retryAfter, ok := s.nextStep(number)
+	if retryAfter > 0 {
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.rateLimit())
+		return
+	}
+
+	if step.Delay > 0 {
+		timer := time.NewTimer(time.Duration(step.Delay))
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+
+	switch {
+	case !ok:
+		w.WriteHeader(http.StatusNoContent)
+	case step.HTTPStatus != 0:
+		w.WriteHeader(step.HTTPStatus)
+	case step.Malformed:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"order": "` + number + `", "status": `))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(models.AccrualResponse{
+			Order:   number,
+			Status:  step.Status,
+			Accrual: step.Accrual,
+		})
+	}
+}
+
+// nextStep учитывает запрос и выбирает шаг сценария. Возвращает положительный retryAfter,
+// если превышен лимит запросов, и ok=false, если у заказа нет сценария.
+func (s *Simulator) nextStep(number string) (step Step, retryAfter time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[number]++
+
+	if s.scenario.RateLimit > 0 {
+		now := s.now()
+		if now.Sub(s.windowStart) >= time.Minute {
+			s.windowStart = now
+			s.windowCount = 0
+		}
+		s.windowCount++
+		if s.windowCount > s.scenario.RateLimit {
+			retryAfter = time.Duration(s.scenario.RetryAfter)
+			if retryAfter <= 0 {
+				retryAfter = s.windowStart.Add(time.Minute).Sub(now)
+			}
+			return Step{}, retryAfter, false
+		}
+	}
+
+	script, found := s.scenario.Orders[number]
+	if !found {
+		script = s.scenario.Default
+	}
+	if len(script) == 0 {
+		return Step{}, 0, false
+	}
+
+	// Запросы, отклоненные по лимиту, не продвигают сценарий
+	served := s.served[number]
+	s.served[number]++
+	return script[min(served, len(script)-1)], 0, true
+}
+
+func (s *Simulator) rateLimit() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.scenario.RateLimit
+}
@@ -0,0 +1,170 @@
+package accrualsim
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// get выполняет запрос к симулятору и возвращает код и тело ответа
+func get(t *testing.T, sim *Simulator, number string) (*http.Response, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	sim.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil))
+	resp := rec.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestSimulator_Progression(t *testing.T) {
+	sim := New(Scenario{})
+	sim.SetOrder("12345678903",
+		WithStatus(models.AccrualStatusRegistered),
+		WithStatus(models.AccrualStatusProcessing),
+		Processed(models.Money(72998)),
+	)
+
+	expected := []string{
+		`{"order":"12345678903","status":"REGISTERED"}`,
+		`{"order":"12345678903","status":"PROCESSING"}`,
+		`{"order":"12345678903","status":"PROCESSED","accrual":729.98}`,
+		// Последний шаг повторяется
+		`{"order":"12345678903","status":"PROCESSED","accrual":729.98}`,
+	}
+	for _, body := range expected {
+		resp, got := get(t, sim, "12345678903")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.JSONEq(t, body, got)
+	}
+	assert.Equal(t, 4, sim.Requests("12345678903"))
+}
+
+func TestSimulator_UnknownOrder(t *testing.T) {
+	sim := New(Scenario{})
+	resp, _ := get(t, sim, "79927398713")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// Сценарий по умолчанию применяется к любому заказу
+	sim = New(Scenario{Default: Script{Processed(models.Money(100))}})
+	resp, body := get(t, sim, "79927398713")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"order":"79927398713","status":"PROCESSED","accrual":1}`, body)
+}
+
+func TestSimulator_Faults(t *testing.T) {
+	sim := New(Scenario{})
+	sim.SetOrder("2377225624",
+		WithHTTPStatus(http.StatusInternalServerError),
+		Step{Malformed: true},
+		WithStatus(models.AccrualStatusInvalid),
+	)
+
+	resp, _ := get(t, sim, "2377225624")
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp, body := get(t, sim, "2377225624")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.False(t, strings.HasSuffix(strings.TrimSpace(body), "}"))
+
+	resp, body = get(t, sim, "2377225624")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"order":"2377225624","status":"INVALID"}`, body)
+}
+
+func TestSimulator_RateLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sim := New(Scenario{Default: Script{WithStatus(models.AccrualStatusProcessing)}, RateLimit: 2})
+	sim.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		resp, _ := get(t, sim, "12345678903")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// По умолчанию Retry-After указывает на конец текущей минуты
+	now = now.Add(15 * time.Second)
+	resp, body := get(t, sim, "12345678903")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "45", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "No more than 2 requests per minute allowed", body)
+
+	// С началом новой минуты лимит восстанавливается
+	now = now.Add(45 * time.Second)
+	resp, _ = get(t, sim, "12345678903")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Новый лимит начинает отсчет заново
+	sim.SetRateLimit(1, 3*time.Second)
+	resp, _ = get(t, sim, "12345678903")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = get(t, sim, "12345678903")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("Retry-After"))
+}
+
+func TestSimulator_SlowResponse(t *testing.T) {
+	sim := New(Scenario{})
+	sim.SetOrder("12345678903", Step{Status: models.AccrualStatusProcessing, Delay: Duration(time.Second)})
+
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	// Клиент не дожидается медленного ответа
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/api/orders/12345678903", nil)
+	require.NoError(t, err)
+
+	_, err = http.DefaultClient.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLoadScenario(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		scenario, err := LoadScenario(strings.NewReader(`{
+			"rate_limit": 10,
+			"retry_after": "5s",
+			"default": [{"status": "REGISTERED"}],
+			"orders": {
+				"12345678903": [{"http_status": 503, "delay": "100ms"}, {"status": "PROCESSED", "accrual": 500}]
+			}
+		}`))
+		require.NoError(t, err)
+		assert.Equal(t, 10, scenario.RateLimit)
+		assert.Equal(t, Duration(5*time.Second), scenario.RetryAfter)
+		require.Len(t, scenario.Orders["12345678903"], 2)
+		assert.Equal(t, Duration(100*time.Millisecond), scenario.Orders["12345678903"][0].Delay)
+		require.NotNil(t, scenario.Orders["12345678903"][1].Accrual)
+		assert.Equal(t, models.Money(50000), *scenario.Orders["12345678903"][1].Accrual)
+	})
+
+	invalid := map[string]string{
+		"Unknown status": `{"orders": {"1": [{"status": "DONE"}]}}`,
+		"Empty script":   `{"orders": {"1": []}}`,
+		"Bad duration":   `{"retry_after": "soon"}`,
+		"Bad code":       `{"default": [{"http_status": 42}]}`,
+		"Unknown field":  `{"orderz": {}}`,
+		"Negative limit": `{"rate_limit": -1}`,
+	}
+	for name, data := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadScenario(strings.NewReader(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadScenarioFile_Example(t *testing.T) {
+	_, err := LoadScenarioFile("../../cmd/accrual-sim/scenario.example.json")
+	require.NoError(t, err)
+}
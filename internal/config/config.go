@@ -1,12 +1,34 @@
 package config
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+)
+
+// Типы хранилища
+const (
+	StorageDatabase = "database"
+	StorageMemory   = "memory"
+)
+
+// Команды управления миграциями
+const (
+	MigrateUp     = "up"
+	MigrateDown   = "down"
+	MigrateStatus = "status"
 )
 
+// ReplayAllOrders значение -replay-accrual для повторной обработки всех заказов с событиями
+const ReplayAllOrders = "all"
+
 // Config содержит конфигурацию сервера
 type Config struct {
 	RunAddress           string
@@ -14,6 +36,86 @@ type Config struct {
 	AccrualSystemAddress string
 	OrderProcessInterval string
 	WorkerCount          int
+	StorageType          string
+	// WorkerMin и WorkerMax границы автоматического подбора числа воркеров; WorkerCount — начальное число.
+	// При равных границах число воркеров не меняется.
+	WorkerMin int
+	WorkerMax int
+	// AccrualMaxAttempts число неудачных попыток обработки заказа подряд до очереди недоставленных
+	AccrualMaxAttempts int
+	// AccrualRetryBackoff начальная задержка перед повторной проверкой заказа
+	AccrualRetryBackoff string
+	// AccrualUnregisteredTimeout сколько заказ может быть не зарегистрирован в системе начисления без расхода попыток
+	AccrualUnregisteredTimeout string
+	// AccrualBreakerThreshold число ошибок системы начисления подряд, после которого запросы приостанавливаются
+	AccrualBreakerThreshold int
+	// AccrualBreakerCooldown пауза перед пробным запросом к системе начисления
+	AccrualBreakerCooldown string
+	// AccrualCallbackSecret общий секрет подписи push-уведомлений; пустой — прием уведомлений выключен
+	AccrualCallbackSecret string
+	// AccrualCallbackTolerance допустимое расхождение времени отправки уведомления
+	AccrualCallbackTolerance string
+	// AccrualPushDeadline сколько ждать уведомления, прежде чем опросить заказ
+	AccrualPushDeadline string
+	// AccrualProvidersFile путь к JSON-описанию нескольких систем начисления и правил выбора
+	AccrualProvidersFile string
+	// AccrualProviders JSON-описание систем начисления, если файл не задан
+	AccrualProviders string
+	// AccrualShadowAddress адрес теневой системы начисления, с которой сравниваются ответы основной;
+	// пустой — теневой режим выключен
+	AccrualShadowAddress string
+	// AdminToken токен служебного API /api/admin; пустой — служебное API выключено
+	AdminToken string
+	// ReconcileInterval период сверки обработанных заказов с системой начисления; 0 — сверка выключена
+	ReconcileInterval string
+	// ReconcileWindow за какой срок назад перепроверяются обработанные заказы
+	ReconcileWindow string
+	// ReconcileSampleRate доля заказов окна, перепроверяемая за проход
+	ReconcileSampleRate float64
+	// ReconcilePolicy что делать с расхождением: adjust — исправить проводкой, review — открыть для разбора
+	ReconcilePolicy string
+	// LedgerCheckInterval период сверки балансов с журналом проводок; 0 — только сверка при запуске
+	LedgerCheckInterval string
+	// LeaderCheckInterval как часто ведомый экземпляр пытается стать ведущим, а ведущий проверяет свою сессию
+	LeaderCheckInterval string
+	// OrderProcessingLeaderOnly очередь заказов обрабатывает только ведущий экземпляр
+	OrderProcessingLeaderOnly bool
+	// SchedulerTierWeights веса тарифов в очереди обработки заказов, например "premium=3,partner=2";
+	// пустые — заказы пользователей всех тарифов чередуются поровну
+	SchedulerTierWeights string
+	// SchedulerRecentWindow сколько заказ после загрузки проверяется раньше очереди; 0 — без повышения
+	SchedulerRecentWindow string
+	// SchedulerViewWindow сколько после просмотра списка заказы пользователя проверяются раньше очереди;
+	// 0 — без повышения
+	SchedulerViewWindow string
+	// JWTKeyFile путь к файлу ключей подписи JWT; если файла нет, он создается
+	JWTKeyFile string
+	// JWTKeys JSON-описание ключей подписи JWT, если файл не задан; такие ключи не поворачиваются
+	JWTKeys string
+	// JWTKeyOverlap сколько прежние ключи принимаются после вступления нового ключа в силу
+	JWTKeyOverlap string
+	// JWTKeyReloadInterval как часто перечитывается файл ключей; новый ключ начинает подписывать
+	// токены через два таких периода после поворота
+	JWTKeyReloadInterval string
+	// JWTSigningAlg алгоритм новых ключей подписи: HS256, RS256 или EdDSA
+	JWTSigningAlg string
+	// JWTIssuer и JWTAudience издатель (iss) и получатель (aud) токенов
+	JWTIssuer   string
+	JWTAudience string
+	// AccessTokenTTL срок действия access токена (JWT)
+	AccessTokenTTL string
+	// RefreshTokenTTL срок действия refresh токена, которым обновляется access токен
+	RefreshTokenTTL string
+	// RotateJWTKeys повернуть ключи в файле ключей; если задано, сервер не запускается
+	RotateJWTKeys bool
+	// ShutdownTimeout общее время на остановку сервера: завершение HTTP-запросов,
+	// обработки заказов и закрытие хранилища
+	ShutdownTimeout string
+	// MigrateCommand команда миграций; если задана, сервер не запускается
+	MigrateCommand string
+	// ReplayAccrualOrders заказы, события которых нужно обработать повторно, или ReplayAllOrders;
+	// если заданы, сервер не запускается
+	ReplayAccrualOrders []string
 }
 
 // GetOrderProcessInterval возвращает интервал обработки заказов как time.Duration
@@ -21,6 +123,94 @@ func (c *Config) GetOrderProcessInterval() (time.Duration, error) {
 	return time.ParseDuration(c.OrderProcessInterval)
 }
 
+// GetAccrualRetryBackoff возвращает начальную задержку повторной проверки как time.Duration
+func (c *Config) GetAccrualRetryBackoff() (time.Duration, error) {
+	return time.ParseDuration(c.AccrualRetryBackoff)
+}
+
+// GetAccrualUnregisteredTimeout возвращает срок ожидания регистрации заказа как time.Duration
+func (c *Config) GetAccrualUnregisteredTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.AccrualUnregisteredTimeout)
+}
+
+// GetAccrualBreakerCooldown возвращает паузу выключателя как time.Duration
+func (c *Config) GetAccrualBreakerCooldown() (time.Duration, error) {
+	return time.ParseDuration(c.AccrualBreakerCooldown)
+}
+
+// GetAccrualCallbackTolerance возвращает допустимое расхождение времени уведомления как time.Duration
+func (c *Config) GetAccrualCallbackTolerance() (time.Duration, error) {
+	return time.ParseDuration(c.AccrualCallbackTolerance)
+}
+
+// GetAccrualPushDeadline возвращает срок ожидания уведомления как time.Duration
+func (c *Config) GetAccrualPushDeadline() (time.Duration, error) {
+	return time.ParseDuration(c.AccrualPushDeadline)
+}
+
+// GetReconcileInterval возвращает период сверки как time.Duration
+func (c *Config) GetReconcileInterval() (time.Duration, error) {
+	return time.ParseDuration(c.ReconcileInterval)
+}
+
+// GetLedgerCheckInterval возвращает период сверки балансов с журналом как time.Duration
+func (c *Config) GetLedgerCheckInterval() (time.Duration, error) {
+	return time.ParseDuration(c.LedgerCheckInterval)
+}
+
+// GetReconcileWindow возвращает окно сверки как time.Duration
+func (c *Config) GetReconcileWindow() (time.Duration, error) {
+	return time.ParseDuration(c.ReconcileWindow)
+}
+
+// GetLeaderCheckInterval возвращает период проверки лидерства как time.Duration
+func (c *Config) GetLeaderCheckInterval() (time.Duration, error) {
+	return time.ParseDuration(c.LeaderCheckInterval)
+}
+
+// GetSchedulingPolicy возвращает правила справедливой очереди обработки заказов
+func (c *Config) GetSchedulingPolicy() (models.SchedulingPolicy, error) {
+	weights, err := models.ParseTierWeights(c.SchedulerTierWeights)
+	if err != nil {
+		return models.SchedulingPolicy{}, err
+	}
+	recentWindow, err := time.ParseDuration(c.SchedulerRecentWindow)
+	if err != nil {
+		return models.SchedulingPolicy{}, err
+	}
+	viewWindow, err := time.ParseDuration(c.SchedulerViewWindow)
+	if err != nil {
+		return models.SchedulingPolicy{}, err
+	}
+	return models.SchedulingPolicy{TierWeights: weights, RecentWindow: recentWindow, ViewWindow: viewWindow}, nil
+}
+
+// GetJWTKeyOverlap возвращает окно перекрытия ключей подписи как time.Duration
+func (c *Config) GetJWTKeyOverlap() (time.Duration, error) {
+	return time.ParseDuration(c.JWTKeyOverlap)
+}
+
+// GetJWTKeyReloadInterval возвращает период перечитывания файла ключей как time.Duration
+func (c *Config) GetJWTKeyReloadInterval() (time.Duration, error) {
+	return time.ParseDuration(c.JWTKeyReloadInterval)
+}
+
+// GetTokenTTL возвращает сроки действия access и refresh токенов как time.Duration
+func (c *Config) GetTokenTTL() (accessTTL, refreshTTL time.Duration, err error) {
+	if accessTTL, err = time.ParseDuration(c.AccessTokenTTL); err != nil {
+		return 0, 0, err
+	}
+	if refreshTTL, err = time.ParseDuration(c.RefreshTokenTTL); err != nil {
+		return 0, 0, err
+	}
+	return accessTTL, refreshTTL, nil
+}
+
+// GetShutdownTimeout возвращает время на остановку сервера как time.Duration
+func (c *Config) GetShutdownTimeout() (time.Duration, error) {
+	return time.ParseDuration(c.ShutdownTimeout)
+}
+
 // Load загружает конфигурацию из флагов и переменных окружения
 func Load() (*Config, error) {
 	var (
@@ -29,6 +219,42 @@ func Load() (*Config, error) {
 		flagAccrualSystemAddress string
 		flagOrderProcessInterval string
 		flagWorkerCount          int
+		flagWorkerMin            int
+		flagWorkerMax            int
+		flagStorageType          string
+		flagMigrateCommand       string
+		flagAccrualMaxAttempts   int
+		flagAccrualRetryBackoff  string
+		flagUnregisteredTimeout  string
+		flagBreakerThreshold     int
+		flagBreakerCooldown      string
+		flagCallbackSecret       string
+		flagCallbackTolerance    string
+		flagPushDeadline         string
+		flagProvidersFile        string
+		flagShadowAddress        string
+		flagAdminToken           string
+		flagReconcileInterval    string
+		flagReconcileWindow      string
+		flagReconcileSampleRate  float64
+		flagReconcilePolicy      string
+		flagLedgerCheckInterval  string
+		flagLeaderCheckInterval  string
+		flagLeaderOnlyOrders     bool
+		flagTierWeights          string
+		flagRecentWindow         string
+		flagViewWindow           string
+		flagJWTKeyFile           string
+		flagJWTKeyOverlap        string
+		flagJWTKeyReload         string
+		flagRotateJWTKeys        bool
+		flagJWTSigningAlg        string
+		flagJWTIssuer            string
+		flagJWTAudience          string
+		flagAccessTokenTTL       string
+		flagRefreshTokenTTL      string
+		flagShutdownTimeout      string
+		flagReplayAccrual        string
 	)
 
 	flag.StringVar(&flagRunAddress, "a", "localhost:8080", "address and port to run server")
@@ -36,13 +262,115 @@ func Load() (*Config, error) {
 	flag.StringVar(&flagAccrualSystemAddress, "r", "", "accrual system address")
 	flag.StringVar(&flagOrderProcessInterval, "i", "5s", "order processing interval")
 	flag.IntVar(&flagWorkerCount, "w", 5, "number of workers for order processing")
+	flag.IntVar(&flagWorkerMin, "workers-min", 0, "minimum number of order processing workers when autoscaling; 0 uses -w")
+	flag.IntVar(&flagWorkerMax, "workers-max", 0, "maximum number of order processing workers when autoscaling; 0 uses -w")
+	flag.StringVar(&flagStorageType, "storage", StorageDatabase, "storage backend: database or memory")
+	flag.StringVar(&flagMigrateCommand, "migrate", "", "run migrations command (up, down or status) and exit")
+	flag.IntVar(&flagAccrualMaxAttempts, "accrual-max-attempts", 10, "failed processing attempts in a row before an order is moved to the dead letter queue")
+	flag.StringVar(&flagAccrualRetryBackoff, "accrual-retry-backoff", "1s", "initial delay before rechecking an order, doubled on each attempt")
+	flag.StringVar(&flagUnregisteredTimeout, "accrual-unregistered-timeout", "168h", "how long an order may stay unregistered in the accrual system before such responses count as failed attempts")
+	flag.IntVar(&flagBreakerThreshold, "accrual-breaker-threshold", 5, "consecutive accrual system failures before requests are paused")
+	flag.StringVar(&flagBreakerCooldown, "accrual-breaker-cooldown", "30s", "pause before a probe request once the accrual circuit breaker opens")
+	flag.StringVar(&flagCallbackSecret, "accrual-callback-secret", "", "shared secret for accrual push callbacks; empty disables the callback endpoint")
+	flag.StringVar(&flagCallbackTolerance, "accrual-callback-tolerance", "5m", "max clock difference for accrual push callback timestamps")
+	flag.StringVar(&flagPushDeadline, "accrual-push-deadline", "10m", "how long to wait for a push callback before polling an order")
+	flag.StringVar(&flagProvidersFile, "accrual-providers", "", "path to JSON file with accrual providers and routing rules")
+	flag.StringVar(&flagShadowAddress, "accrual-shadow-address", "", "shadow accrual system compared with the primary one; its results are never applied")
+	flag.StringVar(&flagAdminToken, "admin-token", "", "bearer token for the admin API; empty disables the admin API")
+	flag.StringVar(&flagReconcileInterval, "reconcile-interval", "1h", "how often to reconcile processed orders with the accrual system; 0 disables")
+	flag.StringVar(&flagReconcileWindow, "reconcile-window", "72h", "how far back processed orders are reconciled")
+	flag.Float64Var(&flagReconcileSampleRate, "reconcile-sample-rate", 0.1, "share of processed orders rechecked per reconciliation run, in (0, 1]")
+	flag.StringVar(&flagReconcilePolicy, "reconcile-policy", models.ReconcilePolicyReview, "what to do with an accrual discrepancy: adjust or review")
+	flag.StringVar(&flagLedgerCheckInterval, "ledger-check-interval", "1h", "how often to check balances against the ledger; 0 checks only on startup")
+	flag.StringVar(&flagLeaderCheckInterval, "leader-check-interval", "5s", "how often a replica tries to become the leader and the leader checks its lock session")
+	flag.BoolVar(&flagLeaderOnlyOrders, "order-processing-leader-only", false, "process the order queue on the leader replica only instead of sharing it through leases")
+	flag.StringVar(&flagTierWeights, "scheduler-tier-weights", "", "order queue weights of user tiers, e.g. premium=3,partner=2; tiers without a weight get 1")
+	flag.StringVar(&flagRecentWindow, "scheduler-recent-window", "1m", "how long a newly uploaded order is checked ahead of the queue; 0 disables")
+	flag.StringVar(&flagViewWindow, "scheduler-view-window", "2m", "how long after viewing the order list a user's orders are checked ahead of the queue; 0 disables")
+	flag.StringVar(&flagJWTKeyFile, "jwt-key-file", "", "path to the JWT signing key file shared by replicas; created if missing")
+	flag.StringVar(&flagJWTKeyOverlap, "jwt-key-overlap", "24h", "how long previous JWT signing keys are accepted after a rotation")
+	flag.StringVar(&flagJWTKeyReload, "jwt-key-reload-interval", "1m", "how often the JWT signing key file is reloaded")
+	flag.StringVar(&flagJWTSigningAlg, "jwt-signing-alg", services.AlgHS256, "algorithm of new JWT signing keys: HS256, RS256 or EdDSA; RS256 and EdDSA public keys are published in /.well-known/jwks.json")
+	flag.StringVar(&flagJWTIssuer, "jwt-issuer", services.DefaultTokenIssuer, "issuer (iss) claim of JWT tokens")
+	flag.StringVar(&flagJWTAudience, "jwt-audience", services.DefaultTokenAudience, "audience (aud) claim of JWT tokens")
+	flag.StringVar(&flagAccessTokenTTL, "access-token-ttl", "15m", "lifetime of access tokens (JWT)")
+	flag.StringVar(&flagRefreshTokenTTL, "refresh-token-ttl", "720h", "lifetime of refresh tokens used to renew access tokens")
+	flag.BoolVar(&flagRotateJWTKeys, "rotate-jwt-keys", false, "rotate JWT signing keys in the key file and exit")
+	flag.StringVar(&flagShutdownTimeout, "shutdown-timeout", "30s", "total time to finish HTTP requests, drain order processing and close storage on shutdown")
+	flag.StringVar(&flagReplayAccrual, "replay-accrual", "", "replay stored accrual events for comma-separated order numbers (or all) and exit")
 	flag.Parse()
 
-	return loadFromValues(flagRunAddress, flagDatabaseURI, flagAccrualSystemAddress, flagOrderProcessInterval, flagWorkerCount)
+	cfg, err := loadFromValues(flagRunAddress, flagDatabaseURI, flagAccrualSystemAddress, flagOrderProcessInterval, flagWorkerCount, flagStorageType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadWorkerPoolValues(flagWorkerMin, flagWorkerMax); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadAccrualRetryValues(flagAccrualMaxAttempts, flagAccrualRetryBackoff, flagUnregisteredTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadAccrualBreakerValues(flagBreakerThreshold, flagBreakerCooldown); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadAccrualCallbackValues(flagCallbackSecret, flagCallbackTolerance, flagPushDeadline); err != nil {
+		return nil, err
+	}
+
+	cfg.loadAccrualProvidersValues(flagProvidersFile)
+	cfg.loadAccrualShadowValues(flagShadowAddress)
+	cfg.loadAdminValues(flagAdminToken)
+
+	if err := cfg.loadReconcileValues(flagReconcileInterval, flagReconcileWindow, flagReconcileSampleRate, flagReconcilePolicy); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadLedgerCheckValues(flagLedgerCheckInterval); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadLeaderValues(flagLeaderCheckInterval, flagLeaderOnlyOrders); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadSchedulerValues(flagTierWeights, flagRecentWindow, flagViewWindow); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadJWTKeyValues(flagJWTKeyFile, flagJWTKeyOverlap, flagJWTKeyReload, flagRotateJWTKeys); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadJWTTokenValues(flagJWTSigningAlg, flagJWTIssuer, flagJWTAudience); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadTokenTTLValues(flagAccessTokenTTL, flagRefreshTokenTTL); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.loadShutdownValues(flagShutdownTimeout); err != nil {
+		return nil, err
+	}
+
+	cfg.ReplayAccrualOrders = parseReplayOrders(flagReplayAccrual)
+
+	switch flagMigrateCommand {
+	case "", MigrateUp, MigrateDown, MigrateStatus:
+		cfg.MigrateCommand = flagMigrateCommand
+	default:
+		return nil, fmt.Errorf("unknown migrate command: %q", flagMigrateCommand)
+	}
+
+	return cfg, nil
 }
 
 // loadFromValues загружает конфигурацию из переданных значений
-func loadFromValues(runAddress, databaseURI, accrualSystemAddress, orderProcessInterval string, workerCount int) (*Config, error) {
+func loadFromValues(runAddress, databaseURI, accrualSystemAddress, orderProcessInterval string, workerCount int, storageType string) (*Config, error) {
 	// Приоритет: flag > env > default
 	if runAddress == "localhost:8080" {
 		if envRunAddress := os.Getenv("RUN_ADDRESS"); envRunAddress != "" {
@@ -72,11 +400,499 @@ func loadFromValues(runAddress, databaseURI, accrualSystemAddress, orderProcessI
 		}
 	}
 
+	if storageType == StorageDatabase {
+		if envStorageType := os.Getenv("STORAGE_TYPE"); envStorageType != "" {
+			storageType = envStorageType
+		}
+	}
+
+	switch storageType {
+	case StorageDatabase, StorageMemory:
+	default:
+		return nil, fmt.Errorf("unknown storage type: %q", storageType)
+	}
+
 	return &Config{
 		RunAddress:           runAddress,
 		DatabaseURI:          databaseURI,
 		AccrualSystemAddress: accrualSystemAddress,
 		OrderProcessInterval: orderProcessInterval,
 		WorkerCount:          workerCount,
+		StorageType:          storageType,
 	}, nil
 }
+
+// loadAccrualRetryValues загружает параметры повторных проверок заказов
+func (c *Config) loadAccrualRetryValues(maxAttempts int, retryBackoff, unregisteredTimeout string) error {
+	// Приоритет: flag > env > default
+	if maxAttempts == 10 {
+		if envMaxAttempts := os.Getenv("ACCRUAL_MAX_ATTEMPTS"); envMaxAttempts != "" {
+			if parsed, err := strconv.Atoi(envMaxAttempts); err == nil {
+				maxAttempts = parsed
+			}
+		}
+	}
+	if retryBackoff == "1s" {
+		if envRetryBackoff := os.Getenv("ACCRUAL_RETRY_BACKOFF"); envRetryBackoff != "" {
+			retryBackoff = envRetryBackoff
+		}
+	}
+	if unregisteredTimeout == "168h" {
+		if envTimeout := os.Getenv("ACCRUAL_UNREGISTERED_TIMEOUT"); envTimeout != "" {
+			unregisteredTimeout = envTimeout
+		}
+	}
+
+	if maxAttempts < 1 {
+		return fmt.Errorf("accrual max attempts must be positive, got %d", maxAttempts)
+	}
+	backoff, err := time.ParseDuration(retryBackoff)
+	if err != nil {
+		return fmt.Errorf("invalid accrual retry backoff: %w", err)
+	}
+	if backoff <= 0 {
+		return fmt.Errorf("accrual retry backoff must be positive, got %s", backoff)
+	}
+	timeout, err := time.ParseDuration(unregisteredTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid accrual unregistered timeout: %w", err)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("accrual unregistered timeout must not be negative, got %s", timeout)
+	}
+
+	c.AccrualMaxAttempts = maxAttempts
+	c.AccrualRetryBackoff = retryBackoff
+	c.AccrualUnregisteredTimeout = unregisteredTimeout
+	return nil
+}
+
+// loadWorkerPoolValues загружает границы числа воркеров; вызывается после загрузки WorkerCount
+func (c *Config) loadWorkerPoolValues(minWorkers, maxWorkers int) error {
+	// Приоритет: flag > env > default
+	if minWorkers == 0 {
+		if envMin := os.Getenv("WORKER_MIN"); envMin != "" {
+			if parsed, err := strconv.Atoi(envMin); err == nil {
+				minWorkers = parsed
+			}
+		}
+	}
+	if maxWorkers == 0 {
+		if envMax := os.Getenv("WORKER_MAX"); envMax != "" {
+			if parsed, err := strconv.Atoi(envMax); err == nil {
+				maxWorkers = parsed
+			}
+		}
+	}
+
+	// Без границ число воркеров закреплено на WorkerCount
+	if maxWorkers == 0 {
+		maxWorkers = max(c.WorkerCount, minWorkers)
+	}
+	if minWorkers == 0 {
+		minWorkers = min(c.WorkerCount, maxWorkers)
+	}
+	if minWorkers < 1 {
+		return fmt.Errorf("minimum worker count must be positive, got %d", minWorkers)
+	}
+	if maxWorkers < minWorkers {
+		return fmt.Errorf("maximum worker count %d is less than minimum %d", maxWorkers, minWorkers)
+	}
+
+	c.WorkerMin = minWorkers
+	c.WorkerMax = maxWorkers
+	return nil
+}
+
+// loadAccrualBreakerValues загружает параметры выключателя системы начисления
+func (c *Config) loadAccrualBreakerValues(threshold int, cooldown string) error {
+	// Приоритет: flag > env > default
+	if threshold == 5 {
+		if envThreshold := os.Getenv("ACCRUAL_BREAKER_THRESHOLD"); envThreshold != "" {
+			if parsed, err := strconv.Atoi(envThreshold); err == nil {
+				threshold = parsed
+			}
+		}
+	}
+	if cooldown == "30s" {
+		if envCooldown := os.Getenv("ACCRUAL_BREAKER_COOLDOWN"); envCooldown != "" {
+			cooldown = envCooldown
+		}
+	}
+
+	if threshold < 1 {
+		return fmt.Errorf("accrual breaker threshold must be positive, got %d", threshold)
+	}
+	parsed, err := time.ParseDuration(cooldown)
+	if err != nil {
+		return fmt.Errorf("invalid accrual breaker cooldown: %w", err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("accrual breaker cooldown must be positive, got %s", parsed)
+	}
+
+	c.AccrualBreakerThreshold = threshold
+	c.AccrualBreakerCooldown = cooldown
+	return nil
+}
+
+// loadAccrualCallbackValues загружает параметры push-уведомлений системы начисления
+func (c *Config) loadAccrualCallbackValues(secret, tolerance, pushDeadline string) error {
+	// Приоритет: flag > env > default
+	if secret == "" {
+		secret = os.Getenv("ACCRUAL_CALLBACK_SECRET")
+	}
+	if tolerance == "5m" {
+		if envTolerance := os.Getenv("ACCRUAL_CALLBACK_TOLERANCE"); envTolerance != "" {
+			tolerance = envTolerance
+		}
+	}
+	if pushDeadline == "10m" {
+		if envPushDeadline := os.Getenv("ACCRUAL_PUSH_DEADLINE"); envPushDeadline != "" {
+			pushDeadline = envPushDeadline
+		}
+	}
+
+	parsedTolerance, err := time.ParseDuration(tolerance)
+	if err != nil {
+		return fmt.Errorf("invalid accrual callback tolerance: %w", err)
+	}
+	if parsedTolerance <= 0 {
+		return fmt.Errorf("accrual callback tolerance must be positive, got %s", parsedTolerance)
+	}
+	parsedDeadline, err := time.ParseDuration(pushDeadline)
+	if err != nil {
+		return fmt.Errorf("invalid accrual push deadline: %w", err)
+	}
+	if parsedDeadline < 0 {
+		return fmt.Errorf("accrual push deadline must not be negative, got %s", parsedDeadline)
+	}
+
+	c.AccrualCallbackSecret = secret
+	c.AccrualCallbackTolerance = tolerance
+	c.AccrualPushDeadline = pushDeadline
+	return nil
+}
+
+// loadAccrualProvidersValues загружает описание нескольких систем начисления.
+// Если ни файл, ни ACCRUAL_PROVIDERS не заданы, используется одна система ACCRUAL_SYSTEM_ADDRESS.
+func (c *Config) loadAccrualProvidersValues(providersFile string) {
+	// Приоритет: flag > env > default
+	if providersFile == "" {
+		providersFile = os.Getenv("ACCRUAL_PROVIDERS_FILE")
+	}
+
+	c.AccrualProvidersFile = providersFile
+	c.AccrualProviders = os.Getenv("ACCRUAL_PROVIDERS")
+}
+
+// loadAccrualShadowValues загружает адрес теневой системы начисления
+func (c *Config) loadAccrualShadowValues(address string) {
+	// Приоритет: flag > env > default
+	if address == "" {
+		address = os.Getenv("ACCRUAL_SHADOW_ADDRESS")
+	}
+
+	c.AccrualShadowAddress = address
+}
+
+// loadAdminValues загружает токен служебного API
+func (c *Config) loadAdminValues(token string) {
+	// Приоритет: flag > env > default
+	if token == "" {
+		token = os.Getenv("ADMIN_TOKEN")
+	}
+
+	c.AdminToken = token
+}
+
+// loadReconcileValues загружает параметры сверки обработанных заказов
+func (c *Config) loadReconcileValues(interval, window string, sampleRate float64, policy string) error {
+	// Приоритет: flag > env > default
+	if interval == "1h" {
+		if envInterval := os.Getenv("RECONCILE_INTERVAL"); envInterval != "" {
+			interval = envInterval
+		}
+	}
+	if window == "72h" {
+		if envWindow := os.Getenv("RECONCILE_WINDOW"); envWindow != "" {
+			window = envWindow
+		}
+	}
+	if sampleRate == 0.1 {
+		if envSampleRate := os.Getenv("RECONCILE_SAMPLE_RATE"); envSampleRate != "" {
+			if parsed, err := strconv.ParseFloat(envSampleRate, 64); err == nil {
+				sampleRate = parsed
+			}
+		}
+	}
+	if policy == models.ReconcilePolicyReview {
+		if envPolicy := os.Getenv("RECONCILE_POLICY"); envPolicy != "" {
+			policy = envPolicy
+		}
+	}
+
+	parsedInterval, err := time.ParseDuration(interval)
+	if err != nil {
+		return fmt.Errorf("invalid reconcile interval: %w", err)
+	}
+	if parsedInterval < 0 {
+		return fmt.Errorf("reconcile interval must not be negative, got %s", parsedInterval)
+	}
+	parsedWindow, err := time.ParseDuration(window)
+	if err != nil {
+		return fmt.Errorf("invalid reconcile window: %w", err)
+	}
+	if parsedWindow <= 0 {
+		return fmt.Errorf("reconcile window must be positive, got %s", parsedWindow)
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		return fmt.Errorf("reconcile sample rate must be in (0, 1], got %g", sampleRate)
+	}
+	switch policy {
+	case models.ReconcilePolicyAdjust, models.ReconcilePolicyReview:
+	default:
+		return fmt.Errorf("unknown reconcile policy: %q", policy)
+	}
+
+	c.ReconcileInterval = interval
+	c.ReconcileWindow = window
+	c.ReconcileSampleRate = sampleRate
+	c.ReconcilePolicy = policy
+	return nil
+}
+
+// loadLedgerCheckValues загружает период сверки балансов с журналом проводок
+func (c *Config) loadLedgerCheckValues(interval string) error {
+	// Приоритет: flag > env > default
+	if interval == "1h" {
+		if envInterval := os.Getenv("LEDGER_CHECK_INTERVAL"); envInterval != "" {
+			interval = envInterval
+		}
+	}
+
+	parsed, err := time.ParseDuration(interval)
+	if err != nil {
+		return fmt.Errorf("invalid ledger check interval: %w", err)
+	}
+	if parsed < 0 {
+		return fmt.Errorf("ledger check interval must not be negative, got %s", parsed)
+	}
+
+	c.LedgerCheckInterval = interval
+	return nil
+}
+
+// loadLeaderValues загружает параметры выборов ведущего экземпляра
+func (c *Config) loadLeaderValues(checkInterval string, leaderOnlyOrders bool) error {
+	// Приоритет: flag > env > default
+	if checkInterval == "5s" {
+		if envInterval := os.Getenv("LEADER_CHECK_INTERVAL"); envInterval != "" {
+			checkInterval = envInterval
+		}
+	}
+	if !leaderOnlyOrders {
+		if envLeaderOnly := os.Getenv("ORDER_PROCESSING_LEADER_ONLY"); envLeaderOnly != "" {
+			if parsed, err := strconv.ParseBool(envLeaderOnly); err == nil {
+				leaderOnlyOrders = parsed
+			}
+		}
+	}
+
+	parsed, err := time.ParseDuration(checkInterval)
+	if err != nil {
+		return fmt.Errorf("invalid leader check interval: %w", err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("leader check interval must be positive, got %s", parsed)
+	}
+
+	c.LeaderCheckInterval = checkInterval
+	c.OrderProcessingLeaderOnly = leaderOnlyOrders
+	return nil
+}
+
+// loadSchedulerValues загружает правила справедливой очереди обработки заказов
+func (c *Config) loadSchedulerValues(tierWeights, recentWindow, viewWindow string) error {
+	// Приоритет: flag > env > default
+	if tierWeights == "" {
+		tierWeights = os.Getenv("SCHEDULER_TIER_WEIGHTS")
+	}
+	if recentWindow == "1m" {
+		if envRecentWindow := os.Getenv("SCHEDULER_RECENT_WINDOW"); envRecentWindow != "" {
+			recentWindow = envRecentWindow
+		}
+	}
+	if viewWindow == "2m" {
+		if envViewWindow := os.Getenv("SCHEDULER_VIEW_WINDOW"); envViewWindow != "" {
+			viewWindow = envViewWindow
+		}
+	}
+
+	if _, err := models.ParseTierWeights(tierWeights); err != nil {
+		return fmt.Errorf("invalid scheduler tier weights: %w", err)
+	}
+	parsedRecentWindow, err := time.ParseDuration(recentWindow)
+	if err != nil {
+		return fmt.Errorf("invalid scheduler recent window: %w", err)
+	}
+	if parsedRecentWindow < 0 {
+		return fmt.Errorf("scheduler recent window must not be negative, got %s", parsedRecentWindow)
+	}
+	parsedViewWindow, err := time.ParseDuration(viewWindow)
+	if err != nil {
+		return fmt.Errorf("invalid scheduler view window: %w", err)
+	}
+	if parsedViewWindow < 0 {
+		return fmt.Errorf("scheduler view window must not be negative, got %s", parsedViewWindow)
+	}
+
+	c.SchedulerTierWeights = tierWeights
+	c.SchedulerRecentWindow = recentWindow
+	c.SchedulerViewWindow = viewWindow
+	return nil
+}
+
+// loadJWTKeyValues загружает параметры ключей подписи JWT
+func (c *Config) loadJWTKeyValues(keyFile, overlap, reloadInterval string, rotate bool) error {
+	// Приоритет: flag > env > default
+	if keyFile == "" {
+		keyFile = os.Getenv("JWT_KEY_FILE")
+	}
+	if overlap == "24h" {
+		if envOverlap := os.Getenv("JWT_KEY_OVERLAP"); envOverlap != "" {
+			overlap = envOverlap
+		}
+	}
+	if reloadInterval == "1m" {
+		if envReloadInterval := os.Getenv("JWT_KEY_RELOAD_INTERVAL"); envReloadInterval != "" {
+			reloadInterval = envReloadInterval
+		}
+	}
+
+	parsedOverlap, err := time.ParseDuration(overlap)
+	if err != nil {
+		return fmt.Errorf("invalid JWT key overlap: %w", err)
+	}
+	if parsedOverlap <= 0 {
+		return fmt.Errorf("JWT key overlap must be positive, got %s", parsedOverlap)
+	}
+	parsedReloadInterval, err := time.ParseDuration(reloadInterval)
+	if err != nil {
+		return fmt.Errorf("invalid JWT key reload interval: %w", err)
+	}
+	if parsedReloadInterval <= 0 {
+		return fmt.Errorf("JWT key reload interval must be positive, got %s", parsedReloadInterval)
+	}
+	if rotate && keyFile == "" {
+		return errors.New("rotating JWT keys requires a JWT key file")
+	}
+
+	c.JWTKeyFile = keyFile
+	c.JWTKeys = os.Getenv("JWT_KEYS")
+	c.JWTKeyOverlap = overlap
+	c.JWTKeyReloadInterval = reloadInterval
+	c.RotateJWTKeys = rotate
+	return nil
+}
+
+// loadJWTTokenValues загружает алгоритм подписи и стандартные утверждения JWT токенов
+func (c *Config) loadJWTTokenValues(signingAlg, issuer, audience string) error {
+	// Приоритет: flag > env > default
+	if signingAlg == services.AlgHS256 {
+		if envSigningAlg := os.Getenv("JWT_SIGNING_ALG"); envSigningAlg != "" {
+			signingAlg = envSigningAlg
+		}
+	}
+	if issuer == services.DefaultTokenIssuer {
+		if envIssuer := os.Getenv("JWT_ISSUER"); envIssuer != "" {
+			issuer = envIssuer
+		}
+	}
+	if audience == services.DefaultTokenAudience {
+		if envAudience := os.Getenv("JWT_AUDIENCE"); envAudience != "" {
+			audience = envAudience
+		}
+	}
+
+	if err := services.ValidateSigningAlgorithm(signingAlg); err != nil {
+		return err
+	}
+	if issuer == "" {
+		return errors.New("JWT issuer must not be empty")
+	}
+	if audience == "" {
+		return errors.New("JWT audience must not be empty")
+	}
+
+	c.JWTSigningAlg = signingAlg
+	c.JWTIssuer = issuer
+	c.JWTAudience = audience
+	return nil
+}
+
+// loadTokenTTLValues загружает сроки действия access и refresh токенов
+func (c *Config) loadTokenTTLValues(accessTTL, refreshTTL string) error {
+	// Приоритет: flag > env > default
+	if accessTTL == "15m" {
+		if envAccessTTL := os.Getenv("ACCESS_TOKEN_TTL"); envAccessTTL != "" {
+			accessTTL = envAccessTTL
+		}
+	}
+	if refreshTTL == "720h" {
+		if envRefreshTTL := os.Getenv("REFRESH_TOKEN_TTL"); envRefreshTTL != "" {
+			refreshTTL = envRefreshTTL
+		}
+	}
+
+	parsedAccessTTL, err := time.ParseDuration(accessTTL)
+	if err != nil {
+		return fmt.Errorf("invalid access token TTL: %w", err)
+	}
+	if parsedAccessTTL <= 0 {
+		return fmt.Errorf("access token TTL must be positive, got %s", parsedAccessTTL)
+	}
+	parsedRefreshTTL, err := time.ParseDuration(refreshTTL)
+	if err != nil {
+		return fmt.Errorf("invalid refresh token TTL: %w", err)
+	}
+	if parsedRefreshTTL <= parsedAccessTTL {
+		return fmt.Errorf("refresh token TTL must be longer than access token TTL %s, got %s", parsedAccessTTL, parsedRefreshTTL)
+	}
+
+	c.AccessTokenTTL = accessTTL
+	c.RefreshTokenTTL = refreshTTL
+	return nil
+}
+
+// loadShutdownValues загружает время на остановку сервера
+func (c *Config) loadShutdownValues(timeout string) error {
+	// Приоритет: flag > env > default
+	if timeout == "30s" {
+		if envTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); envTimeout != "" {
+			timeout = envTimeout
+		}
+	}
+
+	parsed, err := time.ParseDuration(timeout)
+	if err != nil {
+		return fmt.Errorf("invalid shutdown timeout: %w", err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive, got %s", parsed)
+	}
+
+	c.ShutdownTimeout = timeout
+	return nil
+}
+
+// parseReplayOrders разбирает список заказов для повторной обработки, разделенный запятыми
+func parseReplayOrders(value string) []string {
+	var numbers []string
+	for _, number := range strings.Split(value, ",") {
+		if number = strings.TrimSpace(number); number != "" {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers
+}
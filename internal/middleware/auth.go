@@ -11,10 +11,18 @@ import (
 
 type contextKey string
 
-const UserIDKey contextKey = "user_id"
+const (
+	UserIDKey      contextKey = "user_id"
+	TokenClaimsKey contextKey = "token_claims"
+)
+
+// RevocationList список отозванных access токенов
+type RevocationList interface {
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
 
-// AuthMiddleware middleware для аутентификации
-func AuthMiddleware(authService *services.AuthService) func(http.Handler) http.Handler {
+// AuthMiddleware middleware для аутентификации; токены из списка revocations не принимаются
+func AuthMiddleware(authService *services.AuthService, revocations RevocationList) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -37,6 +45,21 @@ func AuthMiddleware(authService *services.AuthService) func(http.Handler) http.H
 				return
 			}
 
+			// Отозванный токен (выход, повторное предъявление refresh токена) не принимается до истечения
+			if claims.ID == "" {
+				http.Error(w, "Token ID required", http.StatusUnauthorized)
+				return
+			}
+			revoked, err := revocations.IsTokenRevoked(r.Context(), claims.ID)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if revoked {
+				http.Error(w, "Token revoked", http.StatusUnauthorized)
+				return
+			}
+
 			// Извлекаем user_id из токена
 			userID, err := strconv.ParseInt(claims.Subject, 10, 64)
 			if err != nil {
@@ -44,8 +67,9 @@ func AuthMiddleware(authService *services.AuthService) func(http.Handler) http.H
 				return
 			}
 
-			// Добавляем user_id в контекст
+			// Добавляем user_id и утверждения токена в контекст
 			ctx := context.WithValue(r.Context(), UserIDKey, userID)
+			ctx = context.WithValue(ctx, TokenClaimsKey, claims)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
@@ -56,3 +80,9 @@ func GetUserIDFromContext(ctx context.Context) (int64, bool) {
 	userID, ok := ctx.Value(UserIDKey).(int64)
 	return userID, ok
 }
+
+// GetTokenClaimsFromContext извлекает утверждения access токена из контекста
+func GetTokenClaimsFromContext(ctx context.Context) (*services.TokenClaims, bool) {
+	claims, ok := ctx.Value(TokenClaimsKey).(*services.TokenClaims)
+	return claims, ok
+}
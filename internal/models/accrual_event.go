@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// Источники событий системы начисления
+const (
+	// AccrualEventPoll ответ на запрос GET /api/orders/{number}
+	AccrualEventPoll = "poll"
+	// AccrualEventCallback push-уведомление системы начисления
+	AccrualEventCallback = "callback"
+)
+
+// AccrualEvent ответ системы начисления о заказе в исходном виде вместе с результатом разбора.
+// События только добавляются и служат доказательством при спорах о начислениях.
+type AccrualEvent struct {
+	ID          int64  `json:"id"`
+	OrderNumber string `json:"order"`
+	// Provider система начисления; пустая, если система одна
+	Provider    string    `json:"provider,omitempty"`
+	Source      string    `json:"source"`
+	RequestedAt time.Time `json:"requested_at"`
+	// HTTPStatus код ответа системы; 0 — ответа нет (сетевая ошибка) или событие — уведомление
+	HTTPStatus int   `json:"http_status"`
+	LatencyMs  int64 `json:"latency_ms"`
+	// Body тело ответа или уведомления без изменений
+	Body string `json:"body"`
+	// Status и Accrual результат разбора тела; пустые, если разобрать не удалось
+	Status  string `json:"status,omitempty"`
+	Accrual *Money `json:"accrual,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
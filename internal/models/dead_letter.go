@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// OrderFailure неудачная попытка обработки заказа
+type OrderFailure struct {
+	// Attempt номер попытки подряд, начиная с 1
+	Attempt  int       `json:"attempt"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetterOrder заказ, обработка которого прекращена после исчерпания попыток,
+// вместе с неудачными попытками от первой к последней
+type DeadLetterOrder struct {
+	Order
+	Failures []OrderFailure `json:"failures"`
+}
+
+// DeadLetterResolution ручное решение по заказу из очереди недоставленных
+type DeadLetterResolution struct {
+	// Status итоговый статус: OrderStatusProcessed или OrderStatusInvalid
+	Status string `json:"status"`
+	// Accrual начисление обработанного заказа
+	Accrual Money `json:"accrual"`
+}
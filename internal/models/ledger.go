@@ -0,0 +1,53 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Виды проводок в журнале
+const (
+	LedgerKindAccrual    = "ACCRUAL"
+	LedgerKindWithdrawal = "WITHDRAWAL"
+	LedgerKindAdjustment = "ADJUSTMENT"
+	LedgerKindOpening    = "OPENING"
+)
+
+// Системные счета, с которыми корреспондируют счета пользователей
+const (
+	LedgerAccountAccruals    = "system:accruals"
+	LedgerAccountWithdrawals = "system:withdrawals"
+	LedgerAccountAdjustments = "system:adjustments"
+	LedgerAccountOpening     = "system:opening"
+)
+
+// LedgerUserAccount возвращает счет баланса пользователя
+func LedgerUserAccount(userID int64) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// LedgerEntry запись журнала проводок.
+// Положительная сумма — кредит счета, отрицательная — дебет;
+// сумма записей одной транзакции всегда равна нулю.
+type LedgerEntry struct {
+	ID            int64     `json:"id"`
+	TransactionID int64     `json:"transaction_id"`
+	Account       string    `json:"account"`
+	UserID        *int64    `json:"user_id,omitempty"`
+	Kind          string    `json:"kind"`
+	Amount        Money     `json:"amount"`
+	Reference     string    `json:"reference,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// LedgerDiscrepancy нарушение согласованности журнала проводок: либо снимок баланса
+// пользователя (UserID) не совпадает с суммой его проводок или с суммой его списаний,
+// либо сумма записей транзакции (TransactionID) не равна нулю
+type LedgerDiscrepancy struct {
+	UserID            int64 `json:"user_id,omitempty"`
+	TransactionID     int64 `json:"transaction_id,omitempty"`
+	BalanceAmount     Money `json:"balance_current"`
+	LedgerAmount      Money `json:"ledger_amount"`
+	BalanceWithdrawn  Money `json:"balance_withdrawn"`
+	WithdrawalsAmount Money `json:"withdrawals_amount"`
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// moneyScale количество минимальных единиц в одной денежной единице
+const moneyScale = 100
+
+// moneyPattern десятичная запись числа, совместимая с JSON-числом
+var moneyPattern = regexp.MustCompile(`^-?\d+(\.\d+)?([eE][+-]?\d{1,3})?$`)
+
+// Ошибки разбора денежных сумм
+var (
+	ErrMoneyPrecision = errors.New("money amount has more than two decimal places")
+	ErrMoneyOverflow  = errors.New("money amount is out of range")
+	ErrMoneyInvalid   = errors.New("invalid money amount")
+)
+
+// Money денежная сумма в минимальных единицах (сотых долях).
+// Хранится как целое число, поэтому сложение и сравнение точны.
+// В JSON и PostgreSQL представляется десятичным числом с не более чем двумя знаками после запятой.
+type Money int64
+
+// ParseMoney разбирает десятичную запись суммы, например "729.98".
+// Возвращает ErrMoneyPrecision, если знаков после запятой больше двух.
+func ParseMoney(s string) (Money, error) {
+	if !moneyPattern.MatchString(s) {
+		return 0, fmt.Errorf("%w: %q", ErrMoneyInvalid, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrMoneyInvalid, s)
+	}
+	return moneyFromRat(r)
+}
+
+// moneyFromRat переводит точное рациональное значение в минимальные единицы
+func moneyFromRat(r *big.Rat) (Money, error) {
+	r = new(big.Rat).Mul(r, big.NewRat(moneyScale, 1))
+	if !r.IsInt() {
+		return 0, ErrMoneyPrecision
+	}
+	minor := r.Num()
+	if !minor.IsInt64() {
+		return 0, ErrMoneyOverflow
+	}
+	return Money(minor.Int64()), nil
+}
+
+// String возвращает десятичную запись суммы без лишних нулей: "729.98", "729.9", "500"
+func (m Money) String() string {
+	sign := ""
+	abs := uint64(m)
+	if m < 0 {
+		sign = "-"
+		abs = uint64(-(m + 1)) + 1 // без переполнения для math.MinInt64
+	}
+
+	units, cents := abs/moneyScale, abs%moneyScale
+	switch {
+	case cents == 0:
+		return fmt.Sprintf("%s%d", sign, units)
+	case cents%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, units, cents/10)
+	default:
+		return fmt.Sprintf("%s%d.%02d", sign, units, cents)
+	}
+}
+
+// MarshalJSON кодирует сумму JSON-числом
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON декодирует сумму из JSON-числа без потери точности
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// ScanNumeric читает значение из колонки PostgreSQL NUMERIC
+func (m *Money) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid {
+		return errors.New("cannot scan NULL into Money")
+	}
+	if v.NaN || v.InfinityModifier != pgtype.Finite {
+		return fmt.Errorf("%w: not a finite number", ErrMoneyInvalid)
+	}
+
+	value := new(big.Rat)
+	if v.Int != nil {
+		value.SetInt(v.Int)
+	}
+
+	// Numeric хранит значение как Int * 10^Exp
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs32(v.Exp))), nil)
+	if v.Exp >= 0 {
+		value.Mul(value, new(big.Rat).SetInt(scale))
+	} else {
+		value.Quo(value, new(big.Rat).SetInt(scale))
+	}
+
+	parsed, err := moneyFromRat(value)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// NumericValue возвращает значение для записи в колонку PostgreSQL NUMERIC
+func (m Money) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: -2, Valid: true}, nil
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
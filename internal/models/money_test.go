@@ -0,0 +1,138 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Money
+		err      error
+	}{
+		{input: "729.98", expected: 72998},
+		{input: "500", expected: 50000},
+		{input: "0.1", expected: 10},
+		{input: "0.10", expected: 10},
+		{input: "-3.05", expected: -305},
+		{input: "1e2", expected: 10000},
+		{input: "1.5E-1", expected: 15},
+		{input: "0.001", err: ErrMoneyPrecision},
+		{input: "729.985", err: ErrMoneyPrecision},
+		{input: "1e-3", err: ErrMoneyPrecision},
+		{input: "100000000000000000000", err: ErrMoneyOverflow},
+		{input: "", err: ErrMoneyInvalid},
+		{input: "1/2", err: ErrMoneyInvalid},
+		{input: "0x10", err: ErrMoneyInvalid},
+		{input: "12,5", err: ErrMoneyInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := ParseMoney(tt.input)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestMoney_String(t *testing.T) {
+	assert.Equal(t, "729.98", Money(72998).String())
+	assert.Equal(t, "729.9", Money(72990).String())
+	assert.Equal(t, "500", Money(50000).String())
+	assert.Equal(t, "0.05", Money(5).String())
+	assert.Equal(t, "0", Money(0).String())
+	assert.Equal(t, "-0.05", Money(-5).String())
+}
+
+func TestMoney_JSON(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		balance := Balance{UserID: 1, Current: 50050, Withdrawn: 4200}
+		data, err := json.Marshal(balance)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"user_id":1,"current":500.5,"withdrawn":42}`, string(data))
+
+		var decoded Balance
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, balance, decoded)
+	})
+
+	t.Run("Exact decimal", func(t *testing.T) {
+		// 0.1 + 0.2 во float64 дает 0.30000000000000004
+		var req WithdrawRequest
+		require.NoError(t, json.Unmarshal([]byte(`{"order":"2377225624","sum":0.3}`), &req))
+		assert.Equal(t, Money(30), req.Sum)
+	})
+
+	t.Run("Too many decimals", func(t *testing.T) {
+		var req WithdrawRequest
+		err := json.Unmarshal([]byte(`{"order":"2377225624","sum":751.001}`), &req)
+		assert.True(t, errors.Is(err, ErrMoneyPrecision))
+	})
+
+	t.Run("String is rejected", func(t *testing.T) {
+		var req WithdrawRequest
+		err := json.Unmarshal([]byte(`{"order":"2377225624","sum":"751"}`), &req)
+		assert.Error(t, err)
+	})
+
+	t.Run("Optional accrual", func(t *testing.T) {
+		var resp AccrualResponse
+		require.NoError(t, json.Unmarshal([]byte(`{"order":"1","status":"PROCESSING","accrual":null}`), &resp))
+		assert.Nil(t, resp.Accrual)
+
+		require.NoError(t, json.Unmarshal([]byte(`{"order":"1","status":"PROCESSED","accrual":729.98}`), &resp))
+		require.NotNil(t, resp.Accrual)
+		assert.Equal(t, Money(72998), *resp.Accrual)
+	})
+}
+
+func TestMoney_Numeric(t *testing.T) {
+	tests := []struct {
+		name     string
+		numeric  pgtype.Numeric
+		expected Money
+		hasError bool
+	}{
+		{name: "Scale 2", numeric: pgtype.Numeric{Int: big.NewInt(72998), Exp: -2, Valid: true}, expected: 72998},
+		{name: "Scale 0", numeric: pgtype.Numeric{Int: big.NewInt(5), Exp: 0, Valid: true}, expected: 500},
+		{name: "Positive exponent", numeric: pgtype.Numeric{Int: big.NewInt(5), Exp: 2, Valid: true}, expected: 50000},
+		{name: "Trailing zeros", numeric: pgtype.Numeric{Int: big.NewInt(15000), Exp: -4, Valid: true}, expected: 150},
+		{name: "Too precise", numeric: pgtype.Numeric{Int: big.NewInt(15001), Exp: -4, Valid: true}, hasError: true},
+		{name: "NaN", numeric: pgtype.Numeric{NaN: true, Valid: true}, hasError: true},
+		{name: "NULL", numeric: pgtype.Numeric{}, hasError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Money
+			err := m.ScanNumeric(tt.numeric)
+			if tt.hasError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, m)
+		})
+	}
+
+	t.Run("Round trip", func(t *testing.T) {
+		numeric, err := Money(-72998).NumericValue()
+		require.NoError(t, err)
+
+		var m Money
+		require.NoError(t, m.ScanNumeric(numeric))
+		assert.Equal(t, Money(-72998), m)
+	})
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Статусы заказа в контракте gophermart
+const (
+	OrderStatusNew        = "NEW"
+	OrderStatusProcessing = "PROCESSING"
+	OrderStatusInvalid    = "INVALID"
+	OrderStatusProcessed  = "PROCESSED"
+)
+
+// Статусы расчета в системе начисления
+const (
+	AccrualStatusRegistered = "REGISTERED"
+	AccrualStatusProcessing = "PROCESSING"
+	AccrualStatusInvalid    = "INVALID"
+	AccrualStatusProcessed  = "PROCESSED"
+)
+
+var (
+	// ErrUnknownAccrualStatus статус системы начисления не входит в ее контракт
+	ErrUnknownAccrualStatus = errors.New("unknown accrual status")
+	// ErrUnknownOrderStatus статус заказа не входит в контракт gophermart
+	ErrUnknownOrderStatus = errors.New("unknown order status")
+	// ErrIllegalTransition переход между статусами заказа запрещен
+	ErrIllegalTransition = errors.New("illegal order status transition")
+)
+
+// PendingOrderStatuses статусы заказов, ожидающих расчета в системе начисления
+var PendingOrderStatuses = []string{OrderStatusNew, OrderStatusProcessing}
+
+// orderTransitions допустимые переходы между статусами заказа.
+// INVALID и PROCESSED конечные: из них переходов нет.
+var orderTransitions = map[string][]string{
+	OrderStatusNew:        {OrderStatusNew, OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+	OrderStatusProcessing: {OrderStatusProcessing, OrderStatusInvalid, OrderStatusProcessed},
+	OrderStatusInvalid:    nil,
+	OrderStatusProcessed:  nil,
+}
+
+// MapAccrualStatus переводит статус системы начисления в статус заказа:
+// REGISTERED соответствует NEW, остальные статусы совпадают по смыслу
+func MapAccrualStatus(status string) (string, error) {
+	switch status {
+	case AccrualStatusRegistered:
+		return OrderStatusNew, nil
+	case AccrualStatusProcessing:
+		return OrderStatusProcessing, nil
+	case AccrualStatusInvalid:
+		return OrderStatusInvalid, nil
+	case AccrualStatusProcessed:
+		return OrderStatusProcessed, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownAccrualStatus, status)
+	}
+}
+
+// IsFinalOrderStatus сообщает, что заказ больше не меняет статус
+func IsFinalOrderStatus(status string) bool {
+	transitions, ok := orderTransitions[status]
+	return ok && len(transitions) == 0
+}
+
+// ValidateOrderTransition проверяет, что заказ может перейти из статуса from в статус to.
+// Переход в тот же статус допустим только для незавершенных заказов.
+func ValidateOrderTransition(from, to string) error {
+	transitions, ok := orderTransitions[from]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownOrderStatus, from)
+	}
+	if _, ok := orderTransitions[to]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownOrderStatus, to)
+	}
+
+	for _, allowed := range transitions {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s -> %s", ErrIllegalTransition, from, to)
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapAccrualStatus(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		err      error
+	}{
+		{input: "REGISTERED", expected: OrderStatusNew},
+		{input: "PROCESSING", expected: OrderStatusProcessing},
+		{input: "INVALID", expected: OrderStatusInvalid},
+		{input: "PROCESSED", expected: OrderStatusProcessed},
+		{input: "NEW", err: ErrUnknownAccrualStatus},
+		{input: "processed", err: ErrUnknownAccrualStatus},
+		{input: "", err: ErrUnknownAccrualStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result, err := MapAccrualStatus(tt.input)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestValidateOrderTransition(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+		err  error
+	}{
+		{from: OrderStatusNew, to: OrderStatusNew},
+		{from: OrderStatusNew, to: OrderStatusProcessing},
+		{from: OrderStatusNew, to: OrderStatusInvalid},
+		{from: OrderStatusNew, to: OrderStatusProcessed},
+		{from: OrderStatusProcessing, to: OrderStatusProcessing},
+		{from: OrderStatusProcessing, to: OrderStatusInvalid},
+		{from: OrderStatusProcessing, to: OrderStatusProcessed},
+		{from: OrderStatusProcessing, to: OrderStatusNew, err: ErrIllegalTransition},
+		{from: OrderStatusProcessed, to: OrderStatusProcessing, err: ErrIllegalTransition},
+		{from: OrderStatusProcessed, to: OrderStatusProcessed, err: ErrIllegalTransition},
+		{from: OrderStatusProcessed, to: OrderStatusInvalid, err: ErrIllegalTransition},
+		{from: OrderStatusInvalid, to: OrderStatusProcessed, err: ErrIllegalTransition},
+		{from: OrderStatusNew, to: AccrualStatusRegistered, err: ErrUnknownOrderStatus},
+		{from: "UNKNOWN", to: OrderStatusNew, err: ErrUnknownOrderStatus},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+"->"+tt.to, func(t *testing.T) {
+			err := ValidateOrderTransition(tt.from, tt.to)
+			if tt.err != nil {
+				assert.True(t, errors.Is(err, tt.err), "unexpected error: %v", err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	assert.True(t, IsFinalOrderStatus(OrderStatusProcessed))
+	assert.True(t, IsFinalOrderStatus(OrderStatusInvalid))
+	assert.False(t, IsFinalOrderStatus(OrderStatusNew))
+	assert.False(t, IsFinalOrderStatus("UNKNOWN"))
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Политики сверки при расхождении начисления с системой начисления
+const (
+	// ReconcilePolicyAdjust исправить начисление проводкой: доначислить или списать разницу
+	ReconcilePolicyAdjust = "adjust"
+	// ReconcilePolicyReview открыть расхождение для ручного разбора
+	ReconcilePolicyReview = "review"
+)
+
+// Статусы расхождений
+const (
+	DiscrepancyStatusOpen     = "OPEN"
+	DiscrepancyStatusAdjusted = "ADJUSTED"
+	DiscrepancyStatusResolved = "RESOLVED"
+)
+
+// AccrualDiscrepancy расхождение начисления по обработанному заказу с тем,
+// что система начисления сообщает при повторной проверке
+type AccrualDiscrepancy struct {
+	ID          int64  `json:"id"`
+	OrderNumber string `json:"order"`
+	UserID      int64  `json:"user_id"`
+	// RecordedAccrual начисление, учтенное в балансе
+	RecordedAccrual Money `json:"recorded_accrual"`
+	// ReportedStatus и ReportedAccrual ответ системы начисления при сверке;
+	// для INVALID начисление считается нулевым
+	ReportedStatus  string     `json:"reported_status"`
+	ReportedAccrual Money      `json:"reported_accrual"`
+	Status          string     `json:"status"`
+	Note            string     `json:"note,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ResolvedAt      *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Delta разница, на которую нужно исправить баланс: положительная — доначисление, отрицательная — списание
+func (d *AccrualDiscrepancy) Delta() Money {
+	return d.ReportedAccrual - d.RecordedAccrual
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultUserTier тариф пользователя по умолчанию
+const DefaultUserTier = "standard"
+
+// MaxUserTierLength наибольшая длина названия тарифа
+const MaxUserTierLength = 32
+
+// Повышения приоритета заказов в очереди обработки, в раундах
+const (
+	// RecentOrderBoost повышение для недавно загруженных заказов
+	RecentOrderBoost = 1
+	// ViewedOrderBoost повышение для заказов пользователя, который сейчас смотрит их список
+	ViewedOrderBoost = 2
+)
+
+// SchedulingPolicy правила справедливой очереди обработки заказов. Заказы каждого
+// пользователя нумеруются от старых к новым и делятся на раунды: за раунд пользователь
+// тарифа с весом w получает w заказов. Очередь выбирает заказы по раундам, поэтому
+// большая очередь одного пользователя не задерживает остальных. Недавно загруженные
+// заказы и заказы пользователя, который смотрит их список, поднимаются на несколько раундов.
+type SchedulingPolicy struct {
+	// TierWeights вес тарифа; тарифы без веса получают вес 1
+	TierWeights map[string]int
+	// RecentWindow сколько заказ считается недавно загруженным; 0 — без повышения
+	RecentWindow time.Duration
+	// ViewWindow сколько после просмотра списка заказы пользователя повышаются; 0 — без повышения
+	ViewWindow time.Duration
+}
+
+// Weight возвращает вес тарифа tier
+func (p SchedulingPolicy) Weight(tier string) int {
+	if weight, ok := p.TierWeights[tier]; ok && weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+// Priority возвращает приоритет заказа: чем меньше, тем раньше заказ обрабатывается.
+// rank — номер заказа среди ожидающих заказов пользователя от старых к новым, начиная с 0;
+// viewedAt — когда пользователь последний раз смотрел список заказов.
+func (p SchedulingPolicy) Priority(rank int, tier string, uploadedAt time.Time, viewedAt *time.Time, now time.Time) int {
+	priority := rank / p.Weight(tier)
+	if p.RecentWindow > 0 && !uploadedAt.Before(now.Add(-p.RecentWindow)) {
+		priority -= RecentOrderBoost
+	}
+	if p.ViewWindow > 0 && viewedAt != nil && !viewedAt.Before(now.Add(-p.ViewWindow)) {
+		priority -= ViewedOrderBoost
+	}
+	return priority
+}
+
+// ValidateUserTier проверяет название тарифа
+func ValidateUserTier(tier string) error {
+	if tier == "" || len(tier) > MaxUserTierLength {
+		return fmt.Errorf("user tier must be 1 to %d characters long, got %q", MaxUserTierLength, tier)
+	}
+	return nil
+}
+
+// ParseTierWeights разбирает веса тарифов в виде "premium=3,partner=1"
+func ParseTierWeights(value string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tier, rawWeight, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("tier weight must be tier=weight, got %q", pair)
+		}
+		tier = strings.TrimSpace(tier)
+		if err := ValidateUserTier(tier); err != nil {
+			return nil, err
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(rawWeight))
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("tier %q weight must be a positive integer, got %q", tier, rawWeight)
+		}
+		weights[tier] = weight
+	}
+	return weights, nil
+}
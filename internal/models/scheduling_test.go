@@ -0,0 +1,49 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulingPolicy_Priority(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	policy := SchedulingPolicy{
+		TierWeights:  map[string]int{"premium": 3},
+		RecentWindow: time.Minute,
+		ViewWindow:   time.Minute,
+	}
+
+	// Вес тарифа: premium получает три заказа за раунд, остальные — по одному
+	assert.Equal(t, 0, policy.Priority(2, "premium", old, nil, now))
+	assert.Equal(t, 1, policy.Priority(3, "premium", old, nil, now))
+	assert.Equal(t, 3, policy.Priority(3, DefaultUserTier, old, nil, now))
+
+	// Недавно загруженный заказ и просматриваемый список поднимаются на несколько раундов
+	assert.Equal(t, 3-RecentOrderBoost, policy.Priority(3, DefaultUserTier, now, nil, now))
+	viewedAt := now.Add(-30 * time.Second)
+	assert.Equal(t, 3-ViewedOrderBoost, policy.Priority(3, DefaultUserTier, old, &viewedAt, now))
+	staleView := now.Add(-2 * time.Minute)
+	assert.Equal(t, 3, policy.Priority(3, DefaultUserTier, old, &staleView, now))
+
+	// Нулевые окна выключают повышения
+	assert.Equal(t, 3, SchedulingPolicy{}.Priority(3, "premium", now, &viewedAt, now))
+}
+
+func TestParseTierWeights(t *testing.T) {
+	weights, err := ParseTierWeights(" premium=3, partner=1,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"premium": 3, "partner": 1}, weights)
+
+	weights, err = ParseTierWeights("")
+	require.NoError(t, err)
+	assert.Empty(t, weights)
+
+	for _, value := range []string{"premium", "premium=0", "premium=x", "=2"} {
+		_, err := ParseTierWeights(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,81 @@
+package models
+
+import "time"
+
+// Итоги сравнения ответа основной системы начисления с теневой
+const (
+	ShadowOutcomeAgree           = "AGREE"
+	ShadowOutcomeStatusMismatch  = "STATUS_MISMATCH"
+	ShadowOutcomeAccrualMismatch = "ACCRUAL_MISMATCH"
+	// ShadowOutcomeShadowError теневая система не ответила или ответила ошибкой
+	ShadowOutcomeShadowError = "SHADOW_ERROR"
+)
+
+// ShadowComparison сравнение ответов основной и теневой систем начисления о заказе.
+// Применяется только ответ основной системы.
+type ShadowComparison struct {
+	ID          int64  `json:"id"`
+	OrderNumber string `json:"order"`
+	// Source откуда пришел ответ основной системы: AccrualEventPoll или AccrualEventCallback
+	Source string `json:"source"`
+	// PrimaryStatus и ShadowStatus статусы в ответах; пустой — заказ не зарегистрирован (204)
+	PrimaryStatus  string `json:"primary_status"`
+	PrimaryAccrual *Money `json:"primary_accrual,omitempty"`
+	ShadowStatus   string `json:"shadow_status"`
+	ShadowAccrual  *Money `json:"shadow_accrual,omitempty"`
+	ShadowError    string `json:"shadow_error,omitempty"`
+	Outcome        string `json:"outcome"`
+	// Final основная система дала окончательный ответ: PROCESSED или INVALID
+	Final      bool      `json:"final"`
+	ComparedAt time.Time `json:"compared_at"`
+}
+
+// ShadowReport сводка сравнений с теневой системой начисления
+type ShadowReport struct {
+	Since             time.Time `json:"since"`
+	Compared          int       `json:"compared"`
+	Agreed            int       `json:"agreed"`
+	StatusMismatches  int       `json:"status_mismatches"`
+	AccrualMismatches int       `json:"accrual_mismatches"`
+	ShadowErrors      int       `json:"shadow_errors"`
+	AgreementRate     float64   `json:"agreement_rate"`
+	// FinalCompared и FinalAgreed сравнения окончательных ответов основной системы: промежуточные
+	// статусы могут расходиться из-за разной скорости расчета, окончательные — нет
+	FinalCompared      int     `json:"final_compared"`
+	FinalAgreed        int     `json:"final_agreed"`
+	FinalAgreementRate float64 `json:"final_agreement_rate"`
+	// Disagreements последние расхождения
+	Disagreements []ShadowComparison `json:"disagreements"`
+}
+
+// Add учитывает count сравнений с итогом outcome
+func (r *ShadowReport) Add(outcome string, final bool, count int) {
+	r.Compared += count
+	switch outcome {
+	case ShadowOutcomeAgree:
+		r.Agreed += count
+	case ShadowOutcomeStatusMismatch:
+		r.StatusMismatches += count
+	case ShadowOutcomeAccrualMismatch:
+		r.AccrualMismatches += count
+	case ShadowOutcomeShadowError:
+		r.ShadowErrors += count
+	}
+	if final {
+		r.FinalCompared += count
+		if outcome == ShadowOutcomeAgree {
+			r.FinalAgreed += count
+		}
+	}
+
+	r.AgreementRate = rate(r.Agreed, r.Compared)
+	r.FinalAgreementRate = rate(r.FinalAgreed, r.FinalCompared)
+}
+
+// rate доля part от total; 0, если сравнений нет
+func rate(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// Результаты предъявления refresh токена, см. RotateRefreshToken
+const (
+	// RefreshTokenRotated токен заменен следующим токеном семейства
+	RefreshTokenRotated = "ROTATED"
+	// RefreshTokenUnknown токен не выдавался
+	RefreshTokenUnknown = "UNKNOWN"
+	// RefreshTokenExpired срок действия токена истек
+	RefreshTokenExpired = "EXPIRED"
+	// RefreshTokenRevoked семейство токена отозвано выходом или повторным предъявлением
+	RefreshTokenRevoked = "REVOKED"
+	// RefreshTokenReused токен уже был заменен: его предъявили повторно, и семейство отозвано
+	RefreshTokenReused = "REUSED"
+)
+
+// RefreshToken refresh токен пользователя. Хранится только хеш токена; токены одного входа
+// образуют семейство, в котором действует только последний токен.
+type RefreshToken struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"user_id"`
+	FamilyID  string `json:"family_id"`
+	TokenHash string `json:"-"`
+	// AccessTokenID и AccessExpiresAt jti и срок действия access токена, выданного вместе с этим токеном
+	AccessTokenID   string    `json:"access_token_id"`
+	AccessExpiresAt time.Time `json:"access_expires_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	// UsedAt время замены токена следующим; nil, пока токен действует
+	UsedAt *time.Time `json:"used_at,omitempty"`
+	// RevokedAt время отзыва семейства токена
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// TokenResponse ответ с токенами пользователя
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn и RefreshExpiresIn сроки действия токенов в секундах
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
+
+// TokenRefreshRequest запрос на обновление токенов
+type TokenRefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required,max=255"`
+}
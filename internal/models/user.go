@@ -9,6 +9,8 @@ type User struct {
 	ID       int64  `json:"id"`
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	// Tier тариф пользователя; определяет вес в очереди обработки заказов
+	Tier string `json:"tier"`
 }
 
 // UserRegisterRequest запрос на регистрацию пользователя
@@ -29,29 +31,43 @@ type Order struct {
 	UserID     int64     `json:"user_id"`
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
-	Accrual    *float64  `json:"accrual,omitempty"`
+	Accrual    *Money    `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
+	// Attempts число подряд неудачных проверок в системе начисления
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error,omitempty"`
+	// NextCheckAt время следующей проверки; nil, если проверки прекращены
+	NextCheckAt *time.Time `json:"next_check_at,omitempty"`
+	// LockedBy обработчик, захвативший заказ до LockedUntil
+	LockedBy    string     `json:"locked_by,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	// Merchant мерчант, указанный при загрузке заказа
+	Merchant string `json:"merchant,omitempty"`
+	// AccrualProvider система начисления, которая проверяет заказ; пустая, пока не выбрана
+	AccrualProvider string `json:"accrual_provider,omitempty"`
+	// DeadLetteredAt время попадания в очередь недоставленных после исчерпания попыток
+	DeadLetteredAt *time.Time `json:"dead_lettered_at,omitempty"`
 }
 
 // OrderResponse ответ с информацией о заказе
 type OrderResponse struct {
 	Number     string    `json:"number"`
 	Status     string    `json:"status"`
-	Accrual    *float64  `json:"accrual,omitempty"`
+	Accrual    *Money    `json:"accrual,omitempty"`
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
 // Balance представляет баланс пользователя
 type Balance struct {
-	UserID    int64   `json:"user_id"`
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	UserID    int64 `json:"user_id"`
+	Current   Money `json:"current"`
+	Withdrawn Money `json:"withdrawn"`
 }
 
 // BalanceResponse ответ с информацией о балансе
 type BalanceResponse struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   Money `json:"current"`
+	Withdrawn Money `json:"withdrawn"`
 }
 
 // Withdrawal представляет списание средств
@@ -59,26 +75,26 @@ type Withdrawal struct {
 	ID          int64     `json:"id"`
 	UserID      int64     `json:"user_id"`
 	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
+	Sum         Money     `json:"sum"`
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
 // WithdrawalResponse ответ с информацией о списании
 type WithdrawalResponse struct {
 	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
+	Sum         Money     `json:"sum"`
 	ProcessedAt time.Time `json:"processed_at"`
 }
 
 // WithdrawRequest запрос на списание средств
 type WithdrawRequest struct {
-	Order string  `json:"order" validate:"required,order_number"`
-	Sum   float64 `json:"sum" validate:"required,gt=0"`
+	Order string `json:"order" validate:"required,order_number"`
+	Sum   Money  `json:"sum" validate:"required,gt=0"`
 }
 
 // AccrualResponse ответ от системы начисления баллов
 type AccrualResponse struct {
-	Order   string   `json:"order"`
-	Status  string   `json:"status"`
-	Accrual *float64 `json:"accrual,omitempty"`
+	Order   string `json:"order"`
+	Status  string `json:"status"`
+	Accrual *Money `json:"accrual,omitempty"`
 }
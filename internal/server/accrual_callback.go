@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"go.uber.org/zap"
+)
+
+// maxCallbackBodySize ограничивает размер тела push-уведомления
+const maxCallbackBodySize = 64 << 10
+
+// AccrualCallbackHandler принимает push-уведомления системы начисления о результатах расчета
+// и применяет их так же, как результаты опроса
+type AccrualCallbackHandler struct {
+	processor *OrderProcessor
+	verifier  *services.CallbackVerifier
+	recorder  services.AccrualEventRecorder
+	logger    *zap.Logger
+}
+
+// NewAccrualCallbackHandler создает обработчик push-уведомлений
+func NewAccrualCallbackHandler(processor *OrderProcessor, verifier *services.CallbackVerifier, logger *zap.Logger) *AccrualCallbackHandler {
+	return &AccrualCallbackHandler{
+		processor: processor,
+		verifier:  verifier,
+		logger:    logger,
+	}
+}
+
+// SetEventRecorder включает запись принятых уведомлений в журнал recorder
+func (h *AccrualCallbackHandler) SetEventRecorder(recorder services.AccrualEventRecorder) {
+	h.recorder = recorder
+}
+
+// ServeHTTP обрабатывает POST /api/internal/accrual/callback
+func (h *AccrualCallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBodySize))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	nonce, nonceExpiresAt, err := h.verifier.Verify(r.Header.Get(services.AccrualTimestampHeader), r.Header.Get(services.AccrualSignatureHeader), body)
+	if err != nil {
+		h.logger.Warn("Rejected accrual callback", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	// Подписи примененных уведомлений общие для всех экземпляров и переживают перезапуск
+	used, err := h.processor.storage.IsCallbackNonceUsed(r.Context(), nonce)
+	if err != nil {
+		h.logger.Error("Failed to check accrual callback nonce", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if used {
+		h.logger.Warn("Rejected accrual callback", zap.Error(services.ErrReplayedCallback))
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	var update models.AccrualResponse
+	if err := json.Unmarshal(body, &update); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if update.Order == "" {
+		http.Error(w, "order is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateAccrualUpdate(&update); err != nil {
+		h.recordEvent(r, body, &update, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.recordEvent(r, body, &update, nil)
+
+	if err := h.processor.ApplyAccrualUpdate(r.Context(), &update); err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		h.logger.Error("Failed to apply accrual callback",
+			zap.String("orderNumber", update.Order),
+			zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Подпись запоминается только после применения: повтор уведомления, которое не удалось
+	// применить, принимается. Одновременные повторы могут пройти проверку оба, но применение
+	// идемпотентно: переходы статусов проверяются, а начисление по заказу выполняется один раз.
+	if err := h.processor.storage.SaveCallbackNonce(r.Context(), nonce, nonceExpiresAt); err != nil {
+		h.logger.Error("Failed to save accrual callback nonce",
+			zap.String("orderNumber", update.Order),
+			zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateAccrualUpdate проверяет статус и начисление из уведомления
+func validateAccrualUpdate(update *models.AccrualResponse) error {
+	if _, err := models.MapAccrualStatus(update.Status); err != nil {
+		return err
+	}
+	if update.Accrual != nil && *update.Accrual < 0 {
+		return errors.New("accrual must not be negative")
+	}
+	return nil
+}
+
+// recordEvent записывает подлинное уведомление в журнал вместе с результатом проверки
+func (h *AccrualCallbackHandler) recordEvent(r *http.Request, body []byte, update *models.AccrualResponse, validationErr error) {
+	if h.recorder == nil {
+		return
+	}
+
+	event := &models.AccrualEvent{
+		OrderNumber: update.Order,
+		Source:      models.AccrualEventCallback,
+		RequestedAt: time.Now(),
+		Body:        string(body),
+		Status:      update.Status,
+		Accrual:     update.Accrual,
+	}
+	if validationErr != nil {
+		event.Error = validationErr.Error()
+	}
+	h.recorder.RecordAccrualEvent(r.Context(), event)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+// sendCallback отправляет подписанное уведомление и возвращает код ответа
+func sendCallback(t *testing.T, handler http.Handler, secret []byte, sentAt time.Time, body string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/internal/accrual/callback", bytes.NewBufferString(body))
+	req.Header.Set(services.AccrualTimestampHeader, strconv.FormatInt(sentAt.Unix(), 10))
+	req.Header.Set(services.AccrualSignatureHeader, services.SignAccrualCallback(secret, sentAt, []byte(body)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestAccrualCallbackHandler(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop())
+
+	secret := []byte("s3cret")
+	handler := NewAccrualCallbackHandler(processor, services.NewCallbackVerifier(secret, time.Minute), zap.NewNop())
+
+	ctx := context.Background()
+	userID := newTestUser(t, store, "user", 0, "12345678903", "79927398713")
+	now := time.Now()
+
+	t.Run("Applies update", func(t *testing.T) {
+		body := `{"order":"12345678903","status":"PROCESSED","accrual":500}`
+		assert.Equal(t, http.StatusOK, sendCallback(t, handler, secret, now, body))
+
+		order, err := store.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, models.OrderStatusProcessed, order.Status)
+
+		balance, err := store.GetBalance(ctx, userID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(50000), balance.Current)
+
+		// Система начисления не опрашивалась
+		assert.Equal(t, 0, accrualService.Calls("12345678903"))
+	})
+
+	t.Run("Replay is rejected", func(t *testing.T) {
+		body := `{"order":"12345678903","status":"PROCESSED","accrual":500}`
+		assert.Equal(t, http.StatusUnauthorized, sendCallback(t, handler, secret, now, body))
+
+		// Другой экземпляр с тем же хранилищем тоже отклоняет повтор
+		replica := NewAccrualCallbackHandler(NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop()),
+			services.NewCallbackVerifier(secret, time.Minute), zap.NewNop())
+		assert.Equal(t, http.StatusUnauthorized, sendCallback(t, replica, secret, now, body))
+	})
+
+	t.Run("Invalid signature", func(t *testing.T) {
+		body := `{"order":"79927398713","status":"INVALID"}`
+		assert.Equal(t, http.StatusUnauthorized, sendCallback(t, handler, []byte("wrong"), now, body))
+		assert.Equal(t, http.StatusUnauthorized, sendCallback(t, handler, secret, now.Add(-time.Hour), body))
+
+		order, err := store.GetOrderByNumber(ctx, "79927398713")
+		require.NoError(t, err)
+		assert.Equal(t, models.OrderStatusNew, order.Status)
+	})
+
+	t.Run("Invalid body", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, sendCallback(t, handler, secret, now, `{"order":`))
+		assert.Equal(t, http.StatusBadRequest, sendCallback(t, handler, secret, now, `{"order":"79927398713","status":"DONE"}`))
+		assert.Equal(t, http.StatusBadRequest, sendCallback(t, handler, secret, now, `{"status":"INVALID"}`))
+	})
+
+	t.Run("Unknown order", func(t *testing.T) {
+		body := `{"order":"2377225624","status":"INVALID"}`
+		assert.Equal(t, http.StatusNotFound, sendCallback(t, handler, secret, now, body))
+	})
+
+	t.Run("Illegal transition is ignored", func(t *testing.T) {
+		body := `{"order":"12345678903","status":"INVALID"}`
+		assert.Equal(t, http.StatusOK, sendCallback(t, handler, secret, now, body))
+
+		order, err := store.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, models.OrderStatusProcessed, order.Status)
+	})
+}
+
+func TestAccrualCallbackHandler_RetryAfterFailure(t *testing.T) {
+	memory := storage.NewMemoryStorage()
+	store := &failingBalanceStorage{MemoryStorage: memory, err: errors.New("database is unavailable")}
+	processor := NewOrderProcessor(store, newStubAccrualService(), 5*time.Second, 1, zap.NewNop())
+
+	secret := []byte("s3cret")
+	handler := NewAccrualCallbackHandler(processor, services.NewCallbackVerifier(secret, time.Minute), zap.NewNop())
+
+	ctx := context.Background()
+	userID := newTestUser(t, memory, "user", 0, "12345678903")
+	now := time.Now()
+
+	// Заказ еще не загружен: повтор того же уведомления после загрузки принимается
+	body := `{"order":"79927398713","status":"INVALID"}`
+	require.Equal(t, http.StatusNotFound, sendCallback(t, handler, secret, now, body))
+	_, err := memory.CreateOrder(ctx, userID, "79927398713")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, sendCallback(t, handler, secret, now, body))
+
+	// Начисление не удалось: повтор того же уведомления применяется
+	body = `{"order":"12345678903","status":"PROCESSED","accrual":500}`
+	require.Equal(t, http.StatusInternalServerError, sendCallback(t, handler, secret, now, body))
+	// Хранилище восстановилось
+	handler = NewAccrualCallbackHandler(NewOrderProcessor(memory, newStubAccrualService(), 5*time.Second, 1, zap.NewNop()),
+		services.NewCallbackVerifier(secret, time.Minute), zap.NewNop())
+	require.Equal(t, http.StatusOK, sendCallback(t, handler, secret, now, body))
+
+	balance, err := memory.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(50000), balance.Current)
+
+	// Примененное уведомление больше не принимается
+	assert.Equal(t, http.StatusUnauthorized, sendCallback(t, handler, secret, now, body))
+}
+
+func TestOrderProcessor_PushDeadline(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop())
+	processor.SetPushDeadline(time.Hour)
+
+	ctx := context.Background()
+	newTestUser(t, store, "user", 0, "12345678903")
+	accrualService.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSING"}, nil)
+
+	// Пока срок ожидания уведомления не истек, заказ не опрашивается
+	processor.ProcessOrders()
+	assert.Equal(t, 0, accrualService.Calls("12345678903"))
+
+	// Без уведомления по истечении срока заказ опрашивается
+	processor.SetPushDeadline(0)
+	processor.ProcessOrders()
+	assert.Equal(t, 1, accrualService.Calls("12345678903"))
+
+	order, err := store.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusProcessing, order.Status)
+}
+
+func TestAccrualCallbackHandler_RecordsEvents(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	processor := NewOrderProcessor(store, newStubAccrualService(), 5*time.Second, 1, zap.NewNop())
+
+	secret := []byte("s3cret")
+	handler := NewAccrualCallbackHandler(processor, services.NewCallbackVerifier(secret, time.Minute), zap.NewNop())
+	handler.SetEventRecorder(NewAccrualEventRecorder(store, zap.NewNop()))
+
+	ctx := context.Background()
+	newTestUser(t, store, "user", 0, "12345678903")
+	now := time.Now()
+
+	body := `{"order":"12345678903","status":"PROCESSED","accrual":500}`
+	require.Equal(t, http.StatusOK, sendCallback(t, handler, secret, now, body))
+	// Подпись не сходится: в журнал не попадает
+	require.Equal(t, http.StatusUnauthorized, sendCallback(t, handler, []byte("wrong"), now, `{"order":"12345678903","status":"INVALID"}`))
+	// Подлинное, но некорректное уведомление записывается с ошибкой
+	require.Equal(t, http.StatusBadRequest, sendCallback(t, handler, secret, now, `{"order":"12345678903","status":"UNKNOWN"}`))
+
+	events, err := store.ListAccrualEvents(ctx, "12345678903")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	assert.Equal(t, models.AccrualEventCallback, events[0].Source)
+	assert.Equal(t, body, events[0].Body)
+	assert.Equal(t, models.AccrualStatusProcessed, events[0].Status)
+	require.NotNil(t, events[0].Accrual)
+	assert.Equal(t, models.Money(50000), *events[0].Accrual)
+	assert.Empty(t, events[0].Error)
+
+	assert.Equal(t, "UNKNOWN", events[1].Status)
+	assert.NotEmpty(t, events[1].Error)
+}
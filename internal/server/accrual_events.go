@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"go.uber.org/zap"
+)
+
+// eventSaveTimeout ограничивает запись события в журнал
+const eventSaveTimeout = 5 * time.Second
+
+// AccrualEventRecorder записывает ответы системы начисления в хранилище
+type AccrualEventRecorder struct {
+	storage Storage
+	logger  *zap.Logger
+}
+
+// NewAccrualEventRecorder создает журнал ответов системы начисления
+func NewAccrualEventRecorder(storage Storage, logger *zap.Logger) *AccrualEventRecorder {
+	return &AccrualEventRecorder{
+		storage: storage,
+		logger:  logger,
+	}
+}
+
+// RecordAccrualEvent сохраняет событие. Событие записывается, даже если ctx запроса
+// уже отменен: ответ получен и должен попасть в журнал.
+func (r *AccrualEventRecorder) RecordAccrualEvent(ctx context.Context, event *models.AccrualEvent) {
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), eventSaveTimeout)
+	defer cancel()
+
+	if err := r.storage.SaveAccrualEvent(saveCtx, event); err != nil {
+		r.logger.Error("Failed to save accrual event",
+			zap.String("orderNumber", event.OrderNumber),
+			zap.String("source", event.Source),
+			zap.Error(err))
+	}
+}
@@ -0,0 +1,531 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"go.uber.org/zap"
+)
+
+// AdminHandlers обработчики служебного API для разбора обращений и ручных операций
+type AdminHandlers struct {
+	storage    Storage
+	reconciler *Reconciler
+	ledger     *LedgerAuditor
+	processor  *OrderProcessor
+	auth       *services.AuthService
+	logger     *zap.Logger
+}
+
+// NewAdminHandlers создает обработчики служебного API
+func NewAdminHandlers(storage Storage, logger *zap.Logger) *AdminHandlers {
+	return &AdminHandlers{
+		storage: storage,
+		logger:  logger,
+	}
+}
+
+// GetAccrualEventsHandler возвращает ответы системы начисления о заказе в порядке получения
+func (h *AdminHandlers) GetAccrualEventsHandler(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	order, err := h.storage.GetOrderByNumber(r.Context(), number)
+	if err != nil {
+		h.logger.Error("Failed to get order by number", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if order == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	events, err := h.storage.ListAccrualEvents(r.Context(), number)
+	if err != nil {
+		h.logger.Error("Failed to get accrual events", zap.String("orderNumber", number), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(events) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// shadowDisagreementsLimit число последних расхождений в отчете теневого режима
+const shadowDisagreementsLimit = 50
+
+// reconciliationStatus состояние сверки для служебного API
+type reconciliationStatus struct {
+	Policy     string           `json:"policy"`
+	Interval   string           `json:"interval"`
+	SampleRate float64          `json:"sample_rate"`
+	Window     string           `json:"window"`
+	LastRun    *ReconcileReport `json:"last_run,omitempty"`
+}
+
+// ledgerCheckStatus состояние сверки балансов с журналом проводок для служебного API
+type ledgerCheckStatus struct {
+	Interval string             `json:"interval"`
+	LastRun  *LedgerCheckReport `json:"last_run,omitempty"`
+}
+
+// requeueRequest тело запроса возврата заказов из очереди недоставленных
+type requeueRequest struct {
+	Orders []string `json:"orders"`
+	// All вернуть все заказы очереди
+	All bool `json:"all"`
+}
+
+// requeueResponse заказы, возвращенные в обработку
+type requeueResponse struct {
+	Requeued []string `json:"requeued"`
+}
+
+// resolveDiscrepancyRequest тело запроса закрытия расхождения
+type resolveDiscrepancyRequest struct {
+	Note string `json:"note"`
+}
+
+// SetReconciler подключает сверку обработанных заказов к служебному API
+func (h *AdminHandlers) SetReconciler(reconciler *Reconciler) {
+	h.reconciler = reconciler
+}
+
+// GetReconciliationHandler возвращает параметры сверки и итоги последнего прохода
+func (h *AdminHandlers) GetReconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	if h.reconciler == nil {
+		http.Error(w, "reconciliation is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	settings := h.reconciler.Settings()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reconciliationStatus{
+		Policy:     settings.Policy,
+		Interval:   settings.Interval.String(),
+		SampleRate: settings.SampleRate,
+		Window:     settings.Window.String(),
+		LastRun:    h.reconciler.LastReport(),
+	})
+}
+
+// RunReconciliationHandler запускает проход сверки и возвращает его итоги
+func (h *AdminHandlers) RunReconciliationHandler(w http.ResponseWriter, r *http.Request) {
+	if h.reconciler == nil {
+		http.Error(w, "reconciliation is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	report := h.reconciler.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// SetLedgerAuditor подключает сверку балансов с журналом проводок к служебному API
+func (h *AdminHandlers) SetLedgerAuditor(auditor *LedgerAuditor) {
+	h.ledger = auditor
+}
+
+// GetLedgerCheckHandler возвращает период сверки балансов с журналом и итоги последней сверки
+func (h *AdminHandlers) GetLedgerCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if h.ledger == nil {
+		http.Error(w, "ledger check is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ledgerCheckStatus{
+		Interval: h.ledger.Interval().String(),
+		LastRun:  h.ledger.LastReport(),
+	})
+}
+
+// RunLedgerCheckHandler сверяет балансы с журналом проводок и возвращает итоги
+func (h *AdminHandlers) RunLedgerCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if h.ledger == nil {
+		http.Error(w, "ledger check is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	report := h.ledger.Run(r.Context())
+	if report.Error != "" {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ListDiscrepanciesHandler возвращает расхождения начислений, при необходимости с фильтром ?status=
+func (h *AdminHandlers) ListDiscrepanciesHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", models.DiscrepancyStatusOpen, models.DiscrepancyStatusAdjusted, models.DiscrepancyStatusResolved:
+	default:
+		http.Error(w, "unknown discrepancy status", http.StatusBadRequest)
+		return
+	}
+
+	discrepancies, err := h.storage.ListAccrualDiscrepancies(r.Context(), status)
+	if err != nil {
+		h.logger.Error("Failed to get accrual discrepancies", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(discrepancies) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discrepancies)
+}
+
+// ResolveDiscrepancyHandler закрывает открытое расхождение после ручного разбора
+func (h *AdminHandlers) ResolveDiscrepancyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid discrepancy id", http.StatusBadRequest)
+		return
+	}
+
+	var req resolveDiscrepancyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	discrepancy, err := h.storage.ResolveAccrualDiscrepancy(r.Context(), id, req.Note)
+	if err != nil {
+		h.logger.Error("Failed to resolve accrual discrepancy", zap.Int64("id", id), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if discrepancy == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(discrepancy)
+}
+
+// GetShadowReportHandler возвращает долю совпадений ответов теневой системы начисления с основной
+// и последние расхождения; ?since=24h ограничивает отчет последними сутками
+func (h *AdminHandlers) GetShadowReportHandler(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			http.Error(w, "invalid since duration", http.StatusBadRequest)
+			return
+		}
+		since = time.Now().Add(-window)
+	}
+
+	report, err := h.storage.GetShadowReport(r.Context(), since, shadowDisagreementsLimit)
+	if err != nil {
+		h.logger.Error("Failed to get shadow report", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ListDeadLettersHandler возвращает заказы из очереди недоставленных с неудачными попытками
+func (h *AdminHandlers) ListDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	orders, err := h.storage.ListDeadLetterOrders(r.Context())
+	if err != nil {
+		h.logger.Error("Failed to get dead letter orders", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if len(orders) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// RequeueDeadLetterHandler возвращает в обработку заказ {number} из очереди недоставленных
+func (h *AdminHandlers) RequeueDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	requeued, err := h.storage.RequeueDeadLetterOrders(r.Context(), []string{number})
+	if err != nil {
+		h.logger.Error("Failed to requeue dead letter order", zap.String("orderNumber", number), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(requeued) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	h.writeRequeued(w, requeued)
+}
+
+// RequeueDeadLettersHandler возвращает в обработку перечисленные заказы очереди недоставленных
+// или всю очередь; заказы, которых нет в очереди, пропускаются
+func (h *AdminHandlers) RequeueDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	var req requeueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+	// Пустой список без all — скорее ошибка, чем просьба вернуть всю очередь
+	if len(req.Orders) == 0 && !req.All {
+		http.Error(w, "orders or all is required", http.StatusBadRequest)
+		return
+	}
+	if req.All {
+		req.Orders = nil
+	}
+
+	requeued, err := h.storage.RequeueDeadLetterOrders(r.Context(), req.Orders)
+	if err != nil {
+		h.logger.Error("Failed to requeue dead letter orders", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeRequeued(w, requeued)
+}
+
+// writeRequeued отвечает списком возвращенных в обработку заказов
+func (h *AdminHandlers) writeRequeued(w http.ResponseWriter, requeued []string) {
+	h.logger.Info("Dead letter orders requeued", zap.Strings("orders", requeued))
+
+	if requeued == nil {
+		requeued = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requeueResponse{Requeued: requeued})
+}
+
+// ResolveDeadLetterHandler вручную завершает заказ из очереди недоставленных
+// с указанными статусом и начислением
+func (h *AdminHandlers) ResolveDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	number := chi.URLParam(r, "number")
+
+	var req models.DeadLetterResolution
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case req.Status != models.OrderStatusProcessed && req.Status != models.OrderStatusInvalid:
+		http.Error(w, "status must be PROCESSED or INVALID", http.StatusBadRequest)
+		return
+	case req.Accrual < 0:
+		http.Error(w, "accrual must not be negative", http.StatusBadRequest)
+		return
+	case req.Status == models.OrderStatusInvalid && req.Accrual != 0:
+		http.Error(w, "invalid order has no accrual", http.StatusBadRequest)
+		return
+	}
+
+	resolved, err := h.storage.ResolveDeadLetterOrder(r.Context(), number, req.Status, req.Accrual)
+	if err != nil {
+		h.logger.Error("Failed to resolve dead letter order", zap.String("orderNumber", number), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !resolved {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	h.logger.Info("Dead letter order resolved manually",
+		zap.String("orderNumber", number),
+		zap.String("status", req.Status),
+		zap.Stringer("accrual", req.Accrual))
+
+	order, err := h.storage.GetOrderByNumber(r.Context(), number)
+	if err != nil {
+		h.logger.Error("Failed to get order by number", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// workerPoolRequest тело запроса изменения пула воркеров: Workers закрепляет размер,
+// Min и Max задают границы автоматического подбора
+type workerPoolRequest struct {
+	Workers *int `json:"workers"`
+	Min     *int `json:"min"`
+	Max     *int `json:"max"`
+}
+
+// SetOrderProcessor подключает управление пулом воркеров обработки заказов к служебному API
+func (h *AdminHandlers) SetOrderProcessor(processor *OrderProcessor) {
+	h.processor = processor
+}
+
+// GetWorkerPoolHandler возвращает размер пула воркеров и замеры, по которым он подбирается
+func (h *AdminHandlers) GetWorkerPoolHandler(w http.ResponseWriter, r *http.Request) {
+	if h.processor == nil {
+		http.Error(w, "order processing is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.processor.WorkerPoolStatus())
+}
+
+// UpdateWorkerPoolHandler меняет пул воркеров без перезапуска: {"workers": N} закрепляет размер,
+// {"min": N, "max": M} возвращает автоматический подбор с новыми границами
+func (h *AdminHandlers) UpdateWorkerPoolHandler(w http.ResponseWriter, r *http.Request) {
+	if h.processor == nil {
+		http.Error(w, "order processing is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req workerPoolRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch {
+	case req.Workers != nil && req.Min == nil && req.Max == nil:
+		err = h.processor.PinWorkers(*req.Workers)
+	case req.Workers == nil && req.Min != nil && req.Max != nil:
+		err = h.processor.SetWorkerBounds(*req.Min, *req.Max)
+	default:
+		http.Error(w, "specify either workers or min and max", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := h.processor.WorkerPoolStatus()
+	h.logger.Info("Worker pool changed via admin API",
+		zap.Int("size", status.Size),
+		zap.Int("min", status.Min),
+		zap.Int("max", status.Max),
+		zap.Bool("auto", status.Auto))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// userTierRequest тело запроса смены тарифа пользователя
+type userTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+// userTierResponse тариф пользователя после смены
+type userTierResponse struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Tier  string `json:"tier"`
+}
+
+// SetUserTierHandler меняет тариф пользователя {id}; тариф задает вес пользователя
+// в справедливой очереди обработки заказов
+func (h *AdminHandlers) SetUserTierHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user id", http.StatusBadRequest)
+		return
+	}
+
+	var req userTierRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request format", http.StatusBadRequest)
+		return
+	}
+	if err := models.ValidateUserTier(req.Tier); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := h.storage.SetUserTier(r.Context(), id, req.Tier)
+	if err != nil {
+		h.logger.Error("Failed to set user tier", zap.Int64("userID", id), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	h.logger.Info("User tier changed via admin API", zap.Int64("userID", id), zap.String("tier", req.Tier))
+
+	user, err := h.storage.GetUserByID(r.Context(), id)
+	if err != nil || user == nil {
+		h.logger.Error("Failed to get user by id", zap.Int64("userID", id), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userTierResponse{ID: user.ID, Login: user.Login, Tier: user.Tier})
+}
+
+// SetAuthService подключает управление ключами подписи JWT к служебному API
+func (h *AdminHandlers) SetAuthService(auth *services.AuthService) {
+	h.auth = auth
+}
+
+// ListJWTKeysHandler возвращает ключи подписи JWT без секретов
+func (h *AdminHandlers) ListJWTKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if h.auth == nil {
+		http.Error(w, "JWT key management is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.auth.Keys())
+}
+
+// RotateJWTKeysHandler добавляет новый ключ подписи JWT в файл ключей. Новый ключ начинает
+// подписывать токены после задержки, за которую его загружают остальные экземпляры;
+// прежние ключи принимаются до конца окна перекрытия.
+func (h *AdminHandlers) RotateJWTKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if h.auth == nil {
+		http.Error(w, "JWT key management is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	keys, err := h.auth.RotateKeys()
+	if err != nil {
+		if errors.Is(err, services.ErrKeysNotRotatable) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		h.logger.Error("Failed to rotate JWT keys", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	h.logger.Info("JWT keys rotated via admin API", zap.String("newKey", keys[len(keys)-1].ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
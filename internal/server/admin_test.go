@@ -0,0 +1,430 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+// newAdminRouter создает роутер со служебным API и токеном администратора "admin-token"
+func newAdminRouter(store Storage) http.Handler {
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+	router.MountAdmin(NewAdminHandlers(store, zap.NewNop()), "admin-token")
+	return router.GetRouter()
+}
+
+// adminRequest выполняет запрос к служебному API с токеном token
+func adminRequest(handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminHandlers_AccrualEvents(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := newAdminRouter(store)
+	ctx := context.Background()
+
+	newTestUser(t, store, "user", 0, "12345678903", "79927398713")
+	recorder := NewAccrualEventRecorder(store, zap.NewNop())
+	recorder.RecordAccrualEvent(ctx, &models.AccrualEvent{OrderNumber: "12345678903", Source: models.AccrualEventPoll,
+		RequestedAt: time.Now(), HTTPStatus: http.StatusNoContent})
+	recorder.RecordAccrualEvent(ctx, &models.AccrualEvent{OrderNumber: "12345678903", Source: models.AccrualEventPoll,
+		RequestedAt: time.Now(), HTTPStatus: http.StatusOK, Body: `{"order":"12345678903","status":"PROCESSING"}`, Status: "PROCESSING"})
+
+	path := "/api/admin/orders/12345678903/accrual-events"
+
+	t.Run("Requires admin token", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, path, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, path, "wrong").Code)
+	})
+
+	t.Run("Lists events in order", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, path, "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var events []models.AccrualEvent
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+		require.Len(t, events, 2)
+		assert.Equal(t, http.StatusNoContent, events[0].HTTPStatus)
+		assert.Equal(t, "PROCESSING", events[1].Status)
+		assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSING"}`, events[1].Body)
+	})
+
+	t.Run("Order without events", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/orders/79927398713/accrual-events", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `[]`, rec.Body.String())
+	})
+
+	t.Run("Unknown order", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/orders/2377225624/accrual-events", "admin-token")
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func TestAdminHandlers_Reconciliation(t *testing.T) {
+	store, _ := newReconcileFixture(t)
+	accrual := newStubAccrualService()
+	accrual.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(50000)}, nil)
+	accrual.On("79927398713", &models.AccrualResponse{Order: "79927398713", Status: "PROCESSED", Accrual: moneyPtr(12000)}, nil)
+	accrual.On("2377225624", &models.AccrualResponse{Order: "2377225624", Status: "PROCESSED", Accrual: moneyPtr(5000)}, nil)
+
+	admin := NewAdminHandlers(store, zap.NewNop())
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+	router.MountAdmin(admin, "admin-token")
+	handler := router.GetRouter()
+
+	t.Run("Disabled without reconciler", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodGet, "/api/admin/reconciliation", "admin-token").Code)
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodPost, "/api/admin/reconciliation/run", "admin-token").Code)
+	})
+
+	admin.SetReconciler(newReconciler(store, accrual, models.ReconcilePolicyReview))
+
+	t.Run("Run and report", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodPost, "/api/admin/reconciliation/run", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var report ReconcileReport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		assert.Equal(t, 3, report.Checked)
+		assert.Equal(t, 1, report.Opened)
+
+		rec = adminRequest(handler, http.MethodGet, "/api/admin/reconciliation", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status reconciliationStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, models.ReconcilePolicyReview, status.Policy)
+		require.NotNil(t, status.LastRun)
+		assert.Equal(t, 1, status.LastRun.Discrepancies)
+	})
+
+	var discrepancyID int64
+	t.Run("List discrepancies", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/discrepancies?status=OPEN", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var discrepancies []models.AccrualDiscrepancy
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &discrepancies))
+		require.Len(t, discrepancies, 1)
+		assert.Equal(t, "79927398713", discrepancies[0].OrderNumber)
+		discrepancyID = discrepancies[0].ID
+
+		rec = adminRequest(handler, http.MethodGet, "/api/admin/discrepancies?status=ADJUSTED", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `[]`, rec.Body.String())
+
+		assert.Equal(t, http.StatusBadRequest, adminRequest(handler, http.MethodGet, "/api/admin/discrepancies?status=LOST", "admin-token").Code)
+		assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, "/api/admin/discrepancies", "").Code)
+	})
+
+	t.Run("Resolve discrepancy", func(t *testing.T) {
+		resolve := func(id int64) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/admin/discrepancies/%d/resolve", id),
+				strings.NewReader(`{"note":"partner confirmed the bonus"}`))
+			req.Header.Set("Authorization", "Bearer admin-token")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+
+		rec := resolve(discrepancyID)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resolved models.AccrualDiscrepancy
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resolved))
+		assert.Equal(t, models.DiscrepancyStatusResolved, resolved.Status)
+		assert.Equal(t, "partner confirmed the bonus", resolved.Note)
+
+		assert.Equal(t, http.StatusNotFound, resolve(discrepancyID).Code)
+		assert.Equal(t, http.StatusBadRequest, adminRequest(handler, http.MethodPost, "/api/admin/discrepancies/abc/resolve", "admin-token").Code)
+	})
+}
+
+func TestAdminHandlers_ShadowReport(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := newAdminRouter(store)
+	ctx := context.Background()
+
+	require.NoError(t, store.SaveShadowComparison(ctx, &models.ShadowComparison{OrderNumber: "12345678903", Source: models.AccrualEventPoll,
+		PrimaryStatus: "INVALID", ShadowStatus: "INVALID", Outcome: models.ShadowOutcomeAgree, Final: true, ComparedAt: time.Now()}))
+	require.NoError(t, store.SaveShadowComparison(ctx, &models.ShadowComparison{OrderNumber: "79927398713", Source: models.AccrualEventPoll,
+		PrimaryStatus: "PROCESSED", ShadowStatus: "INVALID", Outcome: models.ShadowOutcomeStatusMismatch, Final: true,
+		ComparedAt: time.Now().Add(-48 * time.Hour)}))
+
+	t.Run("All comparisons", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/shadow", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var report models.ShadowReport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		assert.Equal(t, 2, report.Compared)
+		assert.InDelta(t, 0.5, report.AgreementRate, 1e-9)
+		require.Len(t, report.Disagreements, 1)
+		assert.Equal(t, "79927398713", report.Disagreements[0].OrderNumber)
+	})
+
+	t.Run("Since window", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/shadow?since=24h", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var report models.ShadowReport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		assert.Equal(t, 1, report.Compared)
+		assert.InDelta(t, 1.0, report.AgreementRate, 1e-9)
+		assert.Empty(t, report.Disagreements)
+
+		assert.Equal(t, http.StatusBadRequest, adminRequest(handler, http.MethodGet, "/api/admin/shadow?since=yesterday", "admin-token").Code)
+	})
+}
+
+func TestAdminHandlers_DeadLetters(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := newAdminRouter(store)
+	ctx := context.Background()
+
+	userID := newTestUser(t, store, "user", 0, "12345678903", "79927398713", "2377225624")
+	for _, number := range []string{"12345678903", "79927398713", "2377225624"} {
+		require.NoError(t, store.ScheduleOrderRetry(ctx, number, "failed to decode accrual response", nil))
+	}
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("List", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/dead-letters", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var orders []models.DeadLetterOrder
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &orders))
+		require.Len(t, orders, 3)
+		require.Len(t, orders[0].Failures, 1)
+		assert.Equal(t, "failed to decode accrual response", orders[0].Failures[0].Error)
+
+		assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, "/api/admin/dead-letters", "").Code)
+	})
+
+	t.Run("Requeue one", func(t *testing.T) {
+		rec := post("/api/admin/dead-letters/12345678903/requeue", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"requeued":["12345678903"]}`, rec.Body.String())
+
+		assert.Equal(t, http.StatusNotFound, post("/api/admin/dead-letters/12345678903/requeue", "").Code)
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		rec := post("/api/admin/dead-letters/79927398713/resolve", `{"status":"PROCESSED","accrual":150}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var order models.Order
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &order))
+		assert.Equal(t, models.OrderStatusProcessed, order.Status)
+		assert.Equal(t, models.Money(15000), *order.Accrual)
+
+		balance, err := store.GetBalance(ctx, userID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(15000), balance.Current)
+
+		assert.Equal(t, http.StatusNotFound, post("/api/admin/dead-letters/79927398713/resolve", `{"status":"INVALID"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, post("/api/admin/dead-letters/2377225624/resolve", `{"status":"NEW"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, post("/api/admin/dead-letters/2377225624/resolve", `{"status":"INVALID","accrual":10}`).Code)
+		assert.Equal(t, http.StatusBadRequest, post("/api/admin/dead-letters/2377225624/resolve", `{"status":"PROCESSED","accrual":-1}`).Code)
+	})
+
+	t.Run("Requeue in bulk", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, post("/api/admin/dead-letters/requeue", `{}`).Code)
+
+		rec := post("/api/admin/dead-letters/requeue", `{"all":true}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"requeued":["2377225624"]}`, rec.Body.String())
+
+		rec = adminRequest(handler, http.MethodGet, "/api/admin/dead-letters", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `[]`, rec.Body.String())
+	})
+}
+
+func TestAdminHandlers_WorkerPool(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	admin := NewAdminHandlers(store, zap.NewNop())
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+	router.MountAdmin(admin, "admin-token")
+	handler := router.GetRouter()
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/admin/workers", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Disabled without processor", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodGet, "/api/admin/workers", "admin-token").Code)
+		assert.Equal(t, http.StatusServiceUnavailable, put(`{"workers":3}`).Code)
+	})
+
+	processor := NewOrderProcessor(store, newStubAccrualService(), time.Second, 5, zap.NewNop())
+	admin.SetOrderProcessor(processor)
+
+	t.Run("Status", func(t *testing.T) {
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/workers", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status WorkerPoolStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, 5, status.Size)
+		assert.Equal(t, 5, status.Min)
+		assert.Equal(t, 5, status.Max)
+	})
+
+	t.Run("Pin size", func(t *testing.T) {
+		rec := put(`{"workers":12}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status WorkerPoolStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, 12, status.Size)
+		assert.False(t, status.Auto)
+	})
+
+	t.Run("Autoscaling bounds", func(t *testing.T) {
+		rec := put(`{"min":2,"max":8}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status WorkerPoolStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.True(t, status.Auto)
+		assert.Equal(t, 2, status.Min)
+		assert.Equal(t, 8, status.Max)
+		// Текущий размер приводится к новым границам
+		assert.Equal(t, 8, status.Size)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, put(`not json`).Code)
+		assert.Equal(t, http.StatusBadRequest, put(`{}`).Code)
+		assert.Equal(t, http.StatusBadRequest, put(`{"workers":3,"min":1,"max":4}`).Code)
+		assert.Equal(t, http.StatusBadRequest, put(`{"min":4}`).Code)
+		assert.Equal(t, http.StatusBadRequest, put(`{"workers":0}`).Code)
+		assert.Equal(t, http.StatusBadRequest, put(`{"min":5,"max":2}`).Code)
+	})
+}
+
+func TestAdminHandlers_UserTier(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	handler := newAdminRouter(store)
+
+	user, err := store.CreateUser(context.Background(), "partner", "password")
+	require.NoError(t, err)
+
+	put := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	path := fmt.Sprintf("/api/admin/users/%d/tier", user.ID)
+
+	rec := put(path, `{"tier":"partner"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":%d,"login":"partner","tier":"partner"}`, user.ID), rec.Body.String())
+
+	stored, err := store.GetUserByID(context.Background(), user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "partner", stored.Tier)
+
+	assert.Equal(t, http.StatusNotFound, put("/api/admin/users/999/tier", `{"tier":"partner"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put("/api/admin/users/abc/tier", `{"tier":"partner"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, put(path, `not json`).Code)
+	assert.Equal(t, http.StatusBadRequest, put(path, `{"tier":""}`).Code)
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodPut, path, "").Code)
+}
+
+func TestAdminHandlers_JWTKeys(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	admin := NewAdminHandlers(store, zap.NewNop())
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+	router.MountAdmin(admin, "admin-token")
+	handler := router.GetRouter()
+
+	t.Run("Disabled without auth service", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodGet, "/api/admin/jwt-keys", "admin-token").Code)
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodPost, "/api/admin/jwt-keys/rotate", "admin-token").Code)
+	})
+
+	t.Run("Keys without file are not rotatable", func(t *testing.T) {
+		admin.SetAuthService(services.NewAuthService("secret"))
+		assert.Equal(t, http.StatusConflict, adminRequest(handler, http.MethodPost, "/api/admin/jwt-keys/rotate", "admin-token").Code)
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		auth, err := services.NewAuthServiceWithKeyFile(filepath.Join(t.TempDir(), "jwt-keys.json"), services.AlgHS256)
+		require.NoError(t, err)
+		admin.SetAuthService(auth)
+
+		rec := adminRequest(handler, http.MethodGet, "/api/admin/jwt-keys", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var keys []services.SigningKeyInfo
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &keys))
+		require.Len(t, keys, 1)
+		assert.True(t, keys[0].Active)
+		assert.NotContains(t, rec.Body.String(), "secret")
+
+		rec = adminRequest(handler, http.MethodPost, "/api/admin/jwt-keys/rotate", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		keys = nil
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &keys))
+		require.Len(t, keys, 2)
+		// Новый ключ вступает в силу после задержки, до тех пор подписывает прежний
+		assert.True(t, keys[0].Active)
+		assert.False(t, keys[1].Active)
+		assert.NotNil(t, keys[0].ExpiresAt)
+	})
+}
+
+func TestJWKSHandler(t *testing.T) {
+	store := storage.NewMemoryStorage()
+
+	// Секрет HS256 не публикуется
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+	rec := httptest.NewRecorder()
+	router.GetRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"keys":[]}`, rec.Body.String())
+
+	keys, err := services.NewKeyRing(services.AlgEdDSA, time.Now())
+	require.NoError(t, err)
+	auth, err := services.NewAuthServiceWithKeys(keys)
+	require.NoError(t, err)
+	router = NewRouter(store, auth, services.NewAccrualService(""), zap.NewNop())
+
+	// Ключи публичны: токен не нужен
+	rec = httptest.NewRecorder()
+	router.GetRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=60", rec.Header().Get("Cache-Control"))
+
+	var jwks services.JSONWebKeySet
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, keys.Keys[0].ID, jwks.Keys[0].KeyID)
+	assert.Equal(t, "OKP", jwks.Keys[0].KeyType)
+	assert.Equal(t, services.AlgEdDSA, jwks.Keys[0].Algorithm)
+	assert.NotEmpty(t, jwks.Keys[0].X)
+}
@@ -2,10 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/middleware"
@@ -53,11 +55,19 @@ func validateOrderNumber(number string) bool {
 	return sum%10 == 0
 }
 
+// MerchantHeader заголовок загрузки заказа с мерчантом, к которому относится заказ
+const MerchantHeader = "X-Merchant"
+
+// maxMerchantLength ограничение длины мерчанта, как в таблице orders
+const maxMerchantLength = 64
+
 // Handlers содержит все HTTP обработчики
 type Handlers struct {
 	storage        Storage
 	authService    *services.AuthService
 	accrualService *services.AccrualService
+	providers      *services.ProviderRegistry
+	leader         *LeaderElector
 	logger         *zap.Logger
 	validate       *validator.Validate
 }
@@ -115,17 +125,15 @@ func (h *Handlers) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Генерируем JWT токен
-	token, err := h.authService.GenerateJWT(user.ID, user.Login)
+	// Выдаем access и refresh токены
+	tokens, err := h.startSession(r.Context(), user)
 	if err != nil {
-		h.logger.Error("Failed to generate JWT", zap.Error(err))
+		h.logger.Error("Failed to issue tokens", zap.Error(err))
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	// Устанавливаем токен в заголовок
-	w.Header().Set("Authorization", "Bearer "+token)
-	w.WriteHeader(http.StatusOK)
+	writeTokens(w, tokens)
 }
 
 // LoginHandler обрабатывает аутентификацию пользователя
@@ -160,17 +168,15 @@ func (h *Handlers) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Генерируем JWT токен
-	token, err := h.authService.GenerateJWT(user.ID, user.Login)
+	// Выдаем access и refresh токены
+	tokens, err := h.startSession(r.Context(), user)
 	if err != nil {
-		h.logger.Error("Failed to generate JWT", zap.Error(err))
+		h.logger.Error("Failed to issue tokens", zap.Error(err))
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	// Устанавливаем токен в заголовок
-	w.Header().Set("Authorization", "Bearer "+token)
-	w.WriteHeader(http.StatusOK)
+	writeTokens(w, tokens)
 }
 
 // UploadOrderHandler обрабатывает загрузку номера заказа
@@ -217,8 +223,15 @@ func (h *Handlers) UploadOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Мерчант необязателен и участвует в выборе системы начисления
+	merchant := r.Header.Get(MerchantHeader)
+	if len(merchant) > maxMerchantLength {
+		http.Error(w, "Merchant is too long", http.StatusBadRequest)
+		return
+	}
+
 	// Создаем новый заказ
-	_, err = h.storage.CreateOrder(r.Context(), userID, orderNumber)
+	_, err = h.storage.CreateMerchantOrder(r.Context(), userID, orderNumber, merchant)
 	if err != nil {
 		h.logger.Error("Failed to create order", zap.Error(err))
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -243,6 +256,12 @@ func (h *Handlers) GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Пользователь ждет статусов своих заказов: очередь проверит их раньше.
+	// Отметка необязательна, ошибка не мешает ответу.
+	if err := h.storage.MarkOrdersViewed(r.Context(), userID, time.Now()); err != nil {
+		h.logger.Warn("Failed to mark orders viewed", zap.Int64("userID", userID), zap.Error(err))
+	}
+
 	if len(orders) == 0 {
 		w.Header().Set("Content-Type", "application/json")
 		w.Write([]byte("[]"))
@@ -282,6 +301,10 @@ func (h *Handlers) WithdrawHandler(w http.ResponseWriter, r *http.Request) {
 
 	var req models.WithdrawRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if errors.Is(err, models.ErrMoneyPrecision) {
+			http.Error(w, "Sum must have at most two decimal places", http.StatusBadRequest)
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
@@ -333,3 +356,56 @@ func (h *Handlers) GetWithdrawalsHandler(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(withdrawals)
 }
+
+// Состояния сервиса в ответе проверки работоспособности
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusDegraded = "degraded"
+)
+
+// HealthResponse ответ проверки работоспособности
+type HealthResponse struct {
+	Status  string                 `json:"status"`
+	Accrual services.BreakerStatus `json:"accrual"`
+	// Providers состояние выключателей по системам начисления, если их несколько
+	Providers map[string]services.BreakerStatus `json:"providers,omitempty"`
+	// Leader состояние выборов ведущего экземпляра, если они включены
+	Leader *LeaderStatus `json:"leader,omitempty"`
+}
+
+// HealthHandler сообщает состояние сервиса. Разомкнутый выключатель системы начисления
+// не мешает обслуживать пользователей, поэтому сервис считается работающим с ограничениями.
+func (h *Handlers) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{
+		Status:  HealthStatusOK,
+		Accrual: h.accrualService.BreakerStatus(),
+	}
+	if response.Accrual.State != services.BreakerClosed.String() {
+		response.Status = HealthStatusDegraded
+	}
+	if h.providers != nil {
+		response.Providers = h.providers.BreakerStatuses()
+		for _, status := range response.Providers {
+			if status.State != services.BreakerClosed.String() {
+				response.Status = HealthStatusDegraded
+			}
+		}
+	}
+	// Ведомый экземпляр работает штатно: фоновые задачи выполняет ведущий
+	if h.leader != nil {
+		status := h.leader.Status()
+		response.Leader = &status
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// JWKSHandler публикует открытые ключи подписи токенов RS256 и EdDSA, чтобы другие
+// сервисы проверяли токены без общего секрета
+func (h *Handlers) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	// Новый ключ публикуется заранее, поэтому короткий кэш не мешает ротации
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(h.authService.JWKS())
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultLeaderElection имя выборов ведущего экземпляра для фоновых задач
+const DefaultLeaderElection = "background-jobs"
+
+// Leadership сообщает, является ли экземпляр ведущим. Фоновые задачи, которые должны
+// выполняться ровно на одном экземпляре, пропускают запуски, пока экземпляр ведомый.
+type Leadership interface {
+	IsLeader() bool
+}
+
+// LeaderStatus состояние выборов ведущего в проверке работоспособности
+type LeaderStatus struct {
+	Election string `json:"election"`
+	Leader   bool   `json:"leader"`
+	// Since время, с которого экземпляр ведущий
+	Since *time.Time `json:"since,omitempty"`
+}
+
+// LeaderElector выбирает ведущий экземпляр через блокировку в хранилище. Блокировка живет,
+// пока жива сессия хранилища; при потере сессии экземпляр перестает быть ведущим
+// и пытается захватить блокировку снова.
+type LeaderElector struct {
+	storage       Storage
+	election      string
+	checkInterval time.Duration
+	logger        *zap.Logger
+	stopChan      chan struct{}
+	done          chan struct{} // закрывается, когда цикл выборов завершился и блокировка снята
+
+	mu        sync.Mutex
+	leader    bool
+	since     time.Time
+	callbacks []func(leader bool)
+}
+
+// NewLeaderElector создает выборы ведущего election; занятая блокировка и живость сессии
+// проверяются раз в checkInterval
+func NewLeaderElector(storage Storage, election string, checkInterval time.Duration, logger *zap.Logger) *LeaderElector {
+	return &LeaderElector{
+		storage:       storage,
+		election:      election,
+		checkInterval: checkInterval,
+		logger:        logger,
+		stopChan:      make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// OnChange регистрирует fn, вызываемую при смене лидерства. Вызывается из цикла выборов,
+// поэтому fn не должна блокироваться. Регистрируется до Start.
+func (e *LeaderElector) OnChange(fn func(leader bool)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.callbacks = append(e.callbacks, fn)
+}
+
+// IsLeader сообщает, является ли экземпляр ведущим
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Status возвращает состояние выборов
+func (e *LeaderElector) Status() LeaderStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := LeaderStatus{Election: e.election, Leader: e.leader}
+	if e.leader {
+		since := e.since
+		status.Since = &since
+	}
+	return status
+}
+
+// Start запускает выборы
+func (e *LeaderElector) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-e.stopChan
+		cancel()
+	}()
+
+	go func() {
+		defer close(e.done)
+		e.run(ctx)
+	}()
+}
+
+// Stop прекращает выборы и снимает блокировку, но ждет не дольше ctx. Вызывается после Start.
+func (e *LeaderElector) Stop(ctx context.Context) error {
+	close(e.stopChan)
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run удерживает блокировку, пока это возможно, и захватывает ее снова после потери сессии
+func (e *LeaderElector) run(ctx context.Context) {
+	for {
+		err := e.storage.HoldLeaderLock(ctx, e.election, e.checkInterval, func() {
+			e.setLeader(true)
+		})
+		e.setLeader(false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		e.logger.Warn("Leader election session lost, retrying",
+			zap.String("election", e.election),
+			zap.Duration("delay", e.checkInterval),
+			zap.Error(err))
+
+		timer := time.NewTimer(e.checkInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// setLeader меняет лидерство и вызывает подписчиков, если оно изменилось
+func (e *LeaderElector) setLeader(leader bool) {
+	e.mu.Lock()
+	if e.leader == leader {
+		e.mu.Unlock()
+		return
+	}
+	e.leader = leader
+	if leader {
+		e.since = time.Now()
+	}
+	callbacks := e.callbacks
+	e.mu.Unlock()
+
+	if leader {
+		e.logger.Info("Became leader", zap.String("election", e.election))
+	} else {
+		e.logger.Info("Leadership lost", zap.String("election", e.election))
+	}
+	for _, fn := range callbacks {
+		fn(leader)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+// leaderChanges записывает вызовы подписчика на смену лидерства
+type leaderChanges struct {
+	mu      sync.Mutex
+	changes []bool
+}
+
+func (c *leaderChanges) record(leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.changes = append(c.changes, leader)
+}
+
+func (c *leaderChanges) get() []bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bool(nil), c.changes...)
+}
+
+func TestLeaderElector_Failover(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	interval := 10 * time.Millisecond
+
+	first := NewLeaderElector(store, "jobs", interval, zap.NewNop())
+	var firstChanges leaderChanges
+	first.OnChange(firstChanges.record)
+	first.Start()
+	require.Eventually(t, first.IsLeader, time.Second, time.Millisecond)
+
+	second := NewLeaderElector(store, "jobs", interval, zap.NewNop())
+	var secondChanges leaderChanges
+	second.OnChange(secondChanges.record)
+	second.Start()
+	defer second.Stop(context.Background())
+
+	// Блокировка занята: второй экземпляр остается ведомым
+	time.Sleep(5 * interval)
+	assert.False(t, second.IsLeader())
+	assert.Nil(t, second.Status().Since)
+
+	status := first.Status()
+	assert.Equal(t, "jobs", status.Election)
+	assert.True(t, status.Leader)
+	require.NotNil(t, status.Since)
+
+	// Остановка снимает блокировку, ведущим становится второй экземпляр
+	require.NoError(t, first.Stop(context.Background()))
+	assert.False(t, first.IsLeader())
+	assert.Equal(t, []bool{true, false}, firstChanges.get())
+
+	require.Eventually(t, second.IsLeader, time.Second, time.Millisecond)
+	assert.Equal(t, []bool{true}, secondChanges.get())
+}
+
+// flakyLeaderStorage хранилище, в котором первые сессии выборов обрываются после захвата блокировки
+type flakyLeaderStorage struct {
+	*storage.MemoryStorage
+	failures atomic.Int32
+}
+
+func (s *flakyLeaderStorage) HoldLeaderLock(ctx context.Context, name string, checkInterval time.Duration, onAcquired func()) error {
+	if s.failures.Add(-1) >= 0 {
+		onAcquired()
+		return errors.New("connection reset")
+	}
+	return s.MemoryStorage.HoldLeaderLock(ctx, name, checkInterval, onAcquired)
+}
+
+func TestLeaderElector_ReacquireAfterSessionLoss(t *testing.T) {
+	store := &flakyLeaderStorage{MemoryStorage: storage.NewMemoryStorage()}
+	store.failures.Store(1)
+
+	elector := NewLeaderElector(store, "jobs", 10*time.Millisecond, zap.NewNop())
+	var changes leaderChanges
+	elector.OnChange(changes.record)
+	elector.Start()
+	defer elector.Stop(context.Background())
+
+	// Потеря сессии снимает лидерство, после чего блокировка захватывается снова
+	require.Eventually(t, func() bool { return len(changes.get()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []bool{true, false, true}, changes.get())
+	assert.True(t, elector.IsLeader())
+}
+
+// staticLeadership лидерство, заданное тестом
+type staticLeadership struct {
+	leader atomic.Bool
+}
+
+func (l *staticLeadership) IsLeader() bool {
+	return l.leader.Load()
+}
+
+func TestOrderProcessor_LeaderOnly(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+
+	orderNumber := "12345678903"
+	accrual := models.Money(100)
+	accrualService.On(orderNumber, &models.AccrualResponse{Order: orderNumber, Status: "PROCESSED", Accrual: &accrual}, nil)
+	newTestUser(t, store, "user", 0, orderNumber)
+
+	leadership := &staticLeadership{}
+	processor := NewOrderProcessor(store, accrualService, 10*time.Millisecond, 1, zap.NewNop())
+	processor.SetLeaderOnly(leadership)
+	processor.Start()
+	defer processor.Stop(context.Background())
+
+	// Ведомый экземпляр очередь не обрабатывает
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, accrualService.Calls(orderNumber))
+
+	leadership.leader.Store(true)
+	assert.Eventually(t, func() bool {
+		order, err := store.GetOrderByNumber(context.Background(), orderNumber)
+		return err == nil && order.Status == "PROCESSED"
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestHealthHandler_Leader(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+
+	// Без выборов ведущего состояние лидерства не выводится
+	rec := httptest.NewRecorder()
+	router.GetRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response HealthResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Nil(t, response.Leader)
+
+	elector := NewLeaderElector(store, "jobs", 10*time.Millisecond, zap.NewNop())
+	router.SetLeaderElector(elector)
+	elector.Start()
+	defer elector.Stop(context.Background())
+	require.Eventually(t, elector.IsLeader, time.Second, time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	router.GetRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	response = HealthResponse{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&response))
+	assert.Equal(t, HealthStatusOK, response.Status)
+	require.NotNil(t, response.Leader)
+	assert.True(t, response.Leader.Leader)
+	assert.Equal(t, "jobs", response.Leader.Election)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"go.uber.org/zap"
+)
+
+// LedgerCheckReport итоги сверки балансов с журналом проводок
+type LedgerCheckReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Discrepancies найденные расхождения; пустой список — балансы согласованы с журналом
+	Discrepancies []models.LedgerDiscrepancy `json:"discrepancies"`
+	// Error ошибка, из-за которой сверка не выполнена
+	Error string `json:"error,omitempty"`
+}
+
+// LedgerAuditor периодически сверяет снимки балансов с журналом проводок и списаниями.
+// Баланс считается по журналу, поэтому расхождение не влияет на списания, но говорит
+// об изменении снимка в обход журнала, которое нужно разобрать.
+type LedgerAuditor struct {
+	storage    Storage
+	interval   time.Duration
+	leadership Leadership // если задано, сверки по расписанию выполняет только ведущий экземпляр
+	logger     *zap.Logger
+	stopChan   chan struct{}
+	done       chan struct{} // закрывается, когда цикл сверок завершился
+
+	mu    sync.Mutex
+	last  *LedgerCheckReport
+	runMu sync.Mutex // сверки не пересекаются
+	nowFn func() time.Time
+}
+
+// NewLedgerAuditor создает сверку балансов с журналом проводок с периодом interval
+func NewLedgerAuditor(storage Storage, interval time.Duration, logger *zap.Logger) *LedgerAuditor {
+	return &LedgerAuditor{
+		storage:  storage,
+		interval: interval,
+		logger:   logger,
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+		nowFn:    time.Now,
+	}
+}
+
+// SetLeaderOnly включает сверки по расписанию только на ведущем экземпляре: журнал общий,
+// и сверять его с каждой реплики незачем. Запуск через служебный API не ограничен.
+func (a *LedgerAuditor) SetLeaderOnly(leadership Leadership) {
+	a.leadership = leadership
+}
+
+// Interval возвращает период сверок; 0 — сверки по расписанию выключены
+func (a *LedgerAuditor) Interval() time.Duration {
+	return a.interval
+}
+
+// Start запускает сверки с периодом interval; при нулевом периоде ничего не делает
+func (a *LedgerAuditor) Start() {
+	if a.interval <= 0 {
+		close(a.done)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-a.stopChan
+		cancel()
+	}()
+
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if a.leadership != nil && !a.leadership.IsLeader() {
+					continue
+				}
+				a.Run(ctx)
+			case <-a.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop останавливает сверки и ждет завершения текущей, но не дольше ctx.
+// Вызывается после Start.
+func (a *LedgerAuditor) Stop(ctx context.Context) error {
+	close(a.stopChan)
+
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LastReport возвращает итоги последней сверки или nil, если сверок еще не было
+func (a *LedgerAuditor) LastReport() *LedgerCheckReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.last == nil {
+		return nil
+	}
+	report := *a.last
+	return &report
+}
+
+// Run сверяет балансы с журналом проводок, логирует расхождения и возвращает итоги
+func (a *LedgerAuditor) Run(ctx context.Context) LedgerCheckReport {
+	a.runMu.Lock()
+	defer a.runMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, processTimeout)
+	defer cancel()
+
+	report := LedgerCheckReport{StartedAt: a.nowFn()}
+	discrepancies, err := a.storage.CheckLedgerConsistency(ctx)
+	if err != nil {
+		a.logger.Error("Failed to check ledger consistency", zap.Error(err))
+		report.Error = err.Error()
+	}
+	report.Discrepancies = discrepancies
+	if report.Discrepancies == nil {
+		report.Discrepancies = []models.LedgerDiscrepancy{}
+	}
+	report.FinishedAt = a.nowFn()
+
+	for _, d := range discrepancies {
+		a.logger.Warn("Ledger discrepancy detected",
+			zap.Int64("userID", d.UserID),
+			zap.Int64("transactionID", d.TransactionID),
+			zap.Stringer("balance", d.BalanceAmount),
+			zap.Stringer("ledger", d.LedgerAmount))
+	}
+
+	a.mu.Lock()
+	a.last = &report
+	a.mu.Unlock()
+
+	return report
+}
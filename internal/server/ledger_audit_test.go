@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+// driftedLedgerStorage хранилище, в котором сверка с журналом находит заданные расхождения
+type driftedLedgerStorage struct {
+	*storage.MemoryStorage
+
+	mu            sync.Mutex
+	discrepancies []models.LedgerDiscrepancy
+	err           error
+	checks        atomic.Int32
+}
+
+func (s *driftedLedgerStorage) CheckLedgerConsistency(ctx context.Context) ([]models.LedgerDiscrepancy, error) {
+	s.checks.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.discrepancies, s.err
+}
+
+func (s *driftedLedgerStorage) drift(discrepancies []models.LedgerDiscrepancy, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.discrepancies, s.err = discrepancies, err
+}
+
+func TestLedgerAuditor_Run(t *testing.T) {
+	ctx := context.Background()
+	store := &driftedLedgerStorage{MemoryStorage: storage.NewMemoryStorage()}
+	auditor := NewLedgerAuditor(store, time.Hour, zap.NewNop())
+	assert.Nil(t, auditor.LastReport())
+
+	report := auditor.Run(ctx)
+	assert.Empty(t, report.Discrepancies)
+	assert.Empty(t, report.Error)
+	require.NotNil(t, auditor.LastReport())
+
+	// Снимок баланса разошелся с журналом уже после запуска
+	drifted := []models.LedgerDiscrepancy{{UserID: 1, BalanceAmount: 10100, LedgerAmount: 10000}}
+	store.drift(drifted, nil)
+	report = auditor.Run(ctx)
+	assert.Equal(t, drifted, report.Discrepancies)
+	assert.Equal(t, drifted, auditor.LastReport().Discrepancies)
+
+	store.drift(nil, errors.New("connection refused"))
+	report = auditor.Run(ctx)
+	assert.Equal(t, "connection refused", report.Error)
+}
+
+func TestLedgerAuditor_LeaderOnly(t *testing.T) {
+	store := &driftedLedgerStorage{MemoryStorage: storage.NewMemoryStorage()}
+	leadership := &staticLeadership{}
+	auditor := NewLedgerAuditor(store, time.Millisecond, zap.NewNop())
+	auditor.SetLeaderOnly(leadership)
+	auditor.Start()
+	defer auditor.Stop(context.Background())
+
+	// Ведомый экземпляр не сверяет журнал по расписанию
+	time.Sleep(20 * time.Millisecond)
+	assert.Zero(t, store.checks.Load())
+
+	leadership.leader.Store(true)
+	require.Eventually(t, func() bool { return auditor.LastReport() != nil }, time.Second, time.Millisecond)
+}
+
+func TestAdminHandlers_LedgerCheck(t *testing.T) {
+	store := &driftedLedgerStorage{MemoryStorage: storage.NewMemoryStorage()}
+	admin := NewAdminHandlers(store, zap.NewNop())
+	router := NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop())
+	router.MountAdmin(admin, "admin-token")
+	handler := router.GetRouter()
+
+	t.Run("Disabled without auditor", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodGet, "/api/admin/ledger/check", "admin-token").Code)
+		assert.Equal(t, http.StatusServiceUnavailable, adminRequest(handler, http.MethodPost, "/api/admin/ledger/check/run", "admin-token").Code)
+	})
+
+	admin.SetLedgerAuditor(NewLedgerAuditor(store, time.Hour, zap.NewNop()))
+
+	t.Run("Run and report", func(t *testing.T) {
+		store.drift([]models.LedgerDiscrepancy{{UserID: 1, BalanceAmount: 10100, LedgerAmount: 10000}}, nil)
+
+		rec := adminRequest(handler, http.MethodPost, "/api/admin/ledger/check/run", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var report LedgerCheckReport
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+		require.Len(t, report.Discrepancies, 1)
+		assert.Equal(t, int64(1), report.Discrepancies[0].UserID)
+
+		rec = adminRequest(handler, http.MethodGet, "/api/admin/ledger/check", "admin-token")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var status ledgerCheckStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		assert.Equal(t, "1h0m0s", status.Interval)
+		require.NotNil(t, status.LastRun)
+		assert.Len(t, status.LastRun.Discrepancies, 1)
+	})
+
+	t.Run("Check failure", func(t *testing.T) {
+		store.drift(nil, errors.New("connection refused"))
+		assert.Equal(t, http.StatusInternalServerError, adminRequest(handler, http.MethodPost, "/api/admin/ledger/check/run", "admin-token").Code)
+	})
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(handler, http.MethodGet, "/api/admin/ledger/check", "").Code)
+}
@@ -2,8 +2,12 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,40 +17,236 @@ import (
 	"go.uber.org/zap"
 )
 
+// Параметры повторных проверок заказа по умолчанию
+const (
+	DefaultMaxAttempts  = 10
+	DefaultRetryBackoff = time.Second
+	// maxRetryBackoff ограничивает рост задержки между проверками
+	maxRetryBackoff = time.Hour
+	// DefaultUnregisteredTimeout сколько ждать регистрации заказа в системе начисления,
+	// прежде чем ответы «заказ не зарегистрирован» начнут засчитываться как неудачные попытки
+	DefaultUnregisteredTimeout = 7 * 24 * time.Hour
+	// maxUnregisteredBackoff ограничивает задержку между проверками незарегистрированного заказа
+	maxUnregisteredBackoff = 15 * time.Minute
+)
+
+const (
+	// processTimeout ограничивает время одного прохода по очереди заказов
+	processTimeout = 30 * time.Second
+	// orderLeaseDuration срок захвата заказа; больше processTimeout, чтобы захват не истек
+	// во время обработки, и достаточно мал, чтобы заказы упавшего экземпляра быстро вернулись в очередь
+	orderLeaseDuration = 2 * processTimeout
+	// claimBatchSize число заказов, захватываемых за один запрос
+	claimBatchSize = 100
+)
+
+// Задержки переподключения подписки на новые заказы
+const (
+	listenRetryMin = time.Second
+	listenRetryMax = 30 * time.Second
+)
+
+// ErrOrderNotFound заказ, о котором сообщила система начисления, не найден
+var ErrOrderNotFound = errors.New("order not found")
+
+// errOrderCheckNotScheduled проверка заказа завершилась, но следующую не удалось назначить;
+// попытка уже учтена ProcessOrder, поэтому повторно ее не записываем
+var errOrderCheckNotScheduled = errors.New("failed to schedule next order check")
+
+// rateLimitSyncer система начисления, которая делит допустимую частоту запросов
+// между экземплярами сервиса через общее хранилище
+type rateLimitSyncer interface {
+	SyncRateLimit(ctx context.Context, store services.RateLimitStore, clientID string, ttl time.Duration) error
+}
+
+// accrualStats система начисления, которая сообщает задержку ответов и допустимый
+// интервал между запросами; по ним подбирается размер пула воркеров
+type accrualStats interface {
+	Latency() time.Duration
+	RequestInterval() time.Duration
+}
+
 // OrderProcessor обрабатывает заказы в фоновом режиме
 type OrderProcessor struct {
 	storage        Storage
 	accrualService services.AccrualServiceIface
 	interval       time.Duration
 	stopChan       chan struct{}
-	workerCount    int
+	wakeup         chan struct{} // внеочередной запуск обработки, сигналы схлопываются
+	listenRetry    time.Duration // начальная задержка переподключения подписки
+	pool           *workerPool
+	workerID       string       // идентификатор экземпляра в захватах заказов
 	nextSendTime   atomic.Int64 // время следующей отправки в наносекундах
+	maxAttempts    int
+	retryBackoff   time.Duration
+	unregistered   time.Duration // срок ожидания регистрации заказа в системе начисления
+	pushDeadline   time.Duration // сколько ждать push-уведомления, прежде чем опросить заказ
+	providers      *services.ProviderRegistry
+	shadow         *ShadowComparer
+	leadership     Leadership // если задано, очередь обрабатывает только ведущий экземпляр
+	scheduling     models.SchedulingPolicy
 	logger         *zap.Logger
+
+	// ctx отменяется, когда время на остановку истекло: прерывает запросы начатых проверок
+	ctx      context.Context
+	cancel   context.CancelFunc
+	loops    sync.WaitGroup // processLoop и listenLoop
+	stopOnce sync.Once
+
+	batchMu    sync.Mutex
+	batch      map[string]struct{} // захваченные заказы текущей пачки, еще не проверенные
+	unfinished []string            // заказы, не проверенные из-за остановки
 }
 
 // NewOrderProcessor создает новый процессор заказов
 func NewOrderProcessor(storage Storage, accrualService services.AccrualServiceIface, interval time.Duration, workerCount int, logger *zap.Logger) *OrderProcessor {
-	return &OrderProcessor{
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &OrderProcessor{
 		storage:        storage,
 		accrualService: accrualService,
 		interval:       interval,
 		stopChan:       make(chan struct{}),
-		workerCount:    workerCount,
+		wakeup:         make(chan struct{}, 1),
+		listenRetry:    listenRetryMin,
+		workerID:       newWorkerID(),
+		maxAttempts:    DefaultMaxAttempts,
+		retryBackoff:   DefaultRetryBackoff,
+		unregistered:   DefaultUnregisteredTimeout,
 		logger:         logger,
+		ctx:            ctx,
+		cancel:         cancel,
 	}
+	p.pool = newWorkerPool(ctx, workerCount, p.handleJob)
+	return p
+}
+
+// SetRetryPolicy задает число попыток проверки заказа и начальную задержку между ними.
+// Задержка удваивается после каждой неудачной попытки.
+func (p *OrderProcessor) SetRetryPolicy(maxAttempts int, backoff time.Duration) {
+	p.maxAttempts = maxAttempts
+	p.retryBackoff = backoff
+}
+
+// SetUnregisteredTimeout задает, сколько после загрузки заказ может оставаться незарегистрированным
+// в системе начисления без расхода попыток. Такой заказ проверяется повторно с задержкой,
+// растущей вместе с его возрастом; по истечении timeout ответы считаются неудачными попытками.
+func (p *OrderProcessor) SetUnregisteredTimeout(timeout time.Duration) {
+	p.unregistered = timeout
+}
+
+// SetPushDeadline включает режим push-уведомлений: заказ опрашивается, только если
+// система начисления не сообщила о нем в течение deadline после назначенной проверки
+func (p *OrderProcessor) SetPushDeadline(deadline time.Duration) {
+	p.pushDeadline = deadline
+}
+
+// SetProviders включает выбор системы начисления для каждого заказа по правилам registry.
+// Выбранная система закрепляется за заказом при первой проверке.
+func (p *OrderProcessor) SetProviders(registry *services.ProviderRegistry) {
+	p.providers = registry
+}
+
+// SetShadow включает теневой режим: каждый ответ системы начисления о заказе сравнивается
+// с ответом теневой системы comparer, применяется только ответ основной
+func (p *OrderProcessor) SetShadow(comparer *ShadowComparer) {
+	p.shadow = comparer
+}
+
+// SetLeaderOnly включает обработку очереди только на ведущем экземпляре. Нужно, когда
+// экземпляры не должны делить очередь по захватам; push-уведомления принимают все экземпляры.
+func (p *OrderProcessor) SetLeaderOnly(leadership Leadership) {
+	p.leadership = leadership
+}
+
+// SetSchedulingPolicy задает правила справедливой очереди: веса тарифов и повышение
+// приоритета недавних и просматриваемых заказов. Без вызова заказы пользователей
+// чередуются поровну без повышений.
+func (p *OrderProcessor) SetSchedulingPolicy(policy models.SchedulingPolicy) {
+	p.scheduling = policy
+}
+
+// SetWorkerBounds включает автоматический подбор числа воркеров между minWorkers и maxWorkers
+// по очереди заказов, задержке ответов и допустимой частоте запросов к системе начисления
+func (p *OrderProcessor) SetWorkerBounds(minWorkers, maxWorkers int) error {
+	return p.pool.setBounds(minWorkers, maxWorkers)
+}
+
+// PinWorkers закрепляет число воркеров и выключает автоматический подбор до следующего SetWorkerBounds
+func (p *OrderProcessor) PinWorkers(workers int) error {
+	return p.pool.pin(workers)
+}
+
+// WorkerPoolStatus возвращает состояние пула воркеров
+func (p *OrderProcessor) WorkerPoolStatus() WorkerPoolStatus {
+	return p.pool.status()
 }
 
 // Start запускает обработку заказов
 func (p *OrderProcessor) Start() {
-	go p.processLoop()
+	p.loops.Add(2)
+	go func() {
+		defer p.loops.Done()
+		p.processLoop()
+	}()
+	go func() {
+		defer p.loops.Done()
+		p.listenLoop()
+	}()
+}
+
+// Stop останавливает обработку заказов: новые заказы не захватываются, начатые проверки
+// дорабатывают, захват с оставшихся заказов снимается. Если ctx истекает раньше,
+// запросы начатых проверок прерываются, и Stop дожидается освобождения заказов.
+// Возвращает номера захваченных заказов, которые не были проверены; после возврата
+// процессор не обращается к хранилищу.
+func (p *OrderProcessor) Stop(ctx context.Context) ([]string, error) {
+	p.stopOnce.Do(func() {
+		close(p.stopChan)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		p.loops.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.cancel()
+		<-done
+		err = ctx.Err()
+	}
+	p.cancel()
+
+	p.batchMu.Lock()
+	defer p.batchMu.Unlock()
+	unfinished := slices.Clone(p.unfinished)
+	slices.Sort(unfinished)
+	return unfinished, err
 }
 
-// Stop останавливает обработку заказов
-func (p *OrderProcessor) Stop() {
-	close(p.stopChan)
+// stopping сообщает, что процессор останавливается
+func (p *OrderProcessor) stopping() bool {
+	select {
+	case <-p.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wake запускает обработку, не дожидаясь очередного тика.
+// Повторные вызовы до начала обработки схлопываются в один запуск.
+func (p *OrderProcessor) Wake() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
 }
 
-// processLoop основной цикл обработки
+// processLoop основной цикл обработки: по тику и по сигналу о новых заказах
 func (p *OrderProcessor) processLoop() {
 	ticker := time.NewTicker(p.interval)
 	defer ticker.Stop()
@@ -54,46 +254,98 @@ func (p *OrderProcessor) processLoop() {
 	for {
 		select {
 		case <-ticker.C:
-			// Проверяем, не нужно ли подождать из-за rate limit
-			nextSend := p.nextSendTime.Load()
-			if nextSend > 0 {
-				now := time.Now().UnixNano()
-				if now < nextSend {
-					waitTime := time.Duration(nextSend - now)
-					p.logger.Info("Rate limit detected, waiting for cooldown", zap.Duration("cooldown", waitTime))
-
-					timer := time.NewTimer(waitTime)
-					select {
-					case <-timer.C:
-						// Время ожидания истекло
-					case <-p.stopChan:
-						timer.Stop()
-						return
-					}
+		case <-p.wakeup:
+		case <-p.stopChan:
+			return
+		}
+
+		// Ведомый экземпляр очередь не обрабатывает; став ведущим, его будит подписка на лидерство
+		if p.leadership != nil && !p.leadership.IsLeader() {
+			continue
+		}
+
+		// Проверяем, не нужно ли подождать из-за rate limit или разомкнутого выключателя
+		nextSend := p.nextSendTime.Load()
+		if nextSend > 0 {
+			now := time.Now().UnixNano()
+			if now < nextSend {
+				waitTime := time.Duration(nextSend - now)
+				p.logger.Info("Accrual requests paused, waiting for cooldown", zap.Duration("cooldown", waitTime))
+
+				timer := time.NewTimer(waitTime)
+				select {
+				case <-timer.C:
+					// Время ожидания истекло
+				case <-p.stopChan:
+					timer.Stop()
+					return
 				}
-				// Сбрасываем время следующей отправки
-				p.nextSendTime.Store(0)
 			}
-			p.ProcessOrders()
-		case <-p.stopChan:
+			// Сбрасываем время следующей отправки
+			p.nextSendTime.Store(0)
+		}
+		p.ProcessOrders()
+	}
+}
+
+// listenLoop подписывается на создание заказов и будит processLoop.
+// При обрыве подписки переподключается с нарастающей задержкой; тикер processLoop
+// продолжает работать, поэтому заказы обрабатываются и без подписки.
+func (p *OrderProcessor) listenLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stopChan
+		cancel()
+	}()
+
+	delay := p.listenRetry
+	for {
+		notified := false
+		err := p.storage.ListenNewOrders(ctx, func() {
+			notified = true
+			p.Wake()
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Подписка работала, начинаем отсчет задержек заново
+		if notified {
+			delay = p.listenRetry
+		}
+		p.logger.Warn("New orders subscription lost, reconnecting",
+			zap.Duration("delay", delay),
+			zap.Error(err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
 			return
 		}
+		delay = min(delay*2, listenRetryMax)
+
+		// Уведомления, отправленные без подписки, потеряны: проверяем очередь сразу
+		p.Wake()
 	}
 }
 
-// ProcessOrders обрабатывает заказы со статусом NEW и PROCESSING
+// ProcessOrders обрабатывает заказы со статусом NEW и PROCESSING.
+// Заказы захватываются пачками, поэтому несколько экземпляров сервиса
+// делят очередь и не опрашивают систему начисления об одном заказе дважды.
 func (p *OrderProcessor) ProcessOrders() {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(p.ctx, processTimeout)
 	defer cancel()
 
-	const batchSize = 100
-	offset := 0
+	p.syncRateLimit(ctx)
+	p.autoscaleWorkers(ctx)
 
 	for {
-		// Получаем заказы со статусом NEW и PROCESSING с пагинацией
-		orders, err := p.storage.GetOrdersByStatusPaginated(ctx, []string{"NEW", "PROCESSING"}, batchSize, offset)
+		orders, err := p.storage.ClaimOrders(ctx, models.PendingOrderStatuses, p.workerID, time.Now().Add(-p.pushDeadline), claimBatchSize, orderLeaseDuration, p.scheduling)
 		if err != nil {
-			p.logger.Error("Failed to get orders for processing", zap.Error(err))
+			p.logger.Error("Failed to claim orders for processing", zap.Error(err))
 			return
 		}
 
@@ -103,142 +355,483 @@ func (p *OrderProcessor) ProcessOrders() {
 
 		p.logger.Info("Processing batch of orders",
 			zap.Int("count", len(orders)),
-			zap.Int("offset", offset),
-			zap.Int("workers", p.workerCount))
+			zap.String("workerID", p.workerID),
+			zap.Int("workers", p.pool.status().Size))
 
+		p.startBatch(orders)
 		p.ProcessOrdersWithWorkers(ctx, orders)
+		p.releaseOrders(ctx, orders)
+		p.finishBatch()
 
-		if len(orders) < batchSize {
+		// Остальные заказы дождутся следующего прохода
+		if len(orders) < claimBatchSize || p.paused() || p.stopping() || ctx.Err() != nil {
 			break
 		}
+	}
+}
+
+// startBatch запоминает захваченные заказы пачки
+func (p *OrderProcessor) startBatch(orders []models.Order) {
+	p.batchMu.Lock()
+	defer p.batchMu.Unlock()
 
-		offset += batchSize
+	p.batch = make(map[string]struct{}, len(orders))
+	for _, order := range orders {
+		p.batch[order.Number] = struct{}{}
 	}
 }
 
-// ProcessOrdersWithWorkers обрабатывает заказы параллельно
-func (p *OrderProcessor) ProcessOrdersWithWorkers(ctx context.Context, orders []models.Order) {
-	// Канал для передачи заказов воркерам
-	orderChan := make(chan models.Order, len(orders))
+// orderChecked отмечает, что проверка заказа завершена
+func (p *OrderProcessor) orderChecked(number string) {
+	p.batchMu.Lock()
+	defer p.batchMu.Unlock()
 
-	// WaitGroup для ожидания завершения всех воркеров
-	var wg sync.WaitGroup
+	delete(p.batch, number)
+}
 
-	// Запускаем воркеры
-	for i := 0; i < p.workerCount; i++ {
-		wg.Add(1)
-		go p.worker(ctx, orderChan, &wg)
+// finishBatch завершает пачку. Непроверенные заказы остаются в очереди; если пачка
+// прервана остановкой, они запоминаются для отчета Stop.
+func (p *OrderProcessor) finishBatch() {
+	p.batchMu.Lock()
+	defer p.batchMu.Unlock()
+
+	if p.stopping() {
+		for number := range p.batch {
+			p.unfinished = append(p.unfinished, number)
+		}
 	}
+	p.batch = nil
+}
 
-	// Отправляем заказы в канал
-	go func() {
-		defer close(orderChan)
-		for _, order := range orders {
-			select {
-			case orderChan <- order:
-			case <-ctx.Done():
-				return
-			}
+// syncRateLimit обменивается с другими экземплярами узнанной частотой запросов к системе начисления.
+// Экземпляр считается активным, пока проходы повторяются; отметка живет несколько интервалов.
+func (p *OrderProcessor) syncRateLimit(ctx context.Context) {
+	syncers := map[string]rateLimitSyncer{}
+	if p.providers != nil {
+		for _, name := range p.providers.Names() {
+			service, _ := p.providers.Provider(name)
+			syncers[name] = service
 		}
-	}()
+	} else if syncer, ok := p.accrualService.(rateLimitSyncer); ok {
+		syncers[""] = syncer
+	}
 
-	wg.Wait()
+	ttl := max(3*p.interval, time.Minute)
+	for name, syncer := range syncers {
+		if err := syncer.SyncRateLimit(ctx, p.storage, p.workerID, ttl); err != nil {
+			// Без синхронизации экземпляр продолжает работать с последней известной частотой
+			p.logger.Warn("Failed to sync accrual rate limit", zap.String("provider", name), zap.Error(err))
+		}
+	}
 }
 
-// worker обрабатывает заказы из канала
-func (p *OrderProcessor) worker(ctx context.Context, orderChan <-chan models.Order, wg *sync.WaitGroup) {
-	defer wg.Done()
+// autoscaleWorkers подбирает размер пула так, чтобы очередь разбиралась за интервал обработки
+func (p *OrderProcessor) autoscaleWorkers(ctx context.Context) {
+	if !p.pool.autoscaling() {
+		return
+	}
 
-	for {
-		select {
-		case order, ok := <-orderChan:
-			if !ok {
-				return
-			}
+	backlog, err := p.storage.CountDueOrders(ctx, models.PendingOrderStatuses, time.Now().Add(-p.pushDeadline))
+	if err != nil {
+		p.logger.Warn("Failed to count due orders, worker pool size unchanged", zap.Error(err))
+		return
+	}
 
-			// Проверяем, не нужно ли подождать из-за rate limit
-			nextSend := p.nextSendTime.Load()
-			if nextSend > 0 {
-				now := time.Now().UnixNano()
-				if now < nextSend {
-					// Воркер завершает работу, так как есть rate limit
-					return
-				}
-			}
+	latency, interval := p.accrualStats()
+	before, after := p.pool.autoscale(backlog, latency, interval, p.interval, p.paused())
+	if before != after {
+		p.logger.Info("Worker pool resized",
+			zap.Int("from", before),
+			zap.Int("to", after),
+			zap.Int("backlog", backlog),
+			zap.Duration("latency", latency),
+			zap.Duration("requestInterval", interval))
+	}
+}
 
-			if err := p.ProcessOrder(ctx, order.Number); err != nil {
-				var rateLimitErr *services.RateLimitError
-				if errors.As(err, &rateLimitErr) {
-					p.logger.Info("Rate limit exceeded, worker stopping",
-						zap.Duration("retryAfter", rateLimitErr.RetryAfter))
+// accrualStats возвращает задержку ответов систем начисления и интервал между запросами,
+// допустимый всеми системами вместе; 0 — неизвестно или без ограничения
+func (p *OrderProcessor) accrualStats() (time.Duration, time.Duration) {
+	var stats []accrualStats
+	if p.providers != nil {
+		for _, name := range p.providers.Names() {
+			service, _ := p.providers.Provider(name)
+			stats = append(stats, service)
+		}
+	} else if s, ok := p.accrualService.(accrualStats); ok {
+		stats = append(stats, s)
+	}
 
-					// Устанавливаем время следующей отправки
-					nextSendTime := time.Now().Add(rateLimitErr.RetryAfter).UnixNano()
-					p.nextSendTime.Store(nextSendTime)
-					return
-				}
-				p.logger.Error("Failed to process order",
-					zap.String("orderNumber", order.Number),
-					zap.Error(err))
-			}
+	// Системы ограничивают частоту независимо: допустимые частоты складываются,
+	// а задержка берется наибольшая, чтобы воркеров хватило на самую медленную
+	var latency time.Duration
+	var perSecond float64
+	limited := len(stats) > 0
+	for _, s := range stats {
+		latency = max(latency, s.Latency())
+		interval := s.RequestInterval()
+		if interval <= 0 {
+			limited = false
+			continue
+		}
+		perSecond += float64(time.Second) / float64(interval)
+	}
+	if !limited {
+		return latency, 0
+	}
+	return latency, time.Duration(float64(time.Second) / perSecond)
+}
 
-		case <-ctx.Done():
-			return
+// accrualServiceFor возвращает систему начисления, которая проверяет заказ,
+// и закрепляет ее за заказом при первой проверке
+func (p *OrderProcessor) accrualServiceFor(ctx context.Context, order *models.Order) (services.AccrualServiceIface, error) {
+	if p.providers == nil {
+		return p.accrualService, nil
+	}
+
+	name := p.providers.Route(order)
+	if order.AccrualProvider == "" {
+		assigned, err := p.storage.AssignOrderProvider(ctx, order.Number, name)
+		if err != nil {
+			return nil, err
+		}
+		name = assigned
+		order.AccrualProvider = assigned
+	}
+
+	return p.providers.Provider(name)
+}
+
+// releaseOrders снимает захват с заказов пачки. Заказы, оставшиеся в очереди,
+// проверяются снова не раньше следующего тика, чтобы текущий проход не захватил их повторно.
+func (p *OrderProcessor) releaseOrders(ctx context.Context, orders []models.Order) {
+	numbers := make([]string, len(orders))
+	for i, order := range orders {
+		numbers[i] = order.Number
+	}
+
+	// Освобождаем заказы, даже если время прохода истекло
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	if err := p.storage.ReleaseOrders(releaseCtx, p.workerID, numbers, time.Now().Add(p.interval)); err != nil {
+		// Захват снимется сам по истечении срока аренды
+		p.logger.Error("Failed to release orders", zap.Error(err))
+	}
+}
+
+// paused сообщает, что запросы к системе начисления приостановлены:
+// система попросила подождать или разомкнут выключатель
+func (p *OrderProcessor) paused() bool {
+	return time.Now().UnixNano() < p.nextSendTime.Load()
+}
+
+// pause приостанавливает запросы к системе начисления на время d
+func (p *OrderProcessor) pause(d time.Duration) {
+	p.nextSendTime.Store(time.Now().Add(d).UnixNano())
+}
+
+// WorkerID возвращает идентификатор экземпляра, под которым захватываются заказы
+func (p *OrderProcessor) WorkerID() string {
+	return p.workerID
+}
+
+// ProcessOrdersWithWorkers обрабатывает заказы параллельно воркерами пула и ждет завершения.
+// Если запросы к системе начисления приостановлены или процессор останавливается,
+// оставшиеся заказы не обрабатываются и дождутся следующего прохода.
+func (p *OrderProcessor) ProcessOrdersWithWorkers(ctx context.Context, orders []models.Order) {
+	p.pool.start()
+
+	var wg sync.WaitGroup
+	for _, order := range orders {
+		if p.paused() || p.stopping() {
+			break
+		}
+		wg.Add(1)
+		if !p.pool.submit(ctx, p.stopChan, workerJob{ctx: ctx, order: order, done: wg.Done}) {
+			wg.Done()
+			break
 		}
 	}
+
+	wg.Wait()
+}
+
+// handleJob обрабатывает заказ, переданный воркеру пула
+func (p *OrderProcessor) handleJob(job workerJob) {
+	defer job.done()
+	ctx, order := job.ctx, job.order
+
+	// Пока заказ ждал воркера, проход мог завершиться или запросы приостановиться
+	if ctx.Err() != nil || p.stopping() || p.paused() {
+		return
+	}
+
+	err := p.ProcessOrder(ctx, order.Number)
+	if err != nil && ctx.Err() != nil {
+		// Проход прерван: заказ остается в очереди, попытка не засчитывается
+		return
+	}
+	p.orderChecked(order.Number)
+	if err == nil {
+		return
+	}
+
+	// У каждой системы начисления свои ограничитель и выключатель: заказы недоступной
+	// системы отклоняются без запросов, а заказы остальных систем продолжают проверяться
+	if p.providers != nil && (errors.Is(err, services.ErrRateLimitExceeded) || errors.Is(err, services.ErrCircuitOpen)) {
+		p.logger.Debug("Accrual provider unavailable, order skipped",
+			zap.String("orderNumber", order.Number),
+			zap.Error(err))
+		return
+	}
+
+	var rateLimitErr *services.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		p.logger.Info("Rate limit exceeded, order processing paused",
+			zap.Duration("retryAfter", rateLimitErr.RetryAfter),
+			zap.Int("limit", rateLimitErr.Limit))
+
+		// Устанавливаем время следующей отправки
+		p.pause(rateLimitErr.RetryAfter)
+		return
+	}
+	var circuitErr *services.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		// Система начисления недоступна: прекращаем весь проход, заказы остаются в очереди
+		p.logger.Warn("Accrual circuit breaker is open, order processing paused",
+			zap.Duration("retryAfter", circuitErr.RetryAfter))
+		p.pause(circuitErr.RetryAfter)
+		return
+	}
+	if errors.Is(err, errOrderCheckNotScheduled) {
+		p.logger.Error("Failed to record order failure",
+			zap.String("orderNumber", order.Number),
+			zap.Error(err))
+		return
+	}
+	p.logger.Error("Failed to process order",
+		zap.String("orderNumber", order.Number),
+		zap.Error(err))
+
+	// Ошибка обработки считается неудачной попыткой: заказ проверяется позже
+	// с нарастающей задержкой, а после исчерпания попыток попадает в очередь недоставленных
+	if err := p.scheduleRetry(ctx, &order, err.Error()); err != nil {
+		p.logger.Error("Failed to record order failure",
+			zap.String("orderNumber", order.Number),
+			zap.Error(err))
+	}
 }
 
 // ProcessOrder обрабатывает конкретный заказ
 func (p *OrderProcessor) ProcessOrder(ctx context.Context, orderNumber string) error {
+	order, err := p.storage.GetOrderByNumber(ctx, orderNumber)
+	if err != nil {
+		return fmt.Errorf("failed to get order: %w", err)
+	}
+	if order == nil {
+		return fmt.Errorf("order %s not found", orderNumber)
+	}
+
+	accrualService, err := p.accrualServiceFor(ctx, order)
+	if err != nil {
+		return fmt.Errorf("failed to choose accrual provider: %w", err)
+	}
+
 	// Получаем информацию о заказе из системы начисления
-	accrualInfo, err := p.accrualService.GetOrderInfo(ctx, orderNumber)
+	accrualInfo, err := accrualService.GetOrderInfo(ctx, orderNumber)
 	if err != nil {
-		// Если ошибка связана с превышением лимита запросов, не обновляем статус
-		if errors.Is(err, services.ErrRateLimitExceeded) {
+		// Если превышен лимит запросов или выключатель разомкнут, заказ не виноват: не обновляем его
+		if errors.Is(err, services.ErrRateLimitExceeded) || errors.Is(err, services.ErrCircuitOpen) {
+			return err
+		}
+		// Проверка прервана остановкой или истечением прохода: заказ не виноват
+		if ctx.Err() != nil {
 			return err
 		}
 
-		// Обновляем статус на INVALID
-		return p.storage.UpdateOrderStatus(ctx, orderNumber, "INVALID", nil)
+		// Остальные ошибки временные: заказ проверяется повторно позже
+		return p.scheduleRetry(ctx, order, err.Error())
+	}
+	if p.shadow != nil {
+		p.shadow.Compare(ctx, models.AccrualEventPoll, orderNumber, accrualInfo)
 	}
 
 	if accrualInfo == nil {
-		// Заказ не найден в системе начисления
-		return p.storage.UpdateOrderStatus(ctx, orderNumber, "INVALID", nil)
+		// Заказ еще не зарегистрирован в системе начисления
+		return p.deferUnregistered(ctx, order)
+	}
+
+	return p.applyAccrualInfo(ctx, order, accrualInfo)
+}
+
+// ApplyAccrualUpdate применяет результат расчета, присланный системой начисления,
+// так же, как результат опроса в ProcessOrder. Возвращает ErrOrderNotFound, если заказа нет.
+func (p *OrderProcessor) ApplyAccrualUpdate(ctx context.Context, update *models.AccrualResponse) error {
+	order, err := p.storage.GetOrderByNumber(ctx, update.Order)
+	if err != nil {
+		return fmt.Errorf("failed to get order: %w", err)
+	}
+	if order == nil {
+		return ErrOrderNotFound
+	}
+	if p.shadow != nil {
+		p.shadow.Compare(ctx, models.AccrualEventCallback, update.Order, update)
+	}
+
+	return p.applyAccrualInfo(ctx, order, update)
+}
+
+// applyAccrualInfo переводит заказ в статус, соответствующий ответу системы начисления,
+// и начисляет баллы обработанному заказу
+func (p *OrderProcessor) applyAccrualInfo(ctx context.Context, order *models.Order, accrualInfo *models.AccrualResponse) error {
+	orderNumber := order.Number
+	status, err := models.MapAccrualStatus(accrualInfo.Status)
+	if err != nil {
+		p.logger.Warn("Refusing order status transition",
+			zap.String("orderNumber", orderNumber),
+			zap.String("from", order.Status),
+			zap.String("accrualStatus", accrualInfo.Status),
+			zap.Error(err))
+		return nil
 	}
 
-	// Обновляем статус и начисление
-	var accrual *float64
-	if accrualInfo.Accrual != nil {
+	// Обновляем статус и начисление; начисление есть только у обработанного заказа
+	var accrual *models.Money
+	if status == models.OrderStatusProcessed && accrualInfo.Accrual != nil {
 		accrual = accrualInfo.Accrual
 	}
 
-	// Если заказ обработан и есть начисление, обновляем статус и баланс в одной транзакции
-	if accrualInfo.Status == "PROCESSED" && accrual != nil && *accrual > 0 {
-		// Получаем заказ для определения пользователя
-		order, err := p.storage.GetOrderByNumber(ctx, orderNumber)
-		if err != nil {
-			return fmt.Errorf("failed to get order for balance update: %w", err)
+	// Если заказ обработан и есть начисление, переводим его в PROCESSED и начисляем баллы атомарно.
+	// Баланс увеличивается в хранилище, поэтому конкурентные начисления не теряются,
+	// а повторная обработка того же заказа не приводит к повторному начислению
+	if status == models.OrderStatusProcessed && accrual != nil && *accrual > 0 {
+		if err := models.ValidateOrderTransition(order.Status, status); err != nil {
+			p.refuseTransition(order, status, err)
+			return nil
 		}
 
-		// Получаем текущий баланс
-		balance, err := p.storage.GetBalance(ctx, order.UserID)
+		credited, err := p.storage.CreditOrderAccrual(ctx, orderNumber, *accrual)
 		if err != nil {
-			return fmt.Errorf("failed to get balance: %w", err)
-		}
-
-		// Обновляем статус заказа и баланс пользователя атомарно
-		newCurrent := balance.Current + *accrual
-		if err := p.storage.UpdateOrderStatusAndBalance(ctx, orderNumber, accrualInfo.Status, accrual, order.UserID, newCurrent, balance.Withdrawn); err != nil {
 			return fmt.Errorf("failed to update order status and balance transactionally: %w", err)
 		}
+		if !credited {
+			p.logger.Info("Order already credited, skipping",
+				zap.String("orderNumber", orderNumber))
+		}
 		return nil
 	}
 
 	// В остальных случаях просто обновляем статус заказа
-	if err := p.storage.UpdateOrderStatus(ctx, orderNumber, accrualInfo.Status, accrual); err != nil {
+	return p.transitionOrder(ctx, order, status, accrual)
+}
+
+// transitionOrder переводит заказ в новый статус, если переход допустим
+// и статус заказа не изменился с момента чтения
+func (p *OrderProcessor) transitionOrder(ctx context.Context, order *models.Order, status string, accrual *models.Money) error {
+	if err := models.ValidateOrderTransition(order.Status, status); err != nil {
+		p.refuseTransition(order, status, err)
+		return nil
+	}
+
+	// Статус не изменился и сбрасывать счетчик попыток не нужно, обновлять нечего
+	if order.Status == status && accrual == nil && order.Attempts == 0 {
+		return nil
+	}
+
+	updated, err := p.storage.TransitionOrderStatus(ctx, order.Number, order.Status, status, accrual)
+	if err != nil {
 		return fmt.Errorf("failed to update order status: %w", err)
 	}
+	if !updated {
+		p.refuseTransition(order, status, errors.New("order status changed concurrently"))
+	}
 
 	return nil
 }
+
+// scheduleRetry откладывает повторную проверку заказа с экспоненциальной задержкой.
+// После исчерпания попыток заказ больше не проверяется, но и не становится INVALID:
+// он попадает в очередь недоставленных и ждет ручного разбора.
+func (p *OrderProcessor) scheduleRetry(ctx context.Context, order *models.Order, reason string) error {
+	attempts := order.Attempts + 1
+
+	var nextCheckAt *time.Time
+	if attempts < p.maxAttempts {
+		delay := p.retryDelay(attempts)
+		next := time.Now().Add(delay)
+		nextCheckAt = &next
+		p.logger.Warn("Accrual check failed, retry scheduled",
+			zap.String("orderNumber", order.Number),
+			zap.Int("attempts", attempts),
+			zap.Duration("delay", delay),
+			zap.String("reason", reason))
+	} else {
+		p.logger.Error("Order check attempts exhausted, order moved to dead letter queue",
+			zap.String("orderNumber", order.Number),
+			zap.Int("attempts", attempts),
+			zap.String("reason", reason))
+	}
+
+	if err := p.storage.ScheduleOrderRetry(ctx, order.Number, reason, nextCheckAt); err != nil {
+		return fmt.Errorf("%w: %w", errOrderCheckNotScheduled, err)
+	}
+
+	return nil
+}
+
+// deferUnregistered откладывает проверку заказа, который система начисления еще не зарегистрировала.
+// Регистрация может запаздывать, поэтому такой ответ не расходует попытки, пока заказ моложе
+// срока ожидания; после него заказ, видимо, так и не будет зарегистрирован и проверяется как неудачный.
+func (p *OrderProcessor) deferUnregistered(ctx context.Context, order *models.Order) error {
+	const reason = "order is not registered in accrual system"
+
+	age := time.Since(order.UploadedAt)
+	if age >= p.unregistered {
+		return p.scheduleRetry(ctx, order, reason)
+	}
+
+	// Чем дольше заказ не регистрируется, тем реже его имеет смысл проверять
+	delay := max(p.retryBackoff, min(age/4, maxUnregisteredBackoff))
+	p.logger.Debug("Order is not registered in accrual system yet, check deferred",
+		zap.String("orderNumber", order.Number),
+		zap.Duration("age", age),
+		zap.Duration("delay", delay))
+
+	if err := p.storage.DeferOrderCheck(ctx, order.Number, reason, time.Now().Add(delay)); err != nil {
+		return fmt.Errorf("%w: %w", errOrderCheckNotScheduled, err)
+	}
+
+	return nil
+}
+
+// retryDelay возвращает задержку перед следующей проверкой после attempts неудачных попыток
+func (p *OrderProcessor) retryDelay(attempts int) time.Duration {
+	delay := p.retryBackoff
+	for i := 1; i < attempts && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryBackoff)
+}
+
+// refuseTransition логирует отклоненную смену статуса заказа
+func (p *OrderProcessor) refuseTransition(order *models.Order, status string, reason error) {
+	p.logger.Warn("Refusing order status transition",
+		zap.String("orderNumber", order.Number),
+		zap.String("from", order.Status),
+		zap.String("to", status),
+		zap.Error(reason))
+}
+
+// newWorkerID формирует идентификатор экземпляра: хост, процесс и случайный суффикс
+func newWorkerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
@@ -4,324 +4,1156 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/accrualsim"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
-	servicesmocks "github.com/vglushak/go-musthave-diploma-tpl/internal/services/mocks"
-	storagemocks "github.com/vglushak/go-musthave-diploma-tpl/internal/storage/mocks"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
 	"go.uber.org/zap"
 )
 
+// stubAccrualResult заранее заданный ответ системы начисления
+type stubAccrualResult struct {
+	resp *models.AccrualResponse
+	err  error
+}
+
+// stubAccrualService заглушка системы начисления с заранее заданными ответами.
+// Для неизвестных заказов возвращает nil, nil, как при ответе 204.
+type stubAccrualService struct {
+	mu        sync.Mutex
+	responses map[string]stubAccrualResult
+	calls     map[string]int
+}
+
+func newStubAccrualService() *stubAccrualService {
+	return &stubAccrualService{
+		responses: make(map[string]stubAccrualResult),
+		calls:     make(map[string]int),
+	}
+}
+
+// On задает ответ для номера заказа
+func (s *stubAccrualService) On(orderNumber string, resp *models.AccrualResponse, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[orderNumber] = stubAccrualResult{resp: resp, err: err}
+}
+
+// Calls возвращает количество запросов по номеру заказа
+func (s *stubAccrualService) Calls(orderNumber string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[orderNumber]
+}
+
+func (s *stubAccrualService) GetOrderInfo(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[orderNumber]++
+	result := s.responses[orderNumber]
+	return result.resp, result.err
+}
+
+// failingBalanceStorage хранилище, в котором атомарное обновление баланса всегда завершается ошибкой
+type failingBalanceStorage struct {
+	*storage.MemoryStorage
+	err error
+}
+
+func (s *failingBalanceStorage) CreditOrderAccrual(ctx context.Context, orderNumber string, accrual models.Money) (bool, error) {
+	return false, s.err
+}
+
+// failingRetryStorage хранилище, в котором назначение повторной проверки всегда завершается ошибкой
+type failingRetryStorage struct {
+	*storage.MemoryStorage
+	calls atomic.Int32
+}
+
+func (s *failingRetryStorage) ScheduleOrderRetry(ctx context.Context, number string, lastError string, nextCheckAt *time.Time) error {
+	s.calls.Add(1)
+	return errors.New("storage unavailable")
+}
+
+// newTestUser создает пользователя с начальным балансом и заказами в статусе NEW
+func newTestUser(t *testing.T, store Storage, login string, current models.Money, orderNumbers ...string) int64 {
+	t.Helper()
+	ctx := context.Background()
+
+	user, err := store.CreateUser(ctx, login, "hash")
+	require.NoError(t, err)
+	require.NoError(t, store.AdjustBalance(ctx, user.ID, current))
+
+	for _, number := range orderNumbers {
+		_, err := store.CreateOrder(ctx, user.ID, number)
+		require.NoError(t, err)
+	}
+
+	return user.ID
+}
+
 func TestNewOrderProcessor(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
 	interval := 5 * time.Second
 
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, interval, 5, zap.NewNop())
+	processor := NewOrderProcessor(store, accrualService, interval, 5, zap.NewNop())
 
 	assert.NotNil(t, processor)
-	assert.Equal(t, mockStorage, processor.storage)
-	assert.Equal(t, mockAccrualService, processor.accrualService)
+	assert.Equal(t, store, processor.storage)
+	assert.Equal(t, accrualService, processor.accrualService)
 	assert.Equal(t, interval, processor.interval)
 	assert.NotNil(t, processor.stopChan)
 }
 
 func TestOrderProcessor_StartStop(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
 	interval := 100 * time.Millisecond
 
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, interval, 5, zap.NewNop())
+	processor := NewOrderProcessor(store, accrualService, interval, 5, zap.NewNop())
 
 	processor.Start()
 
 	time.Sleep(50 * time.Millisecond)
 
-	processor.Stop()
+	unfinished, err := processor.Stop(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, unfinished)
 
-	time.Sleep(50 * time.Millisecond)
+	// Повторная остановка безопасна
+	_, err = processor.Stop(context.Background())
+	require.NoError(t, err)
+}
+
+// blockingAccrualService система начисления, которая отвечает PROCESSED только после release
+// или прерывает запрос по отмене контекста
+type blockingAccrualService struct {
+	started chan string
+	release chan struct{}
+}
+
+func newBlockingAccrualService() *blockingAccrualService {
+	return &blockingAccrualService{
+		started: make(chan string, 10),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *blockingAccrualService) GetOrderInfo(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	s.started <- orderNumber
+	select {
+	case <-s.release:
+		accrual := models.Money(100)
+		return &models.AccrualResponse{Order: orderNumber, Status: "PROCESSED", Accrual: &accrual}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestOrderProcessor_StopDrainsInFlightOrders(t *testing.T) {
+	orderNumbers := []string{"12345678903", "79927398713", "2377225624"}
+
+	t.Run("In-flight order completes", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		accrualService := newBlockingAccrualService()
+		newTestUser(t, store, "user", 0, orderNumbers...)
+
+		processor := NewOrderProcessor(store, accrualService, time.Hour, 1, zap.NewNop())
+		processor.Start()
+		processor.Wake()
+
+		var inFlight string
+		select {
+		case inFlight = <-accrualService.started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("order processing did not start")
+		}
+
+		type stopResult struct {
+			unfinished []string
+			err        error
+		}
+		stopped := make(chan stopResult, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			unfinished, err := processor.Stop(ctx)
+			stopped <- stopResult{unfinished, err}
+		}()
+
+		// Stop ждет начатую проверку
+		select {
+		case <-stopped:
+			t.Fatal("Stop returned before the in-flight order was checked")
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(accrualService.release)
+
+		result := <-stopped
+		require.NoError(t, result.err)
+		assert.Len(t, result.unfinished, 2)
+		assert.NotContains(t, result.unfinished, inFlight)
+
+		order, err := store.GetOrderByNumber(context.Background(), inFlight)
+		require.NoError(t, err)
+		assert.Equal(t, "PROCESSED", order.Status)
+
+		// Остальные заказы не проверялись и возвращены в очередь
+		for _, number := range result.unfinished {
+			order, err := store.GetOrderByNumber(context.Background(), number)
+			require.NoError(t, err)
+			assert.Equal(t, "NEW", order.Status)
+			assert.Empty(t, order.LockedBy)
+		}
+	})
+
+	t.Run("Budget exceeded", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		accrualService := newBlockingAccrualService()
+		newTestUser(t, store, "user", 0, orderNumbers...)
+
+		processor := NewOrderProcessor(store, accrualService, time.Hour, 1, zap.NewNop())
+		processor.Start()
+		processor.Wake()
+
+		select {
+		case <-accrualService.started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("order processing did not start")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		unfinished, err := processor.Stop(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ElementsMatch(t, orderNumbers, unfinished)
+
+		// Прерванная проверка не считается неудачной попыткой
+		for _, number := range orderNumbers {
+			order, err := store.GetOrderByNumber(context.Background(), number)
+			require.NoError(t, err)
+			assert.Equal(t, "NEW", order.Status)
+			assert.Zero(t, order.Attempts)
+			assert.Empty(t, order.LockedBy)
+		}
+	})
 }
 
 func TestOrderProcessor_ProcessOrder_Success(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
-	accrualValue := 100.0
-	userID := int64(1)
+	accrualValue := models.Money(10000)
+	userID := newTestUser(t, store, "user", models.Money(5000), orderNumber)
 
-	// Настраиваем моки
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(&models.AccrualResponse{
+	accrualService.On(orderNumber, &models.AccrualResponse{
 		Order:   orderNumber,
 		Status:  "PROCESSED",
 		Accrual: &accrualValue,
 	}, nil)
 
-	// Добавляем ожидания для получения заказа и баланса
-	mockStorage.EXPECT().GetOrderByNumber(ctx, orderNumber).Return(&models.Order{
-		ID:     1,
-		UserID: userID,
-		Number: orderNumber,
-		Status: "NEW",
-	}, nil)
+	err := processor.ProcessOrder(ctx, orderNumber)
+	require.NoError(t, err)
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	require.NotNil(t, order.Accrual)
+	assert.Equal(t, accrualValue, *order.Accrual)
+
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(15000), balance.Current)
+	assert.Equal(t, models.Money(0), balance.Withdrawn)
+}
 
-	mockStorage.EXPECT().GetBalance(ctx, userID).Return(&models.Balance{
-		UserID:    userID,
-		Current:   50.0,
-		Withdrawn: 0.0,
-	}, nil)
+func TestOrderProcessor_ProcessOrder_InvalidOrder(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
-	// Мок для транзакционного обновления
-	mockStorage.EXPECT().UpdateOrderStatusAndBalance(ctx, orderNumber, "PROCESSED", &accrualValue, userID, 150.0, 0.0).Return(nil)
+	ctx := context.Background()
+	orderNumber := "12345678903"
+	newTestUser(t, store, "user", 0, orderNumber)
+
+	// Система начисления явно отклонила заказ
+	accrualService.On(orderNumber, &models.AccrualResponse{
+		Order:  orderNumber,
+		Status: "INVALID",
+	}, nil)
 
 	err := processor.ProcessOrder(ctx, orderNumber)
+	require.NoError(t, err)
 
-	assert.NoError(t, err)
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "INVALID", order.Status)
+	assert.Nil(t, order.Accrual)
 }
 
-func TestOrderProcessor_ProcessOrder_InvalidOrder(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+func TestOrderProcessor_ProcessOrder_NotRegistered(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+	processor.SetRetryPolicy(3, time.Millisecond)
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
+	userID := newTestUser(t, store, "user", 0, orderNumber)
+
+	// Заказ еще не зарегистрирован в системе начисления: ответов больше, чем попыток,
+	// но ни один не засчитывается неудачей и заказ не попадает в очередь недоставленных
+	accrualService.On(orderNumber, nil, nil)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+
+		order, err := store.GetOrderByNumber(ctx, orderNumber)
+		require.NoError(t, err)
+		assert.Equal(t, "NEW", order.Status)
+		assert.Zero(t, order.Attempts)
+		assert.NotEmpty(t, order.LastError)
+		assert.NotNil(t, order.NextCheckAt)
+		assert.Nil(t, order.DeadLetteredAt)
+	}
 
-	// Моки - заказ не найден
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(nil, nil)
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, orderNumber, "INVALID", (*float64)(nil)).Return(nil)
+	deadLetters, err := store.ListDeadLetterOrders(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
 
-	err := processor.ProcessOrder(ctx, orderNumber)
+	// Заказ зарегистрирован и обработан с опозданием: баллы начисляются
+	accrualService.On(orderNumber, &models.AccrualResponse{Order: orderNumber, Status: "PROCESSED", Accrual: moneyPtr(10000)}, nil)
+	require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
 
-	assert.NoError(t, err)
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(10000), balance.Current)
+}
+
+func TestOrderProcessor_ProcessOrder_NotRegisteredTimeout(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+	processor.SetRetryPolicy(2, time.Millisecond)
+	processor.SetUnregisteredTimeout(0)
+
+	ctx := context.Background()
+	orderNumber := "12345678903"
+	newTestUser(t, store, "user", 0, orderNumber)
+
+	// Срок ожидания регистрации истек: ответы 204 расходуют попытки как обычные ошибки
+	accrualService.On(orderNumber, nil, nil)
+	for attempt := 1; attempt <= 2; attempt++ {
+		require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+
+		order, err := store.GetOrderByNumber(ctx, orderNumber)
+		require.NoError(t, err)
+		assert.Equal(t, attempt, order.Attempts)
+	}
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Nil(t, order.NextCheckAt)
+	assert.NotNil(t, order.DeadLetteredAt)
 }
 
 func TestOrderProcessor_ProcessOrder_RateLimitError(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
+	newTestUser(t, store, "user", 0, orderNumber)
 
-	// Моки - превышение лимита запросов
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(nil, assert.AnError)
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, orderNumber, "INVALID", (*float64)(nil)).Return(nil)
+	// Произвольная ошибка системы начисления считается временной
+	accrualService.On(orderNumber, nil, assert.AnError)
 
+	before := time.Now()
 	err := processor.ProcessOrder(ctx, orderNumber)
-
-	assert.NoError(t, err)
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	require.NoError(t, err)
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+	assert.Equal(t, 1, order.Attempts)
+	assert.Equal(t, assert.AnError.Error(), order.LastError)
+	require.NotNil(t, order.NextCheckAt)
+	assert.True(t, order.NextCheckAt.After(before))
+
+	// До наступления времени проверки заказ не выбирается
+	orders, err := store.GetOrdersByStatusPaginated(ctx, models.PendingOrderStatuses, 100, 0)
+	require.NoError(t, err)
+	assert.Empty(t, orders)
 }
 
 func TestOrderProcessor_ProcessOrder_ActualRateLimitError(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
+	newTestUser(t, store, "user", 0, orderNumber)
 
-	// Моки - реальная rate limit ошибка
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(nil, services.ErrRateLimitExceeded)
+	// Реальная rate limit ошибка
+	accrualService.On(orderNumber, nil, services.ErrRateLimitExceeded)
 
 	err := processor.ProcessOrder(ctx, orderNumber)
 
 	assert.Error(t, err)
 	assert.True(t, errors.Is(err, services.ErrRateLimitExceeded))
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertNotCalled(t, "UpdateOrderStatus")
+
+	// Статус заказа не меняется
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
 }
 
 func TestOrderProcessor_ProcessOrder_NoAccrual(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
+	userID := newTestUser(t, store, "user", models.Money(5000), orderNumber)
 
-	// Моки - заказ обработан, но без начисления
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(&models.AccrualResponse{
+	// Заказ обработан, но без начисления
+	accrualService.On(orderNumber, &models.AccrualResponse{
 		Order:   orderNumber,
 		Status:  "PROCESSED",
 		Accrual: nil,
 	}, nil)
 
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, orderNumber, "PROCESSED", (*float64)(nil)).Return(nil)
-
 	err := processor.ProcessOrder(ctx, orderNumber)
+	require.NoError(t, err)
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	assert.Nil(t, order.Accrual)
 
-	assert.NoError(t, err)
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(5000), balance.Current)
 }
 
 func TestOrderProcessor_ProcessOrdersWithWorkers_RateLimit(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	// Один воркер, чтобы порядок обработки был детерминированным
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop())
 
 	ctx := context.Background()
-	orders := []models.Order{
-		{ID: 1, UserID: 1, Number: "12345678903", Status: "NEW"},
-		{ID: 2, UserID: 2, Number: "12345678904", Status: "PROCESSING"},
-		{ID: 3, UserID: 3, Number: "12345678905", Status: "NEW"},
-	}
+	newTestUser(t, store, "user", 0, "12345678903", "12345678904", "12345678905")
+	orders, err := store.GetOrdersByStatus(ctx, []string{"NEW"})
+	require.NoError(t, err)
 
 	// Первый заказ успешно обрабатывается
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, "12345678903").Return(&models.AccrualResponse{
-		Order:   "12345678903",
-		Status:  "PROCESSED",
-		Accrual: nil,
+	accrualService.On("12345678903", &models.AccrualResponse{
+		Order:  "12345678903",
+		Status: "PROCESSED",
 	}, nil)
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, "12345678903", "PROCESSED", (*float64)(nil)).Return(nil)
 
 	// Второй заказ вызывает rate limit
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, "12345678904").Return(nil, services.ErrRateLimitExceeded)
+	accrualService.On("12345678904", nil, &services.RateLimitError{RetryAfter: time.Minute})
 
 	// Третий заказ не должен обрабатываться из-за rate limit
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, "12345678905").Return(&models.AccrualResponse{
-		Order:   "12345678905",
-		Status:  "PROCESSED",
-		Accrual: nil,
+	accrualService.On("12345678905", &models.AccrualResponse{
+		Order:  "12345678905",
+		Status: "PROCESSED",
 	}, nil)
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, "12345678905", "PROCESSED", (*float64)(nil)).Return(nil)
 
-	// Вызываем ProcessOrdersWithWorkers напрямую
 	processor.ProcessOrdersWithWorkers(ctx, orders)
 
-	// Проверяем, что первый заказ был обработан
-	mockAccrualService.AssertCalled(t, "GetOrderInfo", ctx, "12345678903")
-	mockStorage.AssertCalled(t, "UpdateOrderStatus", ctx, "12345678903", "PROCESSED", (*float64)(nil))
+	// Первый заказ был обработан
+	assert.Equal(t, 1, accrualService.Calls("12345678903"))
+	order, err := store.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+
+	// Второй заказ вызвал rate limit, третий не запрашивался
+	assert.Equal(t, 1, accrualService.Calls("12345678904"))
+	assert.Equal(t, 0, accrualService.Calls("12345678905"))
+	order, err = store.GetOrderByNumber(ctx, "12345678905")
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+}
+
+func TestOrderProcessor_ProcessOrdersWithWorkers_CircuitOpen(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop())
 
-	// Проверяем, что второй заказ вызвал rate limit
-	mockAccrualService.AssertCalled(t, "GetOrderInfo", ctx, "12345678904")
+	ctx := context.Background()
+	newTestUser(t, store, "user", 0, "12345678903", "12345678904")
+	orders, err := store.GetOrdersByStatus(ctx, []string{"NEW"})
+	require.NoError(t, err)
+
+	// Выключатель разомкнут: весь проход приостанавливается
+	accrualService.On("12345678903", nil, &services.CircuitOpenError{RetryAfter: time.Minute})
+	accrualService.On("12345678904", &models.AccrualResponse{Order: "12345678904", Status: "PROCESSED"}, nil)
+
+	processor.ProcessOrdersWithWorkers(ctx, orders)
+
+	assert.Equal(t, 1, accrualService.Calls("12345678903"))
+	assert.Equal(t, 0, accrualService.Calls("12345678904"))
+	assert.True(t, processor.paused())
+
+	// Заказ не виноват в недоступности системы: попытка не засчитывается
+	order, err := store.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+	assert.Equal(t, 0, order.Attempts)
+	assert.Empty(t, order.LastError)
 }
 
 func TestOrderProcessor_ProcessOrdersWithWorkers_Success(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
 	ctx := context.Background()
-	orders := []models.Order{
-		{ID: 1, UserID: 1, Number: "12345678903", Status: "NEW"},
-		{ID: 2, UserID: 2, Number: "12345678904", Status: "PROCESSING"},
+	newTestUser(t, store, "user", 0, "12345678903", "12345678904")
+	orders, err := store.GetOrdersByStatus(ctx, []string{"NEW"})
+	require.NoError(t, err)
+
+	for _, order := range orders {
+		accrualService.On(order.Number, &models.AccrualResponse{
+			Order:  order.Number,
+			Status: "PROCESSED",
+		}, nil)
 	}
 
-	// Моки для успешной обработки всех заказов
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, "12345678903").Return(&models.AccrualResponse{
-		Order:   "12345678903",
-		Status:  "PROCESSED",
-		Accrual: nil,
-	}, nil)
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, "12345678903", "PROCESSED", (*float64)(nil)).Return(nil)
+	processor.ProcessOrdersWithWorkers(ctx, orders)
 
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, "12345678904").Return(&models.AccrualResponse{
-		Order:   "12345678904",
+	// Все заказы были обработаны
+	for _, order := range orders {
+		assert.Equal(t, 1, accrualService.Calls(order.Number))
+		updated, err := store.GetOrderByNumber(ctx, order.Number)
+		require.NoError(t, err)
+		assert.Equal(t, "PROCESSED", updated.Status)
+	}
+}
+
+func TestOrderProcessor_ProcessOrder_TransactionalUpdate_Error(t *testing.T) {
+	store := &failingBalanceStorage{
+		MemoryStorage: storage.NewMemoryStorage(),
+		err:           fmt.Errorf("transaction failed"),
+	}
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+
+	ctx := context.Background()
+	orderNumber := "12345678903"
+	accrualValue := models.Money(10000)
+	newTestUser(t, store, "user", models.Money(5000), orderNumber)
+
+	accrualService.On(orderNumber, &models.AccrualResponse{
+		Order:   orderNumber,
 		Status:  "PROCESSED",
-		Accrual: nil,
+		Accrual: &accrualValue,
 	}, nil)
-	mockStorage.EXPECT().UpdateOrderStatus(ctx, "12345678904", "PROCESSED", (*float64)(nil)).Return(nil)
 
-	// Вызываем ProcessOrdersWithWorkers напрямую
-	processor.ProcessOrdersWithWorkers(ctx, orders)
+	err := processor.ProcessOrder(ctx, orderNumber)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to update order status and balance transactionally")
+
+	// Заказ остается необработанным
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+}
+
+func TestOrderProcessor_DeadLetter(t *testing.T) {
+	store := &failingBalanceStorage{
+		MemoryStorage: storage.NewMemoryStorage(),
+		err:           fmt.Errorf("transaction failed"),
+	}
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop())
+	processor.SetRetryPolicy(2, time.Millisecond)
+
+	ctx := context.Background()
+	orderNumber := "12345678903"
+	newTestUser(t, store, "user", 0, orderNumber)
+	accrualService.On(orderNumber, &models.AccrualResponse{Order: orderNumber, Status: "PROCESSED", Accrual: moneyPtr(10000)}, nil)
+
+	// Ошибка обработки считается неудачной попыткой, а не повторяется на каждом проходе
+	for attempt := 1; attempt <= 2; attempt++ {
+		order, err := store.GetOrderByNumber(ctx, orderNumber)
+		require.NoError(t, err)
+		processor.ProcessOrdersWithWorkers(ctx, []models.Order{*order})
+
+		order, err = store.GetOrderByNumber(ctx, orderNumber)
+		require.NoError(t, err)
+		assert.Equal(t, attempt, order.Attempts)
+		assert.Contains(t, order.LastError, "transaction failed")
+	}
 
-	// Проверяем, что все заказы были обработаны
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+	assert.Nil(t, order.NextCheckAt)
+	assert.NotNil(t, order.DeadLetteredAt)
+
+	deadLetters, err := store.ListDeadLetterOrders(ctx)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, orderNumber, deadLetters[0].Number)
+	require.Len(t, deadLetters[0].Failures, 2)
+	assert.Equal(t, 1, deadLetters[0].Failures[0].Attempt)
+	assert.Equal(t, 2, deadLetters[0].Failures[1].Attempt)
+
+	// Заказ из очереди недоставленных не захватывается для обработки
+	claimed, err := store.ClaimOrders(ctx, models.PendingOrderStatuses, "worker", time.Now(), 10, time.Minute, models.SchedulingPolicy{})
+	require.NoError(t, err)
+	assert.Empty(t, claimed)
 }
 
-func TestOrderProcessor_ProcessOrder_TransactionalUpdate(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+func TestOrderProcessor_ScheduleRetryFailure(t *testing.T) {
+	store := &failingRetryStorage{MemoryStorage: storage.NewMemoryStorage()}
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 1, zap.NewNop())
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
-	accrualValue := 100.0
-	userID := int64(1)
+	newTestUser(t, store, "user", 0, orderNumber)
+	accrualService.On(orderNumber, nil, services.ErrInternalServer)
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+
+	err = processor.ProcessOrder(ctx, orderNumber)
+	assert.ErrorIs(t, err, errOrderCheckNotScheduled)
+
+	// Попытку уже записывал ProcessOrder: воркер не записывает ее второй раз
+	store.calls.Store(0)
+	processor.ProcessOrdersWithWorkers(ctx, []models.Order{*order})
+	assert.Equal(t, int32(1), store.calls.Load())
+}
+
+func TestOrderProcessor_ProcessOrder_ConcurrentCredits(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+
+	ctx := context.Background()
+	const numOrders = 50
+	accrualValue := models.Money(100)
+
+	numbers := make([]string, numOrders)
+	for i := range numbers {
+		numbers[i] = fmt.Sprintf("order%d", i)
+		accrualService.On(numbers[i], &models.AccrualResponse{
+			Order:   numbers[i],
+			Status:  "PROCESSED",
+			Accrual: &accrualValue,
+		}, nil)
+	}
+	userID := newTestUser(t, store, "user", models.Money(5000), numbers...)
+
+	// Каждый заказ одного пользователя обрабатывается одновременно дважды
+	var wg sync.WaitGroup
+	for _, number := range numbers {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(number string) {
+				defer wg.Done()
+				assert.NoError(t, processor.ProcessOrder(ctx, number))
+			}(number)
+		}
+	}
+	wg.Wait()
+
+	// Ни одно начисление не потеряно и ни одно не учтено дважды
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(5000)+numOrders*accrualValue, balance.Current)
+
+	entries, err := store.GetLedgerEntriesByUserID(ctx, userID)
+	require.NoError(t, err)
+	accruals := 0
+	for _, entry := range entries {
+		if entry.Kind == models.LedgerKindAccrual {
+			accruals++
+		}
+	}
+	assert.Equal(t, numOrders, accruals)
+}
+
+func TestOrderProcessor_ProcessOrder_AlreadyCredited(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
 
-	// Моки для успешной обработки с начислением
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(&models.AccrualResponse{
+	ctx := context.Background()
+	orderNumber := "12345678903"
+	accrualValue := models.Money(10000)
+	userID := newTestUser(t, store, "user", 0, orderNumber)
+
+	accrualService.On(orderNumber, &models.AccrualResponse{
 		Order:   orderNumber,
 		Status:  "PROCESSED",
 		Accrual: &accrualValue,
 	}, nil)
 
-	// Моки для получения заказа и баланса
-	mockStorage.EXPECT().GetOrderByNumber(ctx, orderNumber).Return(&models.Order{
-		ID:     1,
-		UserID: userID,
-		Number: orderNumber,
-		Status: "NEW",
-	}, nil)
+	require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+	require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
 
-	mockStorage.EXPECT().GetBalance(ctx, userID).Return(&models.Balance{
-		UserID:    userID,
-		Current:   50.0,
-		Withdrawn: 0.0,
-	}, nil)
-
-	// Мок для транзакционного обновления
-	mockStorage.EXPECT().UpdateOrderStatusAndBalance(ctx, orderNumber, "PROCESSED", &accrualValue, userID, 150.0, 0.0).Return(nil)
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, accrualValue, balance.Current)
+}
 
-	err := processor.ProcessOrder(ctx, orderNumber)
+func TestOrderProcessor_ProcessOrder_StatusMapping(t *testing.T) {
+	tests := []struct {
+		name          string
+		initial       string
+		accrualStatus string
+		expected      string
+	}{
+		{name: "Registered stays new", initial: "NEW", accrualStatus: "REGISTERED", expected: "NEW"},
+		{name: "Processing", initial: "NEW", accrualStatus: "PROCESSING", expected: "PROCESSING"},
+		{name: "Invalid", initial: "PROCESSING", accrualStatus: "INVALID", expected: "INVALID"},
+		{name: "Registered after processing is refused", initial: "PROCESSING", accrualStatus: "REGISTERED", expected: "PROCESSING"},
+		{name: "Processing after processed is refused", initial: "PROCESSED", accrualStatus: "PROCESSING", expected: "PROCESSED"},
+		{name: "Processed after invalid is refused", initial: "INVALID", accrualStatus: "PROCESSED", expected: "INVALID"},
+		{name: "Unknown status is refused", initial: "NEW", accrualStatus: "CANCELLED", expected: "NEW"},
+	}
 
-	assert.NoError(t, err)
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewMemoryStorage()
+			accrualService := newStubAccrualService()
+			processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+
+			ctx := context.Background()
+			orderNumber := "12345678903"
+			userID := newTestUser(t, store, "user", 0, orderNumber)
+			require.NoError(t, store.UpdateOrderStatus(ctx, orderNumber, tt.initial, nil))
+
+			accrualValue := models.Money(10000)
+			accrualService.On(orderNumber, &models.AccrualResponse{
+				Order:   orderNumber,
+				Status:  tt.accrualStatus,
+				Accrual: &accrualValue,
+			}, nil)
+
+			require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+
+			order, err := store.GetOrderByNumber(ctx, orderNumber)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, order.Status)
+			assert.Nil(t, order.Accrual)
+
+			// Ни в одном из случаев баллы не начисляются
+			balance, err := store.GetBalance(ctx, userID)
+			require.NoError(t, err)
+			assert.Equal(t, models.Money(0), balance.Current)
+		})
+	}
 }
 
-func TestOrderProcessor_ProcessOrder_TransactionalUpdate_Error(t *testing.T) {
-	mockStorage := &storagemocks.Storage{}
-	mockAccrualService := &servicesmocks.AccrualServiceIface{}
-	processor := NewOrderProcessor(mockStorage, mockAccrualService, 5*time.Second, 5, zap.NewNop())
+func TestOrderProcessor_ProcessOrder_RetryBackoff(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+	processor.SetRetryPolicy(3, time.Minute)
 
 	ctx := context.Background()
 	orderNumber := "12345678903"
-	accrualValue := 100.0
-	userID := int64(1)
+	newTestUser(t, store, "user", 0, orderNumber)
+
+	accrualService.On(orderNumber, nil, services.ErrInternalServer)
+
+	// Задержка удваивается после каждой неудачной попытки
+	for attempt, delay := range []time.Duration{time.Minute, 2 * time.Minute} {
+		before := time.Now()
+		require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
 
-	// Моки для успешной обработки с начислением
-	mockAccrualService.EXPECT().GetOrderInfo(ctx, orderNumber).Return(&models.AccrualResponse{
+		order, err := store.GetOrderByNumber(ctx, orderNumber)
+		require.NoError(t, err)
+		assert.Equal(t, attempt+1, order.Attempts)
+		require.NotNil(t, order.NextCheckAt)
+		assert.WithinDuration(t, before.Add(delay), *order.NextCheckAt, time.Second)
+	}
+
+	// Попытки исчерпаны: проверки прекращаются, но заказ не становится INVALID
+	require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+
+	order, err := store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "NEW", order.Status)
+	assert.Equal(t, 3, order.Attempts)
+	assert.Nil(t, order.NextCheckAt)
+
+	// Успешная проверка сбрасывает счетчик попыток
+	accrualService.On(orderNumber, &models.AccrualResponse{Order: orderNumber, Status: "PROCESSING"}, nil)
+	require.NoError(t, processor.ProcessOrder(ctx, orderNumber))
+
+	order, err = store.GetOrderByNumber(ctx, orderNumber)
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSING", order.Status)
+	assert.Zero(t, order.Attempts)
+	assert.Empty(t, order.LastError)
+}
+
+func TestOrderProcessor_RetryDelay(t *testing.T) {
+	processor := NewOrderProcessor(storage.NewMemoryStorage(), newStubAccrualService(), time.Second, 1, zap.NewNop())
+	processor.SetRetryPolicy(100, time.Second)
+
+	assert.Equal(t, time.Second, processor.retryDelay(1))
+	assert.Equal(t, 2*time.Second, processor.retryDelay(2))
+	assert.Equal(t, 8*time.Second, processor.retryDelay(4))
+	assert.Equal(t, maxRetryBackoff, processor.retryDelay(50))
+}
+
+func TestOrderProcessor_ProcessOrders(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	processor := NewOrderProcessor(store, accrualService, 5*time.Second, 5, zap.NewNop())
+
+	ctx := context.Background()
+	accrualValue := models.Money(100)
+
+	// Заказов больше, чем помещается в одну пачку
+	const numOrders = claimBatchSize + 50
+	numbers := make([]string, numOrders)
+	for i := range numbers {
+		numbers[i] = fmt.Sprintf("order%d", i)
+		status := "PROCESSED"
+		if i%2 == 0 {
+			// Заказ остается в очереди, но в этом проходе повторно не опрашивается
+			status = "PROCESSING"
+		}
+		accrualService.On(numbers[i], &models.AccrualResponse{
+			Order:   numbers[i],
+			Status:  status,
+			Accrual: &accrualValue,
+		}, nil)
+	}
+	userID := newTestUser(t, store, "user", 0, numbers...)
+
+	processor.ProcessOrders()
+
+	for i, number := range numbers {
+		assert.Equal(t, 1, accrualService.Calls(number), "order %s", number)
+
+		order, err := store.GetOrderByNumber(ctx, number)
+		require.NoError(t, err)
+		assert.Empty(t, order.LockedBy)
+		if i%2 == 0 {
+			assert.Equal(t, "PROCESSING", order.Status)
+		} else {
+			assert.Equal(t, "PROCESSED", order.Status)
+		}
+	}
+
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(numOrders/2)*accrualValue, balance.Current)
+}
+
+func TestOrderProcessor_ProcessOrders_MultipleInstances(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+	accrualValue := models.Money(100)
+
+	const numOrders = 300
+	numbers := make([]string, numOrders)
+	for i := range numbers {
+		numbers[i] = fmt.Sprintf("order%d", i)
+		accrualService.On(numbers[i], &models.AccrualResponse{
+			Order:   numbers[i],
+			Status:  "PROCESSED",
+			Accrual: &accrualValue,
+		}, nil)
+	}
+	userID := newTestUser(t, store, "user", 0, numbers...)
+
+	// Несколько экземпляров сервиса делят одну очередь
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		processor := NewOrderProcessor(store, accrualService, 5*time.Second, 4, zap.NewNop())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processor.ProcessOrders()
+		}()
+	}
+	wg.Wait()
+
+	// Каждый заказ опрошен ровно один раз
+	for _, number := range numbers {
+		assert.Equal(t, 1, accrualService.Calls(number), "order %s", number)
+	}
+
+	balance, err := store.GetBalance(context.Background(), userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(numOrders)*accrualValue, balance.Current)
+}
+
+// flakyListenStorage хранилище, подписка которого обрывается заданное число раз
+type flakyListenStorage struct {
+	*storage.MemoryStorage
+	failures atomic.Int32
+}
+
+func (s *flakyListenStorage) ListenNewOrders(ctx context.Context, onNotify func()) error {
+	if s.failures.Add(-1) >= 0 {
+		return errors.New("connection reset")
+	}
+	return s.MemoryStorage.ListenNewOrders(ctx, onNotify)
+}
+
+func TestOrderProcessor_WakeOnNewOrder(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := newStubAccrualService()
+
+	// Тик не наступит за время теста, обработку запускает только уведомление
+	processor := NewOrderProcessor(store, accrualService, time.Hour, 2, zap.NewNop())
+	processor.Start()
+	defer processor.Stop(context.Background())
+
+	// Даем подписке зарегистрироваться
+	time.Sleep(50 * time.Millisecond)
+
+	orderNumber := "12345678903"
+	accrualValue := models.Money(100)
+	accrualService.On(orderNumber, &models.AccrualResponse{
 		Order:   orderNumber,
 		Status:  "PROCESSED",
 		Accrual: &accrualValue,
 	}, nil)
+	newTestUser(t, store, "user", 0, orderNumber)
 
-	// Моки для получения заказа и баланса
-	mockStorage.EXPECT().GetOrderByNumber(ctx, orderNumber).Return(&models.Order{
-		ID:     1,
-		UserID: userID,
-		Number: orderNumber,
-		Status: "NEW",
-	}, nil)
+	assert.Eventually(t, func() bool {
+		order, err := store.GetOrderByNumber(context.Background(), orderNumber)
+		return err == nil && order.Status == "PROCESSED"
+	}, 2*time.Second, 10*time.Millisecond)
+}
 
-	mockStorage.EXPECT().GetBalance(ctx, userID).Return(&models.Balance{
-		UserID:    userID,
-		Current:   50.0,
-		Withdrawn: 0.0,
-	}, nil)
+func TestOrderProcessor_ListenReconnect(t *testing.T) {
+	store := &flakyListenStorage{MemoryStorage: storage.NewMemoryStorage()}
+	store.failures.Store(2)
+	accrualService := newStubAccrualService()
 
-	// Мок для ошибки транзакционного обновления
-	mockStorage.EXPECT().UpdateOrderStatusAndBalance(ctx, orderNumber, "PROCESSED", &accrualValue, userID, 150.0, 0.0).Return(fmt.Errorf("transaction failed"))
+	processor := NewOrderProcessor(store, accrualService, time.Hour, 2, zap.NewNop())
+	processor.listenRetry = 10 * time.Millisecond
+	processor.Start()
+	defer processor.Stop(context.Background())
 
-	err := processor.ProcessOrder(ctx, orderNumber)
+	// После переподключения подписка снова доставляет уведомления
+	require.Eventually(t, func() bool { return store.failures.Load() < 0 }, 2*time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "failed to update order status and balance transactionally")
-	mockAccrualService.AssertExpectations(t)
-	mockStorage.AssertExpectations(t)
+	orderNumber := "12345678903"
+	accrualService.On(orderNumber, &models.AccrualResponse{Order: orderNumber, Status: "PROCESSING"}, nil)
+	newTestUser(t, store, "user", 0, orderNumber)
+
+	assert.Eventually(t, func() bool {
+		order, err := store.GetOrderByNumber(context.Background(), orderNumber)
+		return err == nil && order.Status == "PROCESSING"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+// TestOrderProcessor_Simulator проверяет обработку заказов против симулятора системы начисления
+func TestOrderProcessor_Simulator(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{})
+	sim.SetOrder("12345678903",
+		accrualsim.WithStatus(models.AccrualStatusRegistered),
+		accrualsim.WithStatus(models.AccrualStatusProcessing),
+		accrualsim.Processed(models.Money(50000)),
+	)
+	sim.SetOrder("79927398713", accrualsim.WithStatus(models.AccrualStatusInvalid))
+	sim.SetOrder("2377225624",
+		accrualsim.WithHTTPStatus(http.StatusServiceUnavailable),
+		accrualsim.Step{Malformed: true},
+		accrualsim.Processed(models.Money(1000)),
+	)
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	store := storage.NewMemoryStorage()
+	accrualService := services.NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	processor := NewOrderProcessor(store, accrualService, time.Millisecond, 2, zap.NewNop())
+	processor.SetRetryPolicy(5, time.Millisecond)
+
+	ctx := context.Background()
+	userID := newTestUser(t, store, "user", 0, "12345678903", "79927398713", "2377225624")
+
+	// Каждый проход продвигает сценарии; временные ошибки откладывают проверку
+	require.Eventually(t, func() bool {
+		processor.ProcessOrders()
+		orders, err := store.GetOrdersByStatus(ctx, models.PendingOrderStatuses)
+		require.NoError(t, err)
+		return len(orders) == 0
+	}, 2*time.Second, 5*time.Millisecond)
+
+	expected := map[string]string{"12345678903": "PROCESSED", "79927398713": "INVALID", "2377225624": "PROCESSED"}
+	for number, status := range expected {
+		order, err := store.GetOrderByNumber(ctx, number)
+		require.NoError(t, err)
+		assert.Equal(t, status, order.Status, "order %s", number)
+	}
+	assert.Equal(t, 3, sim.Requests("2377225624"))
+
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(51000), balance.Current)
+}
+
+// TestOrderProcessor_CircuitBreaker проверяет, что при недоступной системе начисления
+// обработчик перестает отправлять запросы до истечения паузы выключателя
+func TestOrderProcessor_CircuitBreaker(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{
+		Default: accrualsim.Script{accrualsim.WithHTTPStatus(http.StatusServiceUnavailable)},
+	})
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	store := storage.NewMemoryStorage()
+	accrualService := services.NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	accrualService.SetBreakerSettings(services.BreakerSettings{FailureThreshold: 2, CoolDown: time.Minute})
+	processor := NewOrderProcessor(store, accrualService, time.Millisecond, 1, zap.NewNop())
+
+	ctx := context.Background()
+	numbers := []string{"12345678903", "79927398713", "2377225624", "4561261212345467"}
+	newTestUser(t, store, "user", 0, numbers...)
+
+	processor.ProcessOrders()
+
+	// Две ошибки подряд размыкают выключатель, остальные заказы не запрашиваются
+	requests := 0
+	for _, number := range numbers {
+		requests += sim.Requests(number)
+	}
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, "open", accrualService.BreakerStatus().State)
+	assert.True(t, processor.paused())
+
+	orders, err := store.GetOrdersByStatus(ctx, models.PendingOrderStatuses)
+	require.NoError(t, err)
+	attempts := 0
+	for _, order := range orders {
+		attempts += order.Attempts
+	}
+	assert.Len(t, orders, len(numbers))
+	assert.Equal(t, 2, attempts)
+}
+
+// TestOrderProcessor_SharedRateLimit проверяет, что частота, узнанная из ответа 429,
+// сохраняется в хранилище и делится между экземплярами
+func TestOrderProcessor_SharedRateLimit(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{
+		Default: accrualsim.Script{accrualsim.WithStatus(models.AccrualStatusProcessing)},
+	})
+	sim.SetRateLimit(2, time.Minute)
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	store := storage.NewMemoryStorage()
+	accrualService := services.NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	processor := NewOrderProcessor(store, accrualService, time.Second, 1, zap.NewNop())
+
+	ctx := context.Background()
+	newTestUser(t, store, "user", 0, "12345678903", "79927398713", "2377225624")
+
+	processor.ProcessOrders()
+	assert.True(t, processor.paused())
+	assert.Equal(t, 2, accrualService.RateLimit())
+
+	// Узнанная частота сохраняется при следующей синхронизации
+	processor.syncRateLimit(ctx)
+	limit, clients, err := store.SyncAccrualRateLimit(ctx, server.URL, "other", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 2, limit)
+	assert.Equal(t, 2, clients)
+
+	// Новый экземпляр начинает с сохраненной частоты
+	restarted := services.NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	NewOrderProcessor(store, restarted, time.Second, 1, zap.NewNop()).syncRateLimit(ctx)
+	assert.Equal(t, 2, restarted.RateLimit())
+}
+
+// TestOrderProcessor_Providers проверяет выбор системы начисления по правилам,
+// закрепление ее за заказом и независимость систем друг от друга
+func TestOrderProcessor_Providers(t *testing.T) {
+	mainSim := accrualsim.New(accrualsim.Scenario{
+		Default: accrualsim.Script{accrualsim.Processed(models.Money(1000))},
+	})
+	mainServer := httptest.NewServer(mainSim)
+	defer mainServer.Close()
+
+	// Система партнера недоступна
+	partnerSim := accrualsim.New(accrualsim.Scenario{
+		Default: accrualsim.Script{accrualsim.WithHTTPStatus(http.StatusServiceUnavailable)},
+	})
+	partnerServer := httptest.NewServer(partnerSim)
+	defer partnerServer.Close()
+
+	noRetries := 0
+	registry, err := services.NewProviderRegistry(&services.ProvidersConfig{
+		Default: "main",
+		Providers: []services.ProviderConfig{
+			{Name: "main", Address: mainServer.URL, MaxRetries: &noRetries},
+			{Name: "partner", Address: partnerServer.URL, MaxRetries: &noRetries, BreakerThreshold: 1,
+				BreakerCooldown: services.ConfigDuration(time.Minute)},
+		},
+		Routes: []services.RouteRule{{Provider: "partner", Merchant: "acme"}},
+	})
+	require.NoError(t, err)
+
+	store := storage.NewMemoryStorage()
+	processor := NewOrderProcessor(store, registry.Default(), time.Millisecond, 1, zap.NewNop())
+	processor.SetProviders(registry)
+
+	ctx := context.Background()
+	userID := newTestUser(t, store, "user", 0)
+	for _, number := range []string{"12345678903", "79927398713", "2377225624"} {
+		merchant := ""
+		if number != "79927398713" {
+			merchant = "acme"
+		}
+		_, err := store.CreateMerchantOrder(ctx, userID, number, merchant)
+		require.NoError(t, err)
+	}
+
+	processor.ProcessOrders()
+
+	// Выключатель партнера разомкнулся после первой ошибки, но заказ основной системы обработан
+	assert.Equal(t, 1, mainSim.Requests("79927398713"))
+	assert.Equal(t, 1, partnerSim.Requests("12345678903")+partnerSim.Requests("2377225624"))
+	assert.False(t, processor.paused())
+
+	expected := map[string]string{"79927398713": "main", "12345678903": "partner", "2377225624": "partner"}
+	for number, provider := range expected {
+		order, err := store.GetOrderByNumber(ctx, number)
+		require.NoError(t, err)
+		assert.Equal(t, provider, order.AccrualProvider, "order %s", number)
+	}
+
+	order, err := store.GetOrderByNumber(ctx, "79927398713")
+	require.NoError(t, err)
+	assert.Equal(t, models.OrderStatusProcessed, order.Status)
+	assert.Equal(t, services.BreakerOpen.String(), registry.BreakerStatuses()["partner"].State)
 }
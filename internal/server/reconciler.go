@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"go.uber.org/zap"
+)
+
+// reconcileBatchLimit ограничивает число заказов, перепроверяемых за один проход
+const reconcileBatchLimit = 500
+
+// ReconcileSettings параметры сверки обработанных заказов
+type ReconcileSettings struct {
+	// Interval период между проходами сверки
+	Interval time.Duration
+	// Window перепроверяются заказы, обработанные не раньше Window назад
+	Window time.Duration
+	// SampleRate доля заказов окна, перепроверяемая за проход, от 0 до 1
+	SampleRate float64
+	// Policy что делать с расхождением: models.ReconcilePolicyAdjust или models.ReconcilePolicyReview
+	Policy string
+}
+
+// ReconcileReport итоги прохода сверки
+type ReconcileReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Checked число перепроверенных заказов
+	Checked int `json:"checked"`
+	Matched int `json:"matched"`
+	// Pending заказы, по которым система начисления еще не дала окончательного ответа
+	Pending int `json:"pending"`
+	// Discrepancies найденные расхождения; Adjusted из них исправлены проводкой, Opened открыты для разбора
+	Discrepancies int `json:"discrepancies"`
+	Adjusted      int `json:"adjusted"`
+	Opened        int `json:"opened"`
+	Errors        int `json:"errors"`
+}
+
+// Reconciler периодически перепроверяет в системе начисления выборку недавно обработанных заказов
+// и фиксирует расхождения с учтенным начислением
+type Reconciler struct {
+	storage        Storage
+	accrualService services.AccrualServiceIface
+	providers      *services.ProviderRegistry
+	leadership     Leadership // если задано, проходы по расписанию выполняет только ведущий экземпляр
+	settings       ReconcileSettings
+	logger         *zap.Logger
+	stopChan       chan struct{}
+	done           chan struct{} // закрывается, когда цикл проходов завершился
+
+	mu    sync.Mutex
+	last  *ReconcileReport
+	runMu sync.Mutex // проходы не пересекаются
+	nowFn func() time.Time
+}
+
+// NewReconciler создает сверку обработанных заказов
+func NewReconciler(storage Storage, accrualService services.AccrualServiceIface, settings ReconcileSettings, logger *zap.Logger) *Reconciler {
+	return &Reconciler{
+		storage:        storage,
+		accrualService: accrualService,
+		settings:       settings,
+		logger:         logger,
+		stopChan:       make(chan struct{}),
+		done:           make(chan struct{}),
+		nowFn:          time.Now,
+	}
+}
+
+// SetProviders включает перепроверку заказа в системе начисления, закрепленной за ним
+func (r *Reconciler) SetProviders(registry *services.ProviderRegistry) {
+	r.providers = registry
+}
+
+// SetLeaderOnly включает проходы по расписанию только на ведущем экземпляре,
+// чтобы реплики не перепроверяли одни и те же заказы. Запуск через служебный API не ограничен.
+func (r *Reconciler) SetLeaderOnly(leadership Leadership) {
+	r.leadership = leadership
+}
+
+// Settings возвращает параметры сверки
+func (r *Reconciler) Settings() ReconcileSettings {
+	return r.settings
+}
+
+// Start запускает проходы сверки с периодом Interval
+func (r *Reconciler) Start() {
+	// Проход прерывается остановкой: непроверенные заказы попадут в следующие выборки
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-r.stopChan
+		cancel()
+	}()
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.settings.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if r.leadership != nil && !r.leadership.IsLeader() {
+					continue
+				}
+				r.Run(ctx)
+			case <-r.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stop останавливает проходы сверки и ждет завершения текущего прохода, но не дольше ctx.
+// Вызывается после Start.
+func (r *Reconciler) Stop(ctx context.Context) error {
+	close(r.stopChan)
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LastReport возвращает итоги последнего прохода или nil, если проходов еще не было
+func (r *Reconciler) LastReport() *ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last == nil {
+		return nil
+	}
+	report := *r.last
+	return &report
+}
+
+// Run выполняет проход сверки и возвращает его итоги
+func (r *Reconciler) Run(ctx context.Context) ReconcileReport {
+	r.runMu.Lock()
+	defer r.runMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, processTimeout)
+	defer cancel()
+
+	report := ReconcileReport{StartedAt: r.nowFn()}
+	orders, err := r.storage.SampleProcessedOrders(ctx, report.StartedAt.Add(-r.settings.Window), r.settings.SampleRate, reconcileBatchLimit)
+	if err != nil {
+		r.logger.Error("Failed to sample processed orders for reconciliation", zap.Error(err))
+		report.Errors++
+	}
+
+	for i := range orders {
+		if err := r.reconcileOrder(ctx, &orders[i], &report); err != nil {
+			report.Errors++
+			// Система начисления недоступна: остальные заказы проверим в следующий раз
+			if errors.Is(err, services.ErrRateLimitExceeded) || errors.Is(err, services.ErrCircuitOpen) || ctx.Err() != nil {
+				r.logger.Warn("Reconciliation interrupted", zap.Error(err))
+				break
+			}
+			r.logger.Error("Failed to reconcile order",
+				zap.String("orderNumber", orders[i].Number),
+				zap.Error(err))
+		}
+	}
+
+	report.FinishedAt = r.nowFn()
+	r.logger.Info("Reconciliation finished",
+		zap.Int("checked", report.Checked),
+		zap.Int("discrepancies", report.Discrepancies),
+		zap.Int("adjusted", report.Adjusted),
+		zap.Int("errors", report.Errors))
+
+	r.mu.Lock()
+	r.last = &report
+	r.mu.Unlock()
+
+	return report
+}
+
+// reconcileOrder перепроверяет заказ и фиксирует расхождение по политике сверки
+func (r *Reconciler) reconcileOrder(ctx context.Context, order *models.Order, report *ReconcileReport) error {
+	accrualService, err := r.accrualServiceFor(order)
+	if err != nil {
+		return err
+	}
+
+	info, err := accrualService.GetOrderInfo(ctx, order.Number)
+	if err != nil {
+		return err
+	}
+	report.Checked++
+
+	var reported models.Money
+	status := ""
+	if info != nil {
+		status, _ = models.MapAccrualStatus(info.Status)
+	}
+	switch status {
+	case models.OrderStatusProcessed:
+		if info.Accrual != nil {
+			reported = *info.Accrual
+		}
+	case models.OrderStatusInvalid:
+		// Система отменила начисление
+	default:
+		report.Pending++
+		return nil
+	}
+
+	var recorded models.Money
+	if order.Accrual != nil {
+		recorded = *order.Accrual
+	}
+	if reported == recorded {
+		report.Matched++
+		return nil
+	}
+
+	report.Discrepancies++
+	discrepancy := &models.AccrualDiscrepancy{
+		OrderNumber:     order.Number,
+		UserID:          order.UserID,
+		RecordedAccrual: recorded,
+		ReportedStatus:  info.Status,
+		ReportedAccrual: reported,
+	}
+	logFields := []zap.Field{
+		zap.String("orderNumber", order.Number),
+		zap.Stringer("recorded", recorded),
+		zap.Stringer("reported", reported),
+		zap.String("reportedStatus", info.Status),
+	}
+
+	if r.settings.Policy == models.ReconcilePolicyAdjust {
+		adjusted, err := r.storage.AdjustOrderAccrual(ctx, discrepancy)
+		if err != nil {
+			return err
+		}
+		if adjusted {
+			report.Adjusted++
+			r.logger.Warn("Accrual adjusted after reconciliation", logFields...)
+			return nil
+		}
+		// Заказ изменился после выборки или баланса не хватает на списание: решает человек
+		discrepancy.Note = "automatic adjustment was not possible"
+	}
+
+	opened, err := r.storage.OpenAccrualDiscrepancy(ctx, discrepancy)
+	if err != nil {
+		return err
+	}
+	if opened {
+		report.Opened++
+		r.logger.Warn("Accrual discrepancy opened for review", logFields...)
+	}
+	return nil
+}
+
+// accrualServiceFor возвращает систему начисления, закрепленную за заказом
+func (r *Reconciler) accrualServiceFor(order *models.Order) (services.AccrualServiceIface, error) {
+	if r.providers == nil {
+		return r.accrualService, nil
+	}
+	return r.providers.Provider(r.providers.Route(order))
+}
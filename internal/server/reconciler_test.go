@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+// newReconcileFixture создает пользователя с обработанными заказами: 12345678903 на 500,
+// 79927398713 на 100 и 2377225624 на 50
+func newReconcileFixture(t *testing.T) (*storage.MemoryStorage, int64) {
+	t.Helper()
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+
+	userID := newTestUser(t, store, "user", 0, "12345678903", "79927398713", "2377225624")
+	for number, accrual := range map[string]models.Money{"12345678903": 50000, "79927398713": 10000, "2377225624": 5000} {
+		_, err := store.CreditOrderAccrual(ctx, number, accrual)
+		require.NoError(t, err)
+	}
+	return store, userID
+}
+
+// moneyPtr возвращает указатель на сумму
+func moneyPtr(v models.Money) *models.Money {
+	return &v
+}
+
+func newReconciler(store Storage, accrual services.AccrualServiceIface, policy string) *Reconciler {
+	return NewReconciler(store, accrual, ReconcileSettings{
+		Interval:   time.Hour,
+		Window:     time.Hour,
+		SampleRate: 1,
+		Policy:     policy,
+	}, zap.NewNop())
+}
+
+func TestReconciler_Review(t *testing.T) {
+	ctx := context.Background()
+	store, userID := newReconcileFixture(t)
+
+	accrual := newStubAccrualService()
+	accrual.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(50000)}, nil)
+	accrual.On("79927398713", &models.AccrualResponse{Order: "79927398713", Status: "PROCESSED", Accrual: moneyPtr(12000)}, nil)
+	accrual.On("2377225624", &models.AccrualResponse{Order: "2377225624", Status: "INVALID"}, nil)
+
+	reconciler := newReconciler(store, accrual, models.ReconcilePolicyReview)
+	assert.Nil(t, reconciler.LastReport())
+
+	report := reconciler.Run(ctx)
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, 1, report.Matched)
+	assert.Equal(t, 2, report.Discrepancies)
+	assert.Equal(t, 2, report.Opened)
+	assert.Zero(t, report.Adjusted)
+	assert.Zero(t, report.Errors)
+	require.NotNil(t, reconciler.LastReport())
+	assert.Equal(t, report, *reconciler.LastReport())
+
+	// Политика review не меняет баланс
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(65000), balance.Current)
+
+	open, err := store.ListAccrualDiscrepancies(ctx, models.DiscrepancyStatusOpen)
+	require.NoError(t, err)
+	require.Len(t, open, 2)
+	deltas := map[string]models.Money{}
+	for _, d := range open {
+		deltas[d.OrderNumber] = d.Delta()
+	}
+	assert.Equal(t, map[string]models.Money{"79927398713": 2000, "2377225624": -5000}, deltas)
+
+	// Повторный проход не дублирует открытые расхождения
+	report = reconciler.Run(ctx)
+	assert.Equal(t, 2, report.Discrepancies)
+	assert.Zero(t, report.Opened)
+}
+
+func TestReconciler_Adjust(t *testing.T) {
+	ctx := context.Background()
+	store, userID := newReconcileFixture(t)
+
+	accrual := newStubAccrualService()
+	accrual.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(40000)}, nil)
+	accrual.On("79927398713", &models.AccrualResponse{Order: "79927398713", Status: "PROCESSED", Accrual: moneyPtr(12000)}, nil)
+	accrual.On("2377225624", &models.AccrualResponse{Order: "2377225624", Status: "PROCESSING"}, nil)
+
+	report := newReconciler(store, accrual, models.ReconcilePolicyAdjust).Run(ctx)
+	assert.Equal(t, 3, report.Checked)
+	assert.Equal(t, 1, report.Pending)
+	assert.Equal(t, 2, report.Adjusted)
+	assert.Zero(t, report.Opened)
+
+	// 650 - 100 + 20
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(57000), balance.Current)
+
+	order, err := store.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(40000), *order.Accrual)
+
+	ledger, err := store.CheckLedgerConsistency(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, ledger)
+
+	adjusted, err := store.ListAccrualDiscrepancies(ctx, models.DiscrepancyStatusAdjusted)
+	require.NoError(t, err)
+	assert.Len(t, adjusted, 2)
+}
+
+func TestReconciler_AdjustFallsBackToReview(t *testing.T) {
+	ctx := context.Background()
+	store, userID := newReconcileFixture(t)
+	// Пользователь уже потратил почти все баллы
+	_, err := store.ProcessWithdrawal(ctx, userID, "4561261212345467", 64000)
+	require.NoError(t, err)
+
+	accrual := newStubAccrualService()
+	accrual.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "INVALID"}, nil)
+	accrual.On("79927398713", &models.AccrualResponse{Order: "79927398713", Status: "PROCESSED", Accrual: moneyPtr(10000)}, nil)
+	accrual.On("2377225624", &models.AccrualResponse{Order: "2377225624", Status: "PROCESSED", Accrual: moneyPtr(5000)}, nil)
+
+	report := newReconciler(store, accrual, models.ReconcilePolicyAdjust).Run(ctx)
+	assert.Equal(t, 1, report.Discrepancies)
+	assert.Zero(t, report.Adjusted)
+	assert.Equal(t, 1, report.Opened)
+
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(1000), balance.Current)
+
+	open, err := store.ListAccrualDiscrepancies(ctx, models.DiscrepancyStatusOpen)
+	require.NoError(t, err)
+	require.Len(t, open, 1)
+	assert.Equal(t, "12345678903", open[0].OrderNumber)
+	assert.NotEmpty(t, open[0].Note)
+}
+
+func TestReconciler_StopsWhenAccrualUnavailable(t *testing.T) {
+	store, _ := newReconcileFixture(t)
+
+	accrual := newStubAccrualService()
+	for _, number := range []string{"12345678903", "79927398713", "2377225624"} {
+		accrual.On(number, nil, services.ErrCircuitOpen)
+	}
+
+	report := newReconciler(store, accrual, models.ReconcilePolicyReview).Run(context.Background())
+	assert.Zero(t, report.Checked)
+	assert.Equal(t, 1, report.Errors)
+}
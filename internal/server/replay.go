@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"go.uber.org/zap"
+)
+
+// AccrualReplay результат повторной обработки событий заказа
+type AccrualReplay struct {
+	OrderNumber string
+	Events      int
+	// Status и Accrual состояние заказа после повторной обработки
+	Status  string
+	Accrual *models.Money
+	// ActualStatus и ActualAccrual состояние заказа в хранилище
+	ActualStatus  string
+	ActualAccrual *models.Money
+	// Reparsed события, которые текущая логика разбирает иначе, чем при записи
+	Reparsed []int64
+}
+
+// Matches сообщает, что повторная обработка дала то же состояние заказа и тот же разбор ответов
+func (r *AccrualReplay) Matches() bool {
+	return r.Status == r.ActualStatus && equalMoney(r.Accrual, r.ActualAccrual) && len(r.Reparsed) == 0
+}
+
+// replayAccrualService отдает процессору ответ из журнала вместо запроса к системе начисления
+type replayAccrualService struct {
+	info *models.AccrualResponse
+	err  error
+}
+
+// GetOrderInfo возвращает заданный ответ
+func (s *replayAccrualService) GetOrderInfo(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	return s.info, s.err
+}
+
+// ReplayAccrualEvents повторно обрабатывает сохраненные события заказа number текущей логикой
+// разбора и обработки ответов. Обработка идет в пустом хранилище sandbox; source не изменяется.
+func ReplayAccrualEvents(ctx context.Context, source, sandbox Storage, number string, logger *zap.Logger) (*AccrualReplay, error) {
+	order, err := source.GetOrderByNumber(ctx, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order: %w", err)
+	}
+	if order == nil {
+		return nil, ErrOrderNotFound
+	}
+	events, err := source.ListAccrualEvents(ctx, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual events: %w", err)
+	}
+
+	// Заказ в песочнице начинает с того же состояния, что и при загрузке
+	user, err := sandbox.CreateUser(ctx, fmt.Sprintf("replay-%d", order.UserID), "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create replay user: %w", err)
+	}
+	if _, err := sandbox.CreateMerchantOrder(ctx, user.ID, number, order.Merchant); err != nil {
+		return nil, fmt.Errorf("failed to create replay order: %w", err)
+	}
+
+	accrual := &replayAccrualService{}
+	processor := NewOrderProcessor(sandbox, accrual, time.Second, 1, logger)
+	result := &AccrualReplay{
+		OrderNumber:   number,
+		Events:        len(events),
+		ActualStatus:  order.Status,
+		ActualAccrual: order.Accrual,
+	}
+
+	for _, event := range events {
+		info, parseErr := reparseAccrualEvent(&event)
+		if !sameParse(&event, info, parseErr) {
+			result.Reparsed = append(result.Reparsed, event.ID)
+		}
+
+		if event.Source == models.AccrualEventCallback {
+			// Отклоненное уведомление не применялось
+			if parseErr != nil {
+				continue
+			}
+			err = processor.ApplyAccrualUpdate(ctx, info)
+		} else {
+			accrual.info, accrual.err = info, parseErr
+			err = processor.ProcessOrder(ctx, number)
+			// Ответ 429 не меняет заказ
+			if errors.Is(err, services.ErrRateLimitExceeded) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to replay accrual event %d: %w", event.ID, err)
+		}
+	}
+
+	replayed, err := sandbox.GetOrderByNumber(ctx, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get replayed order: %w", err)
+	}
+	result.Status = replayed.Status
+	result.Accrual = replayed.Accrual
+
+	return result, nil
+}
+
+// reparseAccrualEvent разбирает сохраненный ответ или уведомление текущей логикой
+func reparseAccrualEvent(event *models.AccrualEvent) (*models.AccrualResponse, error) {
+	if event.Source == models.AccrualEventCallback {
+		var update models.AccrualResponse
+		if err := json.Unmarshal([]byte(event.Body), &update); err != nil {
+			return nil, fmt.Errorf("failed to decode callback: %w", err)
+		}
+		if err := validateAccrualUpdate(&update); err != nil {
+			return nil, err
+		}
+		return &update, nil
+	}
+
+	// Ответа не было, повторяем исходную ошибку
+	if event.HTTPStatus == 0 {
+		return nil, errors.New(event.Error)
+	}
+	return services.ParseAccrualResponse(event.HTTPStatus, "", []byte(event.Body))
+}
+
+// sameParse сравнивает новый разбор события с записанным
+func sameParse(event *models.AccrualEvent, info *models.AccrualResponse, err error) bool {
+	if err != nil || event.Error != "" {
+		return err != nil && event.Error != ""
+	}
+
+	var (
+		status  string
+		accrual *models.Money
+	)
+	if info != nil {
+		status, accrual = info.Status, info.Accrual
+	}
+	return status == event.Status && equalMoney(accrual, event.Accrual)
+}
+
+// equalMoney сравнивает необязательные суммы
+func equalMoney(a, b *models.Money) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
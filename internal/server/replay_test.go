@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/accrualsim"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestReplayAccrualEvents(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{})
+	sim.SetOrder("12345678903",
+		accrualsim.WithHTTPStatus(http.StatusServiceUnavailable),
+		accrualsim.WithStatus(models.AccrualStatusRegistered),
+		accrualsim.Processed(models.Money(72998)),
+	)
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	store := storage.NewMemoryStorage()
+	accrualService := services.NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	accrualService.SetEventRecorder(NewAccrualEventRecorder(store, zap.NewNop()))
+	processor := NewOrderProcessor(store, accrualService, time.Millisecond, 1, zap.NewNop())
+
+	ctx := context.Background()
+	userID := newTestUser(t, store, "user", 0, "12345678903")
+	for range 3 {
+		require.NoError(t, processor.ProcessOrder(ctx, "12345678903"))
+	}
+
+	order, err := store.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	require.Equal(t, models.OrderStatusProcessed, order.Status)
+
+	t.Run("Matches recorded processing", func(t *testing.T) {
+		replay, err := ReplayAccrualEvents(ctx, store, storage.NewMemoryStorage(), "12345678903", zap.NewNop())
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, replay.Events)
+		assert.Equal(t, models.OrderStatusProcessed, replay.Status)
+		require.NotNil(t, replay.Accrual)
+		assert.Equal(t, models.Money(72998), *replay.Accrual)
+		assert.Empty(t, replay.Reparsed)
+		assert.True(t, replay.Matches())
+
+		// Повторная обработка не меняет хранилище
+		balance, err := store.GetBalance(ctx, userID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(72998), balance.Current)
+	})
+
+	t.Run("Reports differences", func(t *testing.T) {
+		// Ответ, записанный с другим результатом разбора, например до исправления
+		accrual := models.Money(100)
+		require.NoError(t, store.SaveAccrualEvent(ctx, &models.AccrualEvent{
+			OrderNumber: "12345678903",
+			Source:      models.AccrualEventCallback,
+			RequestedAt: time.Now(),
+			Body:        `{"order":"12345678903","status":"PROCESSED","accrual":2}`,
+			Status:      models.AccrualStatusProcessed,
+			Accrual:     &accrual,
+		}))
+
+		replay, err := ReplayAccrualEvents(ctx, store, storage.NewMemoryStorage(), "12345678903", zap.NewNop())
+		require.NoError(t, err)
+		assert.Equal(t, 4, replay.Events)
+		assert.Len(t, replay.Reparsed, 1)
+		assert.False(t, replay.Matches())
+	})
+
+	t.Run("Unknown order", func(t *testing.T) {
+		_, err := ReplayAccrualEvents(ctx, store, storage.NewMemoryStorage(), "79927398713", zap.NewNop())
+		assert.ErrorIs(t, err, ErrOrderNotFound)
+	})
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"net/http"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/middleware"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
@@ -21,20 +23,29 @@ func NewRouter(storage Storage, authService *services.AuthService, accrualServic
 	// Middleware
 	router.Use(middleware.GzipMiddleware)
 
+	// Проверка работоспособности
+	router.Get("/api/health", handlers.HealthHandler)
+
+	// Открытые ключи подписи токенов
+	router.Get("/.well-known/jwks.json", handlers.JWKSHandler)
+
 	// Все маршруты /api/user
 	router.Route("/api/user", func(r chi.Router) {
 		// Публичные
 		r.Post("/register", handlers.RegisterHandler)
 		r.Post("/login", handlers.LoginHandler)
+		r.Post("/token/refresh", handlers.RefreshTokenHandler)
 
 		// Защищённые
 		r.Group(func(protected chi.Router) {
-			protected.Use(middleware.AuthMiddleware(authService))
+			protected.Use(middleware.AuthMiddleware(authService, storage))
 			protected.Post("/orders", handlers.UploadOrderHandler)
 			protected.Get("/orders", handlers.GetOrdersHandler)
 			protected.Get("/balance", handlers.GetBalanceHandler)
 			protected.Post("/balance/withdraw", handlers.WithdrawHandler)
 			protected.Get("/withdrawals", handlers.GetWithdrawalsHandler)
+			protected.Post("/logout", handlers.LogoutHandler)
+			protected.Post("/logout/all", handlers.LogoutAllHandler)
 		})
 	})
 
@@ -44,6 +55,45 @@ func NewRouter(storage Storage, authService *services.AuthService, accrualServic
 	}
 }
 
+// MountAccrualCallback подключает прием push-уведомлений системы начисления
+func (r *Router) MountAccrualCallback(handler *AccrualCallbackHandler) {
+	r.router.Method(http.MethodPost, "/api/internal/accrual/callback", handler)
+}
+
+// MountAdmin подключает служебное API /api/admin, доступное с токеном администратора token
+func (r *Router) MountAdmin(admin *AdminHandlers, token string) {
+	r.router.Route("/api/admin", func(ar chi.Router) {
+		ar.Use(middleware.AdminMiddleware(token))
+		ar.Get("/orders/{number}/accrual-events", admin.GetAccrualEventsHandler)
+		ar.Get("/reconciliation", admin.GetReconciliationHandler)
+		ar.Post("/reconciliation/run", admin.RunReconciliationHandler)
+		ar.Get("/ledger/check", admin.GetLedgerCheckHandler)
+		ar.Post("/ledger/check/run", admin.RunLedgerCheckHandler)
+		ar.Get("/discrepancies", admin.ListDiscrepanciesHandler)
+		ar.Post("/discrepancies/{id}/resolve", admin.ResolveDiscrepancyHandler)
+		ar.Get("/shadow", admin.GetShadowReportHandler)
+		ar.Get("/dead-letters", admin.ListDeadLettersHandler)
+		ar.Post("/dead-letters/requeue", admin.RequeueDeadLettersHandler)
+		ar.Post("/dead-letters/{number}/requeue", admin.RequeueDeadLetterHandler)
+		ar.Post("/dead-letters/{number}/resolve", admin.ResolveDeadLetterHandler)
+		ar.Get("/workers", admin.GetWorkerPoolHandler)
+		ar.Put("/workers", admin.UpdateWorkerPoolHandler)
+		ar.Put("/users/{id}/tier", admin.SetUserTierHandler)
+		ar.Get("/jwt-keys", admin.ListJWTKeysHandler)
+		ar.Post("/jwt-keys/rotate", admin.RotateJWTKeysHandler)
+	})
+}
+
+// SetProviders добавляет состояние систем начисления в проверку работоспособности
+func (r *Router) SetProviders(registry *services.ProviderRegistry) {
+	r.handlers.providers = registry
+}
+
+// SetLeaderElector включает состояние выборов ведущего в проверку работоспособности
+func (r *Router) SetLeaderElector(elector *LeaderElector) {
+	r.handlers.leader = elector
+}
+
 // GetRouter возвращает настроенный роутер
 func (r *Router) GetRouter() *chi.Mux {
 	return r.router
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"go.uber.org/zap"
+)
+
+// shadowTimeout ограничивает запрос к теневой системе начисления и запись сравнения
+const shadowTimeout = 10 * time.Second
+
+// ShadowComparer опрашивает теневую систему начисления о заказах, по которым ответила основная,
+// и записывает результат сравнения. Ответ теневой системы никогда не применяется к заказам.
+type ShadowComparer struct {
+	shadow  services.AccrualServiceIface
+	storage Storage
+	logger  *zap.Logger
+	slots   chan struct{} // ограничивает число одновременных запросов к теневой системе
+	wg      sync.WaitGroup
+}
+
+// NewShadowComparer создает сравнение с теневой системой shadow; одновременно
+// выполняется не больше concurrency запросов
+func NewShadowComparer(shadow services.AccrualServiceIface, storage Storage, concurrency int, logger *zap.Logger) *ShadowComparer {
+	return &ShadowComparer{
+		shadow:  shadow,
+		storage: storage,
+		logger:  logger,
+		slots:   make(chan struct{}, max(concurrency, 1)),
+	}
+}
+
+// Compare запрашивает теневую систему о заказе number в фоне и сравнивает ответ с ответом
+// основной системы primary (nil — заказ не зарегистрирован). Обработка заказа сравнения не ждет;
+// если все запросы к теневой системе заняты, сравнение пропускается.
+func (c *ShadowComparer) Compare(ctx context.Context, source, number string, primary *models.AccrualResponse) {
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		c.logger.Debug("Shadow comparison skipped, shadow accrual system is busy", zap.String("orderNumber", number))
+		return
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer func() {
+			<-c.slots
+			c.wg.Done()
+		}()
+
+		// Ответ основной системы уже получен: сравнение не зависит от отмены обработки
+		compareCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shadowTimeout)
+		defer cancel()
+		c.compare(compareCtx, source, number, primary)
+	}()
+}
+
+// Wait ждет завершения начатых сравнений, но не дольше ctx
+func (c *ShadowComparer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// compare запрашивает теневую систему и записывает сравнение
+func (c *ShadowComparer) compare(ctx context.Context, source, number string, primary *models.AccrualResponse) {
+	comparison := &models.ShadowComparison{
+		OrderNumber: number,
+		Source:      source,
+		ComparedAt:  time.Now(),
+	}
+	if primary != nil {
+		comparison.PrimaryStatus = primary.Status
+		comparison.PrimaryAccrual = primary.Accrual
+	}
+	comparison.Final = comparison.PrimaryStatus == models.AccrualStatusProcessed || comparison.PrimaryStatus == models.AccrualStatusInvalid
+
+	shadowInfo, err := c.shadow.GetOrderInfo(ctx, number)
+	if err != nil {
+		comparison.ShadowError = err.Error()
+		comparison.Outcome = models.ShadowOutcomeShadowError
+	} else {
+		if shadowInfo != nil {
+			comparison.ShadowStatus = shadowInfo.Status
+			comparison.ShadowAccrual = shadowInfo.Accrual
+		}
+		comparison.Outcome = shadowOutcome(comparison)
+	}
+
+	if comparison.Outcome != models.ShadowOutcomeAgree {
+		c.logger.Info("Shadow accrual system disagrees with primary",
+			zap.String("orderNumber", number),
+			zap.String("outcome", comparison.Outcome),
+			zap.String("primaryStatus", comparison.PrimaryStatus),
+			zap.String("shadowStatus", comparison.ShadowStatus),
+			zap.String("shadowError", comparison.ShadowError))
+	}
+
+	if err := c.storage.SaveShadowComparison(ctx, comparison); err != nil {
+		c.logger.Error("Failed to save shadow comparison", zap.String("orderNumber", number), zap.Error(err))
+	}
+}
+
+// shadowOutcome сравнивает ответы: сначала статус, затем начисление обработанного заказа
+func shadowOutcome(c *models.ShadowComparison) string {
+	if c.PrimaryStatus != c.ShadowStatus {
+		return models.ShadowOutcomeStatusMismatch
+	}
+	if c.PrimaryStatus == models.AccrualStatusProcessed && !equalMoney(c.PrimaryAccrual, c.ShadowAccrual) {
+		return models.ShadowOutcomeAccrualMismatch
+	}
+	return models.ShadowOutcomeAgree
+}
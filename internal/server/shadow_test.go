@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestOrderProcessor_Shadow(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	userID := newTestUser(t, store, "user", 0, "12345678903", "79927398713", "2377225624", "4561261212345467")
+
+	primary := newStubAccrualService()
+	primary.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(50000)}, nil)
+	primary.On("79927398713", &models.AccrualResponse{Order: "79927398713", Status: "PROCESSED", Accrual: moneyPtr(10000)}, nil)
+	primary.On("2377225624", &models.AccrualResponse{Order: "2377225624", Status: "PROCESSING"}, nil)
+	primary.On("4561261212345467", &models.AccrualResponse{Order: "4561261212345467", Status: "INVALID"}, nil)
+
+	candidate := newStubAccrualService()
+	candidate.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(50000)}, nil)
+	candidate.On("79927398713", &models.AccrualResponse{Order: "79927398713", Status: "PROCESSED", Accrual: moneyPtr(99900)}, nil)
+	candidate.On("2377225624", nil, nil)
+	candidate.On("4561261212345467", nil, errors.New("connection refused"))
+
+	shadow := NewShadowComparer(candidate, store, 4, zap.NewNop())
+	processor := NewOrderProcessor(store, primary, time.Second, 1, zap.NewNop())
+	processor.SetShadow(shadow)
+
+	for _, number := range []string{"12345678903", "79927398713", "2377225624", "4561261212345467"} {
+		require.NoError(t, processor.ProcessOrder(ctx, number))
+	}
+	require.NoError(t, shadow.Wait(context.Background()))
+
+	// Применяется только ответ основной системы
+	balance, err := store.GetBalance(ctx, userID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(60000), balance.Current)
+	for _, number := range []string{"12345678903", "79927398713", "2377225624", "4561261212345467"} {
+		assert.Equal(t, 1, candidate.Calls(number))
+	}
+
+	report, err := store.GetShadowReport(ctx, time.Time{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Compared)
+	assert.Equal(t, 1, report.Agreed)
+	assert.Equal(t, 1, report.AccrualMismatches)
+	assert.Equal(t, 1, report.StatusMismatches)
+	assert.Equal(t, 1, report.ShadowErrors)
+	assert.InDelta(t, 0.25, report.AgreementRate, 1e-9)
+	assert.Equal(t, 3, report.FinalCompared)
+	assert.Equal(t, 1, report.FinalAgreed)
+	require.Len(t, report.Disagreements, 3)
+
+	byOrder := map[string]models.ShadowComparison{}
+	for _, c := range report.Disagreements {
+		byOrder[c.OrderNumber] = c
+	}
+	assert.Equal(t, models.ShadowOutcomeAccrualMismatch, byOrder["79927398713"].Outcome)
+	assert.Equal(t, models.Money(99900), *byOrder["79927398713"].ShadowAccrual)
+	assert.Equal(t, models.ShadowOutcomeStatusMismatch, byOrder["2377225624"].Outcome)
+	assert.Empty(t, byOrder["2377225624"].ShadowStatus)
+	assert.Equal(t, "connection refused", byOrder["4561261212345467"].ShadowError)
+	assert.Equal(t, models.AccrualEventPoll, byOrder["4561261212345467"].Source)
+}
+
+func TestOrderProcessor_ShadowCallback(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStorage()
+	newTestUser(t, store, "user", 0, "12345678903")
+
+	candidate := newStubAccrualService()
+	candidate.On("12345678903", &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(50000)}, nil)
+
+	shadow := NewShadowComparer(candidate, store, 1, zap.NewNop())
+	processor := NewOrderProcessor(store, newStubAccrualService(), time.Second, 1, zap.NewNop())
+	processor.SetShadow(shadow)
+
+	update := &models.AccrualResponse{Order: "12345678903", Status: "PROCESSED", Accrual: moneyPtr(50000)}
+	require.NoError(t, processor.ApplyAccrualUpdate(ctx, update))
+	require.NoError(t, shadow.Wait(context.Background()))
+
+	report, err := store.GetShadowReport(ctx, time.Time{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Compared)
+	assert.Equal(t, 1, report.FinalAgreed)
+	assert.InDelta(t, 1.0, report.FinalAgreementRate, 1e-9)
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 )
@@ -12,28 +13,108 @@ type Storage interface {
 	CreateUser(ctx context.Context, login, passwordHash string) (*models.User, error)
 	GetUserByLogin(ctx context.Context, login string) (*models.User, error)
 	GetUserByID(ctx context.Context, id int64) (*models.User, error)
+	// Смена тарифа пользователя; false, если пользователя нет
+	SetUserTier(ctx context.Context, userID int64, tier string) (bool, error)
+	// Отметка о просмотре пользователем списка заказов; его заказы проверяются раньше
+	MarkOrdersViewed(ctx context.Context, userID int64, at time.Time) error
+
+	// Refresh токены и отзыв access токенов
+	// Сохранение первого refresh токена нового семейства при входе
+	CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error
+	// Refresh токен по хешу; nil, если токена нет
+	GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error)
+	// Замена действующего refresh токена следующим токеном его семейства; повторное предъявление
+	// уже замененного токена отзывает все семейство. Возвращает результат models.RefreshToken*.
+	RotateRefreshToken(ctx context.Context, tokenHash string, next *models.RefreshToken, now time.Time) (string, error)
+	// Отзыв access токена jti и семейства refresh токенов, выданного вместе с ним
+	RevokeAccessToken(ctx context.Context, userID int64, jti string, expiresAt, now time.Time) error
+	// Отзыв всех семейств refresh токенов пользователя и выданных с ними access токенов
+	RevokeUserTokens(ctx context.Context, userID int64, now time.Time) error
+	// Проверка, отозван ли access токен jti
+	IsTokenRevoked(ctx context.Context, jti string) (bool, error)
 
 	// Order methods
 	CreateOrder(ctx context.Context, userID int64, number string) (*models.Order, error)
+	CreateMerchantOrder(ctx context.Context, userID int64, number, merchant string) (*models.Order, error)
+	// Подписка на создание заказов: блокируется до отмены ctx или обрыва соединения
+	ListenNewOrders(ctx context.Context, onNotify func()) error
 	GetOrderByNumber(ctx context.Context, number string) (*models.Order, error)
 	GetOrdersByUserID(ctx context.Context, userID int64) ([]models.Order, error)
 	GetOrdersByStatus(ctx context.Context, statuses []string) ([]models.Order, error)
 	GetOrdersByStatusPaginated(ctx context.Context, statuses []string, limit, offset int) ([]models.Order, error)
-	UpdateOrderStatus(ctx context.Context, number string, status string, accrual *float64) error
+	UpdateOrderStatus(ctx context.Context, number string, status string, accrual *models.Money) error
+	// Захват заказов, чья проверка назначена не позже dueBefore, с арендой на время lease;
+	// заказы выбираются справедливо между пользователями по правилам policy,
+	// заказы, захваченные другими, пропускаются
+	ClaimOrders(ctx context.Context, statuses []string, workerID string, dueBefore time.Time, limit int, lease time.Duration, policy models.SchedulingPolicy) ([]models.Order, error)
+	// Число заказов, чья проверка назначена не позже dueBefore, включая захваченные
+	CountDueOrders(ctx context.Context, statuses []string, dueBefore time.Time) (int, error)
+	// Освобождение захваченных заказов с переносом следующей проверки не раньше nextCheckAt
+	ReleaseOrders(ctx context.Context, workerID string, numbers []string, nextCheckAt time.Time) error
+	// Закрепление системы начисления за заказом, если она еще не выбрана
+	AssignOrderProvider(ctx context.Context, number, provider string) (string, error)
+	// Смена статуса заказа при условии, что текущий статус равен from; отсчет до следующей проверки начинается заново
+	TransitionOrderStatus(ctx context.Context, number string, from, to string, accrual *models.Money) (bool, error)
+	// Отложенная повторная проверка заказа после временной ошибки системы начисления
+	ScheduleOrderRetry(ctx context.Context, number string, lastError string, nextCheckAt *time.Time) error
+	// Перенос проверки заказа, который система начисления еще не зарегистрировала; попытка не засчитывается
+	DeferOrderCheck(ctx context.Context, number string, reason string, nextCheckAt time.Time) error
+
+	// Допустимая частота запросов к системе начисления, общая для экземпляров сервиса
+	SaveAccrualRateLimit(ctx context.Context, system string, perMinute int) error
+	SyncAccrualRateLimit(ctx context.Context, system, clientID string, ttl time.Duration) (perMinute, clients int, err error)
+
+	// Журнал ответов системы начисления
+	SaveAccrualEvent(ctx context.Context, event *models.AccrualEvent) error
+	ListAccrualEvents(ctx context.Context, orderNumber string) ([]models.AccrualEvent, error)
+	ListAccrualEventOrders(ctx context.Context) ([]string, error)
+
+	// Подписи примененных push-уведомлений, общие для экземпляров сервиса; хранятся до expiresAt
+	IsCallbackNonceUsed(ctx context.Context, nonce string) (bool, error)
+	SaveCallbackNonce(ctx context.Context, nonce string, expiresAt time.Time) error
+
+	// Сверка обработанных заказов с системой начисления
+	SampleProcessedOrders(ctx context.Context, since time.Time, rate float64, limit int) ([]models.Order, error)
+	// Открытие расхождения для ручного разбора; не дублирует уже открытое по заказу
+	OpenAccrualDiscrepancy(ctx context.Context, d *models.AccrualDiscrepancy) (bool, error)
+	// Исправление начисления заказа проводкой; false, если заказ изменился или баланса не хватает на списание
+	AdjustOrderAccrual(ctx context.Context, d *models.AccrualDiscrepancy) (bool, error)
+	ListAccrualDiscrepancies(ctx context.Context, status string) ([]models.AccrualDiscrepancy, error)
+	ResolveAccrualDiscrepancy(ctx context.Context, id int64, note string) (*models.AccrualDiscrepancy, error)
+
+	// Очередь недоставленных: заказы, обработка которых прекращена после исчерпания попыток
+	ListDeadLetterOrders(ctx context.Context) ([]models.DeadLetterOrder, error)
+	RequeueDeadLetterOrders(ctx context.Context, numbers []string) ([]string, error)
+	ResolveDeadLetterOrder(ctx context.Context, number, status string, accrual models.Money) (bool, error)
+
+	// Сравнения с теневой системой начисления
+	SaveShadowComparison(ctx context.Context, c *models.ShadowComparison) error
+	GetShadowReport(ctx context.Context, since time.Time, limit int) (*models.ShadowReport, error)
 
 	// Balance methods
 	GetBalance(ctx context.Context, userID int64) (*models.Balance, error)
-	UpdateBalance(ctx context.Context, userID int64, current, withdrawn float64) error
+	AdjustBalance(ctx context.Context, userID int64, amount models.Money) error
 
 	// Withdrawal methods
-	CreateWithdrawal(ctx context.Context, userID int64, order string, sum float64) (*models.Withdrawal, error)
 	GetWithdrawalsByUserID(ctx context.Context, userID int64) ([]models.Withdrawal, error)
 
 	// Transactional withdrawal - проверяет баланс и создает списание в одной транзакции
-	ProcessWithdrawal(ctx context.Context, userID int64, order string, sum float64) (*models.Withdrawal, error)
+	ProcessWithdrawal(ctx context.Context, userID int64, order string, sum models.Money) (*models.Withdrawal, error)
 
 	// Атомарное обновление статуса заказа и баланса пользователя
-	UpdateOrderStatusAndBalance(ctx context.Context, orderNumber string, status string, accrual *float64, userID int64, newCurrent, withdrawn float64) error
+	UpdateOrderStatusAndBalance(ctx context.Context, orderNumber string, status string, accrual *models.Money, userID int64) error
+	// Однократное начисление: переводит заказ в PROCESSED и увеличивает баланс, если заказ еще ожидает расчета
+	CreditOrderAccrual(ctx context.Context, orderNumber string, accrual models.Money) (bool, error)
+
+	// Ledger methods
+	GetLedgerEntriesByUserID(ctx context.Context, userID int64) ([]models.LedgerEntry, error)
+	// Сверка балансов с журналом проводок
+	CheckLedgerConsistency(ctx context.Context) ([]models.LedgerDiscrepancy, error)
+
+	// Выборы ведущего экземпляра: блокировка name удерживается на время жизни сессии, onAcquired
+	// вызывается при захвате. Блокируется до отмены ctx или потери сессии; повторный захват
+	// остается за вызывающей стороной.
+	HoldLeaderLock(ctx context.Context, name string, checkInterval time.Duration, onAcquired func()) error
 
 	// Database methods
 	Ping(ctx context.Context) error
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/middleware"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"go.uber.org/zap"
+)
+
+// startSession выдает токены нового входа пользователя: access токен и первый refresh токен нового семейства
+func (h *Handlers) startSession(ctx context.Context, user *models.User) (*models.TokenResponse, error) {
+	response, refreshToken, err := h.authService.IssueTokens(user.ID, user.Login, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := h.storage.CreateRefreshToken(ctx, refreshToken); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// writeTokens отправляет токены: access токен в заголовке Authorization, оба токена в теле ответа
+func writeTokens(w http.ResponseWriter, response *models.TokenResponse) {
+	w.Header().Set("Authorization", response.TokenType+" "+response.AccessToken)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// RefreshTokenHandler обменивает refresh токен на новую пару токенов. Refresh токен одноразовый:
+// повторное предъявление замененного токена означает утечку, и все семейство отзывается.
+func (h *Handlers) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req models.TokenRefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := h.validate.Struct(req); err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusBadRequest)
+		return
+	}
+
+	tokenHash := services.HashRefreshToken(req.RefreshToken)
+	stored, err := h.storage.GetRefreshToken(r.Context(), tokenHash)
+	if err != nil {
+		h.logger.Error("Failed to get refresh token", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if stored == nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.storage.GetUserByID(r.Context(), stored.UserID)
+	if err != nil {
+		h.logger.Error("Failed to get user by ID", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	response, next, err := h.authService.IssueTokens(user.ID, user.Login, stored.FamilyID)
+	if err != nil {
+		h.logger.Error("Failed to issue tokens", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Проверка и замена токена выполняются атомарно: из двух одновременных обменов одного токена
+	// успешен только один, второй считается повторным предъявлением
+	result, err := h.storage.RotateRefreshToken(r.Context(), tokenHash, next, time.Now())
+	if err != nil {
+		h.logger.Error("Failed to rotate refresh token", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	switch result {
+	case models.RefreshTokenRotated:
+		writeTokens(w, response)
+	case models.RefreshTokenReused:
+		h.logger.Warn("Refresh token reuse detected, token family revoked",
+			zap.Int64("userID", user.ID),
+			zap.String("familyID", stored.FamilyID))
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+	default:
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+	}
+}
+
+// LogoutHandler завершает текущий вход: отзывает access токен запроса и семейство refresh токенов,
+// выданное вместе с ним
+func (h *Handlers) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	h.logout(w, r, false)
+}
+
+// LogoutAllHandler завершает все входы пользователя на всех устройствах
+func (h *Handlers) LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	h.logout(w, r, true)
+}
+
+// logout отзывает токены текущего входа, а при everywhere — и всех остальных входов пользователя
+func (h *Handlers) logout(w http.ResponseWriter, r *http.Request, everywhere bool) {
+	userID, ok := middleware.GetUserIDFromContext(r.Context())
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	claims, ok := middleware.GetTokenClaimsFromContext(r.Context())
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	if err := h.storage.RevokeAccessToken(r.Context(), userID, claims.ID, claims.ExpiresAt.Time, now); err != nil {
+		h.logger.Error("Failed to revoke access token", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if everywhere {
+		if err := h.storage.RevokeUserTokens(r.Context(), userID, now); err != nil {
+			h.logger.Error("Failed to revoke user tokens", zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
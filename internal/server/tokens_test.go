@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/services"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+// userRequest выполняет запрос пользовательского API с телом body и access токеном token
+func userRequest(handler http.Handler, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeTokens читает токены из успешного ответа
+func decodeTokens(t *testing.T, rec *httptest.ResponseRecorder) models.TokenResponse {
+	t.Helper()
+
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var tokens models.TokenResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&tokens))
+	assert.Equal(t, "Bearer "+tokens.AccessToken, rec.Header().Get("Authorization"))
+	return tokens
+}
+
+// balanceStatus возвращает код ответа защищенного эндпоинта с access токеном token
+func balanceStatus(handler http.Handler, token string) int {
+	req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestTokenHandlers(t *testing.T) {
+	newRouter := func() http.Handler {
+		store := storage.NewMemoryStorage()
+		return NewRouter(store, services.NewAuthService("secret"), services.NewAccrualService(""), zap.NewNop()).GetRouter()
+	}
+	credentials := `{"login": "user", "password": "password"}`
+	refresh := func(handler http.Handler, refreshToken string) *httptest.ResponseRecorder {
+		return userRequest(handler, "/api/user/token/refresh", `{"refresh_token": "`+refreshToken+`"}`, "")
+	}
+
+	t.Run("Refresh", func(t *testing.T) {
+		handler := newRouter()
+		registered := decodeTokens(t, userRequest(handler, "/api/user/register", credentials, ""))
+		assert.NotEmpty(t, registered.RefreshToken)
+		assert.Equal(t, int64(services.DefaultAccessTokenTTL.Seconds()), registered.ExpiresIn)
+		assert.Equal(t, http.StatusOK, balanceStatus(handler, registered.AccessToken))
+
+		refreshed := decodeTokens(t, refresh(handler, registered.RefreshToken))
+		assert.NotEqual(t, registered.RefreshToken, refreshed.RefreshToken)
+		assert.Equal(t, http.StatusOK, balanceStatus(handler, refreshed.AccessToken))
+
+		// Refresh токен обменивается снова, цепочка продолжается
+		decodeTokens(t, refresh(handler, refreshed.RefreshToken))
+
+		assert.Equal(t, http.StatusBadRequest, userRequest(handler, "/api/user/token/refresh", `{`, "").Code)
+		assert.Equal(t, http.StatusBadRequest, userRequest(handler, "/api/user/token/refresh", `{}`, "").Code)
+		assert.Equal(t, http.StatusUnauthorized, refresh(handler, "unknown").Code)
+	})
+
+	t.Run("Reuse revokes the family", func(t *testing.T) {
+		handler := newRouter()
+		registered := decodeTokens(t, userRequest(handler, "/api/user/register", credentials, ""))
+		refreshed := decodeTokens(t, refresh(handler, registered.RefreshToken))
+
+		// Замененный токен предъявлен повторно: отзывается вся цепочка этого входа
+		assert.Equal(t, http.StatusUnauthorized, refresh(handler, registered.RefreshToken).Code)
+		assert.Equal(t, http.StatusUnauthorized, refresh(handler, refreshed.RefreshToken).Code)
+		assert.Equal(t, http.StatusUnauthorized, balanceStatus(handler, registered.AccessToken))
+		assert.Equal(t, http.StatusUnauthorized, balanceStatus(handler, refreshed.AccessToken))
+
+		// Новый вход работает
+		loggedIn := decodeTokens(t, userRequest(handler, "/api/user/login", credentials, ""))
+		assert.Equal(t, http.StatusOK, balanceStatus(handler, loggedIn.AccessToken))
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		handler := newRouter()
+		phone := decodeTokens(t, userRequest(handler, "/api/user/register", credentials, ""))
+		laptop := decodeTokens(t, userRequest(handler, "/api/user/login", credentials, ""))
+
+		assert.Equal(t, http.StatusUnauthorized, userRequest(handler, "/api/user/logout", "", "").Code)
+		require.Equal(t, http.StatusOK, userRequest(handler, "/api/user/logout", "", phone.AccessToken).Code)
+
+		assert.Equal(t, http.StatusUnauthorized, balanceStatus(handler, phone.AccessToken))
+		assert.Equal(t, http.StatusUnauthorized, refresh(handler, phone.RefreshToken).Code)
+
+		// Другой вход продолжает работать
+		assert.Equal(t, http.StatusOK, balanceStatus(handler, laptop.AccessToken))
+		decodeTokens(t, refresh(handler, laptop.RefreshToken))
+	})
+
+	t.Run("Logout everywhere", func(t *testing.T) {
+		handler := newRouter()
+		phone := decodeTokens(t, userRequest(handler, "/api/user/register", credentials, ""))
+		laptop := decodeTokens(t, userRequest(handler, "/api/user/login", credentials, ""))
+		laptop = decodeTokens(t, refresh(handler, laptop.RefreshToken))
+		other := decodeTokens(t, userRequest(handler, "/api/user/register", `{"login": "other", "password": "password"}`, ""))
+
+		require.Equal(t, http.StatusOK, userRequest(handler, "/api/user/logout/all", "", phone.AccessToken).Code)
+
+		for _, tokens := range []models.TokenResponse{phone, laptop} {
+			assert.Equal(t, http.StatusUnauthorized, balanceStatus(handler, tokens.AccessToken))
+			assert.Equal(t, http.StatusUnauthorized, refresh(handler, tokens.RefreshToken).Code)
+		}
+		assert.Equal(t, http.StatusOK, balanceStatus(handler, other.AccessToken))
+	})
+}
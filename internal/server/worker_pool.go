@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// MaxWorkers наибольший допустимый размер пула воркеров
+const MaxWorkers = 256
+
+// WorkerPoolStatus состояние пула воркеров обработки заказов
+type WorkerPoolStatus struct {
+	Size int `json:"size"`
+	Min  int `json:"min"`
+	Max  int `json:"max"`
+	// Auto размер подбирается автоматически между Min и Max; false — размер закреплен вручную
+	Auto bool `json:"auto"`
+	// Backlog, LatencyMs и RateBudget замеры последнего подбора размера
+	Backlog   int   `json:"backlog"`
+	LatencyMs int64 `json:"latency_ms"`
+	// RateBudget сколько воркеров загружает допустимая частота запросов; 0 — частота не ограничена
+	RateBudget int `json:"rate_budget"`
+}
+
+// workerJob заказ, переданный воркеру пула; done вызывается после обработки или пропуска заказа
+type workerJob struct {
+	ctx   context.Context
+	order models.Order
+	done  func()
+}
+
+// workerPool долгоживущий пул воркеров. Воркеры запускаются при первой пачке заказов
+// и живут до отмены ctx; размер пула меняется без перезапуска.
+type workerPool struct {
+	ctx    context.Context
+	handle func(job workerJob)
+	jobs   chan workerJob
+	retire chan struct{} // сигнал одному воркеру завершиться при уменьшении пула
+
+	mu         sync.Mutex
+	started    bool
+	size       int
+	min        int
+	max        int
+	auto       bool
+	backlog    int
+	latency    time.Duration
+	rateBudget int
+}
+
+// newWorkerPool создает пул из size воркеров, каждый обрабатывает заказы функцией handle
+func newWorkerPool(ctx context.Context, size int, handle func(job workerJob)) *workerPool {
+	size = min(max(size, 1), MaxWorkers)
+	return &workerPool{
+		ctx:    ctx,
+		handle: handle,
+		jobs:   make(chan workerJob),
+		retire: make(chan struct{}, MaxWorkers),
+		size:   size,
+		min:    size,
+		max:    size,
+		auto:   true,
+	}
+}
+
+// start запускает воркеры, если они еще не запущены
+func (p *workerPool) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started {
+		return
+	}
+	p.started = true
+	for i := 0; i < p.size; i++ {
+		go p.work()
+	}
+}
+
+// work обрабатывает заказы, пока пул не уменьшится или ctx не будет отменен
+func (p *workerPool) work() {
+	for {
+		select {
+		case job := <-p.jobs:
+			p.handle(job)
+		case <-p.retire:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// submit передает заказ свободному воркеру; возвращает false, если дождаться воркера
+// не удалось до отмены ctx или закрытия stop
+func (p *workerPool) submit(ctx context.Context, stop <-chan struct{}, job workerJob) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-stop:
+		return false
+	}
+}
+
+// resizeLocked меняет число воркеров на n; вызывается под блокировкой
+func (p *workerPool) resizeLocked(n int) {
+	if !p.started {
+		p.size = n
+		return
+	}
+	for ; p.size < n; p.size++ {
+		select {
+		case <-p.retire:
+			// Отменяем еще не выполненное уменьшение вместо запуска нового воркера
+		default:
+			go p.work()
+		}
+	}
+	for ; p.size > n; p.size-- {
+		p.retire <- struct{}{}
+	}
+}
+
+// setBounds задает границы размера и включает автоматический подбор
+func (p *workerPool) setBounds(minSize, maxSize int) error {
+	if minSize < 1 || maxSize < minSize || maxSize > MaxWorkers {
+		return fmt.Errorf("worker pool bounds must satisfy 1 <= min <= max <= %d, got %d..%d", MaxWorkers, minSize, maxSize)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.min, p.max, p.auto = minSize, maxSize, true
+	p.resizeLocked(min(max(p.size, minSize), maxSize))
+	return nil
+}
+
+// pin закрепляет размер пула и выключает автоматический подбор
+func (p *workerPool) pin(size int) error {
+	if size < 1 || size > MaxWorkers {
+		return fmt.Errorf("worker pool size must be in [1, %d], got %d", MaxWorkers, size)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.auto = false
+	p.resizeLocked(size)
+	return nil
+}
+
+// autoscaling сообщает, подбирается ли размер пула автоматически
+func (p *workerPool) autoscaling() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.auto && p.min < p.max
+}
+
+// autoscale подбирает размер пула: столько воркеров, чтобы очередь из backlog заказов
+// разобралась за drainTime при задержке ответа latency, но не больше, чем загружает
+// допустимая частота запросов с интервалом interval. Пока задержка не замерена, размер
+// не меняется; по замерам пул уменьшается не больше чем вдвое за раз. Возвращает размер до и после.
+func (p *workerPool) autoscale(backlog int, latency, interval, drainTime time.Duration, paused bool) (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.backlog = backlog
+	p.latency = latency
+	p.rateBudget = 0
+	if interval > 0 && latency > 0 {
+		// Воркер, ожидающий очереди ограничителя, не ускоряет обработку
+		p.rateBudget = int((latency + interval - 1) / interval)
+	}
+
+	before := p.size
+	if !p.auto {
+		return before, before
+	}
+
+	desired := p.size
+	switch {
+	case paused, backlog == 0:
+		// Запросы приостановлены или очередь пуста: лишние воркеры простаивали бы
+		desired = p.min
+	case latency > 0 && drainTime > 0:
+		desired = int((time.Duration(backlog)*latency + drainTime - 1) / drainTime)
+		desired = min(desired, backlog)
+		if p.rateBudget > 0 {
+			desired = min(desired, p.rateBudget)
+		}
+		// Очередь колеблется между проходами: пул уменьшается постепенно
+		if desired < p.size {
+			desired = max(desired, p.size/2)
+		}
+	}
+	desired = min(max(desired, p.min), p.max)
+
+	p.resizeLocked(desired)
+	return before, desired
+}
+
+// status возвращает состояние пула
+func (p *workerPool) status() WorkerPoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return WorkerPoolStatus{
+		Size:       p.size,
+		Min:        p.min,
+		Max:        p.max,
+		Auto:       p.auto,
+		Backlog:    p.backlog,
+		LatencyMs:  p.latency.Milliseconds(),
+		RateBudget: p.rateBudget,
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+)
+
+func TestWorkerPool_Autoscale(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		backlog  int
+		latency  time.Duration
+		interval time.Duration
+		paused   bool
+		want     int
+	}{
+		{name: "Backlog drained within interval", size: 2, backlog: 300, latency: 100 * time.Millisecond, want: 6},
+		{name: "Capped by maximum", size: 2, backlog: 10000, latency: 100 * time.Millisecond, want: 20},
+		{name: "No more workers than orders", size: 2, backlog: 3, latency: 10 * time.Second, want: 3},
+		{name: "Capped by rate budget", size: 2, backlog: 10000, latency: 100 * time.Millisecond, interval: 25 * time.Millisecond, want: 4},
+		{name: "Empty queue", size: 10, backlog: 0, latency: 100 * time.Millisecond, want: 2},
+		{name: "Paused", size: 10, backlog: 500, latency: 100 * time.Millisecond, paused: true, want: 2},
+		{name: "Unknown latency keeps size", size: 7, backlog: 500, want: 7},
+		{name: "Shrinks at most by half", size: 16, backlog: 10, latency: 100 * time.Millisecond, want: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newWorkerPool(context.Background(), tt.size, func(workerJob) {})
+			require.NoError(t, pool.setBounds(2, 20))
+
+			before, after := pool.autoscale(tt.backlog, tt.latency, tt.interval, 5*time.Second, tt.paused)
+			assert.Equal(t, tt.size, before)
+			assert.Equal(t, tt.want, after)
+			assert.Equal(t, tt.want, pool.status().Size)
+		})
+	}
+
+	t.Run("Pinned size", func(t *testing.T) {
+		pool := newWorkerPool(context.Background(), 5, func(workerJob) {})
+		require.NoError(t, pool.setBounds(2, 20))
+		require.NoError(t, pool.pin(3))
+		assert.False(t, pool.autoscaling())
+
+		_, after := pool.autoscale(10000, 100*time.Millisecond, 0, 5*time.Second, false)
+		assert.Equal(t, 3, after)
+
+		status := pool.status()
+		assert.False(t, status.Auto)
+		assert.Equal(t, 10000, status.Backlog)
+		assert.Equal(t, int64(100), status.LatencyMs)
+	})
+
+	t.Run("Invalid bounds", func(t *testing.T) {
+		pool := newWorkerPool(context.Background(), 5, func(workerJob) {})
+		assert.Error(t, pool.setBounds(0, 10))
+		assert.Error(t, pool.setBounds(10, 5))
+		assert.Error(t, pool.setBounds(1, MaxWorkers+1))
+		assert.Error(t, pool.pin(0))
+	})
+}
+
+func TestWorkerPool_Resize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	release := make(chan struct{})
+	pool := newWorkerPool(ctx, 1, func(job workerJob) {
+		defer job.done()
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	pool.start()
+
+	// runBatch отправляет n заказов и ждет, пока все они не будут переданы воркерам
+	runBatch := func(n int) int {
+		mu.Lock()
+		peak = 0
+		mu.Unlock()
+
+		var wg sync.WaitGroup
+		submitted := make(chan struct{})
+		go func() {
+			defer close(submitted)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				pool.submit(ctx, nil, workerJob{ctx: ctx, order: models.Order{Number: fmt.Sprint(i)}, done: wg.Done})
+			}
+		}()
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return running == min(n, pool.status().Size)
+		}, time.Second, time.Millisecond)
+
+		for i := 0; i < n; i++ {
+			release <- struct{}{}
+		}
+		<-submitted
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return peak
+	}
+
+	assert.Equal(t, 1, runBatch(4))
+
+	// Увеличенный пул обрабатывает заказы параллельно без перезапуска
+	require.NoError(t, pool.pin(4))
+	assert.Equal(t, 4, runBatch(4))
+
+	// Лишние воркеры завершаются после уменьшения пула
+	require.NoError(t, pool.pin(2))
+	assert.Equal(t, 2, runBatch(4))
+}
+
+// statsAccrualService заглушка системы начисления с заданными задержкой и интервалом запросов
+type statsAccrualService struct {
+	*stubAccrualService
+	latency  time.Duration
+	interval time.Duration
+}
+
+func (s *statsAccrualService) Latency() time.Duration {
+	return s.latency
+}
+
+func (s *statsAccrualService) RequestInterval() time.Duration {
+	return s.interval
+}
+
+func TestOrderProcessor_AutoscaleWorkers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	accrualService := &statsAccrualService{stubAccrualService: newStubAccrualService(), latency: 100 * time.Millisecond}
+
+	numbers := make([]string, 30)
+	for i := range numbers {
+		numbers[i] = fmt.Sprintf("order%02d", i)
+	}
+	newTestUser(t, store, "user", 0, numbers...)
+
+	processor := NewOrderProcessor(store, accrualService, time.Second, 1, zap.NewNop())
+	require.NoError(t, processor.SetWorkerBounds(1, 20))
+
+	// 30 заказов по 100 мс за секунду интервала разбирают 3 воркера
+	processor.ProcessOrders()
+	status := processor.WorkerPoolStatus()
+	assert.Equal(t, 3, status.Size)
+	assert.Equal(t, 30, status.Backlog)
+	assert.Equal(t, int64(100), status.LatencyMs)
+	assert.True(t, status.Auto)
+
+	for _, number := range numbers {
+		assert.Equal(t, 1, accrualService.Calls(number))
+	}
+}
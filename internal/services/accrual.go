@@ -1,21 +1,53 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 )
 
+// maxResponseBodySize ограничивает размер тела ответа системы начисления
+const maxResponseBodySize = 64 << 10
+
+// latencySmoothing вес нового замера в скользящей средней задержки ответов
+const latencySmoothing = 0.2
+
 // AccrualService сервис для работы с системой начисления баллов
 type AccrualService struct {
-	client  *retryablehttp.Client
-	baseURL string
+	client   *retryablehttp.Client
+	baseURL  string
+	name     string // имя системы в журнале событий; пустое, если система одна
+	breaker  *CircuitBreaker
+	limiter  *RateLimiter
+	recorder AccrualEventRecorder
+
+	latencyMu sync.Mutex
+	latency   time.Duration // скользящая средняя задержки ответов; 0 — ответов еще не было
+}
+
+// AccrualEventRecorder журнал ответов системы начисления. Ошибки записи обрабатывает сам журнал:
+// запрос к системе уже выполнен, и его результат не должен теряться из-за журнала.
+type AccrualEventRecorder interface {
+	RecordAccrualEvent(ctx context.Context, event *models.AccrualEvent)
+}
+
+// RateLimitStore хранилище допустимой частоты запросов, общее для экземпляров сервиса
+type RateLimitStore interface {
+	// SaveAccrualRateLimit сохраняет число запросов в минуту, допустимое системой начисления system
+	SaveAccrualRateLimit(ctx context.Context, system string, perMinute int) error
+	// SyncAccrualRateLimit отмечает экземпляр clientID активным на время ttl и возвращает
+	// сохраненную частоту (0, если неизвестна) и число активных экземпляров
+	SyncAccrualRateLimit(ctx context.Context, system, clientID string, ttl time.Duration) (perMinute, clients int, err error)
 }
 
 // NewAccrualService создает новый сервис начисления баллов
@@ -33,10 +65,13 @@ func NewAccrualService(baseURL string) *AccrualService {
 		}
 		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
 	}
+	client.ResponseLogHook = captureResponse
 
 	return &AccrualService{
 		client:  client,
 		baseURL: baseURL,
+		breaker: NewCircuitBreaker(DefaultBreakerSettings()),
+		limiter: NewRateLimiter(),
 	}
 }
 
@@ -54,51 +89,213 @@ func NewAccrualServiceWithRetry(baseURL string, maxRetries int, baseDelay, maxDe
 		}
 		return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
 	}
+	client.ResponseLogHook = captureResponse
 
 	return &AccrualService{
 		client:  client,
 		baseURL: baseURL,
+		breaker: NewCircuitBreaker(DefaultBreakerSettings()),
+		limiter: NewRateLimiter(),
+	}
+}
+
+// SetBreakerSettings заменяет автоматический выключатель новым с параметрами settings
+func (s *AccrualService) SetBreakerSettings(settings BreakerSettings) {
+	s.breaker = NewCircuitBreaker(settings)
+}
+
+// SetEventRecorder включает запись каждого ответа системы начисления в журнал recorder
+func (s *AccrualService) SetEventRecorder(recorder AccrualEventRecorder) {
+	s.recorder = recorder
+}
+
+// BreakerStatus возвращает состояние автоматического выключателя для проверок работоспособности
+func (s *AccrualService) BreakerStatus() BreakerStatus {
+	return s.breaker.Status()
+}
+
+// RateLimit возвращает узнанное число запросов в минуту к системе начисления; 0 — неизвестно
+func (s *AccrualService) RateLimit() int {
+	return s.limiter.Limit()
+}
+
+// RequestInterval возвращает интервал между запросами этого экземпляра, допустимый
+// системой начисления; 0 — частота неизвестна и запросы не ограничиваются
+func (s *AccrualService) RequestInterval() time.Duration {
+	return s.limiter.Interval()
+}
+
+// Latency возвращает скользящую среднюю задержки ответов системы начисления без учета
+// ожидания очереди ограничителя; 0 — ответов еще не было
+func (s *AccrualService) Latency() time.Duration {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+
+	return s.latency
+}
+
+// observeLatency учитывает задержку ответа в скользящей средней
+func (s *AccrualService) observeLatency(d time.Duration) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+
+	if s.latency == 0 {
+		s.latency = d
+		return
 	}
+	s.latency += time.Duration(latencySmoothing * float64(d-s.latency))
+}
+
+// SyncRateLimit сохраняет частоту, узнанную из ответов 429, и загружает частоту,
+// узнанную другими экземплярами, вместе с числом экземпляров, между которыми она делится
+func (s *AccrualService) SyncRateLimit(ctx context.Context, store RateLimitStore, clientID string, ttl time.Duration) error {
+	if limit, pending := s.limiter.pendingLimit(); pending {
+		if err := store.SaveAccrualRateLimit(ctx, s.baseURL, limit); err != nil {
+			return fmt.Errorf("failed to save accrual rate limit: %w", err)
+		}
+		s.limiter.markSaved(limit)
+	}
+
+	limit, clients, err := store.SyncAccrualRateLimit(ctx, s.baseURL, clientID, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to sync accrual rate limit: %w", err)
+	}
+	s.limiter.SetLimit(limit, clients)
+
+	return nil
 }
 
-// GetOrderInfo получает информацию о заказе из системы начисления
+// GetOrderInfo получает информацию о заказе из системы начисления.
+// Пока выключатель разомкнут, сразу возвращает *CircuitOpenError.
+// Запросы распределяются с допустимой частотой; если дождаться очереди
+// до истечения ctx нельзя, возвращает *RateLimitError, не отправляя запрос.
 func (s *AccrualService) GetOrderInfo(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
+	if err := s.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	if err := s.limiter.Wait(ctx); err != nil {
+		s.breaker.Cancel()
+		return nil, err
+	}
+
+	result, err := s.getOrderInfo(ctx, orderNumber)
+	switch {
+	case err == nil, errors.Is(err, ErrRateLimitExceeded):
+		// Система отвечает; ограничение частоты обрабатывается отдельно
+		s.breaker.Success()
+	case ctx.Err() != nil:
+		// Запрос отменен вызывающей стороной, о состоянии системы это ничего не говорит
+		s.breaker.Cancel()
+	default:
+		s.breaker.Failure()
+	}
+
+	return result, err
+}
+
+// getOrderInfo выполняет запрос о заказе к системе начисления и записывает ответ в журнал событий
+func (s *AccrualService) getOrderInfo(ctx context.Context, orderNumber string) (*models.AccrualResponse, error) {
 	url := fmt.Sprintf("%s/api/orders/%s", s.baseURL, orderNumber)
 	req, err := retryablehttp.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Выполняем запрос с retry
+	event := &models.AccrualEvent{
+		OrderNumber: orderNumber,
+		Provider:    s.name,
+		Source:      models.AccrualEventPoll,
+		RequestedAt: time.Now(),
+	}
+	if s.recorder != nil {
+		req = req.WithContext(context.WithValue(ctx, eventKey{}, event))
+	}
+	result, err := s.doRequest(req)
+	latency := time.Since(event.RequestedAt)
+	event.LatencyMs = latency.Milliseconds()
+	if ctx.Err() == nil {
+		s.observeLatency(latency)
+	}
+	if result != nil {
+		event.Status = result.Status
+		event.Accrual = result.Accrual
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if s.recorder != nil {
+		s.recorder.RecordAccrualEvent(ctx, event)
+	}
+
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		s.limiter.Learn(rateLimitErr.Limit, rateLimitErr.RetryAfter)
+	}
+
+	return result, err
+}
+
+// doRequest выполняет запрос с retry и разбирает ответ
+func (s *AccrualService) doRequest(req *retryablehttp.Request) (*models.AccrualResponse, error) {
 	resp, err := s.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	switch resp.StatusCode {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	return ParseAccrualResponse(resp.StatusCode, resp.Header.Get("Retry-After"), body)
+}
+
+// eventKey ключ контекста запроса с событием журнала, которое заполняет captureResponse
+type eventKey struct{}
+
+// captureResponse сохраняет код и тело каждого ответа в событие запроса.
+// Если система отвечает ошибкой на все попытки, в журнал попадает последний ответ.
+func captureResponse(_ retryablehttp.Logger, resp *http.Response) {
+	event, ok := resp.Request.Context().Value(eventKey{}).(*models.AccrualEvent)
+	if !ok {
+		return
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBodySize))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	event.HTTPStatus = resp.StatusCode
+	event.Body = string(body)
+}
+
+// ParseAccrualResponse разбирает ответ системы начисления с кодом statusCode,
+// заголовком Retry-After и телом body. Возвращает nil без ошибки, если заказ не зарегистрирован (204).
+func ParseAccrualResponse(statusCode int, retryAfterHeader string, body []byte) (*models.AccrualResponse, error) {
+	switch statusCode {
 	case http.StatusOK:
 		var accrualResp models.AccrualResponse
-		if err := json.NewDecoder(resp.Body).Decode(&accrualResp); err != nil {
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&accrualResp); err != nil {
 			return nil, fmt.Errorf("failed to decode response: %w", err)
 		}
 		return &accrualResp, nil
 	case http.StatusNoContent:
 		return nil, nil
 	case http.StatusTooManyRequests:
-		retryAfterStr := resp.Header.Get("Retry-After")
 		var retryAfter time.Duration
-		if retryAfterStr != "" {
-			if seconds, err := strconv.Atoi(retryAfterStr); err == nil {
+		if retryAfterHeader != "" {
+			if seconds, err := strconv.Atoi(retryAfterHeader); err == nil {
 				retryAfter = time.Duration(seconds) * time.Second
 			}
 		}
-		return nil, &RateLimitError{RetryAfter: retryAfter}
+		// Тело вида "No more than N requests per minute allowed" сообщает допустимую частоту
+		return nil, &RateLimitError{RetryAfter: retryAfter, Limit: parseRateLimit(body)}
 	case http.StatusInternalServerError:
 		return nil, ErrInternalServer
 	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
-		return nil, fmt.Errorf("server error: %d", resp.StatusCode)
+		return nil, fmt.Errorf("server error: %d", statusCode)
 	default:
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status code: %d", statusCode)
 	}
 }
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/accrualsim"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/storage"
+)
+
+// TestAccrualService_Simulator проверяет клиент против симулятора системы начисления
+func TestAccrualService_Simulator(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{})
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	// Без повторов, чтобы каждый шаг сценария соответствовал одному вызову
+	service := NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	ctx := context.Background()
+
+	t.Run("Progression", func(t *testing.T) {
+		sim.SetOrder("12345678903",
+			accrualsim.WithStatus(models.AccrualStatusRegistered),
+			accrualsim.Processed(models.Money(72998)),
+		)
+
+		result, err := service.GetOrderInfo(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, "REGISTERED", result.Status)
+		assert.Nil(t, result.Accrual)
+
+		result, err = service.GetOrderInfo(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, "PROCESSED", result.Status)
+		require.NotNil(t, result.Accrual)
+		assert.Equal(t, models.Money(72998), *result.Accrual)
+	})
+
+	t.Run("Unknown order", func(t *testing.T) {
+		result, err := service.GetOrderInfo(ctx, "79927398713")
+		require.NoError(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("Faults", func(t *testing.T) {
+		sim.SetOrder("2377225624",
+			accrualsim.WithHTTPStatus(http.StatusInternalServerError),
+			accrualsim.WithHTTPStatus(http.StatusServiceUnavailable),
+			accrualsim.Step{Malformed: true},
+		)
+
+		// Ответы 5xx повторяет retryablehttp и сдается после исчерпания попыток
+		_, err := service.GetOrderInfo(ctx, "2377225624")
+		assert.ErrorContains(t, err, "giving up after")
+
+		_, err = service.GetOrderInfo(ctx, "2377225624")
+		assert.ErrorContains(t, err, "giving up after")
+
+		_, err = service.GetOrderInfo(ctx, "2377225624")
+		assert.ErrorContains(t, err, "failed to decode response")
+	})
+
+	t.Run("Rate limit", func(t *testing.T) {
+		sim.SetOrder("12345678903", accrualsim.WithStatus(models.AccrualStatusProcessing))
+		sim.SetRateLimit(1, 7*time.Second)
+		defer sim.SetRateLimit(0, 0)
+
+		_, err := service.GetOrderInfo(ctx, "12345678903")
+		require.NoError(t, err)
+
+		_, err = service.GetOrderInfo(ctx, "12345678903")
+		var rateLimitErr *RateLimitError
+		require.True(t, errors.As(err, &rateLimitErr))
+		assert.Equal(t, 7*time.Second, rateLimitErr.RetryAfter)
+	})
+}
+
+// TestAccrualService_CircuitBreaker проверяет, что после серии ошибок запросы к системе не отправляются
+func TestAccrualService_CircuitBreaker(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{})
+	sim.SetOrder("12345678903",
+		accrualsim.WithHTTPStatus(http.StatusServiceUnavailable),
+		accrualsim.WithHTTPStatus(http.StatusServiceUnavailable),
+		accrualsim.WithStatus(models.AccrualStatusProcessing),
+	)
+	sim.SetOrder("79927398713", accrualsim.WithStatus(models.AccrualStatusProcessing))
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	service := NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	service.SetBreakerSettings(BreakerSettings{FailureThreshold: 2, CoolDown: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	// Ответ 204 не считается неудачей
+	_, err := service.GetOrderInfo(ctx, "2377225624")
+	require.NoError(t, err)
+
+	for range 2 {
+		_, err = service.GetOrderInfo(ctx, "12345678903")
+		require.Error(t, err)
+	}
+	assert.Equal(t, "open", service.BreakerStatus().State)
+
+	// Разомкнутый выключатель отвечает сразу, не обращаясь к системе
+	_, err = service.GetOrderInfo(ctx, "79927398713")
+	var openErr *CircuitOpenError
+	require.True(t, errors.As(err, &openErr))
+	assert.Positive(t, openErr.RetryAfter)
+	assert.Equal(t, 0, sim.Requests("79927398713"))
+
+	// После паузы пробный запрос проходит и замыкает выключатель
+	time.Sleep(60 * time.Millisecond)
+	result, err := service.GetOrderInfo(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, models.AccrualStatusProcessing, result.Status)
+	assert.Equal(t, "closed", service.BreakerStatus().State)
+}
+
+// TestAccrualService_LearnRateLimit проверяет, что частота из ответа 429 сохраняется
+// в общем хранилище и подхватывается другими экземплярами
+func TestAccrualService_LearnRateLimit(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{
+		Default: accrualsim.Script{accrualsim.WithStatus(models.AccrualStatusProcessing)},
+	})
+	sim.SetRateLimit(1, 20*time.Second)
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	store := storage.NewMemoryStorage()
+	ctx := context.Background()
+	first := NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	second := NewAccrualServiceWithRetry(server.URL, 0, time.Millisecond, time.Millisecond)
+	require.NoError(t, second.SyncRateLimit(ctx, store, "second", time.Minute))
+
+	_, err := first.GetOrderInfo(ctx, "12345678903")
+	require.NoError(t, err)
+
+	_, err = first.GetOrderInfo(ctx, "12345678903")
+	var rateLimitErr *RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr))
+	assert.Equal(t, 1, rateLimitErr.Limit)
+	assert.Equal(t, 1, first.RateLimit())
+
+	// Пока система просит подождать, запрос не отправляется
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = first.GetOrderInfo(shortCtx, "12345678903")
+	require.ErrorIs(t, err, ErrRateLimitExceeded)
+	assert.Equal(t, 2, sim.Requests("12345678903"))
+
+	require.NoError(t, first.SyncRateLimit(ctx, store, "first", time.Minute))
+	require.NoError(t, second.SyncRateLimit(ctx, store, "second", time.Minute))
+	assert.Equal(t, 1, second.RateLimit())
+
+	// Частота делится между двумя экземплярами
+	assert.Equal(t, 2*time.Minute, second.limiter.intervalLocked())
+}
+
+// eventLog журнал ответов в памяти для тестов
+type eventLog struct {
+	events []models.AccrualEvent
+}
+
+func (l *eventLog) RecordAccrualEvent(ctx context.Context, event *models.AccrualEvent) {
+	l.events = append(l.events, *event)
+}
+
+// TestAccrualService_EventRecorder проверяет запись ответов системы начисления в исходном виде
+func TestAccrualService_EventRecorder(t *testing.T) {
+	sim := accrualsim.New(accrualsim.Scenario{})
+	server := httptest.NewServer(sim)
+	defer server.Close()
+
+	service := NewAccrualServiceWithRetry(server.URL, 1, time.Millisecond, time.Millisecond)
+	log := &eventLog{}
+	service.SetEventRecorder(log)
+	ctx := context.Background()
+
+	sim.SetOrder("12345678903", accrualsim.Processed(models.Money(72998)))
+	sim.SetOrder("2377225624", accrualsim.WithHTTPStatus(http.StatusServiceUnavailable))
+
+	_, err := service.GetOrderInfo(ctx, "12345678903")
+	require.NoError(t, err)
+	_, err = service.GetOrderInfo(ctx, "79927398713")
+	require.NoError(t, err)
+	_, err = service.GetOrderInfo(ctx, "2377225624")
+	require.Error(t, err)
+
+	require.Len(t, log.events, 3)
+
+	processed := log.events[0]
+	assert.Equal(t, "12345678903", processed.OrderNumber)
+	assert.Equal(t, models.AccrualEventPoll, processed.Source)
+	assert.Equal(t, http.StatusOK, processed.HTTPStatus)
+	assert.JSONEq(t, `{"order":"12345678903","status":"PROCESSED","accrual":729.98}`, processed.Body)
+	assert.Equal(t, models.AccrualStatusProcessed, processed.Status)
+	require.NotNil(t, processed.Accrual)
+	assert.Equal(t, models.Money(72998), *processed.Accrual)
+	assert.Empty(t, processed.Error)
+	assert.False(t, processed.RequestedAt.IsZero())
+
+	unknown := log.events[1]
+	assert.Equal(t, http.StatusNoContent, unknown.HTTPStatus)
+	assert.Empty(t, unknown.Status)
+
+	// После исчерпания повторов записывается последний ответ и итоговая ошибка
+	failed := log.events[2]
+	assert.Equal(t, http.StatusServiceUnavailable, failed.HTTPStatus)
+	assert.Contains(t, failed.Error, "giving up after")
+	assert.Equal(t, 2, sim.Requests("2377225624"))
+
+	// Разбор сохраненного ответа совпадает с исходным
+	info, err := ParseAccrualResponse(processed.HTTPStatus, "", []byte(processed.Body))
+	require.NoError(t, err)
+	assert.Equal(t, processed.Status, info.Status)
+	assert.Equal(t, processed.Accrual, info.Accrual)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 )
 
 func TestNewAccrualService(t *testing.T) {
@@ -59,7 +60,27 @@ func TestAccrualService_GetOrderInfo_Success(t *testing.T) {
 	assert.Equal(t, "12345678903", result.Order)
 	assert.Equal(t, "PROCESSED", result.Status)
 	require.NotNil(t, result.Accrual)
-	assert.Equal(t, 500.0, *result.Accrual)
+	assert.Equal(t, models.Money(50000), *result.Accrual)
+}
+
+func TestAccrualService_Latency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	service := NewAccrualService(server.URL)
+	assert.Zero(t, service.Latency())
+	assert.Zero(t, service.RequestInterval())
+
+	_, err := service.GetOrderInfo(context.Background(), "12345678903")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, service.Latency(), 20*time.Millisecond)
+
+	// Узнанная частота делится между экземплярами
+	service.limiter.SetLimit(60, 2)
+	assert.Equal(t, 2*time.Second, service.RequestInterval())
 }
 
 func TestAccrualService_GetOrderInfo_NotFound(t *testing.T) {
@@ -212,3 +233,26 @@ func TestAccrualService_GetOrderInfo_ContextCancelled(t *testing.T) {
 	// Проверяем, что ошибка связана с контекстом
 	assert.Contains(t, err.Error(), "context")
 }
+
+func TestParseAccrualResponse(t *testing.T) {
+	info, err := ParseAccrualResponse(http.StatusOK, "", []byte(`{"order":"1","status":"PROCESSED","accrual":500}`))
+	require.NoError(t, err)
+	require.NotNil(t, info.Accrual)
+	assert.Equal(t, models.Money(50000), *info.Accrual)
+
+	info, err = ParseAccrualResponse(http.StatusNoContent, "", nil)
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	_, err = ParseAccrualResponse(http.StatusTooManyRequests, "60", []byte("No more than 10 requests per minute allowed"))
+	var rateLimitErr *RateLimitError
+	require.ErrorAs(t, err, &rateLimitErr)
+	assert.Equal(t, 60*time.Second, rateLimitErr.RetryAfter)
+	assert.Equal(t, 10, rateLimitErr.Limit)
+
+	_, err = ParseAccrualResponse(http.StatusInternalServerError, "", nil)
+	assert.ErrorIs(t, err, ErrInternalServer)
+
+	_, err = ParseAccrualResponse(http.StatusOK, "", []byte("{"))
+	assert.ErrorContains(t, err, "failed to decode response")
+}
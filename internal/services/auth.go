@@ -1,26 +1,216 @@
 package services
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Сроки действия токенов по умолчанию
+const (
+	// DefaultAccessTokenTTL срок действия access токена (JWT): короткий, чтобы утекший токен
+	// быстро стал бесполезен
+	DefaultAccessTokenTTL = 15 * time.Minute
+	// DefaultRefreshTokenTTL срок действия refresh токена, которым access токен обновляется без пароля
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// TokenTypeBearer тип выдаваемых access токенов
+const TokenTypeBearer = "Bearer"
+
+// Стандартные утверждения токена по умолчанию
+const (
+	DefaultTokenIssuer   = "gophermart"
+	DefaultTokenAudience = "gophermart"
+)
+
+// TokenClaims утверждения JWT токена: стандартные iss, sub, aud, exp, nbf, iat и jti
+// и логин пользователя
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	// Login логин пользователя; sub — его идентификатор
+	Login string `json:"preferred_username,omitempty"`
+}
+
+// Параметры поворота ключей подписи по умолчанию
+const (
+	// DefaultKeyActivationDelay через сколько новый ключ начинает подписывать токены
+	DefaultKeyActivationDelay = 2 * time.Minute
+	// DefaultKeyOverlap сколько прежние ключи принимаются после вступления нового ключа в силу:
+	// не меньше срока действия access токена, чтобы выданные токены не стали недействительными
+	DefaultKeyOverlap = 24 * time.Hour
+)
+
 // AuthService сервис для аутентификации
 type AuthService struct {
-	jwtSecret []byte
+	mu      sync.RWMutex
+	keys    *KeyRing
+	keyFile string
+	// keyFileSum контрольная сумма файла ключей при последней загрузке
+	keyFileSum [sha256.Size]byte
+
+	algorithm       string // алгоритм новых ключей при повороте
+	activationDelay time.Duration
+	overlap         time.Duration
+
+	issuer   string
+	audience string
+
+	accessTTL  time.Duration
+	refreshTTL time.Duration
 }
 
-// NewAuthService создает новый сервис аутентификации
+// NewAuthService создает сервис аутентификации с одним бессрочным ключом jwtSecret
 func NewAuthService(jwtSecret string) *AuthService {
+	return newAuthService(StaticKeyRing(jwtSecret))
+}
+
+// newAuthService создает сервис аутентификации с набором ключей keys и параметрами по умолчанию
+func newAuthService(keys *KeyRing) *AuthService {
 	return &AuthService{
-		jwtSecret: []byte(jwtSecret),
+		keys:            keys,
+		algorithm:       AlgHS256,
+		activationDelay: DefaultKeyActivationDelay,
+		overlap:         DefaultKeyOverlap,
+		issuer:          DefaultTokenIssuer,
+		audience:        DefaultTokenAudience,
+		accessTTL:       DefaultAccessTokenTTL,
+		refreshTTL:      DefaultRefreshTokenTTL,
+	}
+}
+
+// NewAuthServiceWithKeys создает сервис аутентификации с набором ключей подписи keys
+func NewAuthServiceWithKeys(keys *KeyRing) (*AuthService, error) {
+	if err := keys.Validate(); err != nil {
+		return nil, err
 	}
+	return newAuthService(keys), nil
+}
+
+// NewAuthServiceWithKeyFile создает сервис аутентификации с ключами из файла path;
+// если файла нет, он создается с одним новым ключом алгоритма alg. Поворот ключей тоже
+// создает ключи алгоритма alg. Изменения файла подхватывает ReloadKeyFile.
+func NewAuthServiceWithKeyFile(path, alg string) (*AuthService, error) {
+	if _, err := LoadOrCreateKeyRingFile(path, alg); err != nil {
+		return nil, err
+	}
+	keys, sum, err := readKeyRingFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newAuthService(keys)
+	s.keyFile = path
+	s.keyFileSum = sum
+	s.algorithm = alg
+	return s, nil
+}
+
+// SetTokenClaims задает издателя iss и получателя aud токенов. Токены с другими
+// издателем или получателем не принимаются.
+func (s *AuthService) SetTokenClaims(issuer, audience string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issuer = issuer
+	s.audience = audience
+}
+
+// SetTokenTTL задает сроки действия access и refresh токенов
+func (s *AuthService) SetTokenTTL(accessTTL, refreshTTL time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTTL = accessTTL
+	s.refreshTTL = refreshTTL
+}
+
+// SetKeyRotation задает параметры поворота ключей, см. KeyRing.Rotate. activationDelay должен
+// быть не меньше периода, с которым остальные экземпляры перечитывают файл ключей.
+func (s *AuthService) SetKeyRotation(activationDelay, overlap time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activationDelay = activationDelay
+	s.overlap = overlap
+}
+
+// KeyFile возвращает путь к файлу ключей; пустой, если ключи заданы не файлом
+func (s *AuthService) KeyFile() string {
+	return s.keyFile
+}
+
+// ReloadKeyFile перечитывает файл ключей, если он изменился с последней загрузки.
+// Возвращает true, если набор ключей обновлен. При ошибке остается прежний набор.
+func (s *AuthService) ReloadKeyFile() (bool, error) {
+	if s.keyFile == "" {
+		return false, nil
+	}
+
+	keys, sum, err := readKeyRingFile(s.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sum == s.keyFileSum {
+		return false, nil
+	}
+	s.keys = keys
+	s.keyFileSum = sum
+	return true, nil
+}
+
+// RotateKeys поворачивает ключи в файле ключей и сразу загружает новый набор, см. KeyRing.Rotate.
+// Остальные экземпляры загружают файл сами. Возвращает ErrKeysNotRotatable, если ключи заданы не файлом.
+func (s *AuthService) RotateKeys() ([]SigningKeyInfo, error) {
+	if s.keyFile == "" {
+		return nil, ErrKeysNotRotatable
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := RotateKeyRingFile(s.keyFile, s.algorithm, s.activationDelay, s.overlap); err != nil {
+		return nil, err
+	}
+	keys, sum, err := readKeyRingFile(s.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	s.keyFileSum = sum
+	return keys.Info(time.Now()), nil
+}
+
+// readKeyRingFile читает набор ключей из файла вместе с контрольной суммой содержимого
+func readKeyRingFile(path string) (*KeyRing, [sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, [sha256.Size]byte{}, fmt.Errorf("failed to read JWT keys: %w", err)
+	}
+	keys, err := LoadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, [sha256.Size]byte{}, err
+	}
+	return keys, sha256.Sum256(data), nil
+}
+
+// Keys возвращает сведения о ключах подписи без секретов
+func (s *AuthService) Keys() []SigningKeyInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys.Info(time.Now())
 }
 
 // HashPassword хеширует пароль
@@ -39,38 +229,152 @@ func (s *AuthService) CheckPassword(hashedPassword, password string) error {
 
 // GenerateJWT генерирует JWT токен для пользователя
 func (s *AuthService) GenerateJWT(userID int64, login string) (string, error) {
-	claims := jwt.RegisteredClaims{
-		Subject:   fmt.Sprintf("%d", userID),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		Issuer:    "gophermart",
-		Audience:  []string{login},
+	token, _, err := s.GenerateAccessToken(userID, login)
+	return token, err
+}
+
+// GenerateAccessToken генерирует access токен (JWT) для пользователя и возвращает его утверждения
+func (s *AuthService) GenerateAccessToken(userID int64, login string) (string, *TokenClaims, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	s.mu.RLock()
+	key, ok := s.keys.Active(now)
+	claims := TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.issuer,
+			Subject:   strconv.FormatInt(userID, 10),
+			Audience:  jwt.ClaimStrings{s.audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.accessTTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti,
+		},
+		Login: login,
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return "", nil, ErrNoActiveKey
+	}
+
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.signKey())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signed, &claims, nil
+}
+
+// IssueTokens выдает пользователю access токен и следующий refresh токен семейства familyID;
+// пустой familyID начинает новое семейство при входе. Возвращает ответ пользователю и запись
+// refresh токена для хранилища: сам refresh токен в ней не хранится, только его хеш.
+func (s *AuthService) IssueTokens(userID int64, login, familyID string) (*models.TokenResponse, *models.RefreshToken, error) {
+	accessToken, claims, err := s.GenerateAccessToken(userID, login)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.jwtSecret)
+	if familyID == "" {
+		if familyID, err = newTokenID(); err != nil {
+			return nil, nil, err
+		}
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(secret)
+
+	s.mu.RLock()
+	refreshTTL := s.refreshTTL
+	s.mu.RUnlock()
+
+	issuedAt := claims.IssuedAt.Time
+	response := &models.TokenResponse{
+		AccessToken:      accessToken,
+		TokenType:        TokenTypeBearer,
+		ExpiresIn:        int64(claims.ExpiresAt.Sub(issuedAt).Seconds()),
+		RefreshToken:     refreshToken,
+		RefreshExpiresIn: int64(refreshTTL.Seconds()),
+	}
+	record := &models.RefreshToken{
+		UserID:          userID,
+		FamilyID:        familyID,
+		TokenHash:       HashRefreshToken(refreshToken),
+		AccessTokenID:   claims.ID,
+		AccessExpiresAt: claims.ExpiresAt.Time,
+		CreatedAt:       issuedAt,
+		ExpiresAt:       issuedAt.Add(refreshTTL),
+	}
+	return response, record, nil
 }
 
-// ValidateJWT валидирует JWT токен
-func (s *AuthService) ValidateJWT(tokenString string) (*jwt.RegisteredClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+// HashRefreshToken возвращает хеш refresh токена, под которым он хранится. Токен содержит
+// 256 случайных бит, поэтому медленный хеш, как для паролей, не нужен.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newTokenID генерирует случайный идентификатор токена или семейства токенов
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// ValidateJWT валидирует JWT токен: подпись ключом kid его же алгоритмом, срок действия,
+// издателя и получателя
+func (s *AuthService) ValidateJWT(tokenString string) (*TokenClaims, error) {
+	s.mu.RLock()
+	issuer, audience := s.issuer, s.audience
+	s.mu.RUnlock()
+
+	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		key, ok := s.keys.Lookup(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		// Алгоритм задает ключ, а не заголовок токена: иначе открытый ключ можно выдать за секрет HMAC
+		if token.Method.Alg() != key.alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.jwtSecret, nil
-	})
+		return key.verifyKey(), nil
+	},
+		jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
 	}
 
-	if claims, ok := token.Claims.(*jwt.RegisteredClaims); ok && token.Valid {
+	if claims, ok := token.Claims.(*TokenClaims); ok && token.Valid {
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token")
 }
 
+// Ошибки ключей подписи
+var (
+	ErrNoActiveKey      = errors.New("no active JWT signing key")
+	ErrKeysNotRotatable = errors.New("JWT keys are not loaded from a key file")
+)
+
 // GenerateSecret генерирует секретный ключ для JWT
 func GenerateSecret() (string, error) {
 	bytes := make([]byte, 32)
@@ -1,8 +1,11 @@
 package services
 
 import (
+	"crypto/x509"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -12,7 +15,9 @@ func TestNewAuthService(t *testing.T) {
 	service := NewAuthService(jwtSecret)
 
 	require.NotNil(t, service)
-	assert.Equal(t, []byte(jwtSecret), service.jwtSecret)
+	key, ok := service.keys.Active(time.Now())
+	require.True(t, ok)
+	assert.Equal(t, []byte(jwtSecret), key.Secret)
 }
 
 func TestAuthService_HashPassword(t *testing.T) {
@@ -68,7 +73,117 @@ func TestAuthService_ValidateJWT(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, claims)
 	assert.Equal(t, "123", claims.Subject)
-	assert.Contains(t, claims.Audience, login)
+	assert.Equal(t, login, claims.Login)
+	assert.Equal(t, DefaultTokenIssuer, claims.Issuer)
+	assert.Contains(t, claims.Audience, DefaultTokenAudience)
+	assert.NotEmpty(t, claims.ID)
+	require.NotNil(t, claims.IssuedAt)
+	require.NotNil(t, claims.NotBefore)
+	require.NotNil(t, claims.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(DefaultAccessTokenTTL), claims.ExpiresAt.Time, time.Minute)
+
+	// Каждый токен получает свой jti
+	other, err := service.GenerateJWT(userID, login)
+	require.NoError(t, err)
+	otherClaims, err := service.ValidateJWT(other)
+	require.NoError(t, err)
+	assert.NotEqual(t, claims.ID, otherClaims.ID)
+}
+
+func TestAuthService_AsymmetricAlgorithms(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			keys, err := NewKeyRing(alg, time.Now().Add(-time.Minute))
+			require.NoError(t, err)
+			service, err := NewAuthServiceWithKeys(keys)
+			require.NoError(t, err)
+
+			token, err := service.GenerateJWT(123, "testuser")
+			require.NoError(t, err)
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &TokenClaims{})
+			require.NoError(t, err)
+			assert.Equal(t, alg, parsed.Method.Alg())
+
+			claims, err := service.ValidateJWT(token)
+			require.NoError(t, err)
+			assert.Equal(t, "123", claims.Subject)
+
+			// Другой ключ того же алгоритма токен не принимает
+			otherKeys, err := NewKeyRing(alg, time.Now().Add(-time.Minute))
+			require.NoError(t, err)
+			other, err := NewAuthServiceWithKeys(otherKeys)
+			require.NoError(t, err)
+			_, err = other.ValidateJWT(token)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAuthService_ValidateJWT_AlgorithmConfusion(t *testing.T) {
+	keys, err := NewKeyRing(AlgRS256, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	service, err := NewAuthServiceWithKeys(keys)
+	require.NoError(t, err)
+
+	key, ok := keys.Active(time.Now())
+	require.True(t, ok)
+
+	// Токен HS256, подписанный открытым ключом как секретом, не принимается
+	public, err := x509.MarshalPKIXPublicKey(key.verifyKey())
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    DefaultTokenIssuer,
+		Subject:   "1",
+		Audience:  jwt.ClaimStrings{DefaultTokenAudience},
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	forged.Header["kid"] = key.ID
+	token, err := forged.SignedString(public)
+	require.NoError(t, err)
+
+	_, err = service.ValidateJWT(token)
+	assert.Error(t, err)
+
+	// Неподписанный токен не принимается
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, forged.Claims)
+	unsigned.Header["kid"] = key.ID
+	token, err = unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+
+	_, err = service.ValidateJWT(token)
+	assert.Error(t, err)
+}
+
+func TestAuthService_ValidateJWT_TokenClaims(t *testing.T) {
+	issuer := NewAuthService("test-secret")
+	issuer.SetTokenClaims("gophermart", "orders-service")
+
+	token, err := issuer.GenerateJWT(123, "testuser")
+	require.NoError(t, err)
+
+	claims, err := issuer.ValidateJWT(token)
+	require.NoError(t, err)
+	assert.Equal(t, jwt.ClaimStrings{"orders-service"}, claims.Audience)
+
+	tests := []struct {
+		name     string
+		issuer   string
+		audience string
+	}{
+		{name: "Wrong audience", issuer: "gophermart", audience: "billing-service"},
+		{name: "Wrong issuer", issuer: "other", audience: "orders-service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := NewAuthService("test-secret")
+			verifier.SetTokenClaims(tt.issuer, tt.audience)
+
+			_, err := verifier.ValidateJWT(token)
+			assert.Error(t, err)
+		})
+	}
 }
 
 func TestAuthService_ValidateJWT_InvalidToken(t *testing.T) {
@@ -98,6 +213,43 @@ func TestAuthService_ValidateJWT_WrongSecret(t *testing.T) {
 	assert.Nil(t, claims)
 }
 
+func TestAuthService_IssueTokens(t *testing.T) {
+	service := NewAuthService("test-secret")
+	service.SetTokenTTL(5*time.Minute, time.Hour)
+
+	response, record, err := service.IssueTokens(123, "testuser", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, TokenTypeBearer, response.TokenType)
+	assert.Equal(t, int64(300), response.ExpiresIn)
+	assert.Equal(t, int64(3600), response.RefreshExpiresIn)
+	assert.NotEmpty(t, response.RefreshToken)
+
+	claims, err := service.ValidateJWT(response.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "123", claims.Subject)
+
+	// Хранится только хеш refresh токена вместе с jti выданного с ним access токена
+	assert.Equal(t, int64(123), record.UserID)
+	assert.NotEmpty(t, record.FamilyID)
+	assert.Equal(t, HashRefreshToken(response.RefreshToken), record.TokenHash)
+	assert.NotEqual(t, response.RefreshToken, record.TokenHash)
+	assert.Equal(t, claims.ID, record.AccessTokenID)
+	assert.Equal(t, claims.ExpiresAt.Time, record.AccessExpiresAt)
+	assert.Equal(t, record.CreatedAt.Add(time.Hour), record.ExpiresAt)
+
+	// Следующий токен остается в семействе, каждый токен уникален
+	nextResponse, next, err := service.IssueTokens(123, "testuser", record.FamilyID)
+	require.NoError(t, err)
+	assert.Equal(t, record.FamilyID, next.FamilyID)
+	assert.NotEqual(t, response.RefreshToken, nextResponse.RefreshToken)
+	assert.NotEqual(t, record.AccessTokenID, next.AccessTokenID)
+
+	_, other, err := service.IssueTokens(123, "testuser", "")
+	require.NoError(t, err)
+	assert.NotEqual(t, record.FamilyID, other.FamilyID)
+}
+
 func TestGenerateSecret(t *testing.T) {
 	secret, err := GenerateSecret()
 
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState состояние автоматического выключателя
+type BreakerState int
+
+// Состояния автоматического выключателя
+const (
+	// BreakerClosed запросы проходят, неудачи подсчитываются
+	BreakerClosed BreakerState = iota
+	// BreakerOpen запросы отклоняются без обращения к системе начисления до конца паузы
+	BreakerOpen
+	// BreakerHalfOpen пауза истекла, пропускается по одному пробному запросу
+	BreakerHalfOpen
+)
+
+// String возвращает название состояния
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Параметры выключателя по умолчанию
+const (
+	DefaultBreakerFailureThreshold = 5
+	DefaultBreakerSuccessThreshold = 1
+	DefaultBreakerCoolDown         = 30 * time.Second
+	// probeWait пауза для запросов, пришедших во время пробного запроса
+	probeWait = time.Second
+)
+
+// BreakerSettings параметры автоматического выключателя
+type BreakerSettings struct {
+	// FailureThreshold число неудач подряд, после которого выключатель размыкается
+	FailureThreshold int
+	// SuccessThreshold число успешных пробных запросов, после которого выключатель замыкается
+	SuccessThreshold int
+	// CoolDown пауза между размыканием и первым пробным запросом
+	CoolDown time.Duration
+}
+
+// DefaultBreakerSettings возвращает параметры выключателя по умолчанию
+func DefaultBreakerSettings() BreakerSettings {
+	return BreakerSettings{
+		FailureThreshold: DefaultBreakerFailureThreshold,
+		SuccessThreshold: DefaultBreakerSuccessThreshold,
+		CoolDown:         DefaultBreakerCoolDown,
+	}
+}
+
+// BreakerStatus снимок состояния выключателя для проверок работоспособности
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+}
+
+// CircuitBreaker автоматический выключатель: после серии неудач перестает пропускать
+// запросы на время паузы, затем проверяет систему одиночными пробными запросами
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	settings  BreakerSettings
+	state     BreakerState
+	failures  int // неудачи подряд в замкнутом состоянии
+	successes int // успешные пробные запросы в полуоткрытом состоянии
+	probing   bool
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+// NewCircuitBreaker создает замкнутый выключатель. Неположительное значение параметра
+// заменяется значением по умолчанию.
+func NewCircuitBreaker(settings BreakerSettings) *CircuitBreaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = DefaultBreakerFailureThreshold
+	}
+	if settings.SuccessThreshold <= 0 {
+		settings.SuccessThreshold = DefaultBreakerSuccessThreshold
+	}
+	if settings.CoolDown <= 0 {
+		settings.CoolDown = DefaultBreakerCoolDown
+	}
+
+	return &CircuitBreaker{
+		settings: settings,
+		now:      time.Now,
+	}
+}
+
+// Allow разрешает запрос или возвращает *CircuitOpenError. Разрешенный запрос
+// должен завершиться вызовом Success, Failure или Cancel.
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		retryAt := cb.openedAt.Add(cb.settings.CoolDown)
+		if wait := retryAt.Sub(cb.now()); wait > 0 {
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		cb.state = BreakerHalfOpen
+		cb.successes = 0
+		cb.probing = false
+		fallthrough
+	case BreakerHalfOpen:
+		// Пока пробный запрос не завершился, остальные ждут его результата
+		if cb.probing {
+			return &CircuitOpenError{RetryAfter: min(probeWait, cb.settings.CoolDown)}
+		}
+		cb.probing = true
+	}
+
+	return nil
+}
+
+// Success учитывает успешный запрос
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerClosed:
+		cb.failures = 0
+	case BreakerHalfOpen:
+		cb.probing = false
+		cb.successes++
+		if cb.successes >= cb.settings.SuccessThreshold {
+			cb.state = BreakerClosed
+			cb.failures = 0
+		}
+	}
+}
+
+// Failure учитывает неудачный запрос
+func (cb *CircuitBreaker) Failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case BreakerClosed:
+		cb.failures++
+		if cb.failures >= cb.settings.FailureThreshold {
+			cb.openLocked()
+		}
+	case BreakerHalfOpen:
+		// Пробный запрос не прошел: начинаем паузу заново
+		cb.openLocked()
+	}
+}
+
+// Cancel завершает запрос, результат которого ничего не говорит о системе,
+// например отмененный вызывающей стороной
+func (cb *CircuitBreaker) Cancel() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == BreakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// State возвращает текущее состояние. Разомкнутый выключатель с истекшей паузой
+// считается полуоткрытым.
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.stateLocked()
+}
+
+// Status возвращает снимок состояния
+func (cb *CircuitBreaker) Status() BreakerStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	status := BreakerStatus{
+		State:               cb.stateLocked().String(),
+		ConsecutiveFailures: cb.failures,
+	}
+	if cb.state != BreakerClosed {
+		openedAt := cb.openedAt
+		retryAt := cb.openedAt.Add(cb.settings.CoolDown)
+		status.OpenedAt = &openedAt
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+func (cb *CircuitBreaker) stateLocked() BreakerState {
+	if cb.state == BreakerOpen && !cb.now().Before(cb.openedAt.Add(cb.settings.CoolDown)) {
+		return BreakerHalfOpen
+	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker) openLocked() {
+	cb.state = BreakerOpen
+	cb.openedAt = cb.now()
+	cb.probing = false
+	cb.successes = 0
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreaker(BreakerSettings{FailureThreshold: 3, SuccessThreshold: 2, CoolDown: time.Minute})
+	breaker.now = func() time.Time { return now }
+
+	fail := func() {
+		require.NoError(t, breaker.Allow())
+		breaker.Failure()
+	}
+
+	// Успех сбрасывает счетчик неудач подряд
+	fail()
+	fail()
+	require.NoError(t, breaker.Allow())
+	breaker.Success()
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.Equal(t, 0, breaker.Status().ConsecutiveFailures)
+
+	// Третья неудача подряд размыкает выключатель
+	fail()
+	fail()
+	fail()
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	now = now.Add(20 * time.Second)
+	err := breaker.Allow()
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+	var openErr *CircuitOpenError
+	require.True(t, errors.As(err, &openErr))
+	assert.Equal(t, 40*time.Second, openErr.RetryAfter)
+
+	status := breaker.Status()
+	assert.Equal(t, "open", status.State)
+	require.NotNil(t, status.RetryAt)
+	assert.Equal(t, now.Add(40*time.Second), *status.RetryAt)
+
+	// После паузы пропускается один пробный запрос, остальные ждут
+	now = now.Add(40 * time.Second)
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	require.NoError(t, breaker.Allow())
+	assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// Неудачный пробный запрос начинает паузу заново
+	breaker.Failure()
+	assert.Equal(t, BreakerOpen, breaker.State())
+	assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// Отмененный пробный запрос не меняет состояние
+	now = now.Add(time.Minute)
+	require.NoError(t, breaker.Allow())
+	breaker.Cancel()
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+
+	// Выключатель замыкается после SuccessThreshold успешных пробных запросов
+	require.NoError(t, breaker.Allow())
+	breaker.Success()
+	assert.Equal(t, BreakerHalfOpen, breaker.State())
+	require.NoError(t, breaker.Allow())
+	breaker.Success()
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	status = breaker.Status()
+	assert.Equal(t, "closed", status.State)
+	assert.Nil(t, status.OpenedAt)
+}
+
+func TestNewCircuitBreaker_Defaults(t *testing.T) {
+	breaker := NewCircuitBreaker(BreakerSettings{})
+	assert.Equal(t, DefaultBreakerSettings(), breaker.settings)
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
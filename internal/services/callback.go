@@ -0,0 +1,88 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Заголовки push-уведомлений системы начисления
+const (
+	// AccrualSignatureHeader HMAC-SHA256 в hex от строки "<timestamp>.<тело запроса>"
+	AccrualSignatureHeader = "X-Accrual-Signature"
+	// AccrualTimestampHeader время отправки уведомления в секундах Unix
+	AccrualTimestampHeader = "X-Accrual-Timestamp"
+)
+
+// DefaultCallbackTolerance допустимое расхождение времени отправки уведомления и текущего времени
+const DefaultCallbackTolerance = 5 * time.Minute
+
+// Ошибки проверки push-уведомлений
+var (
+	ErrInvalidSignature = errors.New("invalid callback signature")
+	ErrStaleCallback    = errors.New("callback timestamp is outside the allowed window")
+	ErrReplayedCallback = errors.New("callback has already been received")
+)
+
+// SignAccrualCallback подписывает тело уведомления, отправленного в момент timestamp
+func SignAccrualCallback(secret []byte, timestamp time.Time, body []byte) string {
+	return hex.EncodeToString(callbackMAC(secret, strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+func callbackMAC(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// CallbackVerifier проверяет подпись и свежесть push-уведомлений системы начисления.
+// Уведомление принимается, только если его время отправки отличается от текущего
+// не больше чем на tolerance. Повторы отсекает обработчик по подписям примененных
+// уведомлений в общем хранилище, см. Verify.
+type CallbackVerifier struct {
+	secret    []byte
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+// NewCallbackVerifier создает проверку уведомлений с общим секретом secret
+func NewCallbackVerifier(secret []byte, tolerance time.Duration) *CallbackVerifier {
+	if tolerance <= 0 {
+		tolerance = DefaultCallbackTolerance
+	}
+
+	return &CallbackVerifier{
+		secret:    secret,
+		tolerance: tolerance,
+		now:       time.Now,
+	}
+}
+
+// Verify проверяет уведомление с заголовками timestamp и signature и телом body. Возвращает
+// nonce — ключ подписи уведомления — и срок, до которого его нужно помнить для отсева повторов:
+// после него уведомление отклоняется по времени.
+func (v *CallbackVerifier) Verify(timestamp, signature string, body []byte) (string, time.Time, error) {
+	expected := callbackMAC(v.secret, timestamp, body)
+	actual, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(expected, actual) {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", time.Time{}, ErrInvalidSignature
+	}
+
+	now := v.now()
+	sentAt := time.Unix(seconds, 0)
+	if sentAt.Before(now.Add(-v.tolerance)) || sentAt.After(now.Add(v.tolerance)) {
+		return "", time.Time{}, ErrStaleCallback
+	}
+
+	return hex.EncodeToString(expected), sentAt.Add(v.tolerance), nil
+}
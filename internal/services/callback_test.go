@@ -0,0 +1,53 @@
+package services
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackVerifier(t *testing.T) {
+	secret := []byte("s3cret")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	verifier := NewCallbackVerifier(secret, time.Minute)
+	verifier.now = func() time.Time { return now }
+
+	body := []byte(`{"order":"12345678903","status":"PROCESSED","accrual":500}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	signature := SignAccrualCallback(secret, now, body)
+
+	nonce, expiresAt, err := verifier.Verify(timestamp, signature, body)
+	require.NoError(t, err)
+	assert.Len(t, nonce, 64)
+	// Подпись нужно помнить, пока уведомление не выйдет из окна
+	assert.True(t, now.Add(time.Minute).Equal(expiresAt))
+
+	// Проверка не хранит состояния: повторы отсекает обработчик по общему хранилищу
+	repeated, _, err := verifier.Verify(timestamp, signature, body)
+	require.NoError(t, err)
+	assert.Equal(t, nonce, repeated)
+	other, _, err := verifier.Verify(timestamp, SignAccrualCallback(secret, now, []byte(`{}`)), []byte(`{}`))
+	require.NoError(t, err)
+	assert.NotEqual(t, nonce, other)
+
+	verify := func(timestamp, signature string, body []byte) error {
+		_, _, err := verifier.Verify(timestamp, signature, body)
+		return err
+	}
+
+	// Подпись не совпадает с телом, временем или секретом
+	assert.ErrorIs(t, verify(timestamp, signature, []byte(`{}`)), ErrInvalidSignature)
+	assert.ErrorIs(t, verify(strconv.FormatInt(now.Unix()+1, 10), signature, body), ErrInvalidSignature)
+	assert.ErrorIs(t, verify(timestamp, SignAccrualCallback([]byte("other"), now, body), body), ErrInvalidSignature)
+	assert.ErrorIs(t, verify(timestamp, "not-hex", body), ErrInvalidSignature)
+	assert.ErrorIs(t, verify("", SignAccrualCallback(secret, now, body), body), ErrInvalidSignature)
+
+	// Уведомление вне окна отклоняется, даже с верной подписью
+	old := now.Add(-2 * time.Minute)
+	assert.ErrorIs(t, verify(strconv.FormatInt(old.Unix(), 10), SignAccrualCallback(secret, old, body), body), ErrStaleCallback)
+	future := now.Add(2 * time.Minute)
+	assert.ErrorIs(t, verify(strconv.FormatInt(future.Unix(), 10), SignAccrualCallback(secret, future, body), body), ErrStaleCallback)
+}
@@ -9,11 +9,14 @@ import (
 var (
 	ErrRateLimitExceeded = errors.New("rate limit exceeded")
 	ErrInternalServer    = errors.New("internal server error from accrual system")
+	ErrCircuitOpen       = errors.New("accrual system circuit breaker is open")
 )
 
 // RateLimitError содержит информацию о cooldown
 type RateLimitError struct {
 	RetryAfter time.Duration
+	// Limit допустимое число запросов в минуту из ответа системы; 0 — неизвестно
+	Limit int
 }
 
 func (e *RateLimitError) Error() string {
@@ -23,3 +26,17 @@ func (e *RateLimitError) Error() string {
 func (e *RateLimitError) Is(target error) bool {
 	return target == ErrRateLimitExceeded
 }
+
+// CircuitOpenError возвращается без обращения к системе начисления, пока выключатель разомкнут.
+// RetryAfter время до следующего пробного запроса.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "accrual system circuit breaker is open"
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
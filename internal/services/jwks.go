@@ -0,0 +1,66 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"time"
+)
+
+// JSONWebKey открытый ключ подписи в формате JWK (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// N и E модуль и открытая экспонента ключа RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve и X кривая и открытый ключ Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JSONWebKeySet набор открытых ключей, публикуемый в /.well-known/jwks.json
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// publicJWK возвращает открытый ключ в формате JWK; false для ключей HS256, у которых
+// открытой части нет
+func (k *SigningKey) publicJWK() (JSONWebKey, bool) {
+	jwk := JSONWebKey{KeyID: k.ID, Use: "sig", Algorithm: k.alg()}
+	switch public := k.verifyKey().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return JSONWebKey{}, false
+	}
+	return jwk, true
+}
+
+// JWKS возвращает открытые ключи подписи, которыми проверяются токены: действующие
+// и еще не вступившие в силу, чтобы другие сервисы узнали новый ключ до первого токена с ним
+func (s *AuthService) JWKS() JSONWebKeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range s.keys.Keys {
+		if key.expired(now) {
+			continue
+		}
+		if jwk, ok := key.publicJWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
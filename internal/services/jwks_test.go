@@ -0,0 +1,84 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publicKeyFromJWK восстанавливает открытый ключ так, как это делает сторонний сервис
+func publicKeyFromJWK(t *testing.T, jwk JSONWebKey) interface{} {
+	t.Helper()
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		require.NoError(t, err)
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		require.NoError(t, err)
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "OKP":
+		require.Equal(t, "Ed25519", jwk.Curve)
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		require.NoError(t, err)
+		return ed25519.PublicKey(x)
+	}
+	t.Fatalf("unexpected key type %q", jwk.KeyType)
+	return nil
+}
+
+func TestAuthService_JWKS(t *testing.T) {
+	for _, alg := range []string{AlgRS256, AlgEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			now := time.Now()
+			keys, err := NewKeyRing(alg, now.Add(-time.Minute))
+			require.NoError(t, err)
+			// Новый ключ публикуется до того, как начнет подписывать
+			_, err = keys.Rotate(alg, now, time.Hour, time.Hour)
+			require.NoError(t, err)
+
+			service, err := NewAuthServiceWithKeys(keys)
+			require.NoError(t, err)
+			service.SetTokenClaims("gophermart", "orders-service")
+
+			jwks := service.JWKS()
+			require.Len(t, jwks.Keys, 2)
+
+			token, err := service.GenerateJWT(123, "testuser")
+			require.NoError(t, err)
+
+			// Сторонний сервис проверяет токен по опубликованному ключу, не зная секретов
+			claims := &TokenClaims{}
+			_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+				for _, jwk := range jwks.Keys {
+					if jwk.KeyID == token.Header["kid"] {
+						assert.Equal(t, "sig", jwk.Use)
+						assert.Equal(t, alg, jwk.Algorithm)
+						return publicKeyFromJWK(t, jwk), nil
+					}
+				}
+				return nil, ErrNoActiveKey
+			}, jwt.WithValidMethods([]string{alg}), jwt.WithAudience("orders-service"), jwt.WithIssuer("gophermart"))
+			require.NoError(t, err)
+			assert.Equal(t, "123", claims.Subject)
+			assert.Equal(t, "testuser", claims.Login)
+		})
+	}
+}
+
+func TestAuthService_JWKS_HS256(t *testing.T) {
+	service := NewAuthService("test-secret")
+
+	jwks := service.JWKS()
+
+	// Секрет HS256 никогда не публикуется
+	assert.NotNil(t, jwks.Keys)
+	assert.Empty(t, jwks.Keys)
+}
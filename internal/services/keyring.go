@@ -0,0 +1,456 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Алгоритмы подписи JWT
+const (
+	// AlgHS256 HMAC с общим секретом: проверить токен может только владелец секрета
+	AlgHS256 = "HS256"
+	// AlgRS256 RSA: открытый ключ публикуется в JWKS, и токены проверяют другие сервисы
+	AlgRS256 = "RS256"
+	// AlgEdDSA Ed25519: как RS256, но с короткими ключами и подписями
+	AlgEdDSA = "EdDSA"
+)
+
+// MinSigningKeyLength наименьшая длина секрета HS256 в байтах
+const MinSigningKeyLength = 32
+
+// RSAKeyBits размер создаваемых ключей RS256
+const RSAKeyBits = 2048
+
+// SigningKey ключ подписи JWT. Ключ подписывает новые токены с ActivatesAt до появления
+// более нового ключа и принимается при проверке до ExpiresAt.
+type SigningKey struct {
+	// ID идентификатор ключа, записывается в заголовок kid
+	ID string `json:"kid"`
+	// Algorithm алгоритм подписи; пустой — AlgHS256
+	Algorithm string `json:"alg,omitempty"`
+	// Secret секрет HS256; в JSON записывается в base64
+	Secret []byte `json:"secret,omitempty"`
+	// PrivateKey закрытый ключ RS256 или EdDSA в PEM (PKCS #8)
+	PrivateKey  string    `json:"private_key,omitempty"`
+	ActivatesAt time.Time `json:"activates_at"`
+	// ExpiresAt когда ключ перестает приниматься; nil — бессрочно
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// signer разобранный PrivateKey
+	signer crypto.Signer
+}
+
+// ValidateSigningAlgorithm проверяет, что алгоритм подписи поддерживается
+func ValidateSigningAlgorithm(alg string) error {
+	switch alg {
+	case AlgHS256, AlgRS256, AlgEdDSA:
+		return nil
+	default:
+		return fmt.Errorf("unsupported JWT signing algorithm %q, want %s, %s or %s", alg, AlgHS256, AlgRS256, AlgEdDSA)
+	}
+}
+
+// alg возвращает алгоритм подписи ключа
+func (k *SigningKey) alg() string {
+	if k.Algorithm == "" {
+		return AlgHS256
+	}
+	return k.Algorithm
+}
+
+// parse проверяет ключ и разбирает закрытый ключ
+func (k *SigningKey) parse() error {
+	if err := ValidateSigningAlgorithm(k.alg()); err != nil {
+		return err
+	}
+	if k.alg() == AlgHS256 {
+		if len(k.Secret) < MinSigningKeyLength {
+			return fmt.Errorf("secret must be at least %d bytes", MinSigningKeyLength)
+		}
+		return nil
+	}
+
+	block, _ := pem.Decode([]byte(k.PrivateKey))
+	if block == nil {
+		return errors.New("private key must be PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse private key: %w", err)
+	}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.alg() != AlgRS256 {
+			return fmt.Errorf("RSA private key cannot be used with %s", k.alg())
+		}
+		k.signer = key
+	case ed25519.PrivateKey:
+		if k.alg() != AlgEdDSA {
+			return fmt.Errorf("Ed25519 private key cannot be used with %s", k.alg())
+		}
+		k.signer = key
+	default:
+		return fmt.Errorf("unsupported private key type %T", parsed)
+	}
+	return nil
+}
+
+// signingMethod возвращает метод подписи JWT для алгоритма ключа
+func (k *SigningKey) signingMethod() jwt.SigningMethod {
+	switch k.alg() {
+	case AlgRS256:
+		return jwt.SigningMethodRS256
+	case AlgEdDSA:
+		return jwt.SigningMethodEdDSA
+	default:
+		return jwt.SigningMethodHS256
+	}
+}
+
+// signKey возвращает ключ, которым подписываются токены
+func (k *SigningKey) signKey() any {
+	if k.alg() == AlgHS256 {
+		return k.Secret
+	}
+	return k.signer
+}
+
+// verifyKey возвращает ключ, которым проверяется подпись токенов
+func (k *SigningKey) verifyKey() any {
+	if k.alg() == AlgHS256 {
+		return k.Secret
+	}
+	return k.signer.Public()
+}
+
+// SigningKeyInfo сведения о ключе подписи без секрета
+type SigningKeyInfo struct {
+	ID          string     `json:"kid"`
+	Algorithm   string     `json:"alg"`
+	ActivatesAt time.Time  `json:"activates_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	// Active ключ подписывает новые токены
+	Active bool `json:"active"`
+}
+
+// KeyRing набор ключей подписи JWT: активный ключ и предыдущие, которые еще принимаются
+type KeyRing struct {
+	Keys []SigningKey `json:"keys"`
+}
+
+// NewSigningKey создает ключ подписи алгоритма alg со случайным ключом и идентификатором
+func NewSigningKey(alg string, activatesAt time.Time) (SigningKey, error) {
+	if err := ValidateSigningAlgorithm(alg); err != nil {
+		return SigningKey{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, fmt.Errorf("failed to generate signing key id: %w", err)
+	}
+	key := SigningKey{ID: hex.EncodeToString(id), Algorithm: alg, ActivatesAt: activatesAt}
+
+	var private crypto.Signer
+	switch alg {
+	case AlgHS256:
+		key.Secret = make([]byte, MinSigningKeyLength)
+		if _, err := rand.Read(key.Secret); err != nil {
+			return SigningKey{}, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		return key, nil
+	case AlgRS256:
+		rsaKey, err := rsa.GenerateKey(rand.Reader, RSAKeyBits)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		private = rsaKey
+	case AlgEdDSA:
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return SigningKey{}, fmt.Errorf("failed to generate signing key: %w", err)
+		}
+		private = edKey
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("failed to encode signing key: %w", err)
+	}
+	key.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	key.signer = private
+	return key, nil
+}
+
+// NewKeyRing создает набор из одного нового ключа алгоритма alg, активного с момента now
+func NewKeyRing(alg string, now time.Time) (*KeyRing, error) {
+	key, err := NewSigningKey(alg, now)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRing{Keys: []SigningKey{key}}, nil
+}
+
+// StaticKeyRing создает набор из одного бессрочного ключа с секретом secret. Идентификатор
+// ключа выводится из секрета, поэтому экземпляры с одним секретом понимают токены друг друга.
+func StaticKeyRing(secret string) *KeyRing {
+	sum := sha256.Sum256([]byte(secret))
+	return &KeyRing{Keys: []SigningKey{{ID: hex.EncodeToString(sum[:8]), Algorithm: AlgHS256, Secret: []byte(secret)}}}
+}
+
+// Validate проверяет, что идентификаторы ключей уникальны, а ключи подходят к своим алгоритмам,
+// и разбирает закрытые ключи
+func (r *KeyRing) Validate() error {
+	if len(r.Keys) == 0 {
+		return errors.New("no JWT signing keys configured")
+	}
+
+	ids := make(map[string]bool, len(r.Keys))
+	for i, key := range r.Keys {
+		if key.ID == "" {
+			return fmt.Errorf("signing key %d: kid is required", i)
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("signing key %s: duplicate kid", key.ID)
+		}
+		ids[key.ID] = true
+		if err := r.Keys[i].parse(); err != nil {
+			return fmt.Errorf("signing key %s: %w", key.ID, err)
+		}
+	}
+	return nil
+}
+
+// Active возвращает ключ, которым подписываются новые токены: самый новый из вступивших в силу
+// и не истекших к моменту now
+func (r *KeyRing) Active(now time.Time) (SigningKey, bool) {
+	var active SigningKey
+	found := false
+	for _, key := range r.Keys {
+		if key.ActivatesAt.After(now) || key.expired(now) {
+			continue
+		}
+		if !found || key.ActivatesAt.After(active.ActivatesAt) {
+			active, found = key, true
+		}
+	}
+	return active, found
+}
+
+// Lookup возвращает ключ kid, если он принимается в момент now. Ключ, который еще не вступил
+// в силу, принимается: другой экземпляр мог начать подписывать им раньше.
+func (r *KeyRing) Lookup(kid string, now time.Time) (SigningKey, bool) {
+	for _, key := range r.Keys {
+		if key.ID == kid && !key.expired(now) {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// Info возвращает сведения о ключах без секретов, от старых к новым
+func (r *KeyRing) Info(now time.Time) []SigningKeyInfo {
+	active, _ := r.Active(now)
+	infos := make([]SigningKeyInfo, 0, len(r.Keys))
+	for _, key := range r.Keys {
+		infos = append(infos, SigningKeyInfo{
+			ID:          key.ID,
+			Algorithm:   key.alg(),
+			ActivatesAt: key.ActivatesAt,
+			ExpiresAt:   key.ExpiresAt,
+			Active:      key.ID == active.ID,
+		})
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].ActivatesAt.Before(infos[j].ActivatesAt)
+	})
+	return infos
+}
+
+// Rotate добавляет новый ключ алгоритма alg, который начнет подписывать токены через activationDelay, —
+// за это время остальные экземпляры успевают его загрузить. Прежние ключи принимаются еще
+// overlap после вступления нового ключа в силу, истекшие ключи удаляются. Возвращает новый ключ.
+func (r *KeyRing) Rotate(alg string, now time.Time, activationDelay, overlap time.Duration) (SigningKey, error) {
+	key, err := NewSigningKey(alg, now.Add(activationDelay))
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	expiresAt := key.ActivatesAt.Add(overlap)
+	keys := make([]SigningKey, 0, len(r.Keys)+1)
+	for _, old := range r.Keys {
+		if old.expired(now) {
+			continue
+		}
+		if old.ExpiresAt == nil || old.ExpiresAt.After(expiresAt) {
+			old.ExpiresAt = &expiresAt
+		}
+		keys = append(keys, old)
+	}
+	r.Keys = append(keys, key)
+	return key, nil
+}
+
+// expired сообщает, истек ли ключ к моменту now
+func (k SigningKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// LoadKeyRing читает набор ключей подписи в формате JSON
+func LoadKeyRing(r io.Reader) (*KeyRing, error) {
+	var ring KeyRing
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&ring); err != nil {
+		return nil, fmt.Errorf("failed to decode JWT keys: %w", err)
+	}
+	if err := ring.Validate(); err != nil {
+		return nil, err
+	}
+	return &ring, nil
+}
+
+// LoadKeyRingFile читает набор ключей подписи из файла
+func LoadKeyRingFile(path string) (*KeyRing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open JWT keys: %w", err)
+	}
+	defer f.Close()
+
+	return LoadKeyRing(f)
+}
+
+// SaveKeyRingFile записывает набор ключей в файл целиком: читатели видят либо старый,
+// либо новый набор, но не частично записанный
+func SaveKeyRingFile(path string, ring *KeyRing) error {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JWT keys: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save JWT keys: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save JWT keys: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save JWT keys: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save JWT keys: %w", err)
+	}
+	return nil
+}
+
+// LoadOrCreateKeyRingFile читает набор ключей из файла; если файла нет, создает его с одним новым
+// ключом алгоритма alg. Экземпляры, одновременно стартующие на пустом томе, получают один набор.
+func LoadOrCreateKeyRingFile(path, alg string) (*KeyRing, error) {
+	ring, err := LoadKeyRingFile(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return ring, err
+	}
+
+	unlock, err := lockKeyRingFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return loadOrCreateKeyRingFile(path, alg)
+}
+
+// RotateKeyRingFile поворачивает ключи в файле path на новый ключ алгоритма alg, см. KeyRing.Rotate.
+// Чтение, поворот и запись идут под блокировкой файла, поэтому одновременные повороты
+// из разных процессов не теряют ключи друг друга. Возвращает новый набор.
+func RotateKeyRingFile(path, alg string, activationDelay, overlap time.Duration) (*KeyRing, error) {
+	unlock, err := lockKeyRingFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	ring, err := loadOrCreateKeyRingFile(path, alg)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ring.Rotate(alg, time.Now(), activationDelay, overlap); err != nil {
+		return nil, err
+	}
+	if err := SaveKeyRingFile(path, ring); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// loadOrCreateKeyRingFile как LoadOrCreateKeyRingFile, но без блокировки файла.
+// Файл создается только если его еще нет: набор, созданный другим процессом, перечитывается.
+func loadOrCreateKeyRingFile(path, alg string) (*KeyRing, error) {
+	ring, err := LoadKeyRingFile(path)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return ring, err
+	}
+
+	ring, err = NewKeyRing(alg, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	created, err := createKeyRingFile(path, ring)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return LoadKeyRingFile(path)
+	}
+	return ring, nil
+}
+
+// createKeyRingFile записывает набор ключей в файл, только если его еще нет, как O_CREATE|O_EXCL.
+// Набор пишется во временный файл, который затем жестко связывается с path, поэтому
+// читатели без блокировки не видят частично записанный файл. Возвращает false, если файл уже есть.
+func createKeyRingFile(path string, ring *KeyRing) (bool, error) {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return false, fmt.Errorf("failed to encode JWT keys: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return false, fmt.Errorf("failed to create JWT keys: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, fmt.Errorf("failed to create JWT keys: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return false, fmt.Errorf("failed to create JWT keys: %w", err)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to create JWT keys: %w", err)
+	}
+	return true, nil
+}
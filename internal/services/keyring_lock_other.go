@@ -0,0 +1,9 @@
+//go:build !unix
+
+package services
+
+// lockKeyRingFile без flock блокировка между процессами недоступна: файл ключей по-прежнему
+// создается только если его нет, но одновременные повороты из разных процессов не исключены
+func lockKeyRingFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package services
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockKeyRingFile берет исключительную блокировку flock на файл path.lock рядом с набором ключей
+// и возвращает функцию ее снятия. Блокировка общая для процессов, разделяющих том с ключами.
+func lockKeyRingFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock JWT keys: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock JWT keys: %w", err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,195 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing_Rotate(t *testing.T) {
+	now := time.Now()
+	ring, err := NewKeyRing(AlgHS256, now.Add(-time.Hour))
+	require.NoError(t, err)
+	old := ring.Keys[0]
+
+	key, err := ring.Rotate(AlgHS256, now, time.Minute, 24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, ring.Keys, 2)
+	require.NoError(t, ring.Validate())
+
+	// Новый ключ начинает подписывать после задержки, но принимается сразу
+	active, ok := ring.Active(now)
+	require.True(t, ok)
+	assert.Equal(t, old.ID, active.ID)
+	_, ok = ring.Lookup(key.ID, now)
+	assert.True(t, ok)
+
+	active, ok = ring.Active(now.Add(time.Minute))
+	require.True(t, ok)
+	assert.Equal(t, key.ID, active.ID)
+
+	// Прежний ключ принимается до конца окна перекрытия
+	_, ok = ring.Lookup(old.ID, now.Add(time.Minute+23*time.Hour))
+	assert.True(t, ok)
+	_, ok = ring.Lookup(old.ID, now.Add(time.Minute+24*time.Hour))
+	assert.False(t, ok)
+
+	info := ring.Info(now.Add(time.Minute))
+	require.Len(t, info, 2)
+	assert.Equal(t, old.ID, info[0].ID)
+	assert.False(t, info[0].Active)
+	require.NotNil(t, info[0].ExpiresAt)
+	assert.True(t, info[1].Active)
+
+	// Истекшие ключи удаляются при следующем повороте
+	later := now.Add(48 * time.Hour)
+	_, err = ring.Rotate(AlgHS256, later, time.Minute, 24*time.Hour)
+	require.NoError(t, err)
+	require.Len(t, ring.Keys, 2)
+	assert.Equal(t, key.ID, ring.Keys[0].ID)
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	ring, err := LoadKeyRing(strings.NewReader(`{"keys":[{"kid":"k1","secret":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=","activates_at":"2024-01-01T00:00:00Z"}]}`))
+	require.NoError(t, err)
+	require.Len(t, ring.Keys, 1)
+	assert.Equal(t, "k1", ring.Keys[0].ID)
+
+	tests := map[string]string{
+		"Empty":         `{"keys":[]}`,
+		"Missing kid":   `{"keys":[{"secret":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}]}`,
+		"Short secret":  `{"keys":[{"kid":"k1","secret":"c2hvcnQ="}]}`,
+		"Duplicate kid": `{"keys":[{"kid":"k1","secret":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="},{"kid":"k1","secret":"MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="}]}`,
+		"Unknown field": `{"keys":[],"extra":1}`,
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadKeyRing(strings.NewReader(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestKeyRingFile_Concurrent(t *testing.T) {
+	const workers = 8
+
+	t.Run("Create", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "jwt-keys.json")
+
+		// Экземпляры, стартующие на пустом томе, получают один и тот же ключ
+		ids := make([]string, workers)
+		var wg sync.WaitGroup
+		for i := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ring, err := LoadOrCreateKeyRingFile(path, AlgHS256)
+				if assert.NoError(t, err) && assert.Len(t, ring.Keys, 1) {
+					ids[i] = ring.Keys[0].ID
+				}
+			}()
+		}
+		wg.Wait()
+
+		ring, err := LoadKeyRingFile(path)
+		require.NoError(t, err)
+		require.Len(t, ring.Keys, 1)
+		for _, id := range ids {
+			assert.Equal(t, ring.Keys[0].ID, id)
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "jwt-keys.json")
+
+		// Одновременные повороты не теряют ключи друг друга
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := RotateKeyRingFile(path, AlgHS256, 0, time.Hour)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+
+		ring, err := LoadKeyRingFile(path)
+		require.NoError(t, err)
+		assert.Len(t, ring.Keys, workers+1)
+	})
+}
+
+func TestAuthService_KeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt-keys.json")
+
+	// Файла нет: он создается с одним ключом
+	first, err := NewAuthServiceWithKeyFile(path, AlgHS256)
+	require.NoError(t, err)
+	assert.Equal(t, path, first.KeyFile())
+	require.Len(t, first.Keys(), 1)
+	oldToken, err := first.GenerateJWT(1, "user")
+	require.NoError(t, err)
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(oldToken, &jwt.RegisteredClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, first.Keys()[0].ID, parsed.Header["kid"])
+
+	// Второй экземпляр с тем же файлом принимает токены первого
+	second, err := NewAuthServiceWithKeyFile(path, AlgHS256)
+	require.NoError(t, err)
+	_, err = second.ValidateJWT(oldToken)
+	require.NoError(t, err)
+
+	reloaded, err := second.ReloadKeyFile()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	// Поворот без задержки: первый экземпляр сразу подписывает новым ключом
+	first.SetKeyRotation(0, time.Hour)
+	keys, err := first.RotateKeys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.True(t, keys[1].Active)
+	newToken, err := first.GenerateJWT(1, "user")
+	require.NoError(t, err)
+	parsed, _, err = jwt.NewParser().ParseUnverified(newToken, &jwt.RegisteredClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, keys[1].ID, parsed.Header["kid"])
+
+	// Второй экземпляр узнает новый ключ после перезагрузки файла, старые токены остаются действительными
+	_, err = second.ValidateJWT(newToken)
+	assert.Error(t, err)
+	reloaded, err = second.ReloadKeyFile()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	_, err = second.ValidateJWT(newToken)
+	assert.NoError(t, err)
+	_, err = second.ValidateJWT(oldToken)
+	assert.NoError(t, err)
+
+	// Поврежденный файл не заменяет загруженные ключи
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err = second.ReloadKeyFile()
+	assert.Error(t, err)
+	_, err = second.ValidateJWT(newToken)
+	assert.NoError(t, err)
+}
+
+func TestAuthService_RotateKeysWithoutFile(t *testing.T) {
+	service := NewAuthService("test-secret")
+	_, err := service.RotateKeys()
+	assert.True(t, errors.Is(err, ErrKeysNotRotatable))
+
+	reloaded, err := service.ReloadKeyFile()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitMessage текст ответа 429 системы начисления с допустимым числом запросов
+var rateLimitMessage = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+// parseRateLimit извлекает число запросов в минуту из тела ответа 429; 0, если его нет
+func parseRateLimit(body []byte) int {
+	match := rateLimitMessage.FindSubmatch(body)
+	if match == nil {
+		return 0
+	}
+	limit, err := strconv.Atoi(string(match[1]))
+	if err != nil || limit <= 0 {
+		return 0
+	}
+	return limit
+}
+
+// RateLimiter ограничитель запросов к системе начисления по алгоритму token bucket
+// вместимостью в один токен: запросы распределяются равномерно, без всплесков,
+// поэтому в любую минуту укладывается не больше допустимого числа запросов.
+// Допустимая частота заранее неизвестна: ограничитель узнает ее из ответов 429
+// и делит поровну между экземплярами сервиса. Пока частота неизвестна, запросы не ограничиваются.
+type RateLimiter struct {
+	mu           sync.Mutex
+	limit        int       // допустимое число запросов в минуту на все экземпляры; 0 — неизвестно
+	clients      int       // число экземпляров, делящих limit
+	next         time.Time // время, когда появится следующий токен
+	blockedUntil time.Time // до этого времени система попросила не отправлять запросы
+	learned      bool      // частота узнана из ответа 429 и еще не сохранена
+	now          func() time.Time
+}
+
+// NewRateLimiter создает ограничитель с неизвестной частотой
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		clients: 1,
+		now:     time.Now,
+	}
+}
+
+// Wait ждет разрешения на запрос. Если ожидание не укладывается в срок контекста,
+// сразу возвращает *RateLimitError со временем до освобождения.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	wait, err := l.reserve(deadline)
+	if err != nil {
+		return err
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve забирает ближайший токен и возвращает время ожидания до него.
+// Если токен появится позже deadline, он не забирается.
+func (l *RateLimiter) reserve(deadline time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	slot := now
+	if slot.Before(l.blockedUntil) {
+		slot = l.blockedUntil
+	}
+	if slot.Before(l.next) {
+		slot = l.next
+	}
+	if !deadline.IsZero() && slot.After(deadline) {
+		return 0, &RateLimitError{RetryAfter: slot.Sub(now), Limit: l.limit}
+	}
+	if interval := l.intervalLocked(); interval > 0 {
+		l.next = slot.Add(interval)
+	}
+
+	return slot.Sub(now), nil
+}
+
+// intervalLocked возвращает интервал между запросами этого экземпляра; 0 — без ограничения
+func (l *RateLimiter) intervalLocked() time.Duration {
+	if l.limit <= 0 {
+		return 0
+	}
+	return time.Minute * time.Duration(l.clients) / time.Duration(l.limit)
+}
+
+// Learn учитывает ответ 429: частоту limit (если известна) и паузу retryAfter
+func (l *RateLimiter) Learn(limit int, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if until := l.now().Add(retryAfter); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+	if limit > 0 && limit != l.limit {
+		l.limit = limit
+		l.learned = true
+	}
+	// Выданные до ответа токены больше не действуют
+	l.next = l.blockedUntil
+}
+
+// SetLimit задает частоту, сохраненную ранее этим или другим экземпляром,
+// и число экземпляров, между которыми она делится
+func (l *RateLimiter) SetLimit(limit, clients int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Частота, узнанная после последней синхронизации, новее сохраненной
+	if limit > 0 && !l.learned {
+		l.limit = limit
+	}
+	l.clients = max(clients, 1)
+}
+
+// Limit возвращает известное число запросов в минуту на все экземпляры; 0 — неизвестно
+func (l *RateLimiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit
+}
+
+// Interval возвращает интервал между запросами этого экземпляра; 0 — без ограничения
+func (l *RateLimiter) Interval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.intervalLocked()
+}
+
+// pendingLimit возвращает частоту, узнанную после последнего сохранения
+func (l *RateLimiter) pendingLimit() (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limit, l.learned
+}
+
+// markSaved отмечает частоту limit сохраненной, если с тех пор не узнана новая
+func (l *RateLimiter) markSaved(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit == limit {
+		l.learned = false
+	}
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	assert.Equal(t, 60, parseRateLimit([]byte("No more than 60 requests per minute allowed")))
+	assert.Equal(t, 0, parseRateLimit([]byte("Too Many Requests")))
+	assert.Equal(t, 0, parseRateLimit(nil))
+}
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+
+	// Пока частота неизвестна, запросы не ограничиваются
+	for range 100 {
+		wait, err := limiter.reserve(time.Time{})
+		require.NoError(t, err)
+		assert.Zero(t, wait)
+	}
+
+	// Ответ 429 задает частоту и паузу
+	limiter.Learn(30, 10*time.Second)
+	assert.Equal(t, 30, limiter.Limit())
+
+	wait, err := limiter.reserve(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, wait)
+
+	// Следующие запросы идут с интервалом в две секунды
+	wait, err = limiter.reserve(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, 12*time.Second, wait)
+
+	// Токен позже срока не выдается и не расходуется
+	_, err = limiter.reserve(now.Add(5 * time.Second))
+	var rateLimitErr *RateLimitError
+	require.True(t, errors.As(err, &rateLimitErr))
+	assert.Equal(t, 14*time.Second, rateLimitErr.RetryAfter)
+	assert.Equal(t, 30, rateLimitErr.Limit)
+
+	wait, err = limiter.reserve(now.Add(20 * time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 14*time.Second, wait)
+}
+
+func TestRateLimiter_NeverExceedsLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limiter.SetLimit(20, 1)
+
+	// Запросы отправляются сразу по наступлении слота; считаем их в каждой минуте
+	var sent []time.Time
+	for range 100 {
+		wait, err := limiter.reserve(time.Time{})
+		require.NoError(t, err)
+		now = now.Add(wait)
+		sent = append(sent, now)
+	}
+
+	for i, start := range sent {
+		inWindow := 0
+		for _, at := range sent[i:] {
+			if at.Sub(start) < time.Minute {
+				inWindow++
+			}
+		}
+		assert.LessOrEqual(t, inWindow, 20)
+	}
+}
+
+func TestRateLimiter_SharedLimit(t *testing.T) {
+	limiter := NewRateLimiter()
+
+	// Частота делится между экземплярами
+	limiter.SetLimit(60, 3)
+	assert.Equal(t, 3*time.Second, limiter.intervalLocked())
+
+	// Узнанная, но еще не сохраненная частота не перезаписывается сохраненной
+	limiter.Learn(30, 0)
+	limiter.SetLimit(60, 1)
+	assert.Equal(t, 30, limiter.Limit())
+
+	limit, pending := limiter.pendingLimit()
+	assert.True(t, pending)
+	limiter.markSaved(limit)
+	limiter.SetLimit(60, 1)
+	assert.Equal(t, 60, limiter.Limit())
+}
+
+func TestRateLimiter_WaitContext(t *testing.T) {
+	limiter := NewRateLimiter()
+	limiter.SetLimit(1, 1)
+
+	require.NoError(t, limiter.Wait(context.Background()))
+
+	// Следующий токен через минуту: ожидание не укладывается в срок
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := limiter.Wait(ctx)
+	assert.ErrorIs(t, err, ErrRateLimitExceeded)
+}
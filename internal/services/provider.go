@@ -0,0 +1,272 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// ErrUnknownProvider система начисления не описана в конфигурации
+var ErrUnknownProvider = errors.New("unknown accrual provider")
+
+// ProvidersConfig описание систем начисления и правил выбора системы для заказа
+type ProvidersConfig struct {
+	// Default система для заказов, не подошедших ни под одно правило
+	Default   string           `json:"default"`
+	Providers []ProviderConfig `json:"providers"`
+	// Routes правила выбора системы; применяется первое подошедшее
+	Routes []RouteRule `json:"routes,omitempty"`
+}
+
+// ProviderConfig параметры одной системы начисления. Нулевые значения заменяются значениями по умолчанию.
+type ProviderConfig struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	// MaxRetries число повторов запроса при сетевых ошибках и ответах 5xx
+	MaxRetries   *int           `json:"max_retries,omitempty"`
+	RetryWaitMin ConfigDuration `json:"retry_wait_min,omitempty"`
+	RetryWaitMax ConfigDuration `json:"retry_wait_max,omitempty"`
+	Timeout      ConfigDuration `json:"timeout,omitempty"`
+	// RateLimit допустимое число запросов в минуту, если известно заранее; иначе узнается из ответов 429
+	RateLimit        int            `json:"rate_limit,omitempty"`
+	BreakerThreshold int            `json:"breaker_threshold,omitempty"`
+	BreakerCooldown  ConfigDuration `json:"breaker_cooldown,omitempty"`
+}
+
+// RouteRule правило выбора системы начисления. Заказ подходит под правило,
+// если совпадают все заданные условия; правило без условий подходит под любой заказ.
+type RouteRule struct {
+	Provider string `json:"provider"`
+	// Prefix начало номера заказа
+	Prefix string `json:"prefix,omitempty"`
+	// Length длина номера заказа
+	Length int `json:"length,omitempty"`
+	// Merchant мерчант, указанный при загрузке заказа
+	Merchant string `json:"merchant,omitempty"`
+}
+
+// Matches проверяет, подходит ли заказ под правило
+func (r RouteRule) Matches(order *models.Order) bool {
+	if r.Prefix != "" && !strings.HasPrefix(order.Number, r.Prefix) {
+		return false
+	}
+	if r.Length != 0 && len(order.Number) != r.Length {
+		return false
+	}
+	if r.Merchant != "" && order.Merchant != r.Merchant {
+		return false
+	}
+	return true
+}
+
+// ConfigDuration длительность, в JSON записывается строкой вида "1.5s"
+type ConfigDuration time.Duration
+
+// UnmarshalJSON читает длительность из строки
+func (d *ConfigDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(parsed)
+	return nil
+}
+
+// LoadProvidersConfig читает описание систем начисления в формате JSON
+func LoadProvidersConfig(r io.Reader) (*ProvidersConfig, error) {
+	var cfg ProvidersConfig
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode accrual providers: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadProvidersConfigFile читает описание систем начисления из файла
+func LoadProvidersConfigFile(path string) (*ProvidersConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open accrual providers: %w", err)
+	}
+	defer f.Close()
+
+	return LoadProvidersConfig(f)
+}
+
+// Validate проверяет, что имена систем уникальны, а правила ссылаются на описанные системы
+func (c *ProvidersConfig) Validate() error {
+	if len(c.Providers) == 0 {
+		return errors.New("no accrual providers configured")
+	}
+
+	names := make(map[string]bool, len(c.Providers))
+	for i, provider := range c.Providers {
+		if provider.Name == "" {
+			return fmt.Errorf("accrual provider %d: name is required", i)
+		}
+		if names[provider.Name] {
+			return fmt.Errorf("accrual provider %s: duplicate name", provider.Name)
+		}
+		if provider.Address == "" {
+			return fmt.Errorf("accrual provider %s: address is required", provider.Name)
+		}
+		if provider.MaxRetries != nil && *provider.MaxRetries < 0 {
+			return fmt.Errorf("accrual provider %s: max retries must not be negative", provider.Name)
+		}
+		if provider.RateLimit < 0 || provider.BreakerThreshold < 0 {
+			return fmt.Errorf("accrual provider %s: limits must not be negative", provider.Name)
+		}
+		if provider.RetryWaitMin < 0 || provider.RetryWaitMax < 0 || provider.Timeout < 0 || provider.BreakerCooldown < 0 {
+			return fmt.Errorf("accrual provider %s: durations must not be negative", provider.Name)
+		}
+		names[provider.Name] = true
+	}
+
+	if !names[c.Default] {
+		return fmt.Errorf("default accrual provider %q: %w", c.Default, ErrUnknownProvider)
+	}
+	for i, route := range c.Routes {
+		if !names[route.Provider] {
+			return fmt.Errorf("route %d: accrual provider %q: %w", i, route.Provider, ErrUnknownProvider)
+		}
+		if route.Length < 0 {
+			return fmt.Errorf("route %d: length must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// SetBreakerDefaults задает параметры выключателя для систем, в описании которых
+// breaker_threshold или breaker_cooldown не указаны
+func (c *ProvidersConfig) SetBreakerDefaults(settings BreakerSettings) {
+	for i := range c.Providers {
+		provider := &c.Providers[i]
+		if provider.BreakerThreshold == 0 {
+			provider.BreakerThreshold = settings.FailureThreshold
+		}
+		if provider.BreakerCooldown == 0 {
+			provider.BreakerCooldown = ConfigDuration(settings.CoolDown)
+		}
+	}
+}
+
+// ProviderRegistry набор систем начисления с правилами выбора системы для заказа
+type ProviderRegistry struct {
+	providers map[string]*AccrualService
+	names     []string // в порядке описания
+	routes    []RouteRule
+	fallback  string
+}
+
+// NewProviderRegistry создает клиентов систем начисления по описанию cfg
+func NewProviderRegistry(cfg *ProvidersConfig) (*ProviderRegistry, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	registry := &ProviderRegistry{
+		providers: make(map[string]*AccrualService, len(cfg.Providers)),
+		routes:    cfg.Routes,
+		fallback:  cfg.Default,
+	}
+	for _, provider := range cfg.Providers {
+		registry.providers[provider.Name] = newProviderService(provider)
+		registry.names = append(registry.names, provider.Name)
+	}
+
+	return registry, nil
+}
+
+// newProviderService создает клиент системы начисления с параметрами provider
+func newProviderService(provider ProviderConfig) *AccrualService {
+	maxRetries := 3
+	if provider.MaxRetries != nil {
+		maxRetries = *provider.MaxRetries
+	}
+	waitMin := 100 * time.Millisecond
+	if provider.RetryWaitMin > 0 {
+		waitMin = time.Duration(provider.RetryWaitMin)
+	}
+	waitMax := 5 * time.Second
+	if provider.RetryWaitMax > 0 {
+		waitMax = time.Duration(provider.RetryWaitMax)
+	}
+
+	service := NewAccrualServiceWithRetry(provider.Address, maxRetries, waitMin, waitMax)
+	service.name = provider.Name
+	if provider.Timeout > 0 {
+		service.client.HTTPClient.Timeout = time.Duration(provider.Timeout)
+	}
+	if provider.RateLimit > 0 {
+		service.limiter.SetLimit(provider.RateLimit, 1)
+	}
+	service.SetBreakerSettings(BreakerSettings{
+		FailureThreshold: provider.BreakerThreshold,
+		CoolDown:         time.Duration(provider.BreakerCooldown),
+	})
+
+	return service
+}
+
+// Route выбирает систему начисления для заказа. Система, уже закрепленная за заказом,
+// не меняется, даже если правила изменились.
+func (r *ProviderRegistry) Route(order *models.Order) string {
+	if order.AccrualProvider != "" {
+		return order.AccrualProvider
+	}
+	for _, route := range r.routes {
+		if route.Matches(order) {
+			return route.Provider
+		}
+	}
+	return r.fallback
+}
+
+// Provider возвращает клиент системы начисления name
+func (r *ProviderRegistry) Provider(name string) (*AccrualService, error) {
+	service, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("accrual provider %q: %w", name, ErrUnknownProvider)
+	}
+	return service, nil
+}
+
+// Default возвращает клиент системы начисления по умолчанию
+func (r *ProviderRegistry) Default() *AccrualService {
+	return r.providers[r.fallback]
+}
+
+// Names возвращает имена систем начисления в порядке описания
+func (r *ProviderRegistry) Names() []string {
+	return append([]string(nil), r.names...)
+}
+
+// SetEventRecorder включает журнал ответов для всех систем начисления
+func (r *ProviderRegistry) SetEventRecorder(recorder AccrualEventRecorder) {
+	for _, service := range r.providers {
+		service.SetEventRecorder(recorder)
+	}
+}
+
+// BreakerStatuses возвращает состояние выключателей всех систем начисления
+func (r *ProviderRegistry) BreakerStatuses() map[string]BreakerStatus {
+	statuses := make(map[string]BreakerStatus, len(r.providers))
+	for name, service := range r.providers {
+		statuses[name] = service.BreakerStatus()
+	}
+	return statuses
+}
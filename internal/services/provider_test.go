@@ -0,0 +1,118 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+const testProvidersConfig = `{
+	"default": "main",
+	"providers": [
+		{"name": "main", "address": "http://main:8080"},
+		{"name": "partner", "address": "http://partner:8080", "max_retries": 0, "timeout": "2s",
+			"rate_limit": 120, "breaker_threshold": 2, "breaker_cooldown": "1m"}
+	],
+	"routes": [
+		{"provider": "partner", "merchant": "acme"},
+		{"provider": "partner", "prefix": "9", "length": 16}
+	]
+}`
+
+func TestLoadProvidersConfig(t *testing.T) {
+	cfg, err := LoadProvidersConfig(strings.NewReader(testProvidersConfig))
+	require.NoError(t, err)
+	assert.Equal(t, "main", cfg.Default)
+	require.Len(t, cfg.Providers, 2)
+	assert.Equal(t, ConfigDuration(2*time.Second), cfg.Providers[1].Timeout)
+	require.NotNil(t, cfg.Providers[1].MaxRetries)
+	assert.Equal(t, 0, *cfg.Providers[1].MaxRetries)
+
+	invalid := map[string]string{
+		"no providers":     `{"default": "main"}`,
+		"unknown default":  `{"default": "other", "providers": [{"name": "main", "address": "http://main"}]}`,
+		"unknown route":    `{"default": "main", "providers": [{"name": "main", "address": "http://main"}], "routes": [{"provider": "other"}]}`,
+		"duplicate name":   `{"default": "main", "providers": [{"name": "main", "address": "http://a"}, {"name": "main", "address": "http://b"}]}`,
+		"missing address":  `{"default": "main", "providers": [{"name": "main"}]}`,
+		"bad duration":     `{"default": "main", "providers": [{"name": "main", "address": "http://main", "timeout": "soon"}]}`,
+		"negative retries": `{"default": "main", "providers": [{"name": "main", "address": "http://main", "max_retries": -1}]}`,
+		"unknown field":    `{"default": "main", "providers": [{"name": "main", "address": "http://main", "url": "x"}]}`,
+	}
+	for name, body := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadProvidersConfig(strings.NewReader(body))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProviderRegistry(t *testing.T) {
+	cfg, err := LoadProvidersConfig(strings.NewReader(testProvidersConfig))
+	require.NoError(t, err)
+	registry, err := NewProviderRegistry(cfg)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"main", "partner"}, registry.Names())
+	assert.Equal(t, "http://main:8080", registry.Default().baseURL)
+
+	tests := []struct {
+		name     string
+		order    models.Order
+		provider string
+	}{
+		{"merchant", models.Order{Number: "12345678903", Merchant: "acme"}, "partner"},
+		{"prefix and length", models.Order{Number: "9000000000000009"}, "partner"},
+		{"prefix only", models.Order{Number: "9000000009"}, "main"},
+		{"default", models.Order{Number: "12345678903"}, "main"},
+		{"pinned", models.Order{Number: "12345678903", Merchant: "acme", AccrualProvider: "main"}, "main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.provider, registry.Route(&tt.order))
+		})
+	}
+
+	// Параметры системы применяются к ее клиенту
+	partner, err := registry.Provider("partner")
+	require.NoError(t, err)
+	assert.Equal(t, "http://partner:8080", partner.baseURL)
+	assert.Equal(t, 0, partner.client.RetryMax)
+	assert.Equal(t, 2*time.Second, partner.client.HTTPClient.Timeout)
+	assert.Equal(t, 120, partner.RateLimit())
+	assert.Equal(t, 2, partner.breaker.settings.FailureThreshold)
+	assert.Equal(t, time.Minute, partner.breaker.settings.CoolDown)
+
+	mainProvider, err := registry.Provider("main")
+	require.NoError(t, err)
+	assert.Equal(t, 3, mainProvider.client.RetryMax)
+	assert.Equal(t, DefaultBreakerSettings(), mainProvider.breaker.settings)
+
+	_, err = registry.Provider("other")
+	assert.ErrorIs(t, err, ErrUnknownProvider)
+
+	assert.Len(t, registry.BreakerStatuses(), 2)
+}
+
+func TestProvidersConfig_SetBreakerDefaults(t *testing.T) {
+	cfg, err := LoadProvidersConfig(strings.NewReader(testProvidersConfig))
+	require.NoError(t, err)
+	cfg.SetBreakerDefaults(BreakerSettings{FailureThreshold: 7, CoolDown: 10 * time.Second})
+	registry, err := NewProviderRegistry(cfg)
+	require.NoError(t, err)
+
+	// Система без своих параметров выключателя берет общие
+	mainProvider, err := registry.Provider("main")
+	require.NoError(t, err)
+	assert.Equal(t, 7, mainProvider.breaker.settings.FailureThreshold)
+	assert.Equal(t, 10*time.Second, mainProvider.breaker.settings.CoolDown)
+
+	// Свои параметры системы важнее общих
+	partner, err := registry.Provider("partner")
+	require.NoError(t, err)
+	assert.Equal(t, 2, partner.breaker.settings.FailureThreshold)
+	assert.Equal(t, time.Minute, partner.breaker.settings.CoolDown)
+}
@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// IsCallbackNonceUsed сообщает, применялось ли уже push-уведомление с подписью nonce
+func (s *DatabaseStorage) IsCallbackNonceUsed(ctx context.Context, nonce string) (bool, error) {
+	var used bool
+	query := `SELECT EXISTS (SELECT 1 FROM callback_nonces WHERE nonce = $1 AND expires_at > $2)`
+	if err := s.pool.QueryRow(ctx, query, nonce, time.Now()).Scan(&used); err != nil {
+		return false, fmt.Errorf("failed to check callback nonce: %w", err)
+	}
+
+	return used, nil
+}
+
+// SaveCallbackNonce запоминает подпись примененного push-уведомления до expiresAt
+// и удаляет подписи с истекшим сроком
+func (s *DatabaseStorage) SaveCallbackNonce(ctx context.Context, nonce string, expiresAt time.Time) error {
+	query := `INSERT INTO callback_nonces (nonce, expires_at) VALUES ($1, $2) ON CONFLICT (nonce) DO NOTHING`
+	if _, err := s.pool.Exec(ctx, query, nonce, expiresAt); err != nil {
+		return fmt.Errorf("failed to save callback nonce: %w", err)
+	}
+
+	// Истекшие подписи удаляются по индексу срока хранения
+	if _, err := s.pool.Exec(ctx, `DELETE FROM callback_nonces WHERE expires_at <= $1`, time.Now()); err != nil {
+		return fmt.Errorf("failed to prune callback nonces: %w", err)
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -11,6 +12,24 @@ import (
 	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
 )
 
+// NewOrdersChannel канал LISTEN/NOTIFY, в который CreateOrder сообщает номер нового заказа
+const NewOrdersChannel = "new_orders"
+
+// orderColumns колонки заказа в порядке, ожидаемом scanOrder
+const orderColumns = `id, user_id, number, status, accrual, uploaded_at, attempts, last_error, next_check_at,
+	COALESCE(locked_by, ''), locked_until, COALESCE(merchant, ''), COALESCE(accrual_provider, ''), dead_lettered_at`
+
+// OrdersViewedThrottle как часто обновляется отметка просмотра списка заказов: частые
+// запросы списка не должны превращаться в запись на каждый запрос
+const OrdersViewedThrottle = 10 * time.Second
+
+// scanOrder читает заказ из строки, выбранной по orderColumns
+func scanOrder(row pgx.Row, order *models.Order) error {
+	return row.Scan(&order.ID, &order.UserID, &order.Number, &order.Status, &order.Accrual, &order.UploadedAt,
+		&order.Attempts, &order.LastError, &order.NextCheckAt, &order.LockedBy, &order.LockedUntil,
+		&order.Merchant, &order.AccrualProvider, &order.DeadLetteredAt)
+}
+
 // DatabaseStorage реализация хранилища на PostgreSQL
 type DatabaseStorage struct {
 	pool *pgxpool.Pool
@@ -18,7 +37,18 @@ type DatabaseStorage struct {
 
 // NewDatabaseStorage создает новое подключение к базе данных
 func NewDatabaseStorage(ctx context.Context, databaseURI string) (*DatabaseStorage, error) {
-	pool, err := pgxpool.New(ctx, databaseURI)
+	config, err := pgxpool.ParseConfig(databaseURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse database URI: %w", err)
+	}
+	// Время в базе хранится в UTC независимо от часового пояса хоста и сервера базы данных
+	config.ConnConfig.RuntimeParams["timezone"] = sessionTimeZone
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		registerUTCTimestamps(conn.TypeMap())
+		return nil
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -45,11 +75,11 @@ func (s *DatabaseStorage) Ping(ctx context.Context) error {
 // CreateUser создает нового пользователя
 func (s *DatabaseStorage) CreateUser(ctx context.Context, login, passwordHash string) (*models.User, error) {
 	var user models.User
-	query := `INSERT INTO users (login, password_hash) VALUES ($1, $2) RETURNING id, login, password_hash`
+	query := `INSERT INTO users (login, password_hash) VALUES ($1, $2) RETURNING id, login, password_hash, tier`
 
-	err := s.pool.QueryRow(ctx, query, login, passwordHash).Scan(&user.ID, &user.Login, &user.Password)
+	err := s.pool.QueryRow(ctx, query, login, passwordHash).Scan(&user.ID, &user.Login, &user.Password, &user.Tier)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
+		return nil, fmt.Errorf("failed to create user: %w", wrapUniqueViolation(err))
 	}
 
 	return &user, nil
@@ -58,9 +88,9 @@ func (s *DatabaseStorage) CreateUser(ctx context.Context, login, passwordHash st
 // GetUserByLogin получает пользователя по логину
 func (s *DatabaseStorage) GetUserByLogin(ctx context.Context, login string) (*models.User, error) {
 	var user models.User
-	query := `SELECT id, login, password_hash FROM users WHERE login = $1`
+	query := `SELECT id, login, password_hash, tier FROM users WHERE login = $1`
 
-	err := s.pool.QueryRow(ctx, query, login).Scan(&user.ID, &user.Login, &user.Password)
+	err := s.pool.QueryRow(ctx, query, login).Scan(&user.ID, &user.Login, &user.Password, &user.Tier)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -74,9 +104,9 @@ func (s *DatabaseStorage) GetUserByLogin(ctx context.Context, login string) (*mo
 // GetUserByID получает пользователя по ID
 func (s *DatabaseStorage) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
 	var user models.User
-	query := `SELECT id, login, password_hash FROM users WHERE id = $1`
+	query := `SELECT id, login, password_hash, tier FROM users WHERE id = $1`
 
-	err := s.pool.QueryRow(ctx, query, id).Scan(&user.ID, &user.Login, &user.Password)
+	err := s.pool.QueryRow(ctx, query, id).Scan(&user.ID, &user.Login, &user.Password, &user.Tier)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -87,28 +117,73 @@ func (s *DatabaseStorage) GetUserByID(ctx context.Context, id int64) (*models.Us
 	return &user, nil
 }
 
-// CreateOrder создает новый заказ
+// CreateOrder создает новый заказ и уведомляет слушателей канала NewOrdersChannel
 func (s *DatabaseStorage) CreateOrder(ctx context.Context, userID int64, number string) (*models.Order, error) {
+	return s.CreateMerchantOrder(ctx, userID, number, "")
+}
+
+// CreateMerchantOrder создает заказ мерчанта merchant; пустой merchant — заказ без мерчанта
+func (s *DatabaseStorage) CreateMerchantOrder(ctx context.Context, userID int64, number, merchant string) (*models.Order, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
 	var order models.Order
-	query := `INSERT INTO orders (user_id, number, status, uploaded_at) VALUES ($1, $2, $3, $4) RETURNING id, user_id, number, status, accrual, uploaded_at`
+	query := `INSERT INTO orders (user_id, number, status, uploaded_at, next_check_at, merchant)
+		VALUES ($1, $2, $3, $4, $4, NULLIF($5, '')) RETURNING ` + orderColumns
 
 	now := time.Now()
-	err := s.pool.QueryRow(ctx, query, userID, number, "NEW", now).Scan(
-		&order.ID, &order.UserID, &order.Number, &order.Status, &order.Accrual, &order.UploadedAt)
+	err = scanOrder(tx.QueryRow(ctx, query, userID, number, models.OrderStatusNew, now, merchant), &order)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create order: %w", err)
+		return nil, fmt.Errorf("failed to create order: %w", wrapUniqueViolation(err))
+	}
+
+	// Уведомление доставляется слушателям только после коммита
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, NewOrdersChannel, number); err != nil {
+		return nil, fmt.Errorf("failed to notify about new order: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
 	return &order, nil
 }
 
+// ListenNewOrders слушает канал NewOrdersChannel на отдельном соединении и вызывает
+// onNotify на каждое уведомление. Блокируется до отмены ctx или обрыва соединения;
+// переподключение остается за вызывающей стороной.
+func (s *DatabaseStorage) ListenNewOrders(ctx context.Context, onNotify func()) error {
+	// LISTEN привязан к соединению, поэтому берем отдельное соединение, а не соединение пула
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return fmt.Errorf("failed to connect for listening: %w", err)
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{NewOrdersChannel}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to listen for new orders: %w", err)
+	}
+
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		onNotify()
+	}
+}
+
 // GetOrderByNumber получает заказ по номеру
 func (s *DatabaseStorage) GetOrderByNumber(ctx context.Context, number string) (*models.Order, error) {
 	var order models.Order
-	query := `SELECT id, user_id, number, status, accrual, uploaded_at FROM orders WHERE number = $1`
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE number = $1`
 
-	err := s.pool.QueryRow(ctx, query, number).Scan(
-		&order.ID, &order.UserID, &order.Number, &order.Status, &order.Accrual, &order.UploadedAt)
+	err := scanOrder(s.pool.QueryRow(ctx, query, number), &order)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return nil, nil
@@ -121,7 +196,7 @@ func (s *DatabaseStorage) GetOrderByNumber(ctx context.Context, number string) (
 
 // GetOrdersByUserID получает все заказы пользователя
 func (s *DatabaseStorage) GetOrdersByUserID(ctx context.Context, userID int64) ([]models.Order, error) {
-	query := `SELECT id, user_id, number, status, accrual, uploaded_at FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC`
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE user_id = $1 ORDER BY uploaded_at DESC`
 
 	rows, err := s.pool.Query(ctx, query, userID)
 	if err != nil {
@@ -132,7 +207,7 @@ func (s *DatabaseStorage) GetOrdersByUserID(ctx context.Context, userID int64) (
 	var orders []models.Order
 	for rows.Next() {
 		var order models.Order
-		err := rows.Scan(&order.ID, &order.UserID, &order.Number, &order.Status, &order.Accrual, &order.UploadedAt)
+		err := scanOrder(rows, &order)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan order: %w", err)
 		}
@@ -142,8 +217,196 @@ func (s *DatabaseStorage) GetOrdersByUserID(ctx context.Context, userID int64) (
 	return orders, nil
 }
 
+// ClaimOrders захватывает до limit заказов с указанными статусами, проверка которых назначена
+// не позже dueBefore, за обработчиком workerID на время lease. Заказы выбираются справедливо
+// по правилам policy: по раундам между пользователями, а не по времени загрузки.
+// Заказы, захваченные другими обработчиками, пропускаются без ожидания; захват с истекшим
+// сроком считается снятым.
+func (s *DatabaseStorage) ClaimOrders(ctx context.Context, statuses []string, workerID string, dueBefore time.Time, limit int, lease time.Duration, policy models.SchedulingPolicy) ([]models.Order, error) {
+	if len(statuses) == 0 || limit <= 0 {
+		return []models.Order{}, nil
+	}
+
+	tiers := make([]string, 0, len(policy.TierWeights))
+	weights := make([]int32, 0, len(policy.TierWeights))
+	maxWeight := 1
+	for tier := range policy.TierWeights {
+		tiers = append(tiers, tier)
+		weights = append(weights, int32(policy.Weight(tier)))
+		maxWeight = max(maxWeight, policy.Weight(tier))
+	}
+	now := time.Now()
+	recentBoost, viewBoost := 0, 0
+	if policy.RecentWindow > 0 {
+		recentBoost = models.RecentOrderBoost
+	}
+	if policy.ViewWindow > 0 {
+		viewBoost = models.ViewedOrderBoost
+	}
+
+	// Приоритет совпадает с models.SchedulingPolicy.Priority: номер раунда заказа среди
+	// ожидающих заказов пользователя за вычетом повышений. Ранжируются только первые заказы
+	// каждого пользователя, а не вся очередь: повышение недавнего заказа поднимает его не больше
+	// чем на раунд, то есть не дальше maxWeight заказов, поэтому более поздние заказы пользователя
+	// уступают его первым limit заказам и в пачку не попадут
+	perUser := limit + maxWeight
+	query := `WITH due_users AS (
+			SELECT DISTINCT o.user_id
+			FROM orders o
+			WHERE o.status = ANY($1) AND o.next_check_at <= $6
+				AND (o.locked_until IS NULL OR o.locked_until < $4)
+		), due AS (
+			SELECT q.id, q.uploaded_at,
+				(ROW_NUMBER() OVER (PARTITION BY u.id ORDER BY q.uploaded_at, q.id) - 1) / COALESCE(w.weight, 1)
+					- CASE WHEN q.uploaded_at >= $9 THEN $10::int ELSE 0 END
+					- CASE WHEN u.orders_viewed_at >= $11 THEN $12::int ELSE 0 END AS priority
+			FROM due_users du
+			JOIN users u ON u.id = du.user_id
+			LEFT JOIN unnest($7::text[], $8::int[]) AS w(tier, weight) ON w.tier = u.tier
+			CROSS JOIN LATERAL (
+				SELECT o.id, o.uploaded_at
+				FROM orders o
+				WHERE o.user_id = du.user_id AND o.status = ANY($1) AND o.next_check_at <= $6
+					AND (o.locked_until IS NULL OR o.locked_until < $4)
+				ORDER BY o.uploaded_at, o.id
+				LIMIT $13
+			) q
+		), picked AS (
+			SELECT o.id AS picked_id, due.priority
+			FROM orders o
+			JOIN due ON due.id = o.id
+			WHERE o.status = ANY($1) AND o.next_check_at <= $6
+				AND (o.locked_until IS NULL OR o.locked_until < $4)
+			ORDER BY due.priority, due.uploaded_at, due.id
+			LIMIT $5
+			FOR UPDATE OF o SKIP LOCKED
+		)
+		UPDATE orders SET locked_by = $2, locked_until = $3
+		FROM picked
+		WHERE orders.id = picked.picked_id
+		RETURNING picked.priority, ` + orderColumns
+
+	rows, err := s.pool.Query(ctx, query, statuses, workerID, now.Add(lease), now, limit, dueBefore,
+		tiers, weights, now.Add(-policy.RecentWindow), recentBoost, now.Add(-policy.ViewWindow), viewBoost, perUser)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	priorities := make(map[int64]int)
+	for rows.Next() {
+		var order models.Order
+		var priority int
+		if err := scanOrder(prefixedRow{Row: rows, prefix: []any{&priority}}, &order); err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		priorities[order.ID] = priority
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim orders: %w", err)
+	}
+
+	// RETURNING не сохраняет порядок подзапроса
+	sort.Slice(orders, func(i, j int) bool {
+		if priorities[orders[i].ID] != priorities[orders[j].ID] {
+			return priorities[orders[i].ID] < priorities[orders[j].ID]
+		}
+		if !orders[i].UploadedAt.Equal(orders[j].UploadedAt) {
+			return orders[i].UploadedAt.Before(orders[j].UploadedAt)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+
+	return orders, nil
+}
+
+// prefixedRow строка, перед колонками orderColumns которой выбраны дополнительные колонки prefix
+type prefixedRow struct {
+	pgx.Row
+	prefix []any
+}
+
+// Scan читает дополнительные колонки в prefix, а остальные — в dest
+func (r prefixedRow) Scan(dest ...any) error {
+	return r.Row.Scan(append(append([]any{}, r.prefix...), dest...)...)
+}
+
+// MarkOrdersViewed отмечает, что пользователь userID смотрел список заказов в момент at.
+// Отметка обновляется не чаще раза в OrdersViewedThrottle.
+func (s *DatabaseStorage) MarkOrdersViewed(ctx context.Context, userID int64, at time.Time) error {
+	_, err := s.pool.Exec(ctx,
+		`UPDATE users SET orders_viewed_at = $2
+		WHERE id = $1 AND (orders_viewed_at IS NULL OR orders_viewed_at < $3)`,
+		userID, at, at.Add(-OrdersViewedThrottle))
+	if err != nil {
+		return fmt.Errorf("failed to mark orders viewed: %w", err)
+	}
+	return nil
+}
+
+// SetUserTier меняет тариф пользователя. Возвращает false, если пользователя нет.
+func (s *DatabaseStorage) SetUserTier(ctx context.Context, userID int64, tier string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE users SET tier = $2 WHERE id = $1`, userID, tier)
+	if err != nil {
+		return false, fmt.Errorf("failed to set user tier: %w", err)
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// CountDueOrders возвращает число заказов со статусами statuses, чья проверка назначена
+// не позже dueBefore, включая захваченные другими экземплярами
+func (s *DatabaseStorage) CountDueOrders(ctx context.Context, statuses []string, dueBefore time.Time) (int, error) {
+	var count int
+	err := s.pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM orders WHERE status = ANY($1) AND next_check_at <= $2`,
+		statuses, dueBefore).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count due orders: %w", err)
+	}
+
+	return count, nil
+}
+
+// ReleaseOrders снимает захват обработчика workerID с заказов. Заказам, которые
+// все еще ожидают расчета, следующая проверка назначается не раньше nextCheckAt.
+func (s *DatabaseStorage) ReleaseOrders(ctx context.Context, workerID string, numbers []string, nextCheckAt time.Time) error {
+	if len(numbers) == 0 {
+		return nil
+	}
+
+	query := `UPDATE orders SET locked_by = NULL, locked_until = NULL,
+			next_check_at = CASE WHEN status = ANY($4) AND next_check_at < $3 THEN $3 ELSE next_check_at END
+		WHERE locked_by = $1 AND number = ANY($2)`
+
+	_, err := s.pool.Exec(ctx, query, workerID, numbers, nextCheckAt, models.PendingOrderStatuses)
+	if err != nil {
+		return fmt.Errorf("failed to release orders: %w", err)
+	}
+
+	return nil
+}
+
+// AssignOrderProvider закрепляет за заказом систему начисления provider, если она еще не выбрана.
+// Возвращает систему, закрепленную за заказом, или ErrNotFound.
+func (s *DatabaseStorage) AssignOrderProvider(ctx context.Context, number, provider string) (string, error) {
+	var assigned string
+	query := `UPDATE orders SET accrual_provider = COALESCE(accrual_provider, $2) WHERE number = $1 RETURNING accrual_provider`
+
+	err := s.pool.QueryRow(ctx, query, number, provider).Scan(&assigned)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", fmt.Errorf("failed to assign order provider: %w", ErrNotFound)
+		}
+		return "", fmt.Errorf("failed to assign order provider: %w", err)
+	}
+
+	return assigned, nil
+}
+
 // UpdateOrderStatus обновляет статус заказа
-func (s *DatabaseStorage) UpdateOrderStatus(ctx context.Context, number string, status string, accrual *float64) error {
+func (s *DatabaseStorage) UpdateOrderStatus(ctx context.Context, number string, status string, accrual *models.Money) error {
 	query := `UPDATE orders SET status = $1, accrual = $2 WHERE number = $3`
 
 	_, err := s.pool.Exec(ctx, query, status, accrual, number)
@@ -154,54 +417,207 @@ func (s *DatabaseStorage) UpdateOrderStatus(ctx context.Context, number string,
 	return nil
 }
 
-// GetBalance получает баланс пользователя
-func (s *DatabaseStorage) GetBalance(ctx context.Context, userID int64) (*models.Balance, error) {
-	var balance models.Balance
-	query := `SELECT user_id, current, withdrawn FROM balances WHERE user_id = $1`
+// TransitionOrderStatus меняет статус заказа, только если текущий статус равен from.
+// Возвращает false, если заказ не найден или его статус уже изменился.
+func (s *DatabaseStorage) TransitionOrderStatus(ctx context.Context, number string, from, to string, accrual *models.Money) (bool, error) {
+	query := `UPDATE orders SET status = $1, accrual = $2, attempts = 0, last_error = '', next_check_at = $5, dead_lettered_at = NULL,
+			processed_at = CASE WHEN $1 = 'PROCESSED' THEN $5 ELSE processed_at END
+		WHERE number = $3 AND status = $4`
 
-	err := s.pool.QueryRow(ctx, query, userID).Scan(&balance.UserID, &balance.Current, &balance.Withdrawn)
+	tag, err := s.pool.Exec(ctx, query, to, accrual, number, from, time.Now())
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// Создаем новый баланс если не существует
-			balance = models.Balance{UserID: userID, Current: 0, Withdrawn: 0}
-			err = s.UpdateBalance(ctx, userID, 0, 0)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create balance: %w", err)
-			}
-			return &balance, nil
-		}
-		return nil, fmt.Errorf("failed to get balance: %w", err)
+		return false, fmt.Errorf("failed to update order status: %w", err)
 	}
 
-	return &balance, nil
+	return tag.RowsAffected() == 1, nil
+}
+
+// ScheduleOrderRetry фиксирует неудачную проверку заказа в системе начисления:
+// увеличивает счетчик попыток и назначает время следующей проверки.
+// Если nextCheckAt равен nil, заказ больше не выбирается для проверки и попадает в очередь недоставленных.
+func (s *DatabaseStorage) ScheduleOrderRetry(ctx context.Context, number string, lastError string, nextCheckAt *time.Time) error {
+	// Попытка записывается в журнал неудач; без следующей проверки заказ попадает в очередь недоставленных
+	query := `WITH failed AS (
+			UPDATE orders SET attempts = attempts + 1, last_error = $2, next_check_at = $3,
+				dead_lettered_at = CASE WHEN $5 THEN $6 ELSE NULL END
+			WHERE number = $1 AND status = ANY($4) RETURNING number, attempts
+		)
+		INSERT INTO order_failures (order_number, attempt, error, failed_at)
+		SELECT number, attempts, $2, $6 FROM failed`
+
+	_, err := s.pool.Exec(ctx, query, number, lastError, nextCheckAt, models.PendingOrderStatuses, nextCheckAt == nil, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to schedule order retry: %w", err)
+	}
+
+	return nil
 }
 
-// UpdateBalance обновляет баланс пользователя
-func (s *DatabaseStorage) UpdateBalance(ctx context.Context, userID int64, current, withdrawn float64) error {
-	query := `INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, $3) 
-			  ON CONFLICT (user_id) DO UPDATE SET current = $2, withdrawn = $3`
+// DeferOrderCheck переносит проверку заказа, еще не зарегистрированного в системе начисления,
+// на nextCheckAt. Это не ошибка: счетчик попыток не растет, а в журнал неудач ничего не пишется.
+func (s *DatabaseStorage) DeferOrderCheck(ctx context.Context, number string, reason string, nextCheckAt time.Time) error {
+	query := `UPDATE orders SET last_error = $2, next_check_at = $3, dead_lettered_at = NULL
+		WHERE number = $1 AND status = ANY($4)`
 
-	_, err := s.pool.Exec(ctx, query, userID, current, withdrawn)
+	_, err := s.pool.Exec(ctx, query, number, reason, nextCheckAt, models.PendingOrderStatuses)
 	if err != nil {
-		return fmt.Errorf("failed to update balance: %w", err)
+		return fmt.Errorf("failed to defer order check: %w", err)
 	}
 
 	return nil
 }
 
-// CreateWithdrawal создает новое списание средств
-func (s *DatabaseStorage) CreateWithdrawal(ctx context.Context, userID int64, order string, sum float64) (*models.Withdrawal, error) {
-	var withdrawal models.Withdrawal
-	query := `INSERT INTO withdrawals (user_id, order_number, sum, processed_at) VALUES ($1, $2, $3, $4) RETURNING id, user_id, order_number, sum, processed_at`
+// SaveAccrualRateLimit сохраняет допустимое число запросов в минуту к системе начисления
+func (s *DatabaseStorage) SaveAccrualRateLimit(ctx context.Context, system string, perMinute int) error {
+	query := `INSERT INTO accrual_rate_limits (system, requests_per_minute, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (system) DO UPDATE SET requests_per_minute = EXCLUDED.requests_per_minute, updated_at = EXCLUDED.updated_at`
+
+	_, err := s.pool.Exec(ctx, query, system, perMinute, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save accrual rate limit: %w", err)
+	}
+
+	return nil
+}
+
+// SyncAccrualRateLimit продлевает отметку активности экземпляра clientID на ttl, удаляет
+// истекшие и возвращает сохраненную частоту запросов и число активных экземпляров
+func (s *DatabaseStorage) SyncAccrualRateLimit(ctx context.Context, system, clientID string, ttl time.Duration) (int, int, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
 	now := time.Now()
-	err := s.pool.QueryRow(ctx, query, userID, order, sum, now).Scan(
-		&withdrawal.ID, &withdrawal.UserID, &withdrawal.Order, &withdrawal.Sum, &withdrawal.ProcessedAt)
+	_, err = tx.Exec(ctx, `INSERT INTO accrual_rate_limit_clients (system, client_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (system, client_id) DO UPDATE SET expires_at = EXCLUDED.expires_at`,
+		system, clientID, now.Add(ttl))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create withdrawal: %w", err)
+		return 0, 0, fmt.Errorf("failed to register accrual client: %w", err)
 	}
 
-	return &withdrawal, nil
+	_, err = tx.Exec(ctx, `DELETE FROM accrual_rate_limit_clients WHERE system = $1 AND expires_at < $2`, system, now)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to delete expired accrual clients: %w", err)
+	}
+
+	var perMinute, clients int
+	query := `SELECT COALESCE((SELECT requests_per_minute FROM accrual_rate_limits WHERE system = $1), 0),
+			(SELECT COUNT(*) FROM accrual_rate_limit_clients WHERE system = $1)`
+	if err := tx.QueryRow(ctx, query, system).Scan(&perMinute, &clients); err != nil {
+		return 0, 0, fmt.Errorf("failed to get accrual rate limit: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return perMinute, clients, nil
+}
+
+// SaveAccrualEvent добавляет ответ системы начисления в журнал и заполняет event.ID
+func (s *DatabaseStorage) SaveAccrualEvent(ctx context.Context, event *models.AccrualEvent) error {
+	query := `INSERT INTO accrual_events (order_number, provider, source, requested_at, http_status, latency_ms, body, status, accrual, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+	err := s.pool.QueryRow(ctx, query, event.OrderNumber, event.Provider, event.Source, event.RequestedAt,
+		event.HTTPStatus, event.LatencyMs, event.Body, event.Status, event.Accrual, event.Error).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save accrual event: %w", err)
+	}
+
+	return nil
+}
+
+// ListAccrualEvents возвращает события заказа в порядке записи
+func (s *DatabaseStorage) ListAccrualEvents(ctx context.Context, orderNumber string) ([]models.AccrualEvent, error) {
+	query := `SELECT id, order_number, provider, source, requested_at, http_status, latency_ms, body, status, accrual, error
+		FROM accrual_events WHERE order_number = $1 ORDER BY id`
+
+	rows, err := s.pool.Query(ctx, query, orderNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual events: %w", err)
+	}
+	defer rows.Close()
+
+	var events []models.AccrualEvent
+	for rows.Next() {
+		var event models.AccrualEvent
+		err := rows.Scan(&event.ID, &event.OrderNumber, &event.Provider, &event.Source, &event.RequestedAt,
+			&event.HTTPStatus, &event.LatencyMs, &event.Body, &event.Status, &event.Accrual, &event.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan accrual event: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate accrual events: %w", err)
+	}
+
+	return events, nil
+}
+
+// ListAccrualEventOrders возвращает номера заказов, по которым есть события
+func (s *DatabaseStorage) ListAccrualEventOrders(ctx context.Context) ([]string, error) {
+	rows, err := s.pool.Query(ctx, `SELECT DISTINCT order_number FROM accrual_events ORDER BY order_number`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual event orders: %w", err)
+	}
+
+	numbers, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan accrual event orders: %w", err)
+	}
+
+	return numbers, nil
+}
+
+// GetBalance получает баланс пользователя: текущий баланс — сумма проводок по его счету,
+// списано — сумма его списаний. Снимок в balances только сверяется с ними.
+func (s *DatabaseStorage) GetBalance(ctx context.Context, userID int64) (*models.Balance, error) {
+	balance := models.Balance{UserID: userID}
+	query := `SELECT (` + ledgerBalanceQuery + `),
+		(SELECT COALESCE(SUM(sum), 0) FROM withdrawals WHERE user_id = $1)`
+
+	if err := s.pool.QueryRow(ctx, query, userID).Scan(&balance.Current, &balance.Withdrawn); err != nil {
+		return nil, fmt.Errorf("failed to get balance: %w", err)
+	}
+
+	return &balance, nil
+}
+
+// AdjustBalance проводит по журналу корректировку текущего баланса пользователя на amount.
+// Баланс не может стать отрицательным.
+func (s *DatabaseStorage) AdjustBalance(ctx context.Context, userID int64, amount models.Money) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	balance, err := lockBalance(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if balance.Current+amount < 0 {
+		return fmt.Errorf("insufficient funds: current balance %s, adjustment %s", balance.Current, amount)
+	}
+
+	query := `UPDATE balances SET current = current + $2, updated_at = CURRENT_TIMESTAMP WHERE user_id = $1`
+	if _, err := tx.Exec(ctx, query, userID, amount); err != nil {
+		return fmt.Errorf("failed to update balance: %w", err)
+	}
+
+	if err := postLedgerTransaction(ctx, tx, userID, models.LedgerKindAdjustment, models.LedgerAccountAdjustments, "", amount); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
 }
 
 // GetWithdrawalsByUserID получает все списания пользователя
@@ -234,7 +650,7 @@ func (s *DatabaseStorage) GetOrdersByStatus(ctx context.Context, statuses []stri
 	}
 
 	// Строим запрос с параметрами для статусов
-	query := `SELECT id, user_id, number, status, accrual, uploaded_at FROM orders WHERE status = ANY($1) ORDER BY uploaded_at ASC`
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE status = ANY($1) ORDER BY uploaded_at ASC`
 
 	rows, err := s.pool.Query(ctx, query, statuses)
 	if err != nil {
@@ -245,7 +661,7 @@ func (s *DatabaseStorage) GetOrdersByStatus(ctx context.Context, statuses []stri
 	var orders []models.Order
 	for rows.Next() {
 		var order models.Order
-		err := rows.Scan(&order.ID, &order.UserID, &order.Number, &order.Status, &order.Accrual, &order.UploadedAt)
+		err := scanOrder(rows, &order)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan order: %w", err)
 		}
@@ -255,16 +671,19 @@ func (s *DatabaseStorage) GetOrdersByStatus(ctx context.Context, statuses []stri
 	return orders, nil
 }
 
-// GetOrdersByStatusPaginated получает заказы по статусам с пагинацией
+// GetOrdersByStatusPaginated получает заказы по статусам с пагинацией.
+// Возвращает только заказы, время проверки которых наступило.
 func (s *DatabaseStorage) GetOrdersByStatusPaginated(ctx context.Context, statuses []string, limit, offset int) ([]models.Order, error) {
 	if len(statuses) == 0 {
 		return []models.Order{}, nil
 	}
 
 	// Строим запрос с параметрами для статусов и пагинацией
-	query := `SELECT id, user_id, number, status, accrual, uploaded_at FROM orders WHERE status = ANY($1) ORDER BY uploaded_at ASC LIMIT $2 OFFSET $3`
+	query := `SELECT ` + orderColumns + ` FROM orders
+		WHERE status = ANY($1) AND next_check_at <= $4
+		ORDER BY uploaded_at ASC, id ASC LIMIT $2 OFFSET $3`
 
-	rows, err := s.pool.Query(ctx, query, statuses, limit, offset)
+	rows, err := s.pool.Query(ctx, query, statuses, limit, offset, time.Now())
 	if err != nil {
 		return nil, fmt.Errorf("failed to get orders by status with pagination: %w", err)
 	}
@@ -273,7 +692,7 @@ func (s *DatabaseStorage) GetOrdersByStatusPaginated(ctx context.Context, status
 	var orders []models.Order
 	for rows.Next() {
 		var order models.Order
-		err := rows.Scan(&order.ID, &order.UserID, &order.Number, &order.Status, &order.Accrual, &order.UploadedAt)
+		err := scanOrder(rows, &order)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan order: %w", err)
 		}
@@ -284,7 +703,7 @@ func (s *DatabaseStorage) GetOrdersByStatusPaginated(ctx context.Context, status
 }
 
 // ProcessWithdrawal выполняет списание средств в транзакции
-func (s *DatabaseStorage) ProcessWithdrawal(ctx context.Context, userID int64, order string, sum float64) (*models.Withdrawal, error) {
+func (s *DatabaseStorage) ProcessWithdrawal(ctx context.Context, userID int64, order string, sum models.Money) (*models.Withdrawal, error) {
 	// Начинаем транзакцию
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
@@ -293,22 +712,14 @@ func (s *DatabaseStorage) ProcessWithdrawal(ctx context.Context, userID int64, o
 	defer tx.Rollback(ctx)
 
 	// Получаем баланс с блокировкой строки
-	var balance models.Balance
-	balanceQuery := `SELECT user_id, current, withdrawn FROM balances WHERE user_id = $1 FOR UPDATE`
-
-	err = tx.QueryRow(ctx, balanceQuery, userID).Scan(&balance.UserID, &balance.Current, &balance.Withdrawn)
+	balance, err := lockBalance(ctx, tx, userID)
 	if err != nil {
-		if errors.Is(err, pgx.ErrNoRows) {
-			// Создаем новый баланс если не существует
-			balance = models.Balance{UserID: userID, Current: 0, Withdrawn: 0}
-		} else {
-			return nil, fmt.Errorf("failed to get balance for update: %w", err)
-		}
+		return nil, err
 	}
 
 	// Проверяем достаточность средств
 	if balance.Current < sum {
-		return nil, fmt.Errorf("insufficient funds: current balance %.2f, requested %.2f", balance.Current, sum)
+		return nil, fmt.Errorf("insufficient funds: current balance %s, requested %s", balance.Current, sum)
 	}
 
 	// Создаем списание
@@ -323,16 +734,19 @@ func (s *DatabaseStorage) ProcessWithdrawal(ctx context.Context, userID int64, o
 	}
 
 	// Обновляем баланс
-	newCurrent := balance.Current - sum
-	newWithdrawn := balance.Withdrawn + sum
-	updateBalanceQuery := `INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, $3) 
-						  ON CONFLICT (user_id) DO UPDATE SET current = $2, withdrawn = $3`
+	updateBalanceQuery := `UPDATE balances SET current = current - $2, withdrawn = withdrawn + $2, updated_at = CURRENT_TIMESTAMP
+						  WHERE user_id = $1`
 
-	_, err = tx.Exec(ctx, updateBalanceQuery, userID, newCurrent, newWithdrawn)
+	_, err = tx.Exec(ctx, updateBalanceQuery, userID, sum)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update balance: %w", err)
 	}
 
+	// Проводим списание по журналу
+	if err := postLedgerTransaction(ctx, tx, userID, models.LedgerKindWithdrawal, models.LedgerAccountWithdrawals, order, -sum); err != nil {
+		return nil, err
+	}
+
 	// Подтверждаем транзакцию
 	if err := tx.Commit(ctx); err != nil {
 		return nil, fmt.Errorf("failed to commit transaction: %w", err)
@@ -341,8 +755,13 @@ func (s *DatabaseStorage) ProcessWithdrawal(ctx context.Context, userID int64, o
 	return &withdrawal, nil
 }
 
-// UpdateOrderStatusAndBalance атомарно обновляет статус заказа и баланс пользователя
-func (s *DatabaseStorage) UpdateOrderStatusAndBalance(ctx context.Context, orderNumber string, status string, accrual *float64, userID int64, newCurrent, withdrawn float64) error {
+// UpdateOrderStatusAndBalance атомарно обновляет статус заказа и проводит начисление accrual
+// на баланс пользователя
+func (s *DatabaseStorage) UpdateOrderStatusAndBalance(ctx context.Context, orderNumber string, status string, accrual *models.Money, userID int64) error {
+	if accrual != nil && *accrual < 0 {
+		return fmt.Errorf("failed to credit order %s: negative accrual %s", orderNumber, *accrual)
+	}
+
 	tx, err := s.pool.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -356,12 +775,22 @@ func (s *DatabaseStorage) UpdateOrderStatusAndBalance(ctx context.Context, order
 		return fmt.Errorf("failed to update order status: %w", err)
 	}
 
-	// Обновляем баланс
-	balanceQuery := `INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, $3)
-		ON CONFLICT (user_id) DO UPDATE SET current = $2, withdrawn = $3`
-	_, err = tx.Exec(ctx, balanceQuery, userID, newCurrent, withdrawn)
-	if err != nil {
-		return fmt.Errorf("failed to update balance: %w", err)
+	if accrual != nil {
+		// Обновляем баланс
+		if _, err := lockBalance(ctx, tx, userID); err != nil {
+			return err
+		}
+
+		balanceQuery := `UPDATE balances SET current = current + $2, updated_at = CURRENT_TIMESTAMP WHERE user_id = $1`
+		_, err = tx.Exec(ctx, balanceQuery, userID, *accrual)
+		if err != nil {
+			return fmt.Errorf("failed to update balance: %w", err)
+		}
+
+		// Проводим начисление по журналу
+		if err := postLedgerTransaction(ctx, tx, userID, models.LedgerKindAccrual, models.LedgerAccountAccruals, orderNumber, *accrual); err != nil {
+			return err
+		}
 	}
 
 	if err := tx.Commit(ctx); err != nil {
@@ -370,3 +799,57 @@ func (s *DatabaseStorage) UpdateOrderStatusAndBalance(ctx context.Context, order
 
 	return nil
 }
+
+// CreditOrderAccrual атомарно переводит заказ в статус PROCESSED и увеличивает баланс
+// владельца заказа на сумму начисления. Начисление выполняется не более одного раза:
+// если заказ уже не ожидает расчета (PROCESSED или INVALID), ничего не меняется
+// и возвращается false.
+func (s *DatabaseStorage) CreditOrderAccrual(ctx context.Context, orderNumber string, accrual models.Money) (bool, error) {
+	if accrual < 0 {
+		return false, fmt.Errorf("failed to credit order %s: negative accrual %s", orderNumber, accrual)
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Условие на статус проверяется под блокировкой строки заказа: конкурентная транзакция
+	// дождется нашего коммита, перепроверит условие и не найдет строку
+	var userID int64
+	orderQuery := `UPDATE orders SET status = 'PROCESSED', accrual = $2, attempts = 0, last_error = '', processed_at = $4,
+			dead_lettered_at = NULL
+		WHERE number = $1 AND status = ANY($3) RETURNING user_id`
+	err = tx.QueryRow(ctx, orderQuery, orderNumber, accrual, models.PendingOrderStatuses, time.Now()).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		var exists bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM orders WHERE number = $1)`, orderNumber).Scan(&exists); err != nil {
+			return false, fmt.Errorf("failed to check order: %w", err)
+		}
+		if !exists {
+			return false, fmt.Errorf("failed to credit order %s: %w", orderNumber, ErrNotFound)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update order status: %w", err)
+	}
+
+	// Увеличиваем баланс в SQL, не опираясь на ранее прочитанное значение
+	balanceQuery := `INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, 0)
+		ON CONFLICT (user_id) DO UPDATE SET current = balances.current + EXCLUDED.current, updated_at = CURRENT_TIMESTAMP`
+	if _, err := tx.Exec(ctx, balanceQuery, userID, accrual); err != nil {
+		return false, fmt.Errorf("failed to update balance: %w", err)
+	}
+
+	if err := postLedgerTransaction(ctx, tx, userID, models.LedgerKindAccrual, models.LedgerAccountAccruals, orderNumber, accrual); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
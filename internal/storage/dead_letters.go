@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// ListDeadLetterOrders возвращает заказы из очереди недоставленных в порядке попадания в нее
+// вместе с неудачными попытками, которые к этому привели
+func (s *DatabaseStorage) ListDeadLetterOrders(ctx context.Context) ([]models.DeadLetterOrder, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE dead_lettered_at IS NOT NULL ORDER BY dead_lettered_at, id`
+
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead letter orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.DeadLetterOrder
+	var numbers []string
+	for rows.Next() {
+		var order models.DeadLetterOrder
+		if err := scanOrder(rows, &order.Order); err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, order)
+		numbers = append(numbers, order.Number)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate orders: %w", err)
+	}
+	if len(orders) == 0 {
+		return nil, nil
+	}
+
+	failuresQuery := `SELECT order_number, attempt, error, failed_at FROM order_failures
+		WHERE order_number = ANY($1) ORDER BY id`
+	rows, err = s.pool.Query(ctx, failuresQuery, numbers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order failures: %w", err)
+	}
+	defer rows.Close()
+
+	failures := make(map[string][]models.OrderFailure)
+	for rows.Next() {
+		var (
+			number  string
+			failure models.OrderFailure
+		)
+		if err := rows.Scan(&number, &failure.Attempt, &failure.Error, &failure.FailedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan order failure: %w", err)
+		}
+		failures[number] = append(failures[number], failure)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate order failures: %w", err)
+	}
+
+	for i := range orders {
+		orders[i].Failures = lastFailures(failures[orders[i].Number], orders[i].Attempts)
+	}
+	return orders, nil
+}
+
+// RequeueDeadLetterOrders возвращает заказы numbers из очереди недоставленных в обработку
+// с новым счетчиком попыток; пустой numbers — все заказы очереди. Возвращает возвращенные заказы.
+func (s *DatabaseStorage) RequeueDeadLetterOrders(ctx context.Context, numbers []string) ([]string, error) {
+	query := `UPDATE orders SET attempts = 0, last_error = '', next_check_at = $3, dead_lettered_at = NULL
+		WHERE dead_lettered_at IS NOT NULL AND ($2 OR number = ANY($1)) RETURNING number`
+
+	rows, err := s.pool.Query(ctx, query, numbers, len(numbers) == 0, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to requeue dead letter orders: %w", err)
+	}
+
+	requeued, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan requeued orders: %w", err)
+	}
+
+	return requeued, nil
+}
+
+// ResolveDeadLetterOrder вручную завершает заказ из очереди недоставленных: переводит его в status
+// и для PROCESSED начисляет accrual на баланс владельца. Возвращает false, если заказа нет в очереди.
+func (s *DatabaseStorage) ResolveDeadLetterOrder(ctx context.Context, number, status string, accrual models.Money) (bool, error) {
+	if accrual < 0 {
+		return false, fmt.Errorf("failed to resolve order %s: negative accrual %s", number, accrual)
+	}
+
+	var orderAccrual *models.Money
+	if status == models.OrderStatusProcessed {
+		orderAccrual = &accrual
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Условие проверяется под блокировкой строки: заказ завершается и начисляется один раз
+	var userID int64
+	orderQuery := `UPDATE orders SET status = $2, accrual = $3, attempts = 0, last_error = '', next_check_at = NULL,
+			dead_lettered_at = NULL, processed_at = CASE WHEN $2 = 'PROCESSED' THEN $4 ELSE processed_at END
+		WHERE number = $1 AND dead_lettered_at IS NOT NULL AND status = ANY($5) RETURNING user_id`
+	err = tx.QueryRow(ctx, orderQuery, number, status, orderAccrual, time.Now(), models.PendingOrderStatuses).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve order: %w", err)
+	}
+
+	if status == models.OrderStatusProcessed && accrual > 0 {
+		balanceQuery := `INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, $2, 0)
+			ON CONFLICT (user_id) DO UPDATE SET current = balances.current + EXCLUDED.current, updated_at = CURRENT_TIMESTAMP`
+		if _, err := tx.Exec(ctx, balanceQuery, userID, accrual); err != nil {
+			return false, fmt.Errorf("failed to update balance: %w", err)
+		}
+		if err := postLedgerTransaction(ctx, tx, userID, models.LedgerKindAccrual, models.LedgerAccountAccruals, number, accrual); err != nil {
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+// lastFailures оставляет последние attempts неудач: более ранние относятся к прошлым сериям попыток
+func lastFailures(failures []models.OrderFailure, attempts int) []models.OrderFailure {
+	if len(failures) > attempts {
+		failures = failures[len(failures)-attempts:]
+	}
+	if failures == nil {
+		return []models.OrderFailure{}
+	}
+	return failures
+}
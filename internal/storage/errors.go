@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// uniqueViolationCode код ошибки PostgreSQL при нарушении ограничения уникальности
+const uniqueViolationCode = "23505"
+
+// Ошибки хранилища
+var (
+	ErrConflict = errors.New("unique constraint violation")
+	ErrNotFound = errors.New("not found")
+)
+
+// wrapUniqueViolation приводит ошибку нарушения уникальности PostgreSQL к ErrConflict
+func wrapUniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+		return fmt.Errorf("%w: %s", ErrConflict, pgErr.ConstraintName)
+	}
+	return err
+}
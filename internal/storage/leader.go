@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// leaderLockKey ключ advisory lock для выборов ведущего с именем name
+func leaderLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("leader:" + name))
+	return int64(h.Sum64())
+}
+
+// HoldLeaderLock добивается session-level advisory lock для выборов name и удерживает его.
+// Блокировка берется на отдельном соединении: она живет, пока жива сессия, и снимается
+// сервером при обрыве соединения. Пока блокировку держит другой экземпляр, попытки
+// повторяются раз в checkInterval; после захвата с той же периодичностью проверяется,
+// что сессия жива. Возвращает ошибку при потере сессии и ctx.Err() после отмены ctx.
+func (s *DatabaseStorage) HoldLeaderLock(ctx context.Context, name string, checkInterval time.Duration, onAcquired func()) error {
+	conn, err := pgx.ConnectConfig(ctx, s.pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return fmt.Errorf("failed to connect for leader election: %w", err)
+	}
+	// Закрытие сессии снимает блокировку
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	key := leaderLockKey(name)
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	acquired := false
+	for {
+		// Зависшее соединение не должно удерживать лидерство дольше одного интервала
+		checkCtx, cancel := context.WithTimeout(ctx, checkInterval)
+		if acquired {
+			err = conn.Ping(checkCtx)
+		} else {
+			err = conn.QueryRow(checkCtx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired)
+			if err == nil && acquired {
+				onAcquired()
+			}
+		}
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("failed to hold leader lock: %w", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// postLedgerTransaction проводит сумму amount по счету пользователя и корреспондирующему
+// системному счету в рамках транзакции tx. Положительная сумма зачисляется пользователю,
+// отрицательная списывается. Нулевые суммы не проводятся.
+func postLedgerTransaction(ctx context.Context, tx pgx.Tx, userID int64, kind, counterAccount, reference string, amount models.Money) error {
+	if amount == 0 {
+		return nil
+	}
+
+	query := `WITH t AS (SELECT nextval('ledger_transaction_seq') AS id)
+		INSERT INTO ledger_entries (transaction_id, account, user_id, kind, amount, reference)
+		SELECT t.id, $1::VARCHAR, $2::BIGINT, $3::VARCHAR, $4::DECIMAL(12,2), $5::VARCHAR FROM t
+		UNION ALL
+		SELECT t.id, $6::VARCHAR, NULL, $3::VARCHAR, -$4::DECIMAL(12,2), $5::VARCHAR FROM t`
+
+	_, err := tx.Exec(ctx, query, models.LedgerUserAccount(userID), userID, kind, amount, reference, counterAccount)
+	if err != nil {
+		return fmt.Errorf("failed to post ledger entries: %w", err)
+	}
+
+	return nil
+}
+
+// ledgerBalanceQuery текущий баланс пользователя $1 — сумма проводок по его счету
+const ledgerBalanceQuery = `SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE user_id = $1`
+
+// lockBalance блокирует строку баланса пользователя до конца транзакции, создавая нулевой
+// баланс при отсутствии, и возвращает баланс с текущей суммой по журналу проводок.
+// Каждая проводка по счету пользователя меняет и строку баланса, поэтому под блокировкой
+// сумма по журналу не изменится; снимок в balances для решений не используется.
+func lockBalance(ctx context.Context, tx pgx.Tx, userID int64) (*models.Balance, error) {
+	_, err := tx.Exec(ctx, `INSERT INTO balances (user_id, current, withdrawn) VALUES ($1, 0, 0) ON CONFLICT (user_id) DO NOTHING`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create balance: %w", err)
+	}
+
+	var balance models.Balance
+	query := `SELECT user_id, withdrawn FROM balances WHERE user_id = $1 FOR UPDATE`
+	if err := tx.QueryRow(ctx, query, userID).Scan(&balance.UserID, &balance.Withdrawn); err != nil {
+		return nil, fmt.Errorf("failed to get balance for update: %w", err)
+	}
+	if err := tx.QueryRow(ctx, ledgerBalanceQuery, userID).Scan(&balance.Current); err != nil {
+		return nil, fmt.Errorf("failed to sum ledger entries: %w", err)
+	}
+
+	return &balance, nil
+}
+
+// GetLedgerEntriesByUserID возвращает проводки по счету пользователя, от новых к старым
+func (s *DatabaseStorage) GetLedgerEntriesByUserID(ctx context.Context, userID int64) ([]models.LedgerEntry, error) {
+	query := `SELECT id, transaction_id, account, user_id, kind, amount, reference, created_at
+		FROM ledger_entries WHERE account = $1 ORDER BY id DESC`
+
+	rows, err := s.pool.Query(ctx, query, models.LedgerUserAccount(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ledger entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []models.LedgerEntry
+	for rows.Next() {
+		var entry models.LedgerEntry
+		err := rows.Scan(&entry.ID, &entry.TransactionID, &entry.Account, &entry.UserID,
+			&entry.Kind, &entry.Amount, &entry.Reference, &entry.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan ledger entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// CheckLedgerConsistency сверяет снимки балансов пользователей с журналом проводок и списаниями
+// и проверяет, что каждая транзакция журнала сбалансирована
+func (s *DatabaseStorage) CheckLedgerConsistency(ctx context.Context) ([]models.LedgerDiscrepancy, error) {
+	// Сверяем в одном снимке данных, чтобы не поймать ложное расхождение между запросами
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var discrepancies []models.LedgerDiscrepancy
+
+	balancesQuery := `SELECT COALESCE(b.user_id, l.user_id, w.user_id),
+			COALESCE(b.current, 0), COALESCE(l.total, 0), COALESCE(b.withdrawn, 0), COALESCE(w.total, 0)
+		FROM balances b
+		FULL OUTER JOIN (
+			SELECT user_id, SUM(amount) AS total FROM ledger_entries
+			WHERE user_id IS NOT NULL GROUP BY user_id
+		) l ON l.user_id = b.user_id
+		FULL OUTER JOIN (
+			SELECT user_id, SUM(sum) AS total FROM withdrawals GROUP BY user_id
+		) w ON w.user_id = COALESCE(b.user_id, l.user_id)
+		WHERE COALESCE(b.current, 0) <> COALESCE(l.total, 0)
+			OR COALESCE(b.withdrawn, 0) <> COALESCE(w.total, 0)
+		ORDER BY 1`
+
+	rows, err := tx.Query(ctx, balancesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check balances against ledger: %w", err)
+	}
+	for rows.Next() {
+		var d models.LedgerDiscrepancy
+		if err := rows.Scan(&d.UserID, &d.BalanceAmount, &d.LedgerAmount, &d.BalanceWithdrawn, &d.WithdrawalsAmount); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan ledger discrepancy: %w", err)
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to check balances against ledger: %w", err)
+	}
+
+	transactionsQuery := `SELECT transaction_id, SUM(amount) FROM ledger_entries
+		GROUP BY transaction_id HAVING SUM(amount) <> 0 ORDER BY transaction_id`
+
+	rows, err = tx.Query(ctx, transactionsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check ledger transactions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d models.LedgerDiscrepancy
+		if err := rows.Scan(&d.TransactionID, &d.LedgerAmount); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger discrepancy: %w", err)
+		}
+		discrepancies = append(discrepancies, d)
+	}
+
+	return discrepancies, rows.Err()
+}
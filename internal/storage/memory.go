@@ -0,0 +1,793 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// MemoryStorage реализация хранилища в памяти процесса.
+// Используется в тестах и для локального запуска без базы данных.
+type MemoryStorage struct {
+	mu sync.RWMutex
+
+	users        map[int64]*models.User
+	usersByLogin map[string]int64
+	orders       map[string]*models.Order
+	balances     map[int64]*models.Balance
+	withdrawals  []*models.Withdrawal
+	ledger       []models.LedgerEntry
+
+	nextUserID        int64
+	nextOrderID       int64
+	nextWithdrawalID  int64
+	nextLedgerEntryID int64
+	nextLedgerTxID    int64
+
+	// newOrderListeners подписчики на создание заказов, см. ListenNewOrders
+	newOrderListeners map[chan struct{}]struct{}
+
+	// accrualRateLimits частоты запросов по системам начисления и сроки активности экземпляров
+	accrualRateLimits  map[string]int
+	accrualRateClients map[string]map[string]time.Time
+
+	accrualEvents      []models.AccrualEvent
+	nextAccrualEventID int64
+
+	// processedAt время перевода заказов в PROCESSED, см. SampleProcessedOrders
+	processedAt       map[string]time.Time
+	discrepancies     []*models.AccrualDiscrepancy
+	nextDiscrepancyID int64
+
+	shadowComparisons      []models.ShadowComparison
+	nextShadowComparisonID int64
+
+	// orderFailures неудачные попытки обработки заказов, см. ScheduleOrderRetry
+	orderFailures map[string][]models.OrderFailure
+
+	// leaderLocks захваченные блокировки выборов ведущего, см. HoldLeaderLock
+	leaderLocks map[string]bool
+
+	// ordersViewedAt время последнего просмотра списка заказов пользователями, см. MarkOrdersViewed
+	ordersViewedAt map[int64]time.Time
+
+	// refreshTokens refresh токены по хешу, familyRevokedAt время отзыва их семейств,
+	// revokedTokens сроки действия отозванных access токенов по jti
+	// callbackNonces подписи примененных push-уведомлений и срок их хранения;
+	// callbackNonceExpiry те же подписи по сроку, чтобы удалять истекшие без обхода всех
+	callbackNonces      map[string]time.Time
+	callbackNonceExpiry callbackNonceHeap
+
+	refreshTokens      map[string]*models.RefreshToken
+	nextRefreshTokenID int64
+	familyRevokedAt    map[string]time.Time
+	revokedTokens      map[string]time.Time
+}
+
+// NewMemoryStorage создает пустое хранилище в памяти
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:        make(map[int64]*models.User),
+		usersByLogin: make(map[string]int64),
+		orders:       make(map[string]*models.Order),
+		balances:     make(map[int64]*models.Balance),
+
+		newOrderListeners: make(map[chan struct{}]struct{}),
+
+		accrualRateLimits:  make(map[string]int),
+		accrualRateClients: make(map[string]map[string]time.Time),
+
+		processedAt:   make(map[string]time.Time),
+		orderFailures: make(map[string][]models.OrderFailure),
+		leaderLocks:   make(map[string]bool),
+
+		ordersViewedAt: make(map[int64]time.Time),
+
+		callbackNonces: make(map[string]time.Time),
+
+		refreshTokens:   make(map[string]*models.RefreshToken),
+		familyRevokedAt: make(map[string]time.Time),
+		revokedTokens:   make(map[string]time.Time),
+	}
+}
+
+// Close ничего не делает, хранилище в памяти не держит внешних ресурсов
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// Ping всегда успешен для хранилища в памяти
+func (s *MemoryStorage) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// CreateUser создает нового пользователя
+func (s *MemoryStorage) CreateUser(ctx context.Context, login, passwordHash string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.usersByLogin[login]; exists {
+		return nil, fmt.Errorf("failed to create user: %w: users_login_key", ErrConflict)
+	}
+
+	s.nextUserID++
+	user := &models.User{ID: s.nextUserID, Login: login, Password: passwordHash, Tier: models.DefaultUserTier}
+	s.users[user.ID] = user
+	s.usersByLogin[login] = user.ID
+
+	result := *user
+	return &result, nil
+}
+
+// GetUserByLogin получает пользователя по логину
+func (s *MemoryStorage) GetUserByLogin(ctx context.Context, login string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.usersByLogin[login]
+	if !ok {
+		return nil, nil
+	}
+
+	result := *s.users[id]
+	return &result, nil
+}
+
+// GetUserByID получает пользователя по ID
+func (s *MemoryStorage) GetUserByID(ctx context.Context, id int64) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, nil
+	}
+
+	result := *user
+	return &result, nil
+}
+
+// CreateOrder создает новый заказ
+func (s *MemoryStorage) CreateOrder(ctx context.Context, userID int64, number string) (*models.Order, error) {
+	return s.CreateMerchantOrder(ctx, userID, number, "")
+}
+
+// CreateMerchantOrder создает заказ мерчанта merchant; пустой merchant — заказ без мерчанта
+func (s *MemoryStorage) CreateMerchantOrder(ctx context.Context, userID int64, number, merchant string) (*models.Order, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("failed to create order: user %d: %w", userID, ErrNotFound)
+	}
+	if _, exists := s.orders[number]; exists {
+		return nil, fmt.Errorf("failed to create order: %w: orders_number_key", ErrConflict)
+	}
+
+	s.nextOrderID++
+	now := time.Now()
+	order := &models.Order{
+		ID:          s.nextOrderID,
+		UserID:      userID,
+		Number:      number,
+		Status:      models.OrderStatusNew,
+		UploadedAt:  now,
+		NextCheckAt: &now,
+		Merchant:    merchant,
+	}
+	s.orders[number] = order
+	s.notifyNewOrderLocked()
+
+	return copyOrder(order), nil
+}
+
+// notifyNewOrderLocked сигнализирует подписчикам о новом заказе, не дожидаясь их;
+// вызывается под блокировкой на запись
+func (s *MemoryStorage) notifyNewOrderLocked() {
+	for ch := range s.newOrderListeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// Подписчик еще не обработал предыдущий сигнал, сигналы схлопываются
+		}
+	}
+}
+
+// ListenNewOrders вызывает onNotify после создания заказов до отмены ctx.
+// Сигналы, пришедшие во время выполнения onNotify, схлопываются в один.
+func (s *MemoryStorage) ListenNewOrders(ctx context.Context, onNotify func()) error {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.newOrderListeners[ch] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.newOrderListeners, ch)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ch:
+			onNotify()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// GetOrderByNumber получает заказ по номеру
+func (s *MemoryStorage) GetOrderByNumber(ctx context.Context, number string) (*models.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	order, ok := s.orders[number]
+	if !ok {
+		return nil, nil
+	}
+
+	return copyOrder(order), nil
+}
+
+// GetOrdersByUserID получает все заказы пользователя, от новых к старым
+func (s *MemoryStorage) GetOrdersByUserID(ctx context.Context, userID int64) ([]models.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var orders []models.Order
+	for _, order := range s.orders {
+		if order.UserID == userID {
+			orders = append(orders, *copyOrder(order))
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadedAt.Equal(orders[j].UploadedAt) {
+			return orders[i].UploadedAt.After(orders[j].UploadedAt)
+		}
+		return orders[i].ID > orders[j].ID
+	})
+
+	return orders, nil
+}
+
+// GetOrdersByStatus получает заказы по статусам, от старых к новым
+func (s *MemoryStorage) GetOrdersByStatus(ctx context.Context, statuses []string) ([]models.Order, error) {
+	if len(statuses) == 0 {
+		return []models.Order{}, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ordersByStatusLocked(statuses), nil
+}
+
+// GetOrdersByStatusPaginated получает заказы по статусам с пагинацией.
+// Возвращает только заказы, время проверки которых наступило.
+func (s *MemoryStorage) GetOrdersByStatusPaginated(ctx context.Context, statuses []string, limit, offset int) ([]models.Order, error) {
+	if len(statuses) == 0 {
+		return []models.Order{}, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	orders := slices.DeleteFunc(s.ordersByStatusLocked(statuses), func(order models.Order) bool {
+		return order.NextCheckAt == nil || order.NextCheckAt.After(now)
+	})
+	if offset >= len(orders) {
+		return nil, nil
+	}
+	orders = orders[offset:]
+	if limit >= 0 && limit < len(orders) {
+		orders = orders[:limit]
+	}
+
+	return orders, nil
+}
+
+// ClaimOrders захватывает до limit заказов с указанными статусами, проверка которых назначена
+// не позже dueBefore, за обработчиком workerID на время lease. Заказы выбираются справедливо
+// по правилам policy. Заказы, захваченные другими обработчиками, пропускаются; захват
+// с истекшим сроком считается снятым.
+func (s *MemoryStorage) ClaimOrders(ctx context.Context, statuses []string, workerID string, dueBefore time.Time, limit int, lease time.Duration, policy models.SchedulingPolicy) ([]models.Order, error) {
+	if len(statuses) == 0 || limit <= 0 {
+		return []models.Order{}, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	lockedUntil := now.Add(lease)
+
+	type candidate struct {
+		order    models.Order
+		priority int
+	}
+	var candidates []candidate
+	ranks := make(map[int64]int)
+	for _, order := range s.ordersByStatusLocked(statuses) {
+		if order.NextCheckAt == nil || order.NextCheckAt.After(dueBefore) {
+			continue
+		}
+		if order.LockedUntil != nil && !order.LockedUntil.Before(now) {
+			continue
+		}
+
+		tier := models.DefaultUserTier
+		if user, ok := s.users[order.UserID]; ok {
+			tier = user.Tier
+		}
+		var viewedAt *time.Time
+		if at, ok := s.ordersViewedAt[order.UserID]; ok {
+			viewedAt = &at
+		}
+		priority := policy.Priority(ranks[order.UserID], tier, order.UploadedAt, viewedAt, now)
+		ranks[order.UserID]++
+		candidates = append(candidates, candidate{order: order, priority: priority})
+	}
+
+	// Заказы уже упорядочены по времени загрузки, стабильная сортировка сохраняет этот порядок
+	// внутри одного приоритета
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].priority < candidates[j].priority
+	})
+
+	claimed := make([]models.Order, 0, min(limit, len(candidates)))
+	for _, candidate := range candidates[:min(limit, len(candidates))] {
+		order := s.orders[candidate.order.Number]
+		order.LockedBy = workerID
+		order.LockedUntil = copyTime(&lockedUntil)
+		claimed = append(claimed, *copyOrder(order))
+	}
+
+	return claimed, nil
+}
+
+// MarkOrdersViewed отмечает, что пользователь userID смотрел список заказов в момент at
+func (s *MemoryStorage) MarkOrdersViewed(ctx context.Context, userID int64, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.ordersViewedAt[userID]; ok && !last.Before(at.Add(-OrdersViewedThrottle)) {
+		return nil
+	}
+	s.ordersViewedAt[userID] = at
+	return nil
+}
+
+// SetUserTier меняет тариф пользователя. Возвращает false, если пользователя нет.
+func (s *MemoryStorage) SetUserTier(ctx context.Context, userID int64, tier string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return false, nil
+	}
+	user.Tier = tier
+	return true, nil
+}
+
+// CountDueOrders возвращает число заказов со статусами statuses, чья проверка назначена
+// не позже dueBefore, включая захваченные
+func (s *MemoryStorage) CountDueOrders(ctx context.Context, statuses []string, dueBefore time.Time) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, order := range s.ordersByStatusLocked(statuses) {
+		if order.NextCheckAt != nil && !order.NextCheckAt.After(dueBefore) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// ReleaseOrders снимает захват обработчика workerID с заказов. Заказам, которые
+// все еще ожидают расчета, следующая проверка назначается не раньше nextCheckAt.
+func (s *MemoryStorage) ReleaseOrders(ctx context.Context, workerID string, numbers []string, nextCheckAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, number := range numbers {
+		order, ok := s.orders[number]
+		if !ok || order.LockedBy != workerID {
+			continue
+		}
+
+		order.LockedBy = ""
+		order.LockedUntil = nil
+		if slices.Contains(models.PendingOrderStatuses, order.Status) &&
+			order.NextCheckAt != nil && order.NextCheckAt.Before(nextCheckAt) {
+			order.NextCheckAt = copyTime(&nextCheckAt)
+		}
+	}
+
+	return nil
+}
+
+// ordersByStatusLocked выбирает заказы по статусам; вызывается под блокировкой
+func (s *MemoryStorage) ordersByStatusLocked(statuses []string) []models.Order {
+	var orders []models.Order
+	for _, order := range s.orders {
+		if slices.Contains(statuses, order.Status) {
+			orders = append(orders, *copyOrder(order))
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].UploadedAt.Equal(orders[j].UploadedAt) {
+			return orders[i].UploadedAt.Before(orders[j].UploadedAt)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+
+	return orders
+}
+
+// AssignOrderProvider закрепляет за заказом систему начисления provider, если она еще не выбрана.
+// Возвращает систему, закрепленную за заказом, или ErrNotFound.
+func (s *MemoryStorage) AssignOrderProvider(ctx context.Context, number, provider string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[number]
+	if !ok {
+		return "", fmt.Errorf("failed to assign order provider: %w", ErrNotFound)
+	}
+	if order.AccrualProvider == "" {
+		order.AccrualProvider = provider
+	}
+
+	return order.AccrualProvider, nil
+}
+
+// UpdateOrderStatus обновляет статус заказа
+func (s *MemoryStorage) UpdateOrderStatus(ctx context.Context, number string, status string, accrual *models.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setOrderStatusLocked(number, status, accrual)
+	return nil
+}
+
+// TransitionOrderStatus меняет статус заказа, только если текущий статус равен from.
+// Возвращает false, если заказ не найден или его статус уже изменился.
+func (s *MemoryStorage) TransitionOrderStatus(ctx context.Context, number string, from, to string, accrual *models.Money) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[number]
+	if !ok || order.Status != from {
+		return false, nil
+	}
+
+	s.setOrderStatusLocked(number, to, accrual)
+	now := time.Now()
+	order.Attempts = 0
+	order.LastError = ""
+	order.NextCheckAt = &now
+	order.DeadLetteredAt = nil
+	if to == models.OrderStatusProcessed {
+		s.processedAt[number] = now
+	}
+	return true, nil
+}
+
+// ScheduleOrderRetry фиксирует неудачную проверку заказа в системе начисления:
+// увеличивает счетчик попыток и назначает время следующей проверки.
+// Если nextCheckAt равен nil, заказ больше не выбирается для проверки и попадает в очередь недоставленных.
+func (s *MemoryStorage) ScheduleOrderRetry(ctx context.Context, number string, lastError string, nextCheckAt *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[number]
+	if !ok || !slices.Contains(models.PendingOrderStatuses, order.Status) {
+		return nil
+	}
+
+	now := time.Now()
+	order.Attempts++
+	order.LastError = lastError
+	order.NextCheckAt = copyTime(nextCheckAt)
+	order.DeadLetteredAt = nil
+	if nextCheckAt == nil {
+		order.DeadLetteredAt = &now
+	}
+	s.orderFailures[number] = append(s.orderFailures[number], models.OrderFailure{Attempt: order.Attempts, Error: lastError, FailedAt: now})
+	return nil
+}
+
+// DeferOrderCheck переносит проверку заказа, еще не зарегистрированного в системе начисления,
+// на nextCheckAt. Это не ошибка: счетчик попыток не растет, а в журнал неудач ничего не пишется.
+func (s *MemoryStorage) DeferOrderCheck(ctx context.Context, number string, reason string, nextCheckAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[number]
+	if !ok || !slices.Contains(models.PendingOrderStatuses, order.Status) {
+		return nil
+	}
+
+	order.LastError = reason
+	order.NextCheckAt = &nextCheckAt
+	order.DeadLetteredAt = nil
+	return nil
+}
+
+// setOrderStatusLocked обновляет статус заказа; как и UPDATE в базе,
+// молча пропускает несуществующий заказ
+func (s *MemoryStorage) setOrderStatusLocked(number string, status string, accrual *models.Money) {
+	order, ok := s.orders[number]
+	if !ok {
+		return
+	}
+
+	order.Status = status
+	order.Accrual = copyMoney(accrual)
+}
+
+// SaveAccrualRateLimit сохраняет допустимое число запросов в минуту к системе начисления
+func (s *MemoryStorage) SaveAccrualRateLimit(ctx context.Context, system string, perMinute int) error {
+	if perMinute <= 0 {
+		return fmt.Errorf("accrual rate limit must be positive, got %d", perMinute)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accrualRateLimits[system] = perMinute
+	return nil
+}
+
+// SyncAccrualRateLimit продлевает отметку активности экземпляра clientID на ttl, удаляет
+// истекшие и возвращает сохраненную частоту запросов и число активных экземпляров
+func (s *MemoryStorage) SyncAccrualRateLimit(ctx context.Context, system, clientID string, ttl time.Duration) (int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	clients, ok := s.accrualRateClients[system]
+	if !ok {
+		clients = make(map[string]time.Time)
+		s.accrualRateClients[system] = clients
+	}
+	clients[clientID] = now.Add(ttl)
+	for id, expiresAt := range clients {
+		if expiresAt.Before(now) {
+			delete(clients, id)
+		}
+	}
+
+	return s.accrualRateLimits[system], len(clients), nil
+}
+
+// SaveAccrualEvent добавляет ответ системы начисления в журнал и заполняет event.ID
+func (s *MemoryStorage) SaveAccrualEvent(ctx context.Context, event *models.AccrualEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextAccrualEventID++
+	event.ID = s.nextAccrualEventID
+	saved := *event
+	saved.Accrual = copyMoney(event.Accrual)
+	s.accrualEvents = append(s.accrualEvents, saved)
+	return nil
+}
+
+// ListAccrualEvents возвращает события заказа в порядке записи
+func (s *MemoryStorage) ListAccrualEvents(ctx context.Context, orderNumber string) ([]models.AccrualEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []models.AccrualEvent
+	for _, event := range s.accrualEvents {
+		if event.OrderNumber == orderNumber {
+			event.Accrual = copyMoney(event.Accrual)
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// ListAccrualEventOrders возвращает номера заказов, по которым есть события
+func (s *MemoryStorage) ListAccrualEventOrders(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var numbers []string
+	for _, event := range s.accrualEvents {
+		if !slices.Contains(numbers, event.OrderNumber) {
+			numbers = append(numbers, event.OrderNumber)
+		}
+	}
+	sort.Strings(numbers)
+	return numbers, nil
+}
+
+// GetBalance получает баланс пользователя: текущий баланс — сумма проводок по его счету,
+// списано — сумма его списаний. Снимок баланса только сверяется с ними.
+func (s *MemoryStorage) GetBalance(ctx context.Context, userID int64) (*models.Balance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balance := models.Balance{UserID: userID, Current: s.ledgerBalanceLocked(userID)}
+	for _, w := range s.withdrawals {
+		if w.UserID == userID {
+			balance.Withdrawn += w.Sum
+		}
+	}
+	return &balance, nil
+}
+
+// balanceLocked возвращает баланс пользователя, создавая его при отсутствии;
+// вызывается под блокировкой на запись
+func (s *MemoryStorage) balanceLocked(userID int64) *models.Balance {
+	balance, ok := s.balances[userID]
+	if !ok {
+		balance = &models.Balance{UserID: userID}
+		s.balances[userID] = balance
+	}
+	return balance
+}
+
+// AdjustBalance проводит по журналу корректировку текущего баланса пользователя на amount.
+// Баланс не может стать отрицательным.
+func (s *MemoryStorage) AdjustBalance(ctx context.Context, userID int64, amount models.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("failed to update balance: user %d: %w", userID, ErrNotFound)
+	}
+
+	current := s.ledgerBalanceLocked(userID)
+	if current+amount < 0 {
+		return fmt.Errorf("insufficient funds: current balance %s, adjustment %s", current, amount)
+	}
+
+	s.balanceLocked(userID).Current += amount
+	s.postLedgerLocked(userID, models.LedgerKindAdjustment, models.LedgerAccountAdjustments, "", amount)
+	return nil
+}
+
+// createWithdrawalLocked добавляет списание; вызывается под блокировкой на запись
+func (s *MemoryStorage) createWithdrawalLocked(userID int64, order string, sum models.Money) *models.Withdrawal {
+	s.nextWithdrawalID++
+	withdrawal := &models.Withdrawal{
+		ID:          s.nextWithdrawalID,
+		UserID:      userID,
+		Order:       order,
+		Sum:         sum,
+		ProcessedAt: time.Now(),
+	}
+	s.withdrawals = append(s.withdrawals, withdrawal)
+	return withdrawal
+}
+
+// GetWithdrawalsByUserID получает все списания пользователя, от новых к старым
+func (s *MemoryStorage) GetWithdrawalsByUserID(ctx context.Context, userID int64) ([]models.Withdrawal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var withdrawals []models.Withdrawal
+	for i := len(s.withdrawals) - 1; i >= 0; i-- {
+		if s.withdrawals[i].UserID == userID {
+			withdrawals = append(withdrawals, *s.withdrawals[i])
+		}
+	}
+
+	return withdrawals, nil
+}
+
+// ProcessWithdrawal проверяет баланс и создает списание атомарно
+func (s *MemoryStorage) ProcessWithdrawal(ctx context.Context, userID int64, order string, sum models.Money) (*models.Withdrawal, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("failed to create withdrawal: user %d: %w", userID, ErrNotFound)
+	}
+
+	if current := s.ledgerBalanceLocked(userID); current < sum {
+		return nil, fmt.Errorf("insufficient funds: current balance %s, requested %s", current, sum)
+	}
+
+	withdrawal := s.createWithdrawalLocked(userID, order, sum)
+	balance := s.balanceLocked(userID)
+	balance.Current -= sum
+	balance.Withdrawn += sum
+	s.postLedgerLocked(userID, models.LedgerKindWithdrawal, models.LedgerAccountWithdrawals, order, -sum)
+
+	result := *withdrawal
+	return &result, nil
+}
+
+// UpdateOrderStatusAndBalance атомарно обновляет статус заказа и проводит начисление accrual
+// на баланс пользователя
+func (s *MemoryStorage) UpdateOrderStatusAndBalance(ctx context.Context, orderNumber string, status string, accrual *models.Money, userID int64) error {
+	if accrual != nil && *accrual < 0 {
+		return fmt.Errorf("failed to credit order %s: negative accrual %s", orderNumber, *accrual)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("failed to update balance: user %d: %w", userID, ErrNotFound)
+	}
+
+	s.setOrderStatusLocked(orderNumber, status, accrual)
+
+	if accrual != nil {
+		s.balanceLocked(userID).Current += *accrual
+		s.postLedgerLocked(userID, models.LedgerKindAccrual, models.LedgerAccountAccruals, orderNumber, *accrual)
+	}
+	return nil
+}
+
+// CreditOrderAccrual атомарно переводит заказ в статус PROCESSED и увеличивает баланс
+// владельца заказа на сумму начисления. Если заказ уже не ожидает расчета, возвращает false.
+func (s *MemoryStorage) CreditOrderAccrual(ctx context.Context, orderNumber string, accrual models.Money) (bool, error) {
+	if accrual < 0 {
+		return false, fmt.Errorf("failed to credit order %s: negative accrual %s", orderNumber, accrual)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[orderNumber]
+	if !ok {
+		return false, fmt.Errorf("failed to credit order %s: %w", orderNumber, ErrNotFound)
+	}
+	if !slices.Contains(models.PendingOrderStatuses, order.Status) {
+		return false, nil
+	}
+
+	s.setOrderStatusLocked(orderNumber, models.OrderStatusProcessed, &accrual)
+	order.Attempts = 0
+	order.LastError = ""
+	order.DeadLetteredAt = nil
+	s.processedAt[orderNumber] = time.Now()
+	s.balanceLocked(order.UserID).Current += accrual
+	s.postLedgerLocked(order.UserID, models.LedgerKindAccrual, models.LedgerAccountAccruals, orderNumber, accrual)
+	return true, nil
+}
+
+// copyOrder возвращает копию заказа, не разделяющую память с хранилищем
+func copyOrder(order *models.Order) *models.Order {
+	result := *order
+	result.Accrual = copyMoney(order.Accrual)
+	result.NextCheckAt = copyTime(order.NextCheckAt)
+	result.LockedUntil = copyTime(order.LockedUntil)
+	result.DeadLetteredAt = copyTime(order.DeadLetteredAt)
+	return &result
+}
+
+func copyTime(v *time.Time) *time.Time {
+	if v == nil {
+		return nil
+	}
+	result := *v
+	return &result
+}
+
+func copyMoney(v *models.Money) *models.Money {
+	if v == nil {
+		return nil
+	}
+	result := *v
+	return &result
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"container/heap"
+	"context"
+	"time"
+)
+
+// callbackNonce подпись push-уведомления и срок ее хранения
+type callbackNonce struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// callbackNonceHeap подписи push-уведомлений, упорядоченные по сроку хранения (container/heap)
+type callbackNonceHeap []callbackNonce
+
+func (h callbackNonceHeap) Len() int           { return len(h) }
+func (h callbackNonceHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h callbackNonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *callbackNonceHeap) Push(x any)        { *h = append(*h, x.(callbackNonce)) }
+func (h *callbackNonceHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// IsCallbackNonceUsed сообщает, применялось ли уже push-уведомление с подписью nonce
+func (s *MemoryStorage) IsCallbackNonceUsed(ctx context.Context, nonce string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expiresAt, ok := s.callbackNonces[nonce]
+	return ok && expiresAt.After(time.Now()), nil
+}
+
+// SaveCallbackNonce запоминает подпись примененного push-уведомления до expiresAt
+// и удаляет подписи с истекшим сроком
+func (s *MemoryStorage) SaveCallbackNonce(ctx context.Context, nonce string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for s.callbackNonceExpiry.Len() > 0 && !s.callbackNonceExpiry[0].expiresAt.After(now) {
+		expired := heap.Pop(&s.callbackNonceExpiry).(callbackNonce)
+		if s.callbackNonces[expired.nonce].Equal(expired.expiresAt) {
+			delete(s.callbackNonces, expired.nonce)
+		}
+	}
+
+	if _, ok := s.callbackNonces[nonce]; ok {
+		return nil
+	}
+	s.callbackNonces[nonce] = expiresAt
+	heap.Push(&s.callbackNonceExpiry, callbackNonce{nonce: nonce, expiresAt: expiresAt})
+	return nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// ListDeadLetterOrders возвращает заказы из очереди недоставленных в порядке попадания в нее
+// вместе с неудачными попытками, которые к этому привели
+func (s *MemoryStorage) ListDeadLetterOrders(ctx context.Context) ([]models.DeadLetterOrder, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var orders []models.DeadLetterOrder
+	for _, order := range s.orders {
+		if order.DeadLetteredAt == nil {
+			continue
+		}
+		orders = append(orders, models.DeadLetterOrder{
+			Order:    *copyOrder(order),
+			Failures: slices.Clone(lastFailures(s.orderFailures[order.Number], order.Attempts)),
+		})
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].DeadLetteredAt.Equal(*orders[j].DeadLetteredAt) {
+			return orders[i].DeadLetteredAt.Before(*orders[j].DeadLetteredAt)
+		}
+		return orders[i].ID < orders[j].ID
+	})
+	return orders, nil
+}
+
+// RequeueDeadLetterOrders возвращает заказы numbers из очереди недоставленных в обработку
+// с новым счетчиком попыток; пустой numbers — все заказы очереди. Возвращает возвращенные заказы.
+func (s *MemoryStorage) RequeueDeadLetterOrders(ctx context.Context, numbers []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var requeued []string
+	for number, order := range s.orders {
+		if order.DeadLetteredAt == nil || (len(numbers) > 0 && !slices.Contains(numbers, number)) {
+			continue
+		}
+		order.Attempts = 0
+		order.LastError = ""
+		order.NextCheckAt = &now
+		order.DeadLetteredAt = nil
+		requeued = append(requeued, number)
+	}
+	slices.Sort(requeued)
+	return requeued, nil
+}
+
+// ResolveDeadLetterOrder вручную завершает заказ из очереди недоставленных: переводит его в status
+// и для PROCESSED начисляет accrual на баланс владельца. Возвращает false, если заказа нет в очереди.
+func (s *MemoryStorage) ResolveDeadLetterOrder(ctx context.Context, number, status string, accrual models.Money) (bool, error) {
+	if accrual < 0 {
+		return false, fmt.Errorf("failed to resolve order %s: negative accrual %s", number, accrual)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[number]
+	if !ok || order.DeadLetteredAt == nil || !slices.Contains(models.PendingOrderStatuses, order.Status) {
+		return false, nil
+	}
+
+	var orderAccrual *models.Money
+	if status == models.OrderStatusProcessed {
+		orderAccrual = &accrual
+		s.processedAt[number] = time.Now()
+	}
+	s.setOrderStatusLocked(number, status, orderAccrual)
+	order.Attempts = 0
+	order.LastError = ""
+	order.NextCheckAt = nil
+	order.DeadLetteredAt = nil
+
+	if status == models.OrderStatusProcessed && accrual > 0 {
+		s.balanceLocked(order.UserID).Current += accrual
+		s.postLedgerLocked(order.UserID, models.LedgerKindAccrual, models.LedgerAccountAccruals, number, accrual)
+	}
+	return true, nil
+}
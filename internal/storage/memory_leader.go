@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// HoldLeaderLock захватывает блокировку выборов name, как только она свободна, и держит ее
+// до отмены ctx. Выборы идут между пользователями одного хранилища в пределах процесса.
+func (s *MemoryStorage) HoldLeaderLock(ctx context.Context, name string, checkInterval time.Duration, onAcquired func()) error {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		acquired := !s.leaderLocks[name]
+		s.leaderLocks[name] = true
+		s.mu.Unlock()
+
+		if acquired {
+			defer func() {
+				s.mu.Lock()
+				delete(s.leaderLocks, name)
+				s.mu.Unlock()
+			}()
+
+			onAcquired()
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// ledgerBalanceLocked возвращает текущий баланс пользователя — сумму проводок по его счету;
+// вызывается под блокировкой
+func (s *MemoryStorage) ledgerBalanceLocked(userID int64) models.Money {
+	var total models.Money
+	for _, entry := range s.ledger {
+		if entry.UserID != nil && *entry.UserID == userID {
+			total += entry.Amount
+		}
+	}
+	return total
+}
+
+// postLedgerLocked проводит сумму по счету пользователя и корреспондирующему счету;
+// вызывается под блокировкой на запись
+func (s *MemoryStorage) postLedgerLocked(userID int64, kind, counterAccount, reference string, amount models.Money) {
+	if amount == 0 {
+		return
+	}
+
+	s.nextLedgerTxID++
+	now := time.Now()
+	uid := userID
+	for _, entry := range []models.LedgerEntry{
+		{Account: models.LedgerUserAccount(userID), UserID: &uid, Amount: amount},
+		{Account: counterAccount, Amount: -amount},
+	} {
+		s.nextLedgerEntryID++
+		entry.ID = s.nextLedgerEntryID
+		entry.TransactionID = s.nextLedgerTxID
+		entry.Kind = kind
+		entry.Reference = reference
+		entry.CreatedAt = now
+		s.ledger = append(s.ledger, entry)
+	}
+}
+
+// GetLedgerEntriesByUserID возвращает проводки по счету пользователя, от новых к старым
+func (s *MemoryStorage) GetLedgerEntriesByUserID(ctx context.Context, userID int64) ([]models.LedgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account := models.LedgerUserAccount(userID)
+	var entries []models.LedgerEntry
+	for i := len(s.ledger) - 1; i >= 0; i-- {
+		if s.ledger[i].Account == account {
+			entry := s.ledger[i]
+			uid := *entry.UserID
+			entry.UserID = &uid
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// CheckLedgerConsistency сверяет снимки балансов пользователей с журналом проводок и списаниями
+// и проверяет, что каждая транзакция журнала сбалансирована
+func (s *MemoryStorage) CheckLedgerConsistency(ctx context.Context) ([]models.LedgerDiscrepancy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userTotals := make(map[int64]models.Money)
+	txTotals := make(map[int64]models.Money)
+	for _, entry := range s.ledger {
+		if entry.UserID != nil {
+			userTotals[*entry.UserID] += entry.Amount
+		}
+		txTotals[entry.TransactionID] += entry.Amount
+	}
+
+	withdrawalTotals := make(map[int64]models.Money)
+	for _, w := range s.withdrawals {
+		withdrawalTotals[w.UserID] += w.Sum
+	}
+
+	userIDs := make(map[int64]struct{})
+	for id := range userTotals {
+		userIDs[id] = struct{}{}
+	}
+	for id := range withdrawalTotals {
+		userIDs[id] = struct{}{}
+	}
+	for id := range s.balances {
+		userIDs[id] = struct{}{}
+	}
+
+	var discrepancies []models.LedgerDiscrepancy
+	for id := range userIDs {
+		var balance models.Balance
+		if b, ok := s.balances[id]; ok {
+			balance = *b
+		}
+		if balance.Current != userTotals[id] || balance.Withdrawn != withdrawalTotals[id] {
+			discrepancies = append(discrepancies, models.LedgerDiscrepancy{
+				UserID:            id,
+				BalanceAmount:     balance.Current,
+				LedgerAmount:      userTotals[id],
+				BalanceWithdrawn:  balance.Withdrawn,
+				WithdrawalsAmount: withdrawalTotals[id],
+			})
+		}
+	}
+	for txID, total := range txTotals {
+		if total != 0 {
+			discrepancies = append(discrepancies, models.LedgerDiscrepancy{TransactionID: txID, LedgerAmount: total})
+		}
+	}
+
+	sort.Slice(discrepancies, func(i, j int) bool {
+		if discrepancies[i].UserID != discrepancies[j].UserID {
+			return discrepancies[i].UserID > discrepancies[j].UserID
+		}
+		return discrepancies[i].TransactionID < discrepancies[j].TransactionID
+	})
+
+	return discrepancies, nil
+}
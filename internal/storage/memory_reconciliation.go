@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// SampleProcessedOrders возвращает случайную долю rate заказов, обработанных не раньше since,
+// но не больше limit заказов
+func (s *MemoryStorage) SampleProcessedOrders(ctx context.Context, since time.Time, rate float64, limit int) ([]models.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var orders []models.Order
+	for _, order := range s.ordersByStatusLocked([]string{models.OrderStatusProcessed}) {
+		processedAt, ok := s.processedAt[order.Number]
+		if !ok || processedAt.Before(since) || rand.Float64() >= rate {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		return s.processedAt[orders[i].Number].After(s.processedAt[orders[j].Number])
+	})
+	if len(orders) > limit {
+		orders = orders[:limit]
+	}
+
+	return orders, nil
+}
+
+// OpenAccrualDiscrepancy открывает расхождение для ручного разбора и заполняет d.ID.
+// Если по заказу уже открыто расхождение, новое не создается и возвращается false.
+func (s *MemoryStorage) OpenAccrualDiscrepancy(ctx context.Context, d *models.AccrualDiscrepancy) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.discrepancies {
+		if existing.OrderNumber == d.OrderNumber && existing.Status == models.DiscrepancyStatusOpen {
+			return false, nil
+		}
+	}
+
+	d.Status = models.DiscrepancyStatusOpen
+	s.addDiscrepancyLocked(d)
+	return true, nil
+}
+
+// AdjustOrderAccrual исправляет начисление заказа на d.ReportedAccrual: меняет начисление заказа
+// и баланс владельца на разницу, проводит ее по журналу и записывает исправленное расхождение.
+// Возвращает false без изменений, если начисление заказа уже не равно d.RecordedAccrual
+// или списание разницы увело бы баланс в минус.
+func (s *MemoryStorage) AdjustOrderAccrual(ctx context.Context, d *models.AccrualDiscrepancy) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[d.OrderNumber]
+	if !ok || order.Status != models.OrderStatusProcessed {
+		return false, nil
+	}
+	var accrual models.Money
+	if order.Accrual != nil {
+		accrual = *order.Accrual
+	}
+	if accrual != d.RecordedAccrual {
+		return false, nil
+	}
+
+	delta := d.Delta()
+	if s.ledgerBalanceLocked(d.UserID)+delta < 0 {
+		return false, nil
+	}
+
+	reported := d.ReportedAccrual
+	order.Accrual = &reported
+	s.balanceLocked(d.UserID).Current += delta
+	s.postLedgerLocked(d.UserID, models.LedgerKindAdjustment, models.LedgerAccountAdjustments, d.OrderNumber, delta)
+
+	d.Status = models.DiscrepancyStatusAdjusted
+	s.addDiscrepancyLocked(d)
+	return true, nil
+}
+
+// addDiscrepancyLocked сохраняет копию расхождения и заполняет d.ID и d.CreatedAt;
+// исправленное расхождение закрывается сразу
+func (s *MemoryStorage) addDiscrepancyLocked(d *models.AccrualDiscrepancy) {
+	s.nextDiscrepancyID++
+	d.ID = s.nextDiscrepancyID
+	d.CreatedAt = time.Now()
+	if d.Status != models.DiscrepancyStatusOpen {
+		d.ResolvedAt = copyTime(&d.CreatedAt)
+	}
+
+	saved := *d
+	saved.ResolvedAt = copyTime(d.ResolvedAt)
+	s.discrepancies = append(s.discrepancies, &saved)
+}
+
+// ListAccrualDiscrepancies возвращает расхождения со статусом status (все, если пустой), от новых к старым
+func (s *MemoryStorage) ListAccrualDiscrepancies(ctx context.Context, status string) ([]models.AccrualDiscrepancy, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var discrepancies []models.AccrualDiscrepancy
+	for i := len(s.discrepancies) - 1; i >= 0; i-- {
+		d := *s.discrepancies[i]
+		if status != "" && d.Status != status {
+			continue
+		}
+		d.ResolvedAt = copyTime(d.ResolvedAt)
+		discrepancies = append(discrepancies, d)
+	}
+	return discrepancies, nil
+}
+
+// ResolveAccrualDiscrepancy закрывает открытое расхождение id после ручного разбора.
+// Возвращает nil, если открытого расхождения с таким id нет.
+func (s *MemoryStorage) ResolveAccrualDiscrepancy(ctx context.Context, id int64, note string) (*models.AccrualDiscrepancy, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.discrepancies {
+		if d.ID != id || d.Status != models.DiscrepancyStatusOpen {
+			continue
+		}
+		now := time.Now()
+		d.Status = models.DiscrepancyStatusResolved
+		d.Note = note
+		d.ResolvedAt = &now
+
+		result := *d
+		result.ResolvedAt = copyTime(d.ResolvedAt)
+		return &result, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// SaveShadowComparison записывает сравнение с теневой системой начисления и заполняет c.ID
+func (s *MemoryStorage) SaveShadowComparison(ctx context.Context, c *models.ShadowComparison) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextShadowComparisonID++
+	c.ID = s.nextShadowComparisonID
+	saved := *c
+	saved.PrimaryAccrual = copyMoney(c.PrimaryAccrual)
+	saved.ShadowAccrual = copyMoney(c.ShadowAccrual)
+	s.shadowComparisons = append(s.shadowComparisons, saved)
+	return nil
+}
+
+// GetShadowReport сводит сравнения с теневой системой начисления начиная с since
+// и добавляет не больше limit последних расхождений
+func (s *MemoryStorage) GetShadowReport(ctx context.Context, since time.Time, limit int) (*models.ShadowReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := &models.ShadowReport{Since: since, Disagreements: []models.ShadowComparison{}}
+	for i := len(s.shadowComparisons) - 1; i >= 0; i-- {
+		c := s.shadowComparisons[i]
+		if c.ComparedAt.Before(since) {
+			continue
+		}
+		report.Add(c.Outcome, c.Final, 1)
+		if c.Outcome != models.ShadowOutcomeAgree && len(report.Disagreements) < limit {
+			c.PrimaryAccrual = copyMoney(c.PrimaryAccrual)
+			c.ShadowAccrual = copyMoney(c.ShadowAccrual)
+			report.Disagreements = append(report.Disagreements, c)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,1181 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// TestMemoryStorage тестирует базовые операции хранилища в памяти
+func TestMemoryStorage(t *testing.T) {
+	storage := NewMemoryStorage()
+	defer storage.Close()
+
+	ctx := context.Background()
+	require.NoError(t, storage.Ping(ctx))
+
+	t.Run("CreateUser", func(t *testing.T) {
+		user, err := storage.CreateUser(ctx, "testuser", "hashedpassword")
+		require.NoError(t, err)
+		assert.NotZero(t, user.ID)
+		assert.Equal(t, "testuser", user.Login)
+		assert.Equal(t, "hashedpassword", user.Password)
+	})
+
+	t.Run("CreateUser_Conflict", func(t *testing.T) {
+		_, err := storage.CreateUser(ctx, "testuser", "otherpassword")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrConflict))
+	})
+
+	t.Run("GetUserByLogin", func(t *testing.T) {
+		user, err := storage.GetUserByLogin(ctx, "testuser")
+		require.NoError(t, err)
+		require.NotNil(t, user)
+		assert.Equal(t, "testuser", user.Login)
+
+		byID, err := storage.GetUserByID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, user, byID)
+
+		user, err = storage.GetUserByLogin(ctx, "nonexistent")
+		require.NoError(t, err)
+		assert.Nil(t, user)
+	})
+
+	t.Run("CreateOrder", func(t *testing.T) {
+		user, err := storage.GetUserByLogin(ctx, "testuser")
+		require.NoError(t, err)
+
+		order, err := storage.CreateOrder(ctx, user.ID, "12345678903")
+		require.NoError(t, err)
+		assert.NotZero(t, order.ID)
+		assert.Equal(t, user.ID, order.UserID)
+		assert.Equal(t, "NEW", order.Status)
+
+		_, err = storage.CreateOrder(ctx, user.ID, "12345678903")
+		assert.True(t, errors.Is(err, ErrConflict))
+
+		_, err = storage.CreateOrder(ctx, 999, "79927398713")
+		assert.True(t, errors.Is(err, ErrNotFound))
+	})
+
+	t.Run("GetOrdersByUserID", func(t *testing.T) {
+		user, err := storage.GetUserByLogin(ctx, "testuser")
+		require.NoError(t, err)
+
+		_, err = storage.CreateOrder(ctx, user.ID, "98765432109")
+		require.NoError(t, err)
+
+		orders, err := storage.GetOrdersByUserID(ctx, user.ID)
+		require.NoError(t, err)
+		require.Len(t, orders, 2)
+
+		// Проверяем сортировку (от новых к старым)
+		assert.Equal(t, "98765432109", orders[0].Number)
+		assert.Equal(t, "12345678903", orders[1].Number)
+	})
+
+	t.Run("GetOrdersByStatusPaginated", func(t *testing.T) {
+		orders, err := storage.GetOrdersByStatusPaginated(ctx, []string{"NEW"}, 1, 0)
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		assert.Equal(t, "12345678903", orders[0].Number)
+
+		orders, err = storage.GetOrdersByStatusPaginated(ctx, []string{"NEW"}, 1, 1)
+		require.NoError(t, err)
+		require.Len(t, orders, 1)
+		assert.Equal(t, "98765432109", orders[0].Number)
+
+		orders, err = storage.GetOrdersByStatusPaginated(ctx, []string{"NEW"}, 1, 2)
+		require.NoError(t, err)
+		assert.Empty(t, orders)
+	})
+
+	t.Run("UpdateOrderStatus", func(t *testing.T) {
+		accrual := models.Money(10000)
+		err := storage.UpdateOrderStatus(ctx, "12345678903", "PROCESSED", &accrual)
+		require.NoError(t, err)
+
+		// Изменение исходного значения не должно влиять на хранилище
+		accrual = 1
+
+		order, err := storage.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, "PROCESSED", order.Status)
+		require.NotNil(t, order.Accrual)
+		assert.Equal(t, models.Money(10000), *order.Accrual)
+
+		orders, err := storage.GetOrdersByStatus(ctx, []string{"NEW"})
+		require.NoError(t, err)
+		assert.Len(t, orders, 1)
+	})
+
+	t.Run("GetBalance", func(t *testing.T) {
+		user, err := storage.GetUserByLogin(ctx, "testuser")
+		require.NoError(t, err)
+
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, balance.UserID)
+		assert.Equal(t, models.Money(0), balance.Current)
+		assert.Equal(t, models.Money(0), balance.Withdrawn)
+	})
+
+	t.Run("ProcessWithdrawal", func(t *testing.T) {
+		user, err := storage.GetUserByLogin(ctx, "testuser")
+		require.NoError(t, err)
+
+		require.NoError(t, storage.AdjustBalance(ctx, user.ID, models.Money(10000)))
+
+		withdrawal, err := storage.ProcessWithdrawal(ctx, user.ID, "2377225624", models.Money(4000))
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(4000), withdrawal.Sum)
+
+		_, err = storage.ProcessWithdrawal(ctx, user.ID, "2377225624", models.Money(10000))
+		assert.Error(t, err)
+
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(6000), balance.Current)
+		assert.Equal(t, models.Money(4000), balance.Withdrawn)
+
+		withdrawals, err := storage.GetWithdrawalsByUserID(ctx, user.ID)
+		require.NoError(t, err)
+		require.Len(t, withdrawals, 1)
+		assert.Equal(t, "2377225624", withdrawals[0].Order)
+	})
+
+	t.Run("UpdateOrderStatusAndBalance", func(t *testing.T) {
+		user, err := storage.GetUserByLogin(ctx, "testuser")
+		require.NoError(t, err)
+
+		accrual := models.Money(5000)
+		err = storage.UpdateOrderStatusAndBalance(ctx, "98765432109", "PROCESSED", &accrual, user.ID)
+		require.NoError(t, err)
+
+		order, err := storage.GetOrderByNumber(ctx, "98765432109")
+		require.NoError(t, err)
+		assert.Equal(t, "PROCESSED", order.Status)
+
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(11000), balance.Current)
+		assert.Equal(t, models.Money(4000), balance.Withdrawn)
+	})
+}
+
+// TestMemoryStorage_Concurrent тестирует конкурентный доступ к хранилищу в памяти
+func TestMemoryStorage_Concurrent(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "concurrentuser", "password")
+	require.NoError(t, err)
+	require.NoError(t, storage.AdjustBalance(ctx, user.ID, models.Money(10000)))
+
+	t.Run("ConcurrentOrderCreation", func(t *testing.T) {
+		const numGoroutines = 10
+		var wg sync.WaitGroup
+		var conflicts sync.Map
+
+		for i := 0; i < numGoroutines*2; i++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+
+				// Каждый номер создается дважды, один из вызовов должен получить конфликт
+				orderNumber := fmt.Sprintf("concurrent%d", id%numGoroutines)
+				if _, err := storage.CreateOrder(ctx, user.ID, orderNumber); err != nil {
+					assert.True(t, errors.Is(err, ErrConflict))
+					conflicts.Store(orderNumber, true)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		orders, err := storage.GetOrdersByUserID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Len(t, orders, numGoroutines)
+
+		conflictCount := 0
+		conflicts.Range(func(_, _ any) bool {
+			conflictCount++
+			return true
+		})
+		assert.Equal(t, numGoroutines, conflictCount)
+	})
+
+	t.Run("ConcurrentWithdrawals", func(t *testing.T) {
+		const numGoroutines = 20
+		var wg sync.WaitGroup
+
+		for i := 0; i < numGoroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = storage.ProcessWithdrawal(ctx, user.ID, "2377225624", models.Money(1000))
+			}()
+		}
+		wg.Wait()
+
+		// Списать удается ровно столько, сколько есть на балансе
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(0), balance.Current)
+		assert.Equal(t, models.Money(10000), balance.Withdrawn)
+
+		withdrawals, err := storage.GetWithdrawalsByUserID(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Len(t, withdrawals, 10)
+	})
+}
+
+// TestMemoryStorage_Ledger тестирует журнал проводок хранилища в памяти
+func TestMemoryStorage_Ledger(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "ledgeruser", "password")
+	require.NoError(t, err)
+	_, err = storage.CreateOrder(ctx, user.ID, "12345678903")
+	require.NoError(t, err)
+
+	require.NoError(t, storage.AdjustBalance(ctx, user.ID, models.Money(1000)))
+	accrual := models.Money(5000)
+	require.NoError(t, storage.UpdateOrderStatusAndBalance(ctx, "12345678903", "PROCESSED", &accrual, user.ID))
+	_, err = storage.ProcessWithdrawal(ctx, user.ID, "2377225624", models.Money(2500))
+	require.NoError(t, err)
+	// Нулевая корректировка не создает проводок, а уводящая баланс в минус отклоняется
+	require.NoError(t, storage.AdjustBalance(ctx, user.ID, 0))
+	assert.Error(t, storage.AdjustBalance(ctx, user.ID, models.Money(-3600)))
+
+	entries, err := storage.GetLedgerEntriesByUserID(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, models.LedgerKindWithdrawal, entries[0].Kind)
+	assert.Equal(t, models.Money(-2500), entries[0].Amount)
+	assert.Equal(t, "2377225624", entries[0].Reference)
+	assert.Equal(t, models.LedgerKindAccrual, entries[1].Kind)
+	assert.Equal(t, models.Money(5000), entries[1].Amount)
+	assert.Equal(t, "12345678903", entries[1].Reference)
+	assert.Equal(t, models.LedgerKindAdjustment, entries[2].Kind)
+	assert.Equal(t, models.Money(1000), entries[2].Amount)
+	for _, entry := range entries {
+		assert.Equal(t, models.LedgerUserAccount(user.ID), entry.Account)
+		require.NotNil(t, entry.UserID)
+		assert.Equal(t, user.ID, *entry.UserID)
+	}
+
+	discrepancies, err := storage.CheckLedgerConsistency(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+
+	t.Run("Discrepancy", func(t *testing.T) {
+		// Меняем снимок баланса в обход журнала
+		storage.mu.Lock()
+		storage.balances[user.ID].Current += 100
+		storage.mu.Unlock()
+
+		discrepancies, err := storage.CheckLedgerConsistency(ctx)
+		require.NoError(t, err)
+		require.Len(t, discrepancies, 1)
+		assert.Equal(t, user.ID, discrepancies[0].UserID)
+		assert.Equal(t, models.Money(3600), discrepancies[0].BalanceAmount)
+		assert.Equal(t, models.Money(3500), discrepancies[0].LedgerAmount)
+		assert.Equal(t, models.Money(2500), discrepancies[0].BalanceWithdrawn)
+		assert.Equal(t, models.Money(2500), discrepancies[0].WithdrawalsAmount)
+
+		// Баланс и списания считаются по журналу, а не по разошедшемуся снимку
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(3500), balance.Current)
+		_, err = storage.ProcessWithdrawal(ctx, user.ID, "4561261212345467", models.Money(3600))
+		assert.Error(t, err)
+
+		storage.mu.Lock()
+		storage.balances[user.ID].Current -= 100
+		storage.balances[user.ID].Withdrawn = 0
+		storage.mu.Unlock()
+
+		discrepancies, err = storage.CheckLedgerConsistency(ctx)
+		require.NoError(t, err)
+		require.Len(t, discrepancies, 1)
+		assert.Equal(t, models.Money(0), discrepancies[0].BalanceWithdrawn)
+		assert.Equal(t, models.Money(2500), discrepancies[0].WithdrawalsAmount)
+
+		balance, err = storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(2500), balance.Withdrawn)
+	})
+}
+
+// TestMemoryStorage_CreditOrderAccrual тестирует однократное начисление по заказу
+func TestMemoryStorage_CreditOrderAccrual(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "credituser", "password")
+	require.NoError(t, err)
+
+	_, err = storage.CreditOrderAccrual(ctx, "12345678903", models.Money(100))
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	const numOrders = 20
+	for i := 0; i < numOrders; i++ {
+		_, err := storage.CreateOrder(ctx, user.ID, fmt.Sprintf("credit%d", i))
+		require.NoError(t, err)
+	}
+
+	// Каждый заказ пытаются начислить несколько раз одновременно
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	credits := 0
+	for i := 0; i < numOrders*3; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			credited, err := storage.CreditOrderAccrual(ctx, fmt.Sprintf("credit%d", id%numOrders), models.Money(250))
+			assert.NoError(t, err)
+			if credited {
+				mu.Lock()
+				credits++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, numOrders, credits)
+
+	balance, err := storage.GetBalance(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.Money(numOrders*250), balance.Current)
+
+	order, err := storage.GetOrderByNumber(ctx, "credit0")
+	require.NoError(t, err)
+	assert.Equal(t, "PROCESSED", order.Status)
+	require.NotNil(t, order.Accrual)
+	assert.Equal(t, models.Money(250), *order.Accrual)
+
+	discrepancies, err := storage.CheckLedgerConsistency(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, discrepancies)
+}
+
+// TestMemoryStorage_ScheduleOrderRetry тестирует расписание повторных проверок заказа
+func TestMemoryStorage_ScheduleOrderRetry(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "retryuser", "password")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "98765432109", "2377225624"} {
+		_, err := storage.CreateOrder(ctx, user.ID, number)
+		require.NoError(t, err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "12345678903", "server error: 503", &past))
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "98765432109", "server error: 503", &future))
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "2377225624", "server error: 503", nil))
+
+	order, err := storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, 1, order.Attempts)
+	assert.Equal(t, "server error: 503", order.LastError)
+
+	// Выбираются только заказы, время проверки которых наступило
+	orders, err := storage.GetOrdersByStatusPaginated(ctx, models.PendingOrderStatuses, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, orders, 1)
+	assert.Equal(t, "12345678903", orders[0].Number)
+
+	// Смена статуса сбрасывает счетчик попыток
+	updated, err := storage.TransitionOrderStatus(ctx, "12345678903", models.OrderStatusNew, models.OrderStatusProcessing, nil)
+	require.NoError(t, err)
+	assert.True(t, updated)
+
+	order, err = storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Zero(t, order.Attempts)
+	assert.Empty(t, order.LastError)
+
+	// Завершенные заказы не перепланируются
+	_, err = storage.CreditOrderAccrual(ctx, "12345678903", models.Money(100))
+	require.NoError(t, err)
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "12345678903", "late error", &future))
+
+	order, err = storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Zero(t, order.Attempts)
+}
+
+// TestMemoryStorage_DeferOrderCheck тестирует перенос проверки незарегистрированного заказа
+func TestMemoryStorage_DeferOrderCheck(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "deferuser", "password")
+	require.NoError(t, err)
+	_, err = storage.CreateOrder(ctx, user.ID, "12345678903")
+	require.NoError(t, err)
+
+	next := time.Now().Add(time.Hour)
+	require.NoError(t, storage.DeferOrderCheck(ctx, "12345678903", "not registered", next))
+
+	// Перенос не считается неудачной попыткой
+	order, err := storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Zero(t, order.Attempts)
+	assert.Equal(t, "not registered", order.LastError)
+	require.NotNil(t, order.NextCheckAt)
+	assert.True(t, next.Equal(*order.NextCheckAt))
+
+	// В журнал неудач перенос тоже не попадает
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "12345678903", "timeout", nil))
+	deadLetters, err := storage.ListDeadLetterOrders(ctx)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	require.Len(t, deadLetters[0].Failures, 1)
+	assert.Equal(t, 1, deadLetters[0].Failures[0].Attempt)
+
+	// Перенос возвращает заказ из очереди недоставленных в обработку
+	require.NoError(t, storage.DeferOrderCheck(ctx, "12345678903", "not registered", next))
+	order, err = storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Nil(t, order.DeadLetteredAt)
+
+	// Завершенные заказы не переносятся
+	_, err = storage.CreditOrderAccrual(ctx, "12345678903", models.Money(100))
+	require.NoError(t, err)
+	require.NoError(t, storage.DeferOrderCheck(ctx, "12345678903", "late", next))
+
+	order, err = storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Empty(t, order.LastError)
+}
+
+// TestMemoryStorage_ClaimOrders тестирует захват заказов обработчиками
+func TestMemoryStorage_ClaimOrders(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "claimuser", "password")
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := storage.CreateOrder(ctx, user.ID, fmt.Sprintf("claim%d", i))
+		require.NoError(t, err)
+	}
+
+	first, err := storage.ClaimOrders(ctx, models.PendingOrderStatuses, "worker-1", time.Now(), 3, time.Minute, models.SchedulingPolicy{})
+	require.NoError(t, err)
+	require.Len(t, first, 3)
+	assert.Equal(t, "claim0", first[0].Number)
+	assert.Equal(t, "worker-1", first[0].LockedBy)
+	require.NotNil(t, first[0].LockedUntil)
+
+	// Второй обработчик получает только свободные заказы
+	second, err := storage.ClaimOrders(ctx, models.PendingOrderStatuses, "worker-2", time.Now(), 10, time.Minute, models.SchedulingPolicy{})
+	require.NoError(t, err)
+	require.Len(t, second, 2)
+	assert.Equal(t, "claim3", second[0].Number)
+
+	none, err := storage.ClaimOrders(ctx, models.PendingOrderStatuses, "worker-3", time.Now(), 10, time.Minute, models.SchedulingPolicy{})
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	// Захваченные заказы остаются в очереди
+	due, err := storage.CountDueOrders(ctx, models.PendingOrderStatuses, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 5, due)
+
+	// Чужой захват не снимается
+	nextCheckAt := time.Now().Add(time.Hour)
+	require.NoError(t, storage.ReleaseOrders(ctx, "worker-2", []string{"claim0"}, nextCheckAt))
+	order, err := storage.GetOrderByNumber(ctx, "claim0")
+	require.NoError(t, err)
+	assert.Equal(t, "worker-1", order.LockedBy)
+
+	// Освобожденный заказ проверяется снова не раньше nextCheckAt
+	require.NoError(t, storage.ReleaseOrders(ctx, "worker-1", []string{"claim0"}, nextCheckAt))
+	order, err = storage.GetOrderByNumber(ctx, "claim0")
+	require.NoError(t, err)
+	assert.Empty(t, order.LockedBy)
+	assert.Nil(t, order.LockedUntil)
+	require.NotNil(t, order.NextCheckAt)
+	assert.True(t, order.NextCheckAt.Equal(nextCheckAt))
+
+	due, err = storage.CountDueOrders(ctx, models.PendingOrderStatuses, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 4, due)
+
+	none, err = storage.ClaimOrders(ctx, models.PendingOrderStatuses, "worker-3", time.Now(), 10, time.Minute, models.SchedulingPolicy{})
+	require.NoError(t, err)
+	assert.Empty(t, none)
+
+	// Захват с истекшим сроком, например после падения обработчика, снимается сам
+	_, err = storage.CreateOrder(ctx, user.ID, "claim5")
+	require.NoError(t, err)
+	_, err = storage.ClaimOrders(ctx, models.PendingOrderStatuses, "crashed", time.Now(), 1, -time.Second, models.SchedulingPolicy{})
+	require.NoError(t, err)
+
+	reclaimed, err := storage.ClaimOrders(ctx, models.PendingOrderStatuses, "worker-3", time.Now(), 10, time.Minute, models.SchedulingPolicy{})
+	require.NoError(t, err)
+	require.Len(t, reclaimed, 1)
+	assert.Equal(t, "claim5", reclaimed[0].Number)
+	assert.Equal(t, "worker-3", reclaimed[0].LockedBy)
+}
+
+// TestMemoryStorage_ClaimOrdersFairness тестирует справедливый выбор заказов между пользователями
+func TestMemoryStorage_ClaimOrdersFairness(t *testing.T) {
+	ctx := context.Background()
+
+	// Партнер загружает большую очередь раньше остальных пользователей
+	newQueue := func(t *testing.T) (*MemoryStorage, map[string]int64) {
+		storage := NewMemoryStorage()
+		users := make(map[string]int64)
+		for _, queue := range []struct {
+			login  string
+			orders int
+		}{{"partner", 6}, {"alice", 2}, {"bob", 2}} {
+			user, err := storage.CreateUser(ctx, queue.login, "password")
+			require.NoError(t, err)
+			assert.Equal(t, models.DefaultUserTier, user.Tier)
+			users[queue.login] = user.ID
+			for i := 0; i < queue.orders; i++ {
+				_, err := storage.CreateOrder(ctx, user.ID, fmt.Sprintf("%s%d", queue.login, i))
+				require.NoError(t, err)
+			}
+		}
+		return storage, users
+	}
+	claim := func(t *testing.T, storage *MemoryStorage, limit int, policy models.SchedulingPolicy) []string {
+		orders, err := storage.ClaimOrders(ctx, models.PendingOrderStatuses, "worker", time.Now(), limit, time.Minute, policy)
+		require.NoError(t, err)
+		numbers := make([]string, 0, len(orders))
+		for _, order := range orders {
+			numbers = append(numbers, order.Number)
+		}
+		return numbers
+	}
+
+	t.Run("Round robin", func(t *testing.T) {
+		storage, _ := newQueue(t)
+		assert.Equal(t, []string{"partner0", "alice0", "bob0", "partner1", "alice1", "bob1"},
+			claim(t, storage, 6, models.SchedulingPolicy{}))
+		assert.Equal(t, []string{"partner2", "partner3", "partner4", "partner5"},
+			claim(t, storage, 10, models.SchedulingPolicy{}))
+	})
+
+	t.Run("Tier weights", func(t *testing.T) {
+		storage, users := newQueue(t)
+		updated, err := storage.SetUserTier(ctx, users["partner"], "partner")
+		require.NoError(t, err)
+		assert.True(t, updated)
+		user, err := storage.GetUserByID(ctx, users["partner"])
+		require.NoError(t, err)
+		assert.Equal(t, "partner", user.Tier)
+
+		updated, err = storage.SetUserTier(ctx, 999, "partner")
+		require.NoError(t, err)
+		assert.False(t, updated)
+
+		policy := models.SchedulingPolicy{TierWeights: map[string]int{"partner": 3}}
+		assert.Equal(t, []string{"partner0", "partner1", "partner2", "alice0", "bob0", "partner3"},
+			claim(t, storage, 6, policy))
+	})
+
+	t.Run("Viewed orders", func(t *testing.T) {
+		storage, users := newQueue(t)
+		require.NoError(t, storage.MarkOrdersViewed(ctx, users["bob"], time.Now()))
+
+		policy := models.SchedulingPolicy{ViewWindow: time.Minute}
+		assert.Equal(t, []string{"bob0", "bob1", "partner0", "alice0"}, claim(t, storage, 4, policy))
+
+		// Просмотр давнее окна не повышает приоритет
+		storage, users = newQueue(t)
+		require.NoError(t, storage.MarkOrdersViewed(ctx, users["bob"], time.Now().Add(-time.Hour)))
+		assert.Equal(t, []string{"partner0", "alice0", "bob0"}, claim(t, storage, 3, policy))
+	})
+
+	t.Run("Recent order within a round", func(t *testing.T) {
+		storage, users := newQueue(t)
+		_, err := storage.SetUserTier(ctx, users["partner"], "partner")
+		require.NoError(t, err)
+		storage.mu.Lock()
+		for number, order := range storage.orders {
+			if !slices.Contains([]string{"partner2", "partner3", "partner4", "partner5"}, number) {
+				order.UploadedAt = order.UploadedAt.Add(-time.Hour)
+			}
+		}
+		storage.mu.Unlock()
+
+		// Недавний partner2 обгоняет более ранние заказы своего раунда
+		policy := models.SchedulingPolicy{TierWeights: map[string]int{"partner": 3}, RecentWindow: time.Minute}
+		assert.Equal(t, []string{"partner2"}, claim(t, storage, 1, policy))
+	})
+}
+
+// TestMemoryStorage_ListenNewOrders тестирует уведомления о создании заказов
+func TestMemoryStorage_ListenNewOrders(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	user, err := storage.CreateUser(ctx, "listenuser", "password")
+	require.NoError(t, err)
+
+	notifications := make(chan struct{}, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- storage.ListenNewOrders(ctx, func() { notifications <- struct{}{} })
+	}()
+
+	// Ждем регистрации подписчика
+	require.Eventually(t, func() bool {
+		storage.mu.RLock()
+		defer storage.mu.RUnlock()
+		return len(storage.newOrderListeners) == 1
+	}, time.Second, time.Millisecond)
+
+	_, err = storage.CreateOrder(ctx, user.ID, "12345678903")
+	require.NoError(t, err)
+
+	select {
+	case <-notifications:
+	case <-time.After(time.Second):
+		t.Fatal("notification was not delivered")
+	}
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	assert.Empty(t, storage.newOrderListeners)
+}
+
+func TestMemoryStorage_HoldLeaderLock(t *testing.T) {
+	storage := NewMemoryStorage()
+	interval := 5 * time.Millisecond
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstAcquired := make(chan struct{})
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- storage.HoldLeaderLock(firstCtx, "jobs", interval, func() { close(firstAcquired) })
+	}()
+	<-firstAcquired
+
+	secondCtx, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	secondAcquired := make(chan struct{})
+	secondDone := make(chan error, 1)
+	go func() {
+		secondDone <- storage.HoldLeaderLock(secondCtx, "jobs", interval, func() { close(secondAcquired) })
+	}()
+
+	// Блокировку других выборов можно взять независимо
+	otherCtx, cancelOther := context.WithCancel(context.Background())
+	otherAcquired := make(chan struct{})
+	go storage.HoldLeaderLock(otherCtx, "reports", interval, func() { close(otherAcquired) })
+	<-otherAcquired
+	cancelOther()
+
+	select {
+	case <-secondAcquired:
+		t.Fatal("lock acquired while held by another holder")
+	case <-time.After(10 * interval):
+	}
+
+	// Отмена освобождает блокировку
+	cancelFirst()
+	assert.ErrorIs(t, <-firstDone, context.Canceled)
+	select {
+	case <-secondAcquired:
+	case <-time.After(time.Second):
+		t.Fatal("lock was not acquired after release")
+	}
+
+	cancelSecond()
+	assert.ErrorIs(t, <-secondDone, context.Canceled)
+}
+
+func TestMemoryStorage_AccrualRateLimit(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	system := "http://accrual"
+
+	limit, clients, err := storage.SyncAccrualRateLimit(ctx, system, "a", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, limit)
+	assert.Equal(t, 1, clients)
+
+	require.NoError(t, storage.SaveAccrualRateLimit(ctx, system, 60))
+	assert.Error(t, storage.SaveAccrualRateLimit(ctx, system, 0))
+
+	limit, clients, err = storage.SyncAccrualRateLimit(ctx, system, "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 60, limit)
+	assert.Equal(t, 2, clients)
+
+	// Истекшие экземпляры не учитываются
+	_, _, err = storage.SyncAccrualRateLimit(ctx, system, "a", -time.Second)
+	require.NoError(t, err)
+	_, clients, err = storage.SyncAccrualRateLimit(ctx, system, "b", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, clients)
+
+	// Частоты разных систем независимы
+	limit, _, err = storage.SyncAccrualRateLimit(ctx, "http://other", "a", time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, limit)
+}
+
+func TestMemoryStorage_AssignOrderProvider(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "provideruser", "password")
+	require.NoError(t, err)
+	order, err := storage.CreateMerchantOrder(ctx, user.ID, "12345678903", "acme")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", order.Merchant)
+	assert.Empty(t, order.AccrualProvider)
+
+	provider, err := storage.AssignOrderProvider(ctx, "12345678903", "partner")
+	require.NoError(t, err)
+	assert.Equal(t, "partner", provider)
+
+	// Закрепленная система не меняется
+	provider, err = storage.AssignOrderProvider(ctx, "12345678903", "main")
+	require.NoError(t, err)
+	assert.Equal(t, "partner", provider)
+
+	order, err = storage.GetOrderByNumber(ctx, "12345678903")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", order.Merchant)
+	assert.Equal(t, "partner", order.AccrualProvider)
+
+	_, err = storage.AssignOrderProvider(ctx, "79927398713", "main")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStorage_AccrualEvents(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	accrual := models.Money(50000)
+
+	first := &models.AccrualEvent{OrderNumber: "12345678903", Source: models.AccrualEventPoll,
+		RequestedAt: time.Now(), HTTPStatus: 204}
+	require.NoError(t, storage.SaveAccrualEvent(ctx, first))
+	other := &models.AccrualEvent{OrderNumber: "79927398713", Source: models.AccrualEventPoll, RequestedAt: time.Now()}
+	require.NoError(t, storage.SaveAccrualEvent(ctx, other))
+	second := &models.AccrualEvent{OrderNumber: "12345678903", Source: models.AccrualEventCallback, RequestedAt: time.Now(),
+		Body: `{"order":"12345678903","status":"PROCESSED","accrual":500}`, Status: "PROCESSED", Accrual: &accrual}
+	require.NoError(t, storage.SaveAccrualEvent(ctx, second))
+	assert.NotZero(t, first.ID)
+	assert.Greater(t, second.ID, first.ID)
+
+	events, err := storage.ListAccrualEvents(ctx, "12345678903")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, first.ID, events[0].ID)
+	assert.Equal(t, *second, events[1])
+
+	events, err = storage.ListAccrualEvents(ctx, "2377225624")
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	numbers, err := storage.ListAccrualEventOrders(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"12345678903", "79927398713"}, numbers)
+}
+
+func TestMemoryStorage_Reconciliation(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "user", "hash")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "79927398713", "2377225624"} {
+		_, err := storage.CreateOrder(ctx, user.ID, number)
+		require.NoError(t, err)
+	}
+	_, err = storage.CreditOrderAccrual(ctx, "12345678903", 50000)
+	require.NoError(t, err)
+	_, err = storage.CreditOrderAccrual(ctx, "79927398713", 10000)
+	require.NoError(t, err)
+
+	t.Run("Samples recently processed orders", func(t *testing.T) {
+		orders, err := storage.SampleProcessedOrders(ctx, time.Now().Add(-time.Hour), 1, 10)
+		require.NoError(t, err)
+		assert.Len(t, orders, 2)
+
+		orders, err = storage.SampleProcessedOrders(ctx, time.Now().Add(time.Hour), 1, 10)
+		require.NoError(t, err)
+		assert.Empty(t, orders)
+
+		orders, err = storage.SampleProcessedOrders(ctx, time.Now().Add(-time.Hour), 1, 1)
+		require.NoError(t, err)
+		assert.Len(t, orders, 1)
+	})
+
+	t.Run("Adjust applies the difference", func(t *testing.T) {
+		adjusted, err := storage.AdjustOrderAccrual(ctx, &models.AccrualDiscrepancy{OrderNumber: "12345678903", UserID: user.ID,
+			RecordedAccrual: 50000, ReportedStatus: "PROCESSED", ReportedAccrual: 45000})
+		require.NoError(t, err)
+		assert.True(t, adjusted)
+
+		order, err := storage.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(45000), *order.Accrual)
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(55000), balance.Current)
+
+		discrepancies, err := storage.CheckLedgerConsistency(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, discrepancies)
+
+		// Повторная сверка с устаревшим учтенным начислением ничего не меняет
+		adjusted, err = storage.AdjustOrderAccrual(ctx, &models.AccrualDiscrepancy{OrderNumber: "12345678903", UserID: user.ID,
+			RecordedAccrual: 50000, ReportedStatus: "PROCESSED", ReportedAccrual: 45000})
+		require.NoError(t, err)
+		assert.False(t, adjusted)
+	})
+
+	t.Run("Adjust refuses a negative balance", func(t *testing.T) {
+		adjusted, err := storage.AdjustOrderAccrual(ctx, &models.AccrualDiscrepancy{OrderNumber: "79927398713", UserID: user.ID,
+			RecordedAccrual: 10000, ReportedStatus: "INVALID", ReportedAccrual: 0})
+		require.NoError(t, err)
+		assert.True(t, adjusted)
+
+		// Баллы уже потрачены: списать 450 нельзя
+		_, err = storage.ProcessWithdrawal(ctx, user.ID, "4561261212345467", 44000)
+		require.NoError(t, err)
+		adjusted, err = storage.AdjustOrderAccrual(ctx, &models.AccrualDiscrepancy{OrderNumber: "12345678903", UserID: user.ID,
+			RecordedAccrual: 45000, ReportedStatus: "INVALID", ReportedAccrual: 0})
+		require.NoError(t, err)
+		assert.False(t, adjusted)
+
+		order, err := storage.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(45000), *order.Accrual)
+	})
+
+	t.Run("Open and resolve discrepancies", func(t *testing.T) {
+		d := &models.AccrualDiscrepancy{OrderNumber: "79927398713", UserID: user.ID,
+			RecordedAccrual: 0, ReportedStatus: "PROCESSED", ReportedAccrual: 10000}
+		opened, err := storage.OpenAccrualDiscrepancy(ctx, d)
+		require.NoError(t, err)
+		assert.True(t, opened)
+		assert.NotZero(t, d.ID)
+		assert.Equal(t, models.DiscrepancyStatusOpen, d.Status)
+
+		// Второе открытое расхождение по тому же заказу не создается
+		opened, err = storage.OpenAccrualDiscrepancy(ctx, &models.AccrualDiscrepancy{OrderNumber: "79927398713", UserID: user.ID})
+		require.NoError(t, err)
+		assert.False(t, opened)
+
+		open, err := storage.ListAccrualDiscrepancies(ctx, models.DiscrepancyStatusOpen)
+		require.NoError(t, err)
+		require.Len(t, open, 1)
+		assert.Equal(t, d.ID, open[0].ID)
+		assert.Equal(t, models.Money(10000), open[0].Delta())
+
+		all, err := storage.ListAccrualDiscrepancies(ctx, "")
+		require.NoError(t, err)
+		assert.Len(t, all, 3)
+		assert.Equal(t, d.ID, all[0].ID)
+
+		resolved, err := storage.ResolveAccrualDiscrepancy(ctx, d.ID, "confirmed with partner")
+		require.NoError(t, err)
+		require.NotNil(t, resolved)
+		assert.Equal(t, models.DiscrepancyStatusResolved, resolved.Status)
+		assert.Equal(t, "confirmed with partner", resolved.Note)
+		assert.NotNil(t, resolved.ResolvedAt)
+
+		resolved, err = storage.ResolveAccrualDiscrepancy(ctx, d.ID, "again")
+		require.NoError(t, err)
+		assert.Nil(t, resolved)
+	})
+}
+
+func TestMemoryStorage_ShadowComparisons(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+	now := time.Now()
+	accrual := models.Money(50000)
+
+	comparisons := []*models.ShadowComparison{
+		{OrderNumber: "12345678903", Source: models.AccrualEventPoll, PrimaryStatus: "PROCESSED", PrimaryAccrual: &accrual,
+			ShadowStatus: "PROCESSED", ShadowAccrual: &accrual, Outcome: models.ShadowOutcomeAgree, Final: true, ComparedAt: now.Add(-48 * time.Hour)},
+		{OrderNumber: "79927398713", Source: models.AccrualEventPoll, PrimaryStatus: "PROCESSING", ShadowStatus: "REGISTERED",
+			Outcome: models.ShadowOutcomeStatusMismatch, ComparedAt: now.Add(-time.Hour)},
+		{OrderNumber: "2377225624", Source: models.AccrualEventCallback, PrimaryStatus: "INVALID", ShadowStatus: "INVALID",
+			Outcome: models.ShadowOutcomeAgree, Final: true, ComparedAt: now},
+	}
+	for _, c := range comparisons {
+		require.NoError(t, storage.SaveShadowComparison(ctx, c))
+		assert.NotZero(t, c.ID)
+	}
+
+	report, err := storage.GetShadowReport(ctx, time.Time{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Compared)
+	assert.Equal(t, 2, report.Agreed)
+	assert.Equal(t, 1, report.StatusMismatches)
+	assert.Equal(t, 2, report.FinalCompared)
+	assert.InDelta(t, 1.0, report.FinalAgreementRate, 1e-9)
+	require.Len(t, report.Disagreements, 1)
+	assert.Equal(t, "79927398713", report.Disagreements[0].OrderNumber)
+
+	report, err = storage.GetShadowReport(ctx, now.Add(-24*time.Hour), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Compared)
+	assert.Equal(t, 1, report.FinalCompared)
+
+	report, err = storage.GetShadowReport(ctx, time.Time{}, 0)
+	require.NoError(t, err)
+	assert.Empty(t, report.Disagreements)
+}
+
+func TestMemoryStorage_DeadLetters(t *testing.T) {
+	storage := NewMemoryStorage()
+	ctx := context.Background()
+
+	user, err := storage.CreateUser(ctx, "user", "hash")
+	require.NoError(t, err)
+	for _, number := range []string{"12345678903", "79927398713", "2377225624"} {
+		_, err := storage.CreateOrder(ctx, user.ID, number)
+		require.NoError(t, err)
+	}
+
+	// Серия неудач, прерванная успешной проверкой, в очередь не попадает
+	next := time.Now().Add(time.Minute)
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "12345678903", "timeout", &next))
+	_, err = storage.TransitionOrderStatus(ctx, "12345678903", models.OrderStatusNew, models.OrderStatusProcessing, nil)
+	require.NoError(t, err)
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "12345678903", "decode error", &next))
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "12345678903", "decode error", nil))
+	require.NoError(t, storage.ScheduleOrderRetry(ctx, "79927398713", "order not found", nil))
+
+	deadLetters, err := storage.ListDeadLetterOrders(ctx)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 2)
+	assert.Equal(t, "12345678903", deadLetters[0].Number)
+	assert.Equal(t, []string{"decode error", "decode error"},
+		[]string{deadLetters[0].Failures[0].Error, deadLetters[0].Failures[1].Error})
+	assert.Equal(t, 2, deadLetters[0].Failures[1].Attempt)
+	assert.Len(t, deadLetters[1].Failures, 1)
+
+	t.Run("Requeue", func(t *testing.T) {
+		requeued, err := storage.RequeueDeadLetterOrders(ctx, []string{"79927398713", "2377225624"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"79927398713"}, requeued)
+
+		order, err := storage.GetOrderByNumber(ctx, "79927398713")
+		require.NoError(t, err)
+		assert.Zero(t, order.Attempts)
+		assert.Nil(t, order.DeadLetteredAt)
+		assert.NotNil(t, order.NextCheckAt)
+
+		requeued, err = storage.RequeueDeadLetterOrders(ctx, []string{"79927398713"})
+		require.NoError(t, err)
+		assert.Empty(t, requeued)
+	})
+
+	t.Run("Resolve", func(t *testing.T) {
+		resolved, err := storage.ResolveDeadLetterOrder(ctx, "79927398713", models.OrderStatusProcessed, 10000)
+		require.NoError(t, err)
+		assert.False(t, resolved)
+
+		resolved, err = storage.ResolveDeadLetterOrder(ctx, "12345678903", models.OrderStatusProcessed, 25000)
+		require.NoError(t, err)
+		assert.True(t, resolved)
+
+		order, err := storage.GetOrderByNumber(ctx, "12345678903")
+		require.NoError(t, err)
+		assert.Equal(t, models.OrderStatusProcessed, order.Status)
+		assert.Equal(t, models.Money(25000), *order.Accrual)
+		assert.Nil(t, order.DeadLetteredAt)
+		assert.Nil(t, order.NextCheckAt)
+
+		balance, err := storage.GetBalance(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, models.Money(25000), balance.Current)
+		discrepancies, err := storage.CheckLedgerConsistency(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, discrepancies)
+
+		// Повторное решение не начисляет второй раз
+		resolved, err = storage.ResolveDeadLetterOrder(ctx, "12345678903", models.OrderStatusProcessed, 25000)
+		require.NoError(t, err)
+		assert.False(t, resolved)
+
+		deadLetters, err := storage.ListDeadLetterOrders(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, deadLetters)
+	})
+}
+
+// TestMemoryStorage_RefreshTokens тестирует замену refresh токенов и отзыв токенов
+func TestMemoryStorage_RefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	newToken := func(userID int64, family, hash, jti string) *models.RefreshToken {
+		return &models.RefreshToken{
+			UserID:          userID,
+			FamilyID:        family,
+			TokenHash:       hash,
+			AccessTokenID:   jti,
+			AccessExpiresAt: now.Add(15 * time.Minute),
+			CreatedAt:       now,
+			ExpiresAt:       now.Add(time.Hour),
+		}
+	}
+
+	t.Run("Rotation and reuse", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(1, "family", "hash1", "jti1")))
+
+		stored, err := storage.GetRefreshToken(ctx, "hash1")
+		require.NoError(t, err)
+		require.NotNil(t, stored)
+		assert.Equal(t, "family", stored.FamilyID)
+		assert.Nil(t, stored.UsedAt)
+
+		missing, err := storage.GetRefreshToken(ctx, "missing")
+		require.NoError(t, err)
+		assert.Nil(t, missing)
+
+		result, err := storage.RotateRefreshToken(ctx, "missing", newToken(1, "", "hash0", "jti0"), now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenUnknown, result)
+
+		next := newToken(1, "", "hash2", "jti2")
+		result, err = storage.RotateRefreshToken(ctx, "hash1", next, now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenRotated, result)
+		assert.Equal(t, "family", next.FamilyID)
+
+		stored, err = storage.GetRefreshToken(ctx, "hash1")
+		require.NoError(t, err)
+		assert.NotNil(t, stored.UsedAt)
+
+		// Повторное предъявление замененного токена отзывает семейство и его access токены
+		result, err = storage.RotateRefreshToken(ctx, "hash1", newToken(1, "", "hash3", "jti3"), now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenReused, result)
+
+		for _, jti := range []string{"jti1", "jti2"} {
+			revoked, err := storage.IsTokenRevoked(ctx, jti)
+			require.NoError(t, err)
+			assert.True(t, revoked, jti)
+		}
+		revoked, err := storage.IsTokenRevoked(ctx, "jti3")
+		require.NoError(t, err)
+		assert.False(t, revoked)
+
+		// Последний токен семейства тоже больше не действует
+		result, err = storage.RotateRefreshToken(ctx, "hash2", newToken(1, "", "hash4", "jti4"), now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenRevoked, result)
+		stored, err = storage.GetRefreshToken(ctx, "hash2")
+		require.NoError(t, err)
+		assert.NotNil(t, stored.RevokedAt)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(1, "family", "hash1", "jti1")))
+
+		result, err := storage.RotateRefreshToken(ctx, "hash1", newToken(1, "", "hash2", "jti2"), now.Add(2*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenExpired, result)
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(1, "phone", "hash1", "jti1")))
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(1, "laptop", "hash2", "jti2")))
+
+		// Выход отзывает токен и семейство, выданное с ним; другие входы не затрагиваются
+		require.NoError(t, storage.RevokeAccessToken(ctx, 1, "jti1", now.Add(15*time.Minute), now))
+		revoked, err := storage.IsTokenRevoked(ctx, "jti1")
+		require.NoError(t, err)
+		assert.True(t, revoked)
+		result, err := storage.RotateRefreshToken(ctx, "hash1", newToken(1, "", "hash3", "jti3"), now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenRevoked, result)
+
+		revoked, err = storage.IsTokenRevoked(ctx, "jti2")
+		require.NoError(t, err)
+		assert.False(t, revoked)
+
+		// Истекший токен в список не попадает
+		require.NoError(t, storage.RevokeAccessToken(ctx, 1, "expired", now.Add(-time.Minute), now))
+		revoked, err = storage.IsTokenRevoked(ctx, "expired")
+		require.NoError(t, err)
+		assert.False(t, revoked)
+	})
+
+	t.Run("Logout everywhere", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(1, "phone", "hash1", "jti1")))
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(1, "laptop", "hash2", "jti2")))
+		require.NoError(t, storage.CreateRefreshToken(ctx, newToken(2, "other", "hash3", "jti3")))
+
+		require.NoError(t, storage.RevokeUserTokens(ctx, 1, now))
+
+		for jti, expected := range map[string]bool{"jti1": true, "jti2": true, "jti3": false} {
+			revoked, err := storage.IsTokenRevoked(ctx, jti)
+			require.NoError(t, err)
+			assert.Equal(t, expected, revoked, jti)
+		}
+		result, err := storage.RotateRefreshToken(ctx, "hash2", newToken(1, "", "hash4", "jti4"), now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenRevoked, result)
+		result, err = storage.RotateRefreshToken(ctx, "hash3", newToken(2, "", "hash5", "jti5"), now)
+		require.NoError(t, err)
+		assert.Equal(t, models.RefreshTokenRotated, result)
+	})
+}
+
+// TestMemoryStorage_CallbackNonces тестирует подписи push-уведомлений в памяти
+func TestMemoryStorage_CallbackNonces(t *testing.T) {
+	ctx := context.Background()
+	storage := NewMemoryStorage()
+
+	used, err := storage.IsCallbackNonceUsed(ctx, "nonce")
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	require.NoError(t, storage.SaveCallbackNonce(ctx, "nonce", time.Now().Add(time.Minute)))
+	require.NoError(t, storage.SaveCallbackNonce(ctx, "nonce", time.Now().Add(time.Minute)))
+	used, err = storage.IsCallbackNonceUsed(ctx, "nonce")
+	require.NoError(t, err)
+	assert.True(t, used)
+
+	// Истекшая подпись не считается примененной и удаляется при сохранении следующей
+	require.NoError(t, storage.SaveCallbackNonce(ctx, "expired", time.Now().Add(-time.Second)))
+	used, err = storage.IsCallbackNonceUsed(ctx, "expired")
+	require.NoError(t, err)
+	assert.False(t, used)
+
+	require.NoError(t, storage.SaveCallbackNonce(ctx, "fresh", time.Now().Add(time.Minute)))
+	assert.Len(t, storage.callbackNonces, 2)
+	assert.Equal(t, 2, storage.callbackNonceExpiry.Len())
+}
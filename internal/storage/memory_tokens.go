@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// CreateRefreshToken сохраняет первый refresh токен нового семейства и заполняет token.ID.
+// Заодно удаляются истекшие токены пользователя.
+func (s *MemoryStorage) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	families := make(map[string]bool)
+	for hash, stored := range s.refreshTokens {
+		if stored.UserID == token.UserID && !stored.ExpiresAt.After(token.CreatedAt) {
+			delete(s.refreshTokens, hash)
+			continue
+		}
+		families[stored.FamilyID] = true
+	}
+	for familyID := range s.familyRevokedAt {
+		if !families[familyID] {
+			delete(s.familyRevokedAt, familyID)
+		}
+	}
+	s.insertRefreshTokenLocked(token)
+	return nil
+}
+
+// insertRefreshTokenLocked сохраняет refresh токен; вызывается под блокировкой
+func (s *MemoryStorage) insertRefreshTokenLocked(token *models.RefreshToken) {
+	s.nextRefreshTokenID++
+	token.ID = s.nextRefreshTokenID
+	stored := *token
+	s.refreshTokens[token.TokenHash] = &stored
+}
+
+// GetRefreshToken возвращает refresh токен по хешу; nil, если токена нет
+func (s *MemoryStorage) GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+	return s.refreshTokenLocked(stored), nil
+}
+
+// refreshTokenLocked возвращает копию refresh токена со временем отзыва семейства; вызывается под блокировкой
+func (s *MemoryStorage) refreshTokenLocked(stored *models.RefreshToken) *models.RefreshToken {
+	result := *stored
+	if revokedAt, ok := s.familyRevokedAt[stored.FamilyID]; ok {
+		result.RevokedAt = &revokedAt
+	}
+	return &result
+}
+
+// RotateRefreshToken заменяет действующий refresh токен tokenHash токеном next того же семейства.
+// Если токен уже заменен, его предъявили повторно: семейство отзывается вместе с access токенами.
+func (s *MemoryStorage) RotateRefreshToken(ctx context.Context, tokenHash string, next *models.RefreshToken, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return models.RefreshTokenUnknown, nil
+	}
+	if _, revoked := s.familyRevokedAt[stored.FamilyID]; revoked {
+		return models.RefreshTokenRevoked, nil
+	}
+	if stored.UsedAt != nil {
+		s.revokeTokenFamiliesLocked([]string{stored.FamilyID}, now)
+		return models.RefreshTokenReused, nil
+	}
+	if !stored.ExpiresAt.After(now) {
+		return models.RefreshTokenExpired, nil
+	}
+
+	stored.UsedAt = &now
+	next.FamilyID = stored.FamilyID
+	s.insertRefreshTokenLocked(next)
+	return models.RefreshTokenRotated, nil
+}
+
+// RevokeAccessToken отзывает access токен jti пользователя userID до expiresAt
+// и семейство refresh токенов, выданное вместе с ним
+func (s *MemoryStorage) RevokeAccessToken(ctx context.Context, userID int64, jti string, expiresAt, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stored := range s.refreshTokens {
+		if stored.UserID == userID && stored.AccessTokenID == jti {
+			s.revokeTokenFamiliesLocked([]string{stored.FamilyID}, now)
+			break
+		}
+	}
+	if expiresAt.After(now) {
+		s.revokedTokens[jti] = expiresAt
+	}
+	return nil
+}
+
+// RevokeUserTokens отзывает все семейства refresh токенов пользователя userID и выданные с ними access токены
+func (s *MemoryStorage) RevokeUserTokens(ctx context.Context, userID int64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var families []string
+	for _, stored := range s.refreshTokens {
+		if stored.UserID == userID {
+			families = append(families, stored.FamilyID)
+		}
+	}
+	s.revokeTokenFamiliesLocked(families, now)
+	return nil
+}
+
+// revokeTokenFamiliesLocked отзывает семейства familyIDs и еще не истекшие access токены, выданные
+// с их refresh токенами, и забывает истекшие отозванные токены; вызывается под блокировкой
+func (s *MemoryStorage) revokeTokenFamiliesLocked(familyIDs []string, now time.Time) {
+	for _, familyID := range familyIDs {
+		if _, revoked := s.familyRevokedAt[familyID]; !revoked {
+			s.familyRevokedAt[familyID] = now
+		}
+	}
+	for _, stored := range s.refreshTokens {
+		if slices.Contains(familyIDs, stored.FamilyID) && stored.AccessExpiresAt.After(now) {
+			s.revokedTokens[stored.AccessTokenID] = stored.AccessExpiresAt
+		}
+	}
+	for jti, expiresAt := range s.revokedTokens {
+		if !expiresAt.After(now) {
+			delete(s.revokedTokens, jti)
+		}
+	}
+}
+
+// IsTokenRevoked сообщает, отозван ли access токен jti
+func (s *MemoryStorage) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, revoked := s.revokedTokens[jti]
+	return revoked, nil
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vglushak/go-musthave-diploma-tpl/migrations"
+)
+
+// migrationLockKey ключ advisory lock, под которым выполняются миграции.
+// Не дает нескольким репликам применять миграции одновременно.
+const migrationLockKey int64 = 0x676f706865726d // "gopherm"
+
+const createSchemaMigrationsQuery = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// ErrSchemaTooNew возвращается, если в базе применены миграции, неизвестные бинарному файлу
+var ErrSchemaTooNew = errors.New("database schema is newer than supported by this binary")
+
+// Migration миграция схемы базы данных
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus состояние миграции в базе данных
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Migrator применяет встроенные миграции к базе данных
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewMigrator создает мигратор со встроенными в бинарный файл миграциями
+func NewMigrator(db *DatabaseStorage) (*Migrator, error) {
+	return newMigrator(db.pool, migrations.FS)
+}
+
+func newMigrator(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	list, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: list}, nil
+}
+
+// LoadMigrations читает миграции формата NNN_name.sql, отсортированные по версии
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	seen := make(map[int64]string)
+	result := make([]Migration, 0, len(files))
+	for _, file := range files {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		prefix, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %q: expected NNN_name.sql", file)
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version in %q", file)
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("duplicate migration version %d: %q and %q", version, other, file)
+		}
+		seen[version] = file
+
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", file, err)
+		}
+		up, down, err := parseMigration(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse migration %q: %w", file, err)
+		}
+
+		result = append(result, Migration{Version: version, Name: name, Up: up, Down: down})
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	return result, nil
+}
+
+// parseMigration разбирает файл миграции на секции "-- +goose Up" и "-- +goose Down"
+func parseMigration(content string) (up, down string, err error) {
+	var upBuf, downBuf strings.Builder
+	var current *strings.Builder
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		directive := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(directive, "-- +goose Up"):
+			current = &upBuf
+			continue
+		case strings.HasPrefix(directive, "-- +goose Down"):
+			current = &downBuf
+			continue
+		case strings.HasPrefix(directive, "-- +goose"):
+			// StatementBegin/StatementEnd не нужны: секция выполняется целиком
+			continue
+		}
+		if current != nil {
+			current.WriteString(line)
+			current.WriteString("\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+
+	up = strings.TrimSpace(upBuf.String())
+	if up == "" {
+		return "", "", errors.New("missing -- +goose Up section")
+	}
+	return up, strings.TrimSpace(downBuf.String()), nil
+}
+
+// LatestVersion возвращает последнюю известную бинарному файлу версию схемы
+func (m *Migrator) LatestVersion() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Up применяет все непримененные миграции и возвращает их количество.
+// Возвращает ErrSchemaTooNew, если схема в базе новее бинарного файла.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	applied := 0
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkVersions(versions); err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, migration.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`,
+					migration.Version, migration.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down откатывает последнюю примененную миграцию и возвращает ее версию,
+// либо 0, если откатывать нечего
+func (m *Migrator) Down(ctx context.Context) (int64, error) {
+	var rolledBack int64
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkVersions(versions); err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down section", migration.Version, migration.Name)
+			}
+			err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+				if _, err := tx.Exec(ctx, migration.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("failed to roll back migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+			rolledBack = migration.Version
+			return nil
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Status возвращает состояние всех известных миграций
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var result []MigrationStatus
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, ok := versions[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			result = append(result, status)
+		}
+		return m.checkVersions(versions)
+	})
+	return result, err
+}
+
+// checkVersions проверяет, что в базе нет миграций новее известных бинарному файлу
+func (m *Migrator) checkVersions(applied map[int64]time.Time) error {
+	latest := m.LatestVersion()
+	for version := range applied {
+		if version > latest {
+			return fmt.Errorf("%w: database version %d, latest known %d", ErrSchemaTooNew, version, latest)
+		}
+	}
+	return nil
+}
+
+// withLock выполняет fn на выделенном соединении под advisory lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	if _, err := conn.Exec(ctx, createSchemaMigrationsQuery); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// appliedMigrations возвращает версии примененных миграций и время их применения
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan migration version: %w", err)
+		}
+		result[version] = appliedAt
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vglushak/go-musthave-diploma-tpl/migrations"
+)
+
+func TestLoadMigrations_Embedded(t *testing.T) {
+	list, err := LoadMigrations(migrations.FS)
+	require.NoError(t, err)
+	require.NotEmpty(t, list)
+
+	assert.Equal(t, int64(1), list[0].Version)
+	assert.Equal(t, "create_tables", list[0].Name)
+	assert.Contains(t, list[0].Up, "CREATE TABLE IF NOT EXISTS users")
+	assert.Contains(t, list[0].Down, "DROP TABLE IF EXISTS users")
+	assert.NotContains(t, list[0].Up, "DROP TABLE")
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int64
+		hasError bool
+	}{
+		{
+			name: "Sorted by version",
+			files: fstest.MapFS{
+				"010_third.sql":  {Data: []byte("-- +goose Up\nSELECT 3;")},
+				"002_second.sql": {Data: []byte("-- +goose Up\nSELECT 2;\n-- +goose Down\nSELECT 0;")},
+				"001_first.sql":  {Data: []byte("-- +goose Up\n-- +goose StatementBegin\nSELECT 1;\n-- +goose StatementEnd")},
+				"README.md":      {Data: []byte("not a migration")},
+			},
+			versions: []int64{1, 2, 10},
+		},
+		{
+			name: "Invalid file name",
+			files: fstest.MapFS{
+				"first.sql": {Data: []byte("-- +goose Up\nSELECT 1;")},
+			},
+			hasError: true,
+		},
+		{
+			name: "Duplicate version",
+			files: fstest.MapFS{
+				"001_first.sql":  {Data: []byte("-- +goose Up\nSELECT 1;")},
+				"0001_other.sql": {Data: []byte("-- +goose Up\nSELECT 1;")},
+			},
+			hasError: true,
+		},
+		{
+			name: "Missing up section",
+			files: fstest.MapFS{
+				"001_first.sql": {Data: []byte("SELECT 1;")},
+			},
+			hasError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := LoadMigrations(tt.files)
+			if tt.hasError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var versions []int64
+			for _, migration := range list {
+				versions = append(versions, migration.Version)
+				assert.NotContains(t, migration.Up, "+goose")
+			}
+			assert.Equal(t, tt.versions, versions)
+		})
+	}
+}
+
+func TestMigrator_CheckVersions(t *testing.T) {
+	migrator := &Migrator{migrations: []Migration{{Version: 1}, {Version: 2}}}
+	assert.Equal(t, int64(2), migrator.LatestVersion())
+
+	assert.NoError(t, migrator.checkVersions(nil))
+
+	err := migrator.checkVersions(map[int64]time.Time{1: {}, 3: {}})
+	assert.True(t, errors.Is(err, ErrSchemaTooNew))
+}
+
+// TestMigrator_Integration тестирует применение миграций к реальной базе данных
+func TestMigrator_Integration(t *testing.T) {
+	if !dbAvailable {
+		t.Skip("Database not available, skipping test")
+	}
+	storage, err := NewDatabaseStorage(context.Background(), testDatabaseURI)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	ctx := context.Background()
+	migrator, err := NewMigrator(storage)
+	require.NoError(t, err)
+
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+
+	// Повторный запуск ничего не применяет
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, applied)
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt, "migration %d is not applied", status.Version)
+	}
+
+	// Схема новее бинарного файла
+	futureVersion := migrator.LatestVersion() + 1000
+	_, err = storage.pool.Exec(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, 'future')`, futureVersion)
+	require.NoError(t, err)
+	defer storage.pool.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, futureVersion)
+
+	_, err = migrator.Up(ctx)
+	assert.True(t, errors.Is(err, ErrSchemaTooNew))
+}
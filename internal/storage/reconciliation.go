@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// discrepancyColumns колонки accrual_discrepancies в порядке полей scanDiscrepancy
+const discrepancyColumns = `id, order_number, user_id, recorded_accrual, reported_status, reported_accrual,
+	status, note, created_at, resolved_at`
+
+// scanDiscrepancy читает строку accrual_discrepancies, выбранную с discrepancyColumns
+func scanDiscrepancy(row pgx.Row, d *models.AccrualDiscrepancy) error {
+	return row.Scan(&d.ID, &d.OrderNumber, &d.UserID, &d.RecordedAccrual, &d.ReportedStatus, &d.ReportedAccrual,
+		&d.Status, &d.Note, &d.CreatedAt, &d.ResolvedAt)
+}
+
+// SampleProcessedOrders возвращает случайную долю rate заказов, обработанных не раньше since,
+// но не больше limit заказов
+func (s *DatabaseStorage) SampleProcessedOrders(ctx context.Context, since time.Time, rate float64, limit int) ([]models.Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders
+		WHERE status = 'PROCESSED' AND processed_at >= $1 AND random() < $2
+		ORDER BY processed_at DESC LIMIT $3`
+
+	rows, err := s.pool.Query(ctx, query, since, rate, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample processed orders: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Order
+	for rows.Next() {
+		var order models.Order
+		if err := scanOrder(rows, &order); err != nil {
+			return nil, fmt.Errorf("failed to scan order: %w", err)
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate orders: %w", err)
+	}
+
+	return orders, nil
+}
+
+// OpenAccrualDiscrepancy открывает расхождение для ручного разбора и заполняет d.ID.
+// Если по заказу уже открыто расхождение, новое не создается и возвращается false.
+func (s *DatabaseStorage) OpenAccrualDiscrepancy(ctx context.Context, d *models.AccrualDiscrepancy) (bool, error) {
+	query := `INSERT INTO accrual_discrepancies (order_number, user_id, recorded_accrual, reported_status, reported_accrual, status, note, created_at)
+		VALUES ($1, $2, $3, $4, $5, 'OPEN', $6, $7)
+		ON CONFLICT (order_number) WHERE status = 'OPEN' DO NOTHING
+		RETURNING id, status, created_at`
+
+	err := s.pool.QueryRow(ctx, query, d.OrderNumber, d.UserID, d.RecordedAccrual, d.ReportedStatus, d.ReportedAccrual,
+		d.Note, time.Now()).Scan(&d.ID, &d.Status, &d.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open accrual discrepancy: %w", err)
+	}
+
+	return true, nil
+}
+
+// AdjustOrderAccrual исправляет начисление заказа на d.ReportedAccrual: меняет начисление заказа
+// и баланс владельца на разницу, проводит ее по журналу и записывает исправленное расхождение.
+// Возвращает false без изменений, если начисление заказа уже не равно d.RecordedAccrual
+// или списание разницы увело бы баланс в минус.
+func (s *DatabaseStorage) AdjustOrderAccrual(ctx context.Context, d *models.AccrualDiscrepancy) (bool, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокируем заказ, чтобы конкурентная сверка не исправила его второй раз
+	var accrual models.Money
+	orderQuery := `SELECT COALESCE(accrual, 0) FROM orders WHERE number = $1 AND status = 'PROCESSED' FOR UPDATE`
+	err = tx.QueryRow(ctx, orderQuery, d.OrderNumber).Scan(&accrual)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get order for update: %w", err)
+	}
+	if accrual != d.RecordedAccrual {
+		return false, nil
+	}
+
+	balance, err := lockBalance(ctx, tx, d.UserID)
+	if err != nil {
+		return false, err
+	}
+	delta := d.Delta()
+	if balance.Current+delta < 0 {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE orders SET accrual = $2 WHERE number = $1`, d.OrderNumber, d.ReportedAccrual); err != nil {
+		return false, fmt.Errorf("failed to update order accrual: %w", err)
+	}
+	balanceQuery := `UPDATE balances SET current = current + $2, updated_at = CURRENT_TIMESTAMP WHERE user_id = $1`
+	if _, err := tx.Exec(ctx, balanceQuery, d.UserID, delta); err != nil {
+		return false, fmt.Errorf("failed to update balance: %w", err)
+	}
+	if err := postLedgerTransaction(ctx, tx, d.UserID, models.LedgerKindAdjustment, models.LedgerAccountAdjustments, d.OrderNumber, delta); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	discrepancyQuery := `INSERT INTO accrual_discrepancies (order_number, user_id, recorded_accrual, reported_status, reported_accrual, status, note, created_at, resolved_at)
+		VALUES ($1, $2, $3, $4, $5, 'ADJUSTED', $6, $7, $7) RETURNING id, status, created_at, resolved_at`
+	err = tx.QueryRow(ctx, discrepancyQuery, d.OrderNumber, d.UserID, d.RecordedAccrual, d.ReportedStatus, d.ReportedAccrual,
+		d.Note, now).Scan(&d.ID, &d.Status, &d.CreatedAt, &d.ResolvedAt)
+	if err != nil {
+		return false, fmt.Errorf("failed to record accrual discrepancy: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
+
+// ListAccrualDiscrepancies возвращает расхождения со статусом status (все, если пустой), от новых к старым
+func (s *DatabaseStorage) ListAccrualDiscrepancies(ctx context.Context, status string) ([]models.AccrualDiscrepancy, error) {
+	query := `SELECT ` + discrepancyColumns + ` FROM accrual_discrepancies
+		WHERE $1 = '' OR status = $1 ORDER BY id DESC`
+
+	rows, err := s.pool.Query(ctx, query, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accrual discrepancies: %w", err)
+	}
+	defer rows.Close()
+
+	var discrepancies []models.AccrualDiscrepancy
+	for rows.Next() {
+		var d models.AccrualDiscrepancy
+		if err := scanDiscrepancy(rows, &d); err != nil {
+			return nil, fmt.Errorf("failed to scan accrual discrepancy: %w", err)
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate accrual discrepancies: %w", err)
+	}
+
+	return discrepancies, nil
+}
+
+// ResolveAccrualDiscrepancy закрывает открытое расхождение id после ручного разбора.
+// Возвращает nil, если открытого расхождения с таким id нет.
+func (s *DatabaseStorage) ResolveAccrualDiscrepancy(ctx context.Context, id int64, note string) (*models.AccrualDiscrepancy, error) {
+	query := `UPDATE accrual_discrepancies SET status = 'RESOLVED', note = $2, resolved_at = $3
+		WHERE id = $1 AND status = 'OPEN' RETURNING ` + discrepancyColumns
+
+	var d models.AccrualDiscrepancy
+	err := scanDiscrepancy(s.pool.QueryRow(ctx, query, id, note, time.Now()), &d)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve accrual discrepancy: %w", err)
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// SaveShadowComparison записывает сравнение с теневой системой начисления и заполняет c.ID
+func (s *DatabaseStorage) SaveShadowComparison(ctx context.Context, c *models.ShadowComparison) error {
+	query := `INSERT INTO accrual_shadow_comparisons (order_number, source, primary_status, primary_accrual,
+			shadow_status, shadow_accrual, shadow_error, outcome, final, compared_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+	err := s.pool.QueryRow(ctx, query, c.OrderNumber, c.Source, c.PrimaryStatus, c.PrimaryAccrual,
+		c.ShadowStatus, c.ShadowAccrual, c.ShadowError, c.Outcome, c.Final, c.ComparedAt).Scan(&c.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save shadow comparison: %w", err)
+	}
+
+	return nil
+}
+
+// GetShadowReport сводит сравнения с теневой системой начисления начиная с since
+// и добавляет не больше limit последних расхождений
+func (s *DatabaseStorage) GetShadowReport(ctx context.Context, since time.Time, limit int) (*models.ShadowReport, error) {
+	report := &models.ShadowReport{Since: since, Disagreements: []models.ShadowComparison{}}
+
+	countQuery := `SELECT outcome, final, COUNT(*) FROM accrual_shadow_comparisons
+		WHERE compared_at >= $1 GROUP BY outcome, final`
+	rows, err := s.pool.Query(ctx, countQuery, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count shadow comparisons: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			outcome string
+			final   bool
+			count   int
+		)
+		if err := rows.Scan(&outcome, &final, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan shadow comparison counts: %w", err)
+		}
+		report.Add(outcome, final, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate shadow comparison counts: %w", err)
+	}
+
+	disagreementsQuery := `SELECT id, order_number, source, primary_status, primary_accrual,
+			shadow_status, shadow_accrual, shadow_error, outcome, final, compared_at
+		FROM accrual_shadow_comparisons
+		WHERE compared_at >= $1 AND outcome <> 'AGREE' ORDER BY id DESC LIMIT $2`
+	rows, err = s.pool.Query(ctx, disagreementsQuery, since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shadow disagreements: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ShadowComparison
+		err := rows.Scan(&c.ID, &c.OrderNumber, &c.Source, &c.PrimaryStatus, &c.PrimaryAccrual,
+			&c.ShadowStatus, &c.ShadowAccrual, &c.ShadowError, &c.Outcome, &c.Final, &c.ComparedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan shadow disagreement: %w", err)
+		}
+		report.Disagreements = append(report.Disagreements, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate shadow disagreements: %w", err)
+	}
+
+	return report, nil
+}
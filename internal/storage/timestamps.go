@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Колонки TIMESTAMP хранят время без зоны, а pgx читает его как UTC. Чтобы прочитанное время
+// совпадало с записанным на любом часовом поясе хоста, все время в базе хранится в UTC:
+// сессия работает в зоне UTC (CURRENT_TIMESTAMP и значения по умолчанию), а время из Go
+// перед записью переводится в UTC.
+
+// sessionTimeZone часовой пояс сессий с базой данных
+const sessionTimeZone = "UTC"
+
+// registerUTCTimestamps заменяет кодек TIMESTAMP в typeMap на переводящий время в UTC при записи
+func registerUTCTimestamps(typeMap *pgtype.Map) {
+	typeMap.RegisterType(&pgtype.Type{
+		Name:  "timestamp",
+		OID:   pgtype.TimestampOID,
+		Codec: &utcTimestampCodec{TimestampCodec: &pgtype.TimestampCodec{}},
+	})
+}
+
+// utcTimestampCodec кодек TIMESTAMP, записывающий время в UTC. Стандартный кодек отбрасывает
+// зону и записывает местное время хоста как есть.
+type utcTimestampCodec struct {
+	*pgtype.TimestampCodec
+}
+
+func (c *utcTimestampCodec) PlanEncode(m *pgtype.Map, oid uint32, format int16, value any) pgtype.EncodePlan {
+	plan := c.TimestampCodec.PlanEncode(m, oid, format, value)
+	if plan == nil {
+		return nil
+	}
+	return utcTimestampEncodePlan{next: plan}
+}
+
+// utcTimestampEncodePlan переводит время в UTC и передает его стандартному плану записи
+type utcTimestampEncodePlan struct {
+	next pgtype.EncodePlan
+}
+
+func (p utcTimestampEncodePlan) Encode(value any, buf []byte) ([]byte, error) {
+	ts, err := value.(pgtype.TimestampValuer).TimestampValue()
+	if err != nil {
+		return nil, err
+	}
+	if ts.Valid && ts.InfinityModifier == pgtype.Finite {
+		ts.Time = ts.Time.UTC()
+	}
+	return p.next.Encode(ts, buf)
+}
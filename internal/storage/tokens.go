@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/vglushak/go-musthave-diploma-tpl/internal/models"
+)
+
+// refreshTokenColumns колонки refresh токена вместе со временем отзыва его семейства
+const refreshTokenColumns = `t.id, t.user_id, t.family_id, t.token_hash, t.access_token_id, t.access_expires_at,
+	t.created_at, t.expires_at, t.used_at, f.revoked_at`
+
+// scanRefreshToken читает refresh токен из строки с колонками refreshTokenColumns
+func scanRefreshToken(row pgx.Row) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+	err := row.Scan(&token.ID, &token.UserID, &token.FamilyID, &token.TokenHash, &token.AccessTokenID,
+		&token.AccessExpiresAt, &token.CreatedAt, &token.ExpiresAt, &token.UsedAt, &token.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// CreateRefreshToken сохраняет первый refresh токен нового семейства и заполняет token.ID.
+// Заодно удаляются семейства пользователя, все токены которых истекли.
+func (s *DatabaseStorage) CreateRefreshToken(ctx context.Context, token *models.RefreshToken) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Access токены истекают раньше refresh токенов, поэтому вместе с семейством забываются только истекшие
+	pruneQuery := `DELETE FROM token_families f WHERE f.user_id = $1
+		AND NOT EXISTS (SELECT 1 FROM refresh_tokens t WHERE t.family_id = f.id AND t.expires_at > $2)`
+	if _, err := tx.Exec(ctx, pruneQuery, token.UserID, token.CreatedAt); err != nil {
+		return fmt.Errorf("failed to prune token families: %w", err)
+	}
+
+	familyQuery := `INSERT INTO token_families (id, user_id, created_at) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(ctx, familyQuery, token.FamilyID, token.UserID, token.CreatedAt); err != nil {
+		return fmt.Errorf("failed to create token family: %w", wrapUniqueViolation(err))
+	}
+
+	if err := insertRefreshToken(ctx, tx, token); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// insertRefreshToken сохраняет refresh токен в транзакции tx и заполняет token.ID
+func insertRefreshToken(ctx context.Context, tx pgx.Tx, token *models.RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (family_id, user_id, token_hash, access_token_id, access_expires_at,
+			created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+	err := tx.QueryRow(ctx, query, token.FamilyID, token.UserID, token.TokenHash, token.AccessTokenID,
+		token.AccessExpiresAt, token.CreatedAt, token.ExpiresAt).Scan(&token.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", wrapUniqueViolation(err))
+	}
+
+	return nil
+}
+
+// GetRefreshToken возвращает refresh токен по хешу; nil, если токена нет
+func (s *DatabaseStorage) GetRefreshToken(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	query := `SELECT ` + refreshTokenColumns + `
+		FROM refresh_tokens t JOIN token_families f ON f.id = t.family_id
+		WHERE t.token_hash = $1`
+
+	token, err := scanRefreshToken(s.pool.QueryRow(ctx, query, tokenHash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken заменяет действующий refresh токен tokenHash токеном next того же семейства.
+// Если токен уже заменен, его предъявили повторно: семейство отзывается вместе с access токенами.
+func (s *DatabaseStorage) RotateRefreshToken(ctx context.Context, tokenHash string, next *models.RefreshToken, now time.Time) (string, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокировка семейства упорядочивает замену токена с отзывом семейства: отзыв не пропустит
+	// следующий токен, а замена не продолжит отозванное семейство
+	query := `SELECT ` + refreshTokenColumns + `
+		FROM refresh_tokens t JOIN token_families f ON f.id = t.family_id
+		WHERE t.token_hash = $1 FOR UPDATE OF f`
+	token, err := scanRefreshToken(tx.QueryRow(ctx, query, tokenHash))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.RefreshTokenUnknown, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	result := models.RefreshTokenRotated
+	switch {
+	case token.RevokedAt != nil:
+		return models.RefreshTokenRevoked, nil
+	case token.UsedAt != nil:
+		if err := revokeTokenFamilies(ctx, tx, []string{token.FamilyID}, now); err != nil {
+			return "", err
+		}
+		result = models.RefreshTokenReused
+	case !token.ExpiresAt.After(now):
+		return models.RefreshTokenExpired, nil
+	default:
+		if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = $2 WHERE id = $1`, token.ID, now); err != nil {
+			return "", fmt.Errorf("failed to mark refresh token used: %w", err)
+		}
+		next.FamilyID = token.FamilyID
+		if err := insertRefreshToken(ctx, tx, next); err != nil {
+			return "", err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return result, nil
+}
+
+// RevokeAccessToken отзывает access токен jti пользователя userID до expiresAt
+// и семейство refresh токенов, выданное вместе с ним
+func (s *DatabaseStorage) RevokeAccessToken(ctx context.Context, userID int64, jti string, expiresAt, now time.Time) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT f.id FROM token_families f JOIN refresh_tokens t ON t.family_id = f.id
+		WHERE t.access_token_id = $1 AND t.user_id = $2 FOR UPDATE OF f`
+	rows, err := tx.Query(ctx, query, jti, userID)
+	if err != nil {
+		return fmt.Errorf("failed to lock token family: %w", err)
+	}
+	families, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to scan token families: %w", err)
+	}
+
+	if err := revokeTokenFamilies(ctx, tx, families, now); err != nil {
+		return err
+	}
+
+	if expiresAt.After(now) {
+		revokeQuery := `INSERT INTO revoked_tokens (jti, user_id, expires_at, revoked_at) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (jti) DO NOTHING`
+		if _, err := tx.Exec(ctx, revokeQuery, jti, userID, expiresAt, now); err != nil {
+			return fmt.Errorf("failed to revoke access token: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeUserTokens отзывает все семейства refresh токенов пользователя userID и выданные с ними access токены
+func (s *DatabaseStorage) RevokeUserTokens(ctx context.Context, userID int64, now time.Time) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	query := `SELECT id FROM token_families WHERE user_id = $1 AND revoked_at IS NULL FOR UPDATE`
+	rows, err := tx.Query(ctx, query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to lock token families: %w", err)
+	}
+	families, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to scan token families: %w", err)
+	}
+
+	if err := revokeTokenFamilies(ctx, tx, families, now); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// revokeTokenFamilies отзывает заблокированные в транзакции tx семейства familyIDs и еще
+// не истекшие access токены, выданные с их refresh токенами, и удаляет истекшие отозванные токены
+func revokeTokenFamilies(ctx context.Context, tx pgx.Tx, familyIDs []string, now time.Time) error {
+	if len(familyIDs) == 0 {
+		return nil
+	}
+
+	familyQuery := `UPDATE token_families SET revoked_at = $2 WHERE id = ANY($1) AND revoked_at IS NULL`
+	if _, err := tx.Exec(ctx, familyQuery, familyIDs, now); err != nil {
+		return fmt.Errorf("failed to revoke token families: %w", err)
+	}
+
+	accessQuery := `INSERT INTO revoked_tokens (jti, user_id, expires_at, revoked_at)
+		SELECT access_token_id, user_id, access_expires_at, $2 FROM refresh_tokens
+		WHERE family_id = ANY($1) AND access_expires_at > $2
+		ON CONFLICT (jti) DO NOTHING`
+	if _, err := tx.Exec(ctx, accessQuery, familyIDs, now); err != nil {
+		return fmt.Errorf("failed to revoke access tokens: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM revoked_tokens WHERE expires_at <= $1`, now); err != nil {
+		return fmt.Errorf("failed to prune revoked tokens: %w", err)
+	}
+
+	return nil
+}
+
+// IsTokenRevoked сообщает, отозван ли access токен jti
+func (s *DatabaseStorage) IsTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	var revoked bool
+	err := s.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)`, jti).Scan(&revoked)
+	if err != nil {
+		return false, fmt.Errorf("failed to check revoked token: %w", err)
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,52 @@
+-- +goose Up
+-- Журнал проводок по балансам пользователей (двойная запись).
+-- Каждая операция — пара записей с общим transaction_id и суммой amount, равной нулю:
+-- положительная сумма — кредит счета, отрицательная — дебет.
+CREATE SEQUENCE IF NOT EXISTS ledger_transaction_seq;
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    transaction_id BIGINT NOT NULL,
+    account VARCHAR(64) NOT NULL,
+    -- Журнал только дополняется: пользователя с проводками удалить нельзя
+    user_id BIGINT REFERENCES users(id) ON DELETE RESTRICT,
+    kind VARCHAR(32) NOT NULL,
+    amount DECIMAL(12,2) NOT NULL,
+    reference VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_user_id ON ledger_entries(user_id);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_transaction_id ON ledger_entries(transaction_id);
+
+-- Журнал только дополняется: изменение и удаление записей запрещены
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION ledger_entries_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger_entries is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TRIGGER IF EXISTS ledger_entries_append_only ON ledger_entries;
+CREATE TRIGGER ledger_entries_append_only
+    BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION ledger_entries_append_only();
+
+-- Начальные остатки для уже существующих балансов
+WITH opening AS (
+    SELECT user_id, current, nextval('ledger_transaction_seq') AS transaction_id
+    FROM balances b
+    WHERE current <> 0
+      AND NOT EXISTS (SELECT 1 FROM ledger_entries le WHERE le.user_id = b.user_id)
+)
+INSERT INTO ledger_entries (transaction_id, account, user_id, kind, amount)
+SELECT transaction_id, 'user:' || user_id, user_id, 'OPENING', current FROM opening
+UNION ALL
+SELECT transaction_id, 'system:opening', NULL, 'OPENING', -current FROM opening;
+
+-- +goose Down
+DROP TABLE IF EXISTS ledger_entries;
+DROP FUNCTION IF EXISTS ledger_entries_append_only();
+DROP SEQUENCE IF EXISTS ledger_transaction_seq;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- Раньше статус системы начисления сохранялся как есть: REGISTERED соответствует NEW
+UPDATE orders SET status = 'NEW' WHERE status = 'REGISTERED';
+
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
+ALTER TABLE orders ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED'));
+
+-- +goose Down
+ALTER TABLE orders DROP CONSTRAINT IF EXISTS orders_status_check;
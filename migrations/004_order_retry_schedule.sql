@@ -0,0 +1,15 @@
+-- +goose Up
+-- Расписание проверок заказа в системе начисления: временные ошибки
+-- не делают заказ INVALID, а откладывают следующую проверку
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS last_error TEXT NOT NULL DEFAULT '';
+-- NULL означает, что проверки прекращены после исчерпания попыток
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS next_check_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_orders_status_next_check_at ON orders(status, next_check_at);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_orders_status_next_check_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS next_check_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS last_error;
+ALTER TABLE orders DROP COLUMN IF EXISTS attempts;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Аренда заказов обработчиками: заказ, захваченный одним экземпляром сервиса,
+-- не выбирается другими до освобождения или истечения locked_until
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_by VARCHAR(128);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_orders_locked_by ON orders(locked_by) WHERE locked_by IS NOT NULL;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_orders_locked_by;
+ALTER TABLE orders DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE orders DROP COLUMN IF EXISTS locked_by;
@@ -0,0 +1,20 @@
+-- +goose Up
+-- Допустимая частота запросов к системе начисления, узнанная из ответов 429;
+-- общая для всех экземпляров сервиса и переживает перезапуск
+CREATE TABLE IF NOT EXISTS accrual_rate_limits (
+    system VARCHAR(255) PRIMARY KEY,
+    requests_per_minute INT NOT NULL CHECK (requests_per_minute > 0),
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Экземпляры, опрашивающие систему начисления; частота делится между активными
+CREATE TABLE IF NOT EXISTS accrual_rate_limit_clients (
+    system VARCHAR(255) NOT NULL,
+    client_id VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (system, client_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS accrual_rate_limit_clients;
+DROP TABLE IF EXISTS accrual_rate_limits;
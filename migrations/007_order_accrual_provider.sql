@@ -0,0 +1,9 @@
+-- +goose Up
+-- Мерчант, указанный при загрузке заказа, и система начисления, выбранная для заказа
+-- при первой проверке; все последующие проверки идут в ту же систему
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS merchant VARCHAR(64);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS accrual_provider VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE orders DROP COLUMN IF EXISTS accrual_provider;
+ALTER TABLE orders DROP COLUMN IF EXISTS merchant;
@@ -0,0 +1,21 @@
+-- +goose Up
+-- Журнал ответов системы начисления в исходном виде: доказательство при спорах
+-- о начислениях и материал для повторной обработки после исправлений
+CREATE TABLE IF NOT EXISTS accrual_events (
+    id BIGSERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL,
+    provider VARCHAR(64) NOT NULL DEFAULT '',
+    source VARCHAR(16) NOT NULL,
+    requested_at TIMESTAMP NOT NULL,
+    http_status INT NOT NULL DEFAULT 0,
+    latency_ms BIGINT NOT NULL DEFAULT 0,
+    body TEXT NOT NULL DEFAULT '',
+    status VARCHAR(32) NOT NULL DEFAULT '',
+    accrual DECIMAL(10,2),
+    error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_accrual_events_order_number ON accrual_events(order_number, id);
+
+-- +goose Down
+DROP TABLE IF EXISTS accrual_events;
@@ -0,0 +1,29 @@
+-- +goose Up
+-- Время перевода заказа в PROCESSED: сверка перепроверяет недавно обработанные заказы
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS processed_at TIMESTAMP;
+UPDATE orders SET processed_at = uploaded_at WHERE status = 'PROCESSED' AND processed_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_orders_processed_at ON orders(processed_at) WHERE status = 'PROCESSED';
+
+-- Расхождения начислений, найденные сверкой: исправленные проводкой
+-- и открытые для ручного разбора
+CREATE TABLE IF NOT EXISTS accrual_discrepancies (
+    id BIGSERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL REFERENCES orders(number),
+    user_id BIGINT NOT NULL REFERENCES users(id),
+    recorded_accrual DECIMAL(10,2) NOT NULL,
+    reported_status VARCHAR(32) NOT NULL,
+    reported_accrual DECIMAL(10,2) NOT NULL,
+    status VARCHAR(16) NOT NULL CHECK (status IN ('OPEN', 'ADJUSTED', 'RESOLVED')),
+    note TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    resolved_at TIMESTAMP
+);
+
+-- По заказу открыто не больше одного расхождения, повторные сверки его не дублируют
+CREATE UNIQUE INDEX IF NOT EXISTS idx_accrual_discrepancies_open
+    ON accrual_discrepancies(order_number) WHERE status = 'OPEN';
+
+-- +goose Down
+DROP TABLE IF EXISTS accrual_discrepancies;
+DROP INDEX IF EXISTS idx_orders_processed_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS processed_at;
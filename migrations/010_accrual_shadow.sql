@@ -0,0 +1,20 @@
+-- +goose Up
+-- Сравнения ответов основной системы начисления с теневой, кандидатом на замену
+CREATE TABLE IF NOT EXISTS accrual_shadow_comparisons (
+    id BIGSERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL,
+    source VARCHAR(16) NOT NULL,
+    primary_status VARCHAR(32) NOT NULL DEFAULT '',
+    primary_accrual DECIMAL(10,2),
+    shadow_status VARCHAR(32) NOT NULL DEFAULT '',
+    shadow_accrual DECIMAL(10,2),
+    shadow_error TEXT NOT NULL DEFAULT '',
+    outcome VARCHAR(32) NOT NULL CHECK (outcome IN ('AGREE', 'STATUS_MISMATCH', 'ACCRUAL_MISMATCH', 'SHADOW_ERROR')),
+    final BOOLEAN NOT NULL DEFAULT FALSE,
+    compared_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_accrual_shadow_comparisons_compared_at ON accrual_shadow_comparisons(compared_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS accrual_shadow_comparisons;
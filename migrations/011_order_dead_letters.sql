@@ -0,0 +1,22 @@
+-- +goose Up
+-- Заказы, обработка которых прекращена после исчерпания попыток, ждут разбора в очереди недоставленных
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS dead_lettered_at TIMESTAMP;
+UPDATE orders SET dead_lettered_at = CURRENT_TIMESTAMP
+    WHERE status IN ('NEW', 'PROCESSING') AND next_check_at IS NULL AND attempts > 0;
+CREATE INDEX IF NOT EXISTS idx_orders_dead_lettered_at ON orders(dead_lettered_at) WHERE dead_lettered_at IS NOT NULL;
+
+-- Неудачные попытки обработки заказа: причины, по которым заказ попал в очередь недоставленных
+CREATE TABLE IF NOT EXISTS order_failures (
+    id BIGSERIAL PRIMARY KEY,
+    order_number VARCHAR(255) NOT NULL REFERENCES orders(number),
+    attempt INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    failed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_failures_order_number ON order_failures(order_number, id);
+
+-- +goose Down
+DROP TABLE IF EXISTS order_failures;
+DROP INDEX IF EXISTS idx_orders_dead_lettered_at;
+ALTER TABLE orders DROP COLUMN IF EXISTS dead_lettered_at;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Тариф пользователя задает его вес в справедливой очереди обработки заказов
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tier VARCHAR(32) NOT NULL DEFAULT 'standard';
+-- Время последнего просмотра списка заказов: заказы просматривающего пользователя проверяются раньше
+ALTER TABLE users ADD COLUMN IF NOT EXISTS orders_viewed_at TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE users DROP COLUMN IF EXISTS orders_viewed_at;
+ALTER TABLE users DROP COLUMN IF EXISTS tier;
@@ -0,0 +1,43 @@
+-- +goose Up
+-- Семейство refresh токенов: цепочка токенов одного входа, каждый токен заменяется следующим.
+-- Отзыв семейства блокирует его строку, поэтому не пересекается с выдачей следующего токена.
+CREATE TABLE IF NOT EXISTS token_families (
+    id VARCHAR(32) PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_token_families_user_id ON token_families(user_id);
+
+-- Refresh токены хранятся только в виде SHA-256 хеша вместе с идентификатором access токена,
+-- выданного с ними, чтобы при отзыве семейства отозвать и его
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id BIGSERIAL PRIMARY KEY,
+    family_id VARCHAR(32) NOT NULL REFERENCES token_families(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    access_token_id VARCHAR(32) NOT NULL,
+    access_expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_access_token_id ON refresh_tokens(access_token_id);
+
+-- Отозванные access токены по jti; хранятся, пока токен не истечет
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(32) PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens(expires_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS revoked_tokens;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS token_families;
@@ -0,0 +1,12 @@
+-- +goose Up
+-- Подписи примененных push-уведомлений системы начисления, общие для всех экземпляров:
+-- повтор перехваченного уведомления отклоняется, пока оно не вышло из окна по времени
+CREATE TABLE IF NOT EXISTS callback_nonces (
+    nonce CHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_callback_nonces_expires_at ON callback_nonces(expires_at);
+
+-- +goose Down
+DROP TABLE IF EXISTS callback_nonces;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- Первые ожидающие заказы пользователя при справедливом выборе читаются по индексу,
+-- без сортировки всей его очереди
+CREATE INDEX IF NOT EXISTS idx_orders_user_id_uploaded_at ON orders(user_id, uploaded_at, id);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_orders_user_id_uploaded_at;
@@ -0,0 +1,10 @@
+// Package migrations содержит SQL миграции схемы базы данных,
+// встроенные в бинарный файл.
+package migrations
+
+import "embed"
+
+// FS файлы миграций в формате goose: NNN_name.sql с секциями Up и Down
+//
+//go:embed *.sql
+var FS embed.FS